@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"log"
+	"log/slog"
+
+	"github.com/SunPodder/shorty/internal/config"
+	"github.com/SunPodder/shorty/internal/db"
+	"github.com/SunPodder/shorty/internal/handler"
+	"github.com/SunPodder/shorty/internal/logging"
+	"github.com/SunPodder/shorty/internal/middleware"
+	"github.com/SunPodder/shorty/internal/telemetry"
+	"github.com/aws/aws-lambda-go/lambda"
+)
+
+func main() {
+	logger, err := logging.NewFromEnv()
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	slog.SetDefault(logger)
+
+	cfg, err := config.Load()
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	cfg.Apply()
+
+	if _, err := telemetry.NewFromEnv(context.Background(), telemetry.Options{Service: "forgot"}); err != nil {
+		log.Fatalf("%v", err)
+	}
+
+	limit, store, err := middleware.RateLimitFromEnv(middleware.ForgotPasswordRateLimit)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+
+	db.InitDynamoDBClient()
+	lambda.Start(middleware.WithTelemetry(middleware.WithLogging(middleware.WithCORS(middleware.WithRateLimit(limit, store, handler.ForgotPassword)))))
+}
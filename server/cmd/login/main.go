@@ -1,13 +1,55 @@
 package main
 
 import (
+	"context"
+	"log"
+	"log/slog"
+
+	"github.com/SunPodder/shorty/internal/audit"
+	"github.com/SunPodder/shorty/internal/config"
 	"github.com/SunPodder/shorty/internal/db"
 	"github.com/SunPodder/shorty/internal/handler"
+	"github.com/SunPodder/shorty/internal/logging"
+	"github.com/SunPodder/shorty/internal/mail"
 	"github.com/SunPodder/shorty/internal/middleware"
+	"github.com/SunPodder/shorty/internal/telemetry"
 	"github.com/aws/aws-lambda-go/lambda"
 )
 
 func main() {
+	logger, err := logging.NewFromEnv()
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	slog.SetDefault(logger)
+
+	cfg, err := config.Load()
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	cfg.Apply()
+
+	if _, err := telemetry.NewFromEnv(context.Background(), telemetry.Options{Service: "login"}); err != nil {
+		log.Fatalf("%v", err)
+	}
+
+	limit, store, err := middleware.RateLimitFromEnv(middleware.LoginRateLimit)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+
+	mailer, err := mail.NewFromEnv()
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	handler.Mailer = mailer
+
+	sink, err := audit.NewFromEnv()
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	handler.AuditSink = sink
+
 	db.InitDynamoDBClient()
-	lambda.Start(middleware.WithCORS(handler.Login))
+	lambda.Start(middleware.WithTelemetry(middleware.WithLogging(middleware.WithCORS(middleware.WithRateLimit(limit, store, handler.Login)))))
 }
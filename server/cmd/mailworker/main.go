@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"log"
+	"log/slog"
+
+	"github.com/SunPodder/shorty/internal/config"
+	"github.com/SunPodder/shorty/internal/db"
+	"github.com/SunPodder/shorty/internal/handler"
+	"github.com/SunPodder/shorty/internal/logging"
+	"github.com/SunPodder/shorty/internal/mail"
+	"github.com/SunPodder/shorty/internal/telemetry"
+	"github.com/aws/aws-lambda-go/lambda"
+)
+
+// Sends the queued emails, runs on a schedule rather than behind the API
+func main() {
+	logger, err := logging.NewFromEnv()
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	slog.SetDefault(logger)
+
+	cfg, err := config.Load()
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	cfg.Apply()
+
+	if _, err := telemetry.NewFromEnv(context.Background(), telemetry.Options{Service: "mailworker"}); err != nil {
+		log.Fatalf("%v", err)
+	}
+
+	mailer, err := mail.NewFromEnv()
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	handler.Mailer = mailer
+
+	db.InitDynamoDBClient()
+	lambda.Start(func(ctx context.Context) error {
+		defer telemetry.Flush(ctx)
+		return handler.SendQueuedMail(ctx)
+	})
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+
+	"github.com/SunPodder/shorty/internal/db"
+)
+
+// Normalizes the emails of users registered before emails were normalized
+// and writes the email locks they lack. Until it has completed, new
+// registrations scan the users table for emails differing only in case.
+// Users whose email collides with another user's are listed and must be
+// resolved by hand before running it again:
+//
+//	go run ./cmd/migrateemails
+func main() {
+	users := flag.String("users", db.DefaultTables.Users, "table of the users")
+	emails := flag.String("emails", db.DefaultTables.UserEmails, "table of the email locks")
+	jobs := flag.String("jobs", db.DefaultTables.Jobs, "table recording the completed migration")
+	endpoint := flag.String("endpoint", "", "DynamoDB endpoint, the regional one when empty")
+	flag.Parse()
+
+	tables := db.DefaultTables
+	tables.Users = *users
+	tables.UserEmails = *emails
+	tables.Jobs = *jobs
+	db.SetTables(tables)
+	db.Endpoint = *endpoint
+	db.InitDynamoDBClient()
+
+	normalized, locked, conflicts, err := db.MigrateUserEmails(context.Background())
+	log.Printf("normalized %d emails, locked %d", normalized, locked)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	for _, id := range conflicts {
+		log.Printf("user %s: email already taken by another user", id)
+	}
+	if len(conflicts) > 0 {
+		log.Fatalf("%d users conflict, resolve them and run again", len(conflicts))
+	}
+}
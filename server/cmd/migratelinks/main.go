@@ -0,0 +1,33 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+
+	"github.com/SunPodder/shorty/internal/db"
+)
+
+// Copies the links of the table from before custom domains into the
+// links table. Run it once the links table exists and again after the
+// Lambdas switched to it, to pick up links created in between:
+//
+//	go run ./cmd/migratelinks -from shorty_urls -to shorty_links
+func main() {
+	from := flag.String("from", "shorty_urls", "table of the links to copy")
+	to := flag.String("to", db.DefaultTables.URLs, "table to copy the links to")
+	endpoint := flag.String("endpoint", "", "DynamoDB endpoint, the regional one when empty")
+	flag.Parse()
+
+	tables := db.DefaultTables
+	tables.URLs = *to
+	db.SetTables(tables)
+	db.Endpoint = *endpoint
+	db.InitDynamoDBClient()
+
+	copied, skipped, err := db.MigrateLegacyURLs(context.Background(), *from)
+	log.Printf("copied %d links, skipped %d already in %s", copied, skipped, *to)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"log"
+	"log/slog"
+
+	"github.com/SunPodder/shorty/internal/config"
+	"github.com/SunPodder/shorty/internal/db"
+	"github.com/SunPodder/shorty/internal/handler"
+	"github.com/SunPodder/shorty/internal/logging"
+	"github.com/SunPodder/shorty/internal/middleware"
+	"github.com/SunPodder/shorty/internal/qr"
+	"github.com/SunPodder/shorty/internal/telemetry"
+	"github.com/aws/aws-lambda-go/lambda"
+)
+
+func main() {
+	logger, err := logging.NewFromEnv()
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	slog.SetDefault(logger)
+
+	cfg, err := config.Load()
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	cfg.Apply()
+
+	if _, err := telemetry.NewFromEnv(context.Background(), telemetry.Options{Service: "qr"}); err != nil {
+		log.Fatalf("%v", err)
+	}
+
+	logo, err := qr.LogoFromEnv()
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	handler.QRLogo = logo
+
+	limit, store, err := middleware.RateLimitFromEnv(middleware.QRRateLimit)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+
+	db.InitDynamoDBClient()
+	lambda.Start(middleware.WithTelemetry(middleware.WithLogging(middleware.WithCORS(middleware.WithRateLimit(limit, store, handler.QR)))))
+}
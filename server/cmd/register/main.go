@@ -1,13 +1,50 @@
 package main
 
 import (
+	"context"
+	"log"
+	"log/slog"
+
+	"github.com/SunPodder/shorty/internal/config"
 	"github.com/SunPodder/shorty/internal/db"
 	"github.com/SunPodder/shorty/internal/handler"
+	"github.com/SunPodder/shorty/internal/logging"
+	"github.com/SunPodder/shorty/internal/mail"
 	"github.com/SunPodder/shorty/internal/middleware"
+	"github.com/SunPodder/shorty/internal/telemetry"
+	"github.com/SunPodder/shorty/utils"
 	"github.com/aws/aws-lambda-go/lambda"
 )
 
 func main() {
+	logger, err := logging.NewFromEnv()
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	slog.SetDefault(logger)
+
+	cfg, err := config.Load()
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	cfg.Apply()
+
+	if _, err := telemetry.NewFromEnv(context.Background(), telemetry.Options{Service: "register"}); err != nil {
+		log.Fatalf("%v", err)
+	}
+
+	mailer, err := mail.NewFromEnv()
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	handler.Mailer = mailer
+
+	policy, err := utils.PasswordPolicyFromEnv()
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	handler.PasswordPolicy = policy
+
 	db.InitDynamoDBClient()
-	lambda.Start(middleware.WithCORS(handler.Register))
+	lambda.Start(middleware.WithTelemetry(middleware.WithLogging(middleware.WithCORS(handler.Register))))
 }
@@ -1,13 +1,48 @@
 package main
 
 import (
+	"context"
+	"log"
+	"log/slog"
+
+	"github.com/SunPodder/shorty/internal/config"
 	"github.com/SunPodder/shorty/internal/db"
 	"github.com/SunPodder/shorty/internal/handler"
+	"github.com/SunPodder/shorty/internal/logging"
 	"github.com/SunPodder/shorty/internal/middleware"
+	"github.com/SunPodder/shorty/internal/telemetry"
+	"github.com/SunPodder/shorty/internal/webhook"
 	"github.com/aws/aws-lambda-go/lambda"
 )
 
 func main() {
+	logger, err := logging.NewFromEnv()
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	slog.SetDefault(logger)
+
+	cfg, err := config.Load()
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	cfg.Apply()
+
+	if _, err := telemetry.NewFromEnv(context.Background(), telemetry.Options{Service: "resolve"}); err != nil {
+		log.Fatalf("%v", err)
+	}
+
+	dispatcher, err := webhook.NewFromEnv()
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	handler.WebhookDispatcher = dispatcher
+
+	limit, store, err := middleware.RateLimitFromEnv(middleware.ResolveRateLimit)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+
 	db.InitDynamoDBClient()
-	lambda.Start(middleware.WithCORS(handler.Resolve))
+	lambda.Start(middleware.WithTelemetry(middleware.WithLogging(middleware.WithCORS(middleware.WithRateLimit(limit, store, handler.Resolve)))))
 }
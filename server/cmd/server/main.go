@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/SunPodder/shorty/internal/audit"
+	"github.com/SunPodder/shorty/internal/config"
+	"github.com/SunPodder/shorty/internal/db"
+	"github.com/SunPodder/shorty/internal/handler"
+	"github.com/SunPodder/shorty/internal/httpapi"
+	"github.com/SunPodder/shorty/internal/logging"
+	"github.com/SunPodder/shorty/internal/mail"
+	"github.com/SunPodder/shorty/internal/middleware"
+	"github.com/SunPodder/shorty/internal/oidc"
+	"github.com/SunPodder/shorty/internal/qr"
+	"github.com/SunPodder/shorty/internal/reputation"
+	"github.com/SunPodder/shorty/internal/telemetry"
+	"github.com/SunPodder/shorty/internal/webhook"
+	"github.com/SunPodder/shorty/utils"
+)
+
+// Serves the whole API from one process instead of a Lambda per
+// endpoint, with Prometheus metrics at /metrics
+func main() {
+	logger, err := logging.NewFromEnv()
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	slog.SetDefault(logger)
+
+	cfg, err := config.Load()
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	cfg.Apply()
+
+	provider, err := telemetry.NewFromEnv(context.Background(), telemetry.Options{Service: "server", Prometheus: true})
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+
+	mailer, err := mail.NewFromEnv()
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	handler.Mailer = mailer
+
+	sink, err := audit.NewFromEnv()
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	handler.AuditSink = sink
+
+	checker, err := reputation.NewFromEnv()
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	handler.URLChecker = checker
+
+	dispatcher, err := webhook.NewFromEnv()
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	handler.WebhookDispatcher = dispatcher
+
+	policy, err := utils.PasswordPolicyFromEnv()
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	handler.PasswordPolicy = policy
+
+	providers, err := oidc.ProvidersFromEnv(handler.PublicURL)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	handler.SSOProviders = providers
+
+	logo, err := qr.LogoFromEnv()
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	handler.QRLogo = logo
+
+	rateLimited := func(limit middleware.RateLimit, next middleware.HandlerFunc) middleware.HandlerFunc {
+		limit, store, err := middleware.RateLimitFromEnv(limit)
+		if err != nil {
+			log.Fatalf("%v", err)
+		}
+		return middleware.WithRateLimit(limit, store, next)
+	}
+	authed := func(next middleware.HandlerFunc) middleware.HandlerFunc {
+		return middleware.WithAuth(middleware.AuthRequired, next)
+	}
+
+	// The same handlers and middleware as the Lambda of each endpoint
+	account := authed(handler.Account)
+	admin := authed(handler.Admin)
+	apiKeys := authed(handler.APIKeys)
+	domains := authed(handler.Domains)
+	links := authed(handler.Links)
+	twoFactor := authed(handler.TwoFactor)
+	webhooks := authed(handler.Webhooks)
+	workspaces := authed(handler.Workspaces)
+	routes := []httpapi.Route{
+		{Method: "POST", Resource: "/new", Handler: middleware.WithAuth(middleware.AuthOptional, rateLimited(middleware.ShortenRateLimit, handler.Shorten))},
+		{Method: "GET", Resource: "/{short_code}", Handler: rateLimited(middleware.ResolveRateLimit, handler.Resolve)},
+		{Method: "GET", Resource: "/{short_code}/qr", Handler: rateLimited(middleware.QRRateLimit, handler.QR)},
+		{Method: "POST", Resource: "/{short_code}/report", Handler: rateLimited(middleware.ReportRateLimit, handler.ReportLink)},
+		{Method: "GET", Resource: "/preview/{short_code}", Handler: handler.Preview},
+		{Method: "POST", Resource: "/register", Handler: handler.Register},
+		{Method: "GET", Resource: "/verify", Handler: handler.Verify},
+		{Method: "POST", Resource: "/verify/resend", Handler: authed(rateLimited(middleware.ResendVerificationRateLimit, handler.ResendVerification))},
+		{Method: "ANY", Resource: "/unlock", Handler: handler.Unlock},
+		{Method: "POST", Resource: "/login", Handler: rateLimited(middleware.LoginRateLimit, handler.Login)},
+		{Method: "POST", Resource: "/login/mfa", Handler: rateLimited(middleware.MFARateLimit, handler.LoginMFA)},
+		{Method: "POST", Resource: "/password/forgot", Handler: rateLimited(middleware.ForgotPasswordRateLimit, handler.ForgotPassword)},
+		{Method: "ANY", Resource: "/password/reset", Handler: rateLimited(middleware.ResetPasswordRateLimit, handler.ResetPassword)},
+		{Method: "GET", Resource: "/sso/{provider}/login", Handler: handler.SSO},
+		{Method: "GET", Resource: "/sso/{provider}/callback", Handler: handler.SSO},
+		{Method: "ANY", Resource: "/me", Handler: account},
+		{Method: "ANY", Resource: "/me/profile", Handler: account},
+		{Method: "ANY", Resource: "/me/password", Handler: account},
+		{Method: "ANY", Resource: "/me/audit", Handler: account},
+		{Method: "ANY", Resource: "/me/keys", Handler: apiKeys},
+		{Method: "ANY", Resource: "/me/keys/{key_id}", Handler: apiKeys},
+		{Method: "ANY", Resource: "/me/2fa", Handler: twoFactor},
+		{Method: "POST", Resource: "/me/2fa/verify", Handler: twoFactor},
+		{Method: "ANY", Resource: "/links/{short_code}", Handler: links},
+		{Method: "ANY", Resource: "/domains", Handler: domains},
+		{Method: "DELETE", Resource: "/domains/{domain}", Handler: domains},
+		{Method: "POST", Resource: "/domains/{domain}/verify", Handler: domains},
+		{Method: "ANY", Resource: "/workspaces", Handler: workspaces},
+		{Method: "ANY", Resource: "/workspaces/invitation", Handler: handler.WorkspaceInvitation},
+		{Method: "ANY", Resource: "/workspaces/{workspace_id}/members", Handler: workspaces},
+		{Method: "ANY", Resource: "/workspaces/{workspace_id}/members/{user_id}", Handler: workspaces},
+		{Method: "ANY", Resource: "/webhooks", Handler: webhooks},
+		{Method: "ANY", Resource: "/webhooks/{webhook_id}", Handler: webhooks},
+		{Method: "ANY", Resource: "/webhooks/{webhook_id}/test", Handler: webhooks},
+		{Method: "ANY", Resource: "/webhooks/{webhook_id}/deliveries", Handler: webhooks},
+		{Method: "ANY", Resource: "/webhooks/{webhook_id}/deliveries/{delivery_id}/redeliver", Handler: webhooks},
+		{Method: "ANY", Resource: "/admin/users", Handler: admin},
+		{Method: "ANY", Resource: "/admin/users/{user_id}", Handler: admin},
+		{Method: "POST", Resource: "/admin/users/{user_id}/unlock", Handler: admin},
+		{Method: "ANY", Resource: "/admin/users/{user_id}/disable", Handler: admin},
+		{Method: "ANY", Resource: "/admin/links", Handler: admin},
+		{Method: "ANY", Resource: "/admin/links/{short_code}/takedown", Handler: admin},
+		{Method: "ANY", Resource: "/admin/links/{short_code}/owner", Handler: admin},
+		{Method: "ANY", Resource: "/admin/links/{short_code}/reports", Handler: admin},
+		{Method: "ANY", Resource: "/admin/reports", Handler: admin},
+		{Method: "ANY", Resource: "/admin/stats", Handler: admin},
+		{Method: "ANY", Resource: "/admin/audit", Handler: admin},
+	}
+	for i := range routes {
+		routes[i].Handler = middleware.WithTelemetry(middleware.WithLogging(middleware.WithCORS(routes[i].Handler)))
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("GET /metrics", provider.MetricsHandler())
+	mux.Handle("/", httpapi.NewMux(routes))
+
+	addr := os.Getenv("HTTP_ADDR")
+	if addr == "" {
+		addr = ":8080"
+	}
+	server := &http.Server{Addr: addr, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+
+	db.InitDynamoDBClient()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+		provider.Shutdown(shutdownCtx)
+	}()
+
+	// The webhooks, mail and stats workers run on a schedule in AWS
+	go runEvery(ctx, time.Minute, "deliver webhooks", handler.DeliverWebhooks)
+	go runEvery(ctx, time.Minute, "send queued mail", handler.SendQueuedMail)
+	go runEvery(ctx, 15*time.Minute, "refresh stats", handler.RefreshStats)
+
+	slog.Info("listening", "addr", addr)
+	if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Fatalf("%v", err)
+	}
+}
+
+// Runs job right away and then every interval until ctx is done, each
+// run within the interval
+func runEvery(ctx context.Context, interval time.Duration, name string, job func(context.Context) error) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		runCtx, cancel := context.WithTimeout(ctx, interval)
+		if err := job(runCtx); err != nil {
+			slog.ErrorContext(runCtx, name, "error", err)
+		}
+		cancel()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
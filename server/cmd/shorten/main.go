@@ -1,13 +1,62 @@
 package main
 
 import (
+	"context"
+	"log"
+	"log/slog"
+
+	"github.com/SunPodder/shorty/internal/audit"
+	"github.com/SunPodder/shorty/internal/config"
 	"github.com/SunPodder/shorty/internal/db"
 	"github.com/SunPodder/shorty/internal/handler"
+	"github.com/SunPodder/shorty/internal/logging"
 	"github.com/SunPodder/shorty/internal/middleware"
+	"github.com/SunPodder/shorty/internal/reputation"
+	"github.com/SunPodder/shorty/internal/telemetry"
+	"github.com/SunPodder/shorty/internal/webhook"
 	"github.com/aws/aws-lambda-go/lambda"
 )
 
 func main() {
+	logger, err := logging.NewFromEnv()
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	slog.SetDefault(logger)
+
+	cfg, err := config.Load()
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	cfg.Apply()
+
+	if _, err := telemetry.NewFromEnv(context.Background(), telemetry.Options{Service: "shorten"}); err != nil {
+		log.Fatalf("%v", err)
+	}
+
+	limit, store, err := middleware.RateLimitFromEnv(middleware.ShortenRateLimit)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+
+	sink, err := audit.NewFromEnv()
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	handler.AuditSink = sink
+
+	checker, err := reputation.NewFromEnv()
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	handler.URLChecker = checker
+
+	dispatcher, err := webhook.NewFromEnv()
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	handler.WebhookDispatcher = dispatcher
+
 	db.InitDynamoDBClient()
-	lambda.Start(middleware.WithCORS(handler.Shorten))
+	lambda.Start(middleware.WithTelemetry(middleware.WithLogging(middleware.WithCORS(middleware.WithAuth(middleware.AuthOptional, middleware.WithRateLimit(limit, store, handler.Shorten))))))
 }
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"log"
+	"log/slog"
+
+	"github.com/SunPodder/shorty/internal/config"
+	"github.com/SunPodder/shorty/internal/db"
+	"github.com/SunPodder/shorty/internal/handler"
+	"github.com/SunPodder/shorty/internal/logging"
+	"github.com/SunPodder/shorty/internal/telemetry"
+	"github.com/SunPodder/shorty/internal/webhook"
+	"github.com/aws/aws-lambda-go/lambda"
+)
+
+// Runs on a schedule rather than behind the API
+func main() {
+	logger, err := logging.NewFromEnv()
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	slog.SetDefault(logger)
+
+	cfg, err := config.Load()
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	cfg.Apply()
+
+	if _, err := telemetry.NewFromEnv(context.Background(), telemetry.Options{Service: "webhookworker"}); err != nil {
+		log.Fatalf("%v", err)
+	}
+
+	dispatcher, err := webhook.NewFromEnv()
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	handler.WebhookDispatcher = dispatcher
+
+	db.InitDynamoDBClient()
+	lambda.Start(func(ctx context.Context, job handler.WebhookJob) error {
+		defer telemetry.Flush(ctx)
+		return handler.RunWebhookJob(ctx, job)
+	})
+}
@@ -3,6 +3,10 @@ data "aws_region" "current" {}
 resource "aws_api_gateway_rest_api" "shorty_api" {
   name        = "shorty-api"
   description = "API Gateway for Shorty URL service"
+
+  # Lets Lambda return binary bodies such as QR code PNGs. Browsers ask
+  # for images with image/* in their Accept header.
+  binary_media_types = ["image/png", "image/*"]
 }
 
 module "me_endpoint" {
@@ -10,14 +14,13 @@ module "me_endpoint" {
 
   endpoint_name        = "me"
   path_part            = "me"
-  http_method          = "GET"
+  http_method          = "ANY"
   lambda_function_name = aws_lambda_function.me.function_name
   lambda_invoke_arn    = aws_lambda_function.me.invoke_arn
   lambda_function_arn  = aws_lambda_function.me.arn
   rest_api_id          = aws_api_gateway_rest_api.shorty_api.id
   root_resource_id     = aws_api_gateway_rest_api.shorty_api.root_resource_id
   authorization_type   = "NONE"
-  enable_cors          = true
 }
 
 module "shorten_endpoint" {
@@ -80,13 +83,722 @@ module "resolve_endpoint" {
   enable_cors          = true
 }
 
+resource "aws_api_gateway_resource" "preview" {
+  rest_api_id = aws_api_gateway_rest_api.shorty_api.id
+  parent_id   = aws_api_gateway_rest_api.shorty_api.root_resource_id
+  path_part   = "preview"
+}
+
+module "preview_endpoint" {
+  source = "./modules/api_gateway_endpoint"
+
+  endpoint_name        = "preview"
+  path_part            = "{short_code}"
+  http_method          = "GET"
+  lambda_function_name = aws_lambda_function.preview.function_name
+  lambda_invoke_arn    = aws_lambda_function.preview.invoke_arn
+  lambda_function_arn  = aws_lambda_function.preview.arn
+  rest_api_id          = aws_api_gateway_rest_api.shorty_api.id
+  root_resource_id     = aws_api_gateway_resource.preview.id
+  authorization_type   = "NONE"
+  enable_cors          = true
+}
+
+module "domains_endpoint" {
+  source = "./modules/api_gateway_endpoint"
+
+  endpoint_name        = "domains"
+  path_part            = "domains"
+  http_method          = "ANY"
+  lambda_function_name = aws_lambda_function.domains.function_name
+  lambda_invoke_arn    = aws_lambda_function.domains.invoke_arn
+  lambda_function_arn  = aws_lambda_function.domains.arn
+  rest_api_id          = aws_api_gateway_rest_api.shorty_api.id
+  root_resource_id     = aws_api_gateway_rest_api.shorty_api.root_resource_id
+  authorization_type   = "NONE"
+}
+
+module "domain_endpoint" {
+  source = "./modules/api_gateway_endpoint"
+
+  endpoint_name        = "domain"
+  path_part            = "{domain}"
+  http_method          = "DELETE"
+  lambda_function_name = aws_lambda_function.domains.function_name
+  lambda_invoke_arn    = aws_lambda_function.domains.invoke_arn
+  lambda_function_arn  = aws_lambda_function.domains.arn
+  rest_api_id          = aws_api_gateway_rest_api.shorty_api.id
+  root_resource_id     = module.domains_endpoint.api_gateway_resource_id
+  authorization_type   = "NONE"
+  enable_cors          = true
+}
+
+module "domain_verify_endpoint" {
+  source = "./modules/api_gateway_endpoint"
+
+  endpoint_name        = "domain_verify"
+  path_part            = "verify"
+  http_method          = "POST"
+  lambda_function_name = aws_lambda_function.domains.function_name
+  lambda_invoke_arn    = aws_lambda_function.domains.invoke_arn
+  lambda_function_arn  = aws_lambda_function.domains.arn
+  rest_api_id          = aws_api_gateway_rest_api.shorty_api.id
+  root_resource_id     = module.domain_endpoint.api_gateway_resource_id
+  authorization_type   = "NONE"
+  enable_cors          = true
+}
+
+module "workspaces_endpoint" {
+  source = "./modules/api_gateway_endpoint"
+
+  endpoint_name        = "workspaces"
+  path_part            = "workspaces"
+  http_method          = "ANY"
+  lambda_function_name = aws_lambda_function.workspaces.function_name
+  lambda_invoke_arn    = aws_lambda_function.workspaces.invoke_arn
+  lambda_function_arn  = aws_lambda_function.workspaces.arn
+  rest_api_id          = aws_api_gateway_rest_api.shorty_api.id
+  root_resource_id     = aws_api_gateway_rest_api.shorty_api.root_resource_id
+  authorization_type   = "NONE"
+}
+
+module "workspace_invitation_endpoint" {
+  source = "./modules/api_gateway_endpoint"
+
+  endpoint_name        = "workspace_invitation"
+  path_part            = "invitation"
+  http_method          = "ANY"
+  lambda_function_name = aws_lambda_function.workspaces.function_name
+  lambda_invoke_arn    = aws_lambda_function.workspaces.invoke_arn
+  lambda_function_arn  = aws_lambda_function.workspaces.arn
+  rest_api_id          = aws_api_gateway_rest_api.shorty_api.id
+  root_resource_id     = module.workspaces_endpoint.api_gateway_resource_id
+  authorization_type   = "NONE"
+  enable_cors          = true
+}
+
+resource "aws_api_gateway_resource" "workspace" {
+  rest_api_id = aws_api_gateway_rest_api.shorty_api.id
+  parent_id   = module.workspaces_endpoint.api_gateway_resource_id
+  path_part   = "{workspace_id}"
+}
+
+module "workspace_members_endpoint" {
+  source = "./modules/api_gateway_endpoint"
+
+  endpoint_name        = "workspace_members"
+  path_part            = "members"
+  http_method          = "ANY"
+  lambda_function_name = aws_lambda_function.workspaces.function_name
+  lambda_invoke_arn    = aws_lambda_function.workspaces.invoke_arn
+  lambda_function_arn  = aws_lambda_function.workspaces.arn
+  rest_api_id          = aws_api_gateway_rest_api.shorty_api.id
+  root_resource_id     = aws_api_gateway_resource.workspace.id
+  authorization_type   = "NONE"
+}
+
+module "workspace_member_endpoint" {
+  source = "./modules/api_gateway_endpoint"
+
+  endpoint_name        = "workspace_member"
+  path_part            = "{user_id}"
+  http_method          = "ANY"
+  lambda_function_name = aws_lambda_function.workspaces.function_name
+  lambda_invoke_arn    = aws_lambda_function.workspaces.invoke_arn
+  lambda_function_arn  = aws_lambda_function.workspaces.arn
+  rest_api_id          = aws_api_gateway_rest_api.shorty_api.id
+  root_resource_id     = module.workspace_members_endpoint.api_gateway_resource_id
+  authorization_type   = "NONE"
+}
+
+resource "aws_api_gateway_resource" "links" {
+  rest_api_id = aws_api_gateway_rest_api.shorty_api.id
+  parent_id   = aws_api_gateway_rest_api.shorty_api.root_resource_id
+  path_part   = "links"
+}
+
+module "link_endpoint" {
+  source = "./modules/api_gateway_endpoint"
+
+  endpoint_name        = "link"
+  path_part            = "{short_code}"
+  http_method          = "ANY"
+  lambda_function_name = aws_lambda_function.links.function_name
+  lambda_invoke_arn    = aws_lambda_function.links.invoke_arn
+  lambda_function_arn  = aws_lambda_function.links.arn
+  rest_api_id          = aws_api_gateway_rest_api.shorty_api.id
+  root_resource_id     = aws_api_gateway_resource.links.id
+  authorization_type   = "NONE"
+}
+
+module "api_keys_endpoint" {
+  source = "./modules/api_gateway_endpoint"
+
+  endpoint_name        = "api_keys"
+  path_part            = "keys"
+  http_method          = "ANY"
+  lambda_function_name = aws_lambda_function.apikeys.function_name
+  lambda_invoke_arn    = aws_lambda_function.apikeys.invoke_arn
+  lambda_function_arn  = aws_lambda_function.apikeys.arn
+  rest_api_id          = aws_api_gateway_rest_api.shorty_api.id
+  root_resource_id     = module.me_endpoint.api_gateway_resource_id
+  authorization_type   = "NONE"
+}
+
+module "api_key_endpoint" {
+  source = "./modules/api_gateway_endpoint"
+
+  endpoint_name        = "api_key"
+  path_part            = "{key_id}"
+  http_method          = "ANY"
+  lambda_function_name = aws_lambda_function.apikeys.function_name
+  lambda_invoke_arn    = aws_lambda_function.apikeys.invoke_arn
+  lambda_function_arn  = aws_lambda_function.apikeys.arn
+  rest_api_id          = aws_api_gateway_rest_api.shorty_api.id
+  root_resource_id     = module.api_keys_endpoint.api_gateway_resource_id
+  authorization_type   = "NONE"
+}
+
+module "unlock_endpoint" {
+  source = "./modules/api_gateway_endpoint"
+
+  endpoint_name        = "unlock"
+  path_part            = "unlock"
+  http_method          = "ANY"
+  lambda_function_name = aws_lambda_function.unlock.function_name
+  lambda_invoke_arn    = aws_lambda_function.unlock.invoke_arn
+  lambda_function_arn  = aws_lambda_function.unlock.arn
+  rest_api_id          = aws_api_gateway_rest_api.shorty_api.id
+  root_resource_id     = aws_api_gateway_rest_api.shorty_api.root_resource_id
+  authorization_type   = "NONE"
+  enable_cors          = true
+}
+
+resource "aws_api_gateway_resource" "admin" {
+  rest_api_id = aws_api_gateway_rest_api.shorty_api.id
+  parent_id   = aws_api_gateway_rest_api.shorty_api.root_resource_id
+  path_part   = "admin"
+}
+
+module "admin_users_endpoint" {
+  source = "./modules/api_gateway_endpoint"
+
+  endpoint_name        = "admin_users"
+  path_part            = "users"
+  http_method          = "ANY"
+  lambda_function_name = aws_lambda_function.admin.function_name
+  lambda_invoke_arn    = aws_lambda_function.admin.invoke_arn
+  lambda_function_arn  = aws_lambda_function.admin.arn
+  rest_api_id          = aws_api_gateway_rest_api.shorty_api.id
+  root_resource_id     = aws_api_gateway_resource.admin.id
+  authorization_type   = "NONE"
+}
+
+module "admin_user_endpoint" {
+  source = "./modules/api_gateway_endpoint"
+
+  endpoint_name        = "admin_user"
+  path_part            = "{user_id}"
+  http_method          = "ANY"
+  lambda_function_name = aws_lambda_function.admin.function_name
+  lambda_invoke_arn    = aws_lambda_function.admin.invoke_arn
+  lambda_function_arn  = aws_lambda_function.admin.arn
+  rest_api_id          = aws_api_gateway_rest_api.shorty_api.id
+  root_resource_id     = module.admin_users_endpoint.api_gateway_resource_id
+  authorization_type   = "NONE"
+}
+
+module "admin_unlock_endpoint" {
+  source = "./modules/api_gateway_endpoint"
+
+  endpoint_name        = "admin_unlock"
+  path_part            = "unlock"
+  http_method          = "POST"
+  lambda_function_name = aws_lambda_function.admin.function_name
+  lambda_invoke_arn    = aws_lambda_function.admin.invoke_arn
+  lambda_function_arn  = aws_lambda_function.admin.arn
+  rest_api_id          = aws_api_gateway_rest_api.shorty_api.id
+  root_resource_id     = module.admin_user_endpoint.api_gateway_resource_id
+  authorization_type   = "NONE"
+  enable_cors          = true
+}
+
+module "admin_user_disable_endpoint" {
+  source = "./modules/api_gateway_endpoint"
+
+  endpoint_name        = "admin_user_disable"
+  path_part            = "disable"
+  http_method          = "ANY"
+  lambda_function_name = aws_lambda_function.admin.function_name
+  lambda_invoke_arn    = aws_lambda_function.admin.invoke_arn
+  lambda_function_arn  = aws_lambda_function.admin.arn
+  rest_api_id          = aws_api_gateway_rest_api.shorty_api.id
+  root_resource_id     = module.admin_user_endpoint.api_gateway_resource_id
+  authorization_type   = "NONE"
+}
+
+module "admin_links_endpoint" {
+  source = "./modules/api_gateway_endpoint"
+
+  endpoint_name        = "admin_links"
+  path_part            = "links"
+  http_method          = "ANY"
+  lambda_function_name = aws_lambda_function.admin.function_name
+  lambda_invoke_arn    = aws_lambda_function.admin.invoke_arn
+  lambda_function_arn  = aws_lambda_function.admin.arn
+  rest_api_id          = aws_api_gateway_rest_api.shorty_api.id
+  root_resource_id     = aws_api_gateway_resource.admin.id
+  authorization_type   = "NONE"
+}
+
+resource "aws_api_gateway_resource" "admin_link" {
+  rest_api_id = aws_api_gateway_rest_api.shorty_api.id
+  parent_id   = module.admin_links_endpoint.api_gateway_resource_id
+  path_part   = "{short_code}"
+}
+
+module "admin_link_takedown_endpoint" {
+  source = "./modules/api_gateway_endpoint"
+
+  endpoint_name        = "admin_link_takedown"
+  path_part            = "takedown"
+  http_method          = "ANY"
+  lambda_function_name = aws_lambda_function.admin.function_name
+  lambda_invoke_arn    = aws_lambda_function.admin.invoke_arn
+  lambda_function_arn  = aws_lambda_function.admin.arn
+  rest_api_id          = aws_api_gateway_rest_api.shorty_api.id
+  root_resource_id     = aws_api_gateway_resource.admin_link.id
+  authorization_type   = "NONE"
+}
+
+module "admin_link_owner_endpoint" {
+  source = "./modules/api_gateway_endpoint"
+
+  endpoint_name        = "admin_link_owner"
+  path_part            = "owner"
+  http_method          = "ANY"
+  lambda_function_name = aws_lambda_function.admin.function_name
+  lambda_invoke_arn    = aws_lambda_function.admin.invoke_arn
+  lambda_function_arn  = aws_lambda_function.admin.arn
+  rest_api_id          = aws_api_gateway_rest_api.shorty_api.id
+  root_resource_id     = aws_api_gateway_resource.admin_link.id
+  authorization_type   = "NONE"
+}
+
+module "admin_stats_endpoint" {
+  source = "./modules/api_gateway_endpoint"
+
+  endpoint_name        = "admin_stats"
+  path_part            = "stats"
+  http_method          = "ANY"
+  lambda_function_name = aws_lambda_function.admin.function_name
+  lambda_invoke_arn    = aws_lambda_function.admin.invoke_arn
+  lambda_function_arn  = aws_lambda_function.admin.arn
+  rest_api_id          = aws_api_gateway_rest_api.shorty_api.id
+  root_resource_id     = aws_api_gateway_resource.admin.id
+  authorization_type   = "NONE"
+}
+
+module "verify_endpoint" {
+  source = "./modules/api_gateway_endpoint"
+
+  endpoint_name        = "verify"
+  path_part            = "verify"
+  http_method          = "GET"
+  lambda_function_name = aws_lambda_function.verify.function_name
+  lambda_invoke_arn    = aws_lambda_function.verify.invoke_arn
+  lambda_function_arn  = aws_lambda_function.verify.arn
+  rest_api_id          = aws_api_gateway_rest_api.shorty_api.id
+  root_resource_id     = aws_api_gateway_rest_api.shorty_api.root_resource_id
+  authorization_type   = "NONE"
+  enable_cors          = true
+}
+
+module "verify_resend_endpoint" {
+  source = "./modules/api_gateway_endpoint"
+
+  endpoint_name        = "verify_resend"
+  path_part            = "resend"
+  http_method          = "POST"
+  lambda_function_name = aws_lambda_function.verify.function_name
+  lambda_invoke_arn    = aws_lambda_function.verify.invoke_arn
+  lambda_function_arn  = aws_lambda_function.verify.arn
+  rest_api_id          = aws_api_gateway_rest_api.shorty_api.id
+  root_resource_id     = module.verify_endpoint.api_gateway_resource_id
+  authorization_type   = "NONE"
+  enable_cors          = true
+}
+
+resource "aws_api_gateway_resource" "password" {
+  rest_api_id = aws_api_gateway_rest_api.shorty_api.id
+  parent_id   = aws_api_gateway_rest_api.shorty_api.root_resource_id
+  path_part   = "password"
+}
+
+module "password_forgot_endpoint" {
+  source = "./modules/api_gateway_endpoint"
+
+  endpoint_name        = "password_forgot"
+  path_part            = "forgot"
+  http_method          = "POST"
+  lambda_function_name = aws_lambda_function.forgot.function_name
+  lambda_invoke_arn    = aws_lambda_function.forgot.invoke_arn
+  lambda_function_arn  = aws_lambda_function.forgot.arn
+  rest_api_id          = aws_api_gateway_rest_api.shorty_api.id
+  root_resource_id     = aws_api_gateway_resource.password.id
+  authorization_type   = "NONE"
+  enable_cors          = true
+}
+
+module "password_reset_endpoint" {
+  source = "./modules/api_gateway_endpoint"
+
+  endpoint_name        = "password_reset"
+  path_part            = "reset"
+  http_method          = "ANY"
+  lambda_function_name = aws_lambda_function.reset.function_name
+  lambda_invoke_arn    = aws_lambda_function.reset.invoke_arn
+  lambda_function_arn  = aws_lambda_function.reset.arn
+  rest_api_id          = aws_api_gateway_rest_api.shorty_api.id
+  root_resource_id     = aws_api_gateway_resource.password.id
+  authorization_type   = "NONE"
+  enable_cors          = true
+}
+
+module "login_mfa_endpoint" {
+  source = "./modules/api_gateway_endpoint"
+
+  endpoint_name        = "login_mfa"
+  path_part            = "mfa"
+  http_method          = "POST"
+  lambda_function_name = aws_lambda_function.mfa.function_name
+  lambda_invoke_arn    = aws_lambda_function.mfa.invoke_arn
+  lambda_function_arn  = aws_lambda_function.mfa.arn
+  rest_api_id          = aws_api_gateway_rest_api.shorty_api.id
+  root_resource_id     = module.login_endpoint.api_gateway_resource_id
+  authorization_type   = "NONE"
+  enable_cors          = true
+}
+
+module "two_factor_endpoint" {
+  source = "./modules/api_gateway_endpoint"
+
+  endpoint_name        = "two_factor"
+  path_part            = "2fa"
+  http_method          = "ANY"
+  lambda_function_name = aws_lambda_function.twofactor.function_name
+  lambda_invoke_arn    = aws_lambda_function.twofactor.invoke_arn
+  lambda_function_arn  = aws_lambda_function.twofactor.arn
+  rest_api_id          = aws_api_gateway_rest_api.shorty_api.id
+  root_resource_id     = module.me_endpoint.api_gateway_resource_id
+  authorization_type   = "NONE"
+}
+
+module "two_factor_verify_endpoint" {
+  source = "./modules/api_gateway_endpoint"
+
+  endpoint_name        = "two_factor_verify"
+  path_part            = "verify"
+  http_method          = "POST"
+  lambda_function_name = aws_lambda_function.twofactor.function_name
+  lambda_invoke_arn    = aws_lambda_function.twofactor.invoke_arn
+  lambda_function_arn  = aws_lambda_function.twofactor.arn
+  rest_api_id          = aws_api_gateway_rest_api.shorty_api.id
+  root_resource_id     = module.two_factor_endpoint.api_gateway_resource_id
+  authorization_type   = "NONE"
+  enable_cors          = true
+}
+
+resource "aws_api_gateway_resource" "sso" {
+  rest_api_id = aws_api_gateway_rest_api.shorty_api.id
+  parent_id   = aws_api_gateway_rest_api.shorty_api.root_resource_id
+  path_part   = "sso"
+}
+
+resource "aws_api_gateway_resource" "sso_provider" {
+  rest_api_id = aws_api_gateway_rest_api.shorty_api.id
+  parent_id   = aws_api_gateway_resource.sso.id
+  path_part   = "{provider}"
+}
+
+module "sso_login_endpoint" {
+  source = "./modules/api_gateway_endpoint"
+
+  endpoint_name        = "sso_login"
+  path_part            = "login"
+  http_method          = "GET"
+  lambda_function_name = aws_lambda_function.sso.function_name
+  lambda_invoke_arn    = aws_lambda_function.sso.invoke_arn
+  lambda_function_arn  = aws_lambda_function.sso.arn
+  rest_api_id          = aws_api_gateway_rest_api.shorty_api.id
+  root_resource_id     = aws_api_gateway_resource.sso_provider.id
+  authorization_type   = "NONE"
+  enable_cors          = true
+}
+
+module "sso_callback_endpoint" {
+  source = "./modules/api_gateway_endpoint"
+
+  endpoint_name        = "sso_callback"
+  path_part            = "callback"
+  http_method          = "GET"
+  lambda_function_name = aws_lambda_function.sso.function_name
+  lambda_invoke_arn    = aws_lambda_function.sso.invoke_arn
+  lambda_function_arn  = aws_lambda_function.sso.arn
+  rest_api_id          = aws_api_gateway_rest_api.shorty_api.id
+  root_resource_id     = aws_api_gateway_resource.sso_provider.id
+  authorization_type   = "NONE"
+  enable_cors          = true
+}
+
+module "me_profile_endpoint" {
+  source = "./modules/api_gateway_endpoint"
+
+  endpoint_name        = "me_profile"
+  path_part            = "profile"
+  http_method          = "ANY"
+  lambda_function_name = aws_lambda_function.me.function_name
+  lambda_invoke_arn    = aws_lambda_function.me.invoke_arn
+  lambda_function_arn  = aws_lambda_function.me.arn
+  rest_api_id          = aws_api_gateway_rest_api.shorty_api.id
+  root_resource_id     = module.me_endpoint.api_gateway_resource_id
+  authorization_type   = "NONE"
+}
+
+module "me_password_endpoint" {
+  source = "./modules/api_gateway_endpoint"
+
+  endpoint_name        = "me_password"
+  path_part            = "password"
+  http_method          = "ANY"
+  lambda_function_name = aws_lambda_function.me.function_name
+  lambda_invoke_arn    = aws_lambda_function.me.invoke_arn
+  lambda_function_arn  = aws_lambda_function.me.arn
+  rest_api_id          = aws_api_gateway_rest_api.shorty_api.id
+  root_resource_id     = module.me_endpoint.api_gateway_resource_id
+  authorization_type   = "NONE"
+}
+
+module "admin_audit_endpoint" {
+  source = "./modules/api_gateway_endpoint"
+
+  endpoint_name        = "admin_audit"
+  path_part            = "audit"
+  http_method          = "ANY"
+  lambda_function_name = aws_lambda_function.admin.function_name
+  lambda_invoke_arn    = aws_lambda_function.admin.invoke_arn
+  lambda_function_arn  = aws_lambda_function.admin.arn
+  rest_api_id          = aws_api_gateway_rest_api.shorty_api.id
+  root_resource_id     = aws_api_gateway_resource.admin.id
+  authorization_type   = "NONE"
+}
+
+module "me_audit_endpoint" {
+  source = "./modules/api_gateway_endpoint"
+
+  endpoint_name        = "me_audit"
+  path_part            = "audit"
+  http_method          = "ANY"
+  lambda_function_name = aws_lambda_function.me.function_name
+  lambda_invoke_arn    = aws_lambda_function.me.invoke_arn
+  lambda_function_arn  = aws_lambda_function.me.arn
+  rest_api_id          = aws_api_gateway_rest_api.shorty_api.id
+  root_resource_id     = module.me_endpoint.api_gateway_resource_id
+  authorization_type   = "NONE"
+}
+
+module "report_endpoint" {
+  source = "./modules/api_gateway_endpoint"
+
+  endpoint_name        = "report"
+  path_part            = "report"
+  http_method          = "POST"
+  lambda_function_name = aws_lambda_function.report.function_name
+  lambda_invoke_arn    = aws_lambda_function.report.invoke_arn
+  lambda_function_arn  = aws_lambda_function.report.arn
+  rest_api_id          = aws_api_gateway_rest_api.shorty_api.id
+  root_resource_id     = module.resolve_endpoint.api_gateway_resource_id
+  authorization_type   = "NONE"
+  enable_cors          = true
+}
+
+module "admin_reports_endpoint" {
+  source = "./modules/api_gateway_endpoint"
+
+  endpoint_name        = "admin_reports"
+  path_part            = "reports"
+  http_method          = "ANY"
+  lambda_function_name = aws_lambda_function.admin.function_name
+  lambda_invoke_arn    = aws_lambda_function.admin.invoke_arn
+  lambda_function_arn  = aws_lambda_function.admin.arn
+  rest_api_id          = aws_api_gateway_rest_api.shorty_api.id
+  root_resource_id     = aws_api_gateway_resource.admin.id
+  authorization_type   = "NONE"
+}
+
+module "admin_link_reports_endpoint" {
+  source = "./modules/api_gateway_endpoint"
+
+  endpoint_name        = "admin_link_reports"
+  path_part            = "reports"
+  http_method          = "ANY"
+  lambda_function_name = aws_lambda_function.admin.function_name
+  lambda_invoke_arn    = aws_lambda_function.admin.invoke_arn
+  lambda_function_arn  = aws_lambda_function.admin.arn
+  rest_api_id          = aws_api_gateway_rest_api.shorty_api.id
+  root_resource_id     = aws_api_gateway_resource.admin_link.id
+  authorization_type   = "NONE"
+}
+
+module "qr_endpoint" {
+  source = "./modules/api_gateway_endpoint"
+
+  endpoint_name        = "qr"
+  path_part            = "qr"
+  http_method          = "GET"
+  lambda_function_name = aws_lambda_function.qr.function_name
+  lambda_invoke_arn    = aws_lambda_function.qr.invoke_arn
+  lambda_function_arn  = aws_lambda_function.qr.arn
+  rest_api_id          = aws_api_gateway_rest_api.shorty_api.id
+  root_resource_id     = module.resolve_endpoint.api_gateway_resource_id
+  authorization_type   = "NONE"
+  enable_cors          = true
+}
+
+module "webhooks_endpoint" {
+  source = "./modules/api_gateway_endpoint"
+
+  endpoint_name        = "webhooks"
+  path_part            = "webhooks"
+  http_method          = "ANY"
+  lambda_function_name = aws_lambda_function.webhooks.function_name
+  lambda_invoke_arn    = aws_lambda_function.webhooks.invoke_arn
+  lambda_function_arn  = aws_lambda_function.webhooks.arn
+  rest_api_id          = aws_api_gateway_rest_api.shorty_api.id
+  root_resource_id     = aws_api_gateway_rest_api.shorty_api.root_resource_id
+  authorization_type   = "NONE"
+}
+
+module "webhook_endpoint" {
+  source = "./modules/api_gateway_endpoint"
+
+  endpoint_name        = "webhook"
+  path_part            = "{webhook_id}"
+  http_method          = "ANY"
+  lambda_function_name = aws_lambda_function.webhooks.function_name
+  lambda_invoke_arn    = aws_lambda_function.webhooks.invoke_arn
+  lambda_function_arn  = aws_lambda_function.webhooks.arn
+  rest_api_id          = aws_api_gateway_rest_api.shorty_api.id
+  root_resource_id     = module.webhooks_endpoint.api_gateway_resource_id
+  authorization_type   = "NONE"
+}
+
+module "webhook_test_endpoint" {
+  source = "./modules/api_gateway_endpoint"
+
+  endpoint_name        = "webhook_test"
+  path_part            = "test"
+  http_method          = "ANY"
+  lambda_function_name = aws_lambda_function.webhooks.function_name
+  lambda_invoke_arn    = aws_lambda_function.webhooks.invoke_arn
+  lambda_function_arn  = aws_lambda_function.webhooks.arn
+  rest_api_id          = aws_api_gateway_rest_api.shorty_api.id
+  root_resource_id     = module.webhook_endpoint.api_gateway_resource_id
+  authorization_type   = "NONE"
+}
+
+module "webhook_deliveries_endpoint" {
+  source = "./modules/api_gateway_endpoint"
+
+  endpoint_name        = "webhook_deliveries"
+  path_part            = "deliveries"
+  http_method          = "ANY"
+  lambda_function_name = aws_lambda_function.webhooks.function_name
+  lambda_invoke_arn    = aws_lambda_function.webhooks.invoke_arn
+  lambda_function_arn  = aws_lambda_function.webhooks.arn
+  rest_api_id          = aws_api_gateway_rest_api.shorty_api.id
+  root_resource_id     = module.webhook_endpoint.api_gateway_resource_id
+  authorization_type   = "NONE"
+}
+
+module "webhook_delivery_endpoint" {
+  source = "./modules/api_gateway_endpoint"
+
+  endpoint_name        = "webhook_delivery"
+  path_part            = "{delivery_id}"
+  http_method          = "ANY"
+  lambda_function_name = aws_lambda_function.webhooks.function_name
+  lambda_invoke_arn    = aws_lambda_function.webhooks.invoke_arn
+  lambda_function_arn  = aws_lambda_function.webhooks.arn
+  rest_api_id          = aws_api_gateway_rest_api.shorty_api.id
+  root_resource_id     = module.webhook_deliveries_endpoint.api_gateway_resource_id
+  authorization_type   = "NONE"
+}
+
+module "webhook_redeliver_endpoint" {
+  source = "./modules/api_gateway_endpoint"
+
+  endpoint_name        = "webhook_redeliver"
+  path_part            = "redeliver"
+  http_method          = "ANY"
+  lambda_function_name = aws_lambda_function.webhooks.function_name
+  lambda_invoke_arn    = aws_lambda_function.webhooks.invoke_arn
+  lambda_function_arn  = aws_lambda_function.webhooks.arn
+  rest_api_id          = aws_api_gateway_rest_api.shorty_api.id
+  root_resource_id     = module.webhook_delivery_endpoint.api_gateway_resource_id
+  authorization_type   = "NONE"
+}
+
 resource "aws_api_gateway_deployment" "shorty_api" {
   depends_on = [
     module.me_endpoint.api_gateway_integration,
     module.shorten_endpoint.api_gateway_integration,
     module.login_endpoint.api_gateway_integration,
     module.register_endpoint.api_gateway_integration,
-    module.resolve_endpoint.api_gateway_integration
+    module.resolve_endpoint.api_gateway_integration,
+    module.preview_endpoint.api_gateway_integration,
+    module.domains_endpoint.api_gateway_integration,
+    module.domain_endpoint.api_gateway_integration,
+    module.domain_verify_endpoint.api_gateway_integration,
+    module.workspaces_endpoint.api_gateway_integration,
+    module.workspace_invitation_endpoint.api_gateway_integration,
+    module.workspace_members_endpoint.api_gateway_integration,
+    module.workspace_member_endpoint.api_gateway_integration,
+    module.link_endpoint.api_gateway_integration,
+    module.api_keys_endpoint.api_gateway_integration,
+    module.api_key_endpoint.api_gateway_integration,
+    module.unlock_endpoint.api_gateway_integration,
+    module.admin_unlock_endpoint.api_gateway_integration,
+    module.admin_users_endpoint.api_gateway_integration,
+    module.admin_user_endpoint.api_gateway_integration,
+    module.admin_user_disable_endpoint.api_gateway_integration,
+    module.admin_links_endpoint.api_gateway_integration,
+    module.admin_link_takedown_endpoint.api_gateway_integration,
+    module.admin_link_owner_endpoint.api_gateway_integration,
+    module.admin_stats_endpoint.api_gateway_integration,
+    module.verify_endpoint.api_gateway_integration,
+    module.verify_resend_endpoint.api_gateway_integration,
+    module.password_forgot_endpoint.api_gateway_integration,
+    module.password_reset_endpoint.api_gateway_integration,
+    module.login_mfa_endpoint.api_gateway_integration,
+    module.two_factor_endpoint.api_gateway_integration,
+    module.two_factor_verify_endpoint.api_gateway_integration,
+    module.sso_login_endpoint.api_gateway_integration,
+    module.sso_callback_endpoint.api_gateway_integration,
+    module.me_profile_endpoint.api_gateway_integration,
+    module.me_password_endpoint.api_gateway_integration,
+    module.admin_audit_endpoint.api_gateway_integration,
+    module.me_audit_endpoint.api_gateway_integration,
+    module.report_endpoint.api_gateway_integration,
+    module.admin_reports_endpoint.api_gateway_integration,
+    module.admin_link_reports_endpoint.api_gateway_integration,
+    module.qr_endpoint.api_gateway_integration,
+    module.webhooks_endpoint.api_gateway_integration,
+    module.webhook_endpoint.api_gateway_integration,
+    module.webhook_test_endpoint.api_gateway_integration,
+    module.webhook_deliveries_endpoint.api_gateway_integration,
+    module.webhook_delivery_endpoint.api_gateway_integration,
+    module.webhook_redeliver_endpoint.api_gateway_integration
   ]
   rest_api_id = aws_api_gateway_rest_api.shorty_api.id
 
@@ -96,7 +808,23 @@ resource "aws_api_gateway_deployment" "shorty_api" {
       aws_lambda_function.shorten.source_code_hash,
       aws_lambda_function.login.source_code_hash,
       aws_lambda_function.register.source_code_hash,
-      aws_lambda_function.resolve.source_code_hash
+      aws_lambda_function.resolve.source_code_hash,
+      aws_lambda_function.preview.source_code_hash,
+      aws_lambda_function.domains.source_code_hash,
+      aws_lambda_function.workspaces.source_code_hash,
+      aws_lambda_function.links.source_code_hash,
+      aws_lambda_function.apikeys.source_code_hash,
+      aws_lambda_function.admin.source_code_hash,
+      aws_lambda_function.unlock.source_code_hash,
+      aws_lambda_function.verify.source_code_hash,
+      aws_lambda_function.forgot.source_code_hash,
+      aws_lambda_function.reset.source_code_hash,
+      aws_lambda_function.mfa.source_code_hash,
+      aws_lambda_function.twofactor.source_code_hash,
+      aws_lambda_function.sso.source_code_hash,
+      aws_lambda_function.report.source_code_hash,
+      aws_lambda_function.qr.source_code_hash,
+      aws_lambda_function.webhooks.source_code_hash
     ]))
   }
 
@@ -19,6 +19,8 @@ resource "aws_dynamodb_table" "shorty_users" {
   }
 }
 
+# Links from before custom domains, keyed by short code alone. Kept until
+# cmd/migratelinks has copied them to shorty_links.
 resource "aws_dynamodb_table" "shorty_urls" {
   name           = "shorty_urls"
   billing_mode   = "PAY_PER_REQUEST"
@@ -37,4 +39,356 @@ resource "aws_dynamodb_table" "shorty_urls" {
     hash_key           = "user_id"
     projection_type    = "ALL"
   }
+
+  lifecycle {
+    prevent_destroy = true
+  }
+}
+
+# Short codes are scoped per domain, links on the shared host use the
+# "default" domain.
+resource "aws_dynamodb_table" "shorty_links" {
+  name           = "shorty_links"
+  billing_mode   = "PAY_PER_REQUEST"
+  hash_key       = "domain"
+  range_key      = "short_code"
+
+  attribute {
+    name = "domain"
+    type = "S"
+  }
+  attribute {
+    name = "short_code"
+    type = "S"
+  }
+  attribute {
+    name = "user_id"
+    type = "S"
+  }
+  attribute {
+    name = "workspace_id"
+    type = "S"
+  }
+  global_secondary_index {
+    name               = "user_id-index"
+    hash_key           = "user_id"
+    projection_type    = "ALL"
+  }
+  global_secondary_index {
+    name               = "workspace_id-index"
+    hash_key           = "workspace_id"
+    projection_type    = "ALL"
+  }
+}
+
+resource "aws_dynamodb_table" "shorty_domains" {
+  name           = "shorty_domains"
+  billing_mode   = "PAY_PER_REQUEST"
+  hash_key       = "domain"
+
+  attribute {
+    name = "domain"
+    type = "S"
+  }
+  attribute {
+    name = "user_id"
+    type = "S"
+  }
+  global_secondary_index {
+    name               = "user_id-index"
+    hash_key           = "user_id"
+    projection_type    = "ALL"
+  }
+  # Claims that were never verified expire
+  ttl {
+    attribute_name = "expires_at"
+    enabled        = true
+  }
+}
+
+resource "aws_dynamodb_table" "shorty_workspaces" {
+  name           = "shorty_workspaces"
+  billing_mode   = "PAY_PER_REQUEST"
+  hash_key       = "id"
+
+  attribute {
+    name = "id"
+    type = "S"
+  }
+}
+
+resource "aws_dynamodb_table" "shorty_workspace_members" {
+  name           = "shorty_workspace_members"
+  billing_mode   = "PAY_PER_REQUEST"
+  hash_key       = "workspace_id"
+  range_key      = "user_id"
+
+  attribute {
+    name = "workspace_id"
+    type = "S"
+  }
+  attribute {
+    name = "user_id"
+    type = "S"
+  }
+  global_secondary_index {
+    name               = "user_id-index"
+    hash_key           = "user_id"
+    projection_type    = "ALL"
+  }
+}
+
+# Pending invitations to workspaces, removed once accepted or expired
+resource "aws_dynamodb_table" "shorty_workspace_invites" {
+  name           = "shorty_workspace_invites"
+  billing_mode   = "PAY_PER_REQUEST"
+  hash_key       = "workspace_id"
+  range_key      = "user_id"
+
+  attribute {
+    name = "workspace_id"
+    type = "S"
+  }
+  attribute {
+    name = "user_id"
+    type = "S"
+  }
+  ttl {
+    attribute_name = "expires_at"
+    enabled        = true
+  }
+}
+
+# API keys are stored hashed, the id is the clear part of the key
+resource "aws_dynamodb_table" "shorty_api_keys" {
+  name           = "shorty_api_keys"
+  billing_mode   = "PAY_PER_REQUEST"
+  hash_key       = "id"
+
+  attribute {
+    name = "id"
+    type = "S"
+  }
+  attribute {
+    name = "user_id"
+    type = "S"
+  }
+  global_secondary_index {
+    name               = "user_id-index"
+    hash_key           = "user_id"
+    projection_type    = "ALL"
+  }
+}
+
+# Token buckets of the rate limiter, expired once they are full again
+resource "aws_dynamodb_table" "shorty_rate_limits" {
+  name           = "shorty_rate_limits"
+  billing_mode   = "PAY_PER_REQUEST"
+  hash_key       = "key"
+
+  attribute {
+    name = "key"
+    type = "S"
+  }
+  ttl {
+    attribute_name = "expires_at"
+    enabled        = true
+  }
+}
+
+# Links between users and their accounts at external identity providers,
+# keyed by "<provider>|<subject>"
+resource "aws_dynamodb_table" "shorty_identities" {
+  name           = "shorty_identities"
+  billing_mode   = "PAY_PER_REQUEST"
+  hash_key       = "id"
+
+  attribute {
+    name = "id"
+    type = "S"
+  }
+  attribute {
+    name = "user_id"
+    type = "S"
+  }
+  global_secondary_index {
+    name               = "user_id-index"
+    hash_key           = "user_id"
+    projection_type    = "ALL"
+  }
+}
+
+# One item per normalized email, written in the same transaction as the
+# user that holds it so emails stay unique
+resource "aws_dynamodb_table" "shorty_user_emails" {
+  name           = "shorty_user_emails"
+  billing_mode   = "PAY_PER_REQUEST"
+  hash_key       = "email"
+
+  attribute {
+    name = "email"
+    type = "S"
+  }
+}
+
+# Append-only log of sensitive actions
+resource "aws_dynamodb_table" "shorty_audit_log" {
+  name           = "shorty_audit_log"
+  billing_mode   = "PAY_PER_REQUEST"
+  hash_key       = "id"
+
+  attribute {
+    name = "id"
+    type = "S"
+  }
+  attribute {
+    name = "actor_id"
+    type = "S"
+  }
+  attribute {
+    name = "target_id"
+    type = "S"
+  }
+  attribute {
+    name = "created_at"
+    type = "S"
+  }
+  global_secondary_index {
+    name               = "actor_id-index"
+    hash_key           = "actor_id"
+    range_key          = "created_at"
+    projection_type    = "ALL"
+  }
+  global_secondary_index {
+    name               = "target_id-index"
+    hash_key           = "target_id"
+    range_key          = "created_at"
+    projection_type    = "ALL"
+  }
+}
+
+# Abuse reports of links, one per link and reporter
+resource "aws_dynamodb_table" "shorty_reports" {
+  name           = "shorty_reports"
+  billing_mode   = "PAY_PER_REQUEST"
+  hash_key       = "id"
+
+  attribute {
+    name = "id"
+    type = "S"
+  }
+  attribute {
+    name = "link_id"
+    type = "S"
+  }
+  attribute {
+    name = "status"
+    type = "S"
+  }
+  attribute {
+    name = "created_at"
+    type = "S"
+  }
+  global_secondary_index {
+    name               = "link_id-index"
+    hash_key           = "link_id"
+    projection_type    = "ALL"
+  }
+  global_secondary_index {
+    name               = "status-index"
+    hash_key           = "status"
+    range_key          = "created_at"
+    projection_type    = "ALL"
+  }
+}
+
+resource "aws_dynamodb_table" "shorty_webhooks" {
+  name           = "shorty_webhooks"
+  billing_mode   = "PAY_PER_REQUEST"
+  hash_key       = "id"
+
+  attribute {
+    name = "id"
+    type = "S"
+  }
+  attribute {
+    name = "user_id"
+    type = "S"
+  }
+  global_secondary_index {
+    name               = "user_id-index"
+    hash_key           = "user_id"
+    projection_type    = "ALL"
+  }
+}
+
+# Deliveries of webhook events. Only pending deliveries carry
+# next_attempt_at, which keeps them alone in the status-index.
+resource "aws_dynamodb_table" "shorty_webhook_deliveries" {
+  name           = "shorty_webhook_deliveries"
+  billing_mode   = "PAY_PER_REQUEST"
+  hash_key       = "id"
+
+  attribute {
+    name = "id"
+    type = "S"
+  }
+  attribute {
+    name = "webhook_id"
+    type = "S"
+  }
+  attribute {
+    name = "created_at"
+    type = "S"
+  }
+  attribute {
+    name = "status"
+    type = "S"
+  }
+  attribute {
+    name = "next_attempt_at"
+    type = "N"
+  }
+  global_secondary_index {
+    name               = "webhook_id-index"
+    hash_key           = "webhook_id"
+    range_key          = "created_at"
+    projection_type    = "ALL"
+  }
+  global_secondary_index {
+    name               = "status-index"
+    hash_key           = "status"
+    range_key          = "next_attempt_at"
+    projection_type    = "ALL"
+  }
+}
+
+# Emails waiting to be sent by the mail worker, removed once sent. Emails
+# that couldn't be sent before they expire are dropped.
+resource "aws_dynamodb_table" "shorty_mail_outbox" {
+  name           = "shorty_mail_outbox"
+  billing_mode   = "PAY_PER_REQUEST"
+  hash_key       = "id"
+
+  attribute {
+    name = "id"
+    type = "S"
+  }
+  ttl {
+    attribute_name = "expires_at"
+    enabled        = true
+  }
+}
+
+# Progress of the scheduled jobs that take more than one run, such as
+# the rescan of all links
+resource "aws_dynamodb_table" "shorty_jobs" {
+  name           = "shorty_jobs"
+  billing_mode   = "PAY_PER_REQUEST"
+  hash_key       = "name"
+
+  attribute {
+    name = "name"
+    type = "S"
+  }
 }
@@ -24,12 +24,38 @@ resource "aws_iam_role_policy" "lambda_exec_policy" {
           "dynamodb:GetItem",
           "dynamodb:PutItem",
           "dynamodb:UpdateItem",
+          "dynamodb:DeleteItem",
           "dynamodb:Query",
-          "dynamodb:Scan"
+          "dynamodb:Scan",
+          "dynamodb:ConditionCheckItem"
         ]
         Resource = [
           aws_dynamodb_table.shorty_users.arn,
-          aws_dynamodb_table.shorty_urls.arn
+          aws_dynamodb_table.shorty_links.arn,
+          aws_dynamodb_table.shorty_domains.arn,
+          aws_dynamodb_table.shorty_workspaces.arn,
+          aws_dynamodb_table.shorty_workspace_members.arn,
+          aws_dynamodb_table.shorty_workspace_invites.arn,
+          aws_dynamodb_table.shorty_api_keys.arn,
+          aws_dynamodb_table.shorty_rate_limits.arn,
+          aws_dynamodb_table.shorty_identities.arn,
+          aws_dynamodb_table.shorty_user_emails.arn,
+          aws_dynamodb_table.shorty_audit_log.arn,
+          aws_dynamodb_table.shorty_reports.arn,
+          aws_dynamodb_table.shorty_webhooks.arn,
+          aws_dynamodb_table.shorty_webhook_deliveries.arn,
+          aws_dynamodb_table.shorty_mail_outbox.arn,
+          aws_dynamodb_table.shorty_jobs.arn,
+          "${aws_dynamodb_table.shorty_users.arn}/index/*",
+          "${aws_dynamodb_table.shorty_links.arn}/index/*",
+          "${aws_dynamodb_table.shorty_domains.arn}/index/*",
+          "${aws_dynamodb_table.shorty_workspace_members.arn}/index/*",
+          "${aws_dynamodb_table.shorty_api_keys.arn}/index/*",
+          "${aws_dynamodb_table.shorty_identities.arn}/index/*",
+          "${aws_dynamodb_table.shorty_audit_log.arn}/index/*",
+          "${aws_dynamodb_table.shorty_reports.arn}/index/*",
+          "${aws_dynamodb_table.shorty_webhooks.arn}/index/*",
+          "${aws_dynamodb_table.shorty_webhook_deliveries.arn}/index/*"
         ]
       },
       {
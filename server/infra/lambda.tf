@@ -1,3 +1,167 @@
+# Settings every function reads at startup, see internal/config
+variable "jwt_secret" {
+  description = "Secret signing session tokens, at least 32 characters"
+  type        = string
+  sensitive   = true
+}
+
+variable "hash_key" {
+  description = "Key of the backup code and reporter IP hashes, at least 32 characters. The JWT secret is used when empty"
+  type        = string
+  sensitive   = true
+  default     = ""
+}
+
+variable "public_url" {
+  description = "Public URL of the API, used in the links of emails and SSO callbacks, like https://sho.rt"
+  type        = string
+
+  validation {
+    condition     = can(regex("^https?://[^/]+", var.public_url))
+    error_message = "public_url must be an http or https URL."
+  }
+}
+
+variable "cors_allowed_origins" {
+  description = "Origins allowed to call the API from browsers, or [\"*\"] for any"
+  type        = list(string)
+  default     = ["*"]
+}
+
+variable "sso_redirect_url" {
+  description = "Page of the frontend SSO logins are redirected to with their session. The session is returned as JSON when empty"
+  type        = string
+  default     = ""
+}
+
+variable "session_ttl" {
+  description = "How long session tokens are valid, like 24h. Uses the default of internal/config when empty"
+  type        = string
+  default     = ""
+}
+
+variable "short_code_length" {
+  description = "Length of generated short codes. Uses the default of internal/config when null"
+  type        = number
+  default     = null
+}
+
+variable "redirect_status" {
+  description = "Status code of redirects to the original URLs: 301, 302, 307 or 308. Uses the default of internal/config when null"
+  type        = number
+  default     = null
+}
+
+variable "require_email_verification" {
+  description = "Whether users have to verify their email before logging in"
+  type        = bool
+  default     = false
+}
+
+variable "registration_enabled" {
+  description = "Whether new users can register"
+  type        = bool
+  default     = true
+}
+
+variable "report_threshold" {
+  description = "Reports a link can get before it's taken down for review. Uses the default of internal/config when null"
+  type        = number
+  default     = null
+}
+
+variable "screening_action" {
+  description = "What happens to links flagged by the URL screening: reject or quarantine. Uses the default of internal/config when empty"
+  type        = string
+  default     = ""
+}
+
+variable "safe_browsing_api_key" {
+  description = "Google Safe Browsing API key. Links are only screened against the blocklist when empty"
+  type        = string
+  sensitive   = true
+  default     = ""
+}
+
+variable "webhook_click_sample_rate" {
+  description = "Share of clicks sent as link.clicked webhook events, above 0 and at most 1. Uses the default of internal/config when null"
+  type        = number
+  default     = null
+}
+
+variable "oidc_providers" {
+  description = "JSON array of the OIDC providers users can log in with, see internal/oidc"
+  type        = string
+  sensitive   = true
+  default     = ""
+}
+
+variable "mailer" {
+  description = "How emails are sent: log, file or smtp"
+  type        = string
+  default     = "log"
+}
+
+variable "mail_from" {
+  description = "Sender address of the emails"
+  type        = string
+  default     = ""
+}
+
+variable "smtp_host" {
+  description = "SMTP server sending the emails when mailer is smtp"
+  type        = string
+  default     = ""
+}
+
+variable "smtp_port" {
+  description = "Port of the SMTP server"
+  type        = number
+  default     = null
+}
+
+variable "smtp_username" {
+  description = "User name on the SMTP server"
+  type        = string
+  default     = ""
+}
+
+variable "smtp_password" {
+  description = "Password on the SMTP server"
+  type        = string
+  sensitive   = true
+  default     = ""
+}
+
+locals {
+  # Unset settings are left out so the functions use their defaults
+  lambda_environment = {
+    for name, value in {
+      JWT_SECRET                 = var.jwt_secret
+      HASH_KEY                   = var.hash_key
+      PUBLIC_URL                 = var.public_url
+      CORS_ALLOWED_ORIGINS       = join(",", var.cors_allowed_origins)
+      SSO_REDIRECT_URL           = var.sso_redirect_url
+      SESSION_TTL                = var.session_ttl
+      SHORT_CODE_LENGTH          = var.short_code_length == null ? "" : tostring(var.short_code_length)
+      REDIRECT_STATUS            = var.redirect_status == null ? "" : tostring(var.redirect_status)
+      REQUIRE_EMAIL_VERIFICATION = tostring(var.require_email_verification)
+      REGISTRATION_ENABLED       = tostring(var.registration_enabled)
+      REPORT_THRESHOLD           = var.report_threshold == null ? "" : tostring(var.report_threshold)
+      SCREENING_ACTION           = var.screening_action
+      SAFE_BROWSING_API_KEY      = var.safe_browsing_api_key
+      WEBHOOK_CLICK_SAMPLE_RATE  = var.webhook_click_sample_rate == null ? "" : tostring(var.webhook_click_sample_rate)
+      OIDC_PROVIDERS             = var.oidc_providers
+      MAILER                     = var.mailer
+      MAIL_FROM                  = var.mail_from
+      SMTP_HOST                  = var.smtp_host
+      SMTP_PORT                  = var.smtp_port == null ? "" : tostring(var.smtp_port)
+      SMTP_USERNAME              = var.smtp_username
+      SMTP_PASSWORD              = var.smtp_password
+    } : name => value if value != ""
+  }
+}
+
 resource "aws_lambda_function" "me" {
   function_name = "me"
   handler       = "me"
@@ -5,6 +169,9 @@ resource "aws_lambda_function" "me" {
   filename      = "${path.module}/../bin/me.zip"
   source_code_hash = filebase64sha256("${path.module}/../bin/me.zip")
   role          = aws_iam_role.lambda_exec.arn
+  environment {
+    variables = local.lambda_environment
+  }
 }
 
 resource "aws_lambda_function" "shorten" {
@@ -14,6 +181,9 @@ resource "aws_lambda_function" "shorten" {
   filename      = "${path.module}/../bin/shorten.zip"
   source_code_hash = filebase64sha256("${path.module}/../bin/shorten.zip")
   role          = aws_iam_role.lambda_exec.arn
+  environment {
+    variables = local.lambda_environment
+  }
 }
 
 resource "aws_lambda_function" "login" {
@@ -23,6 +193,9 @@ resource "aws_lambda_function" "login" {
   filename      = "${path.module}/../bin/login.zip"
   source_code_hash = filebase64sha256("${path.module}/../bin/login.zip")
   role          = aws_iam_role.lambda_exec.arn
+  environment {
+    variables = local.lambda_environment
+  }
 }
 
 resource "aws_lambda_function" "register" {
@@ -32,6 +205,9 @@ resource "aws_lambda_function" "register" {
   filename      = "${path.module}/../bin/register.zip"
   source_code_hash = filebase64sha256("${path.module}/../bin/register.zip")
   role          = aws_iam_role.lambda_exec.arn
+  environment {
+    variables = local.lambda_environment
+  }
 }
 
 resource "aws_lambda_function" "resolve" {
@@ -41,4 +217,356 @@ resource "aws_lambda_function" "resolve" {
   filename      = "${path.module}/../bin/resolve.zip"
   source_code_hash = filebase64sha256("${path.module}/../bin/resolve.zip")
   role          = aws_iam_role.lambda_exec.arn
+  environment {
+    variables = local.lambda_environment
+  }
+}
+
+resource "aws_lambda_function" "preview" {
+  function_name = "preview"
+  handler       = "preview"
+  runtime       = "go1.x"
+  filename      = "${path.module}/../bin/preview.zip"
+  source_code_hash = filebase64sha256("${path.module}/../bin/preview.zip")
+  role          = aws_iam_role.lambda_exec.arn
+  environment {
+    variables = local.lambda_environment
+  }
+}
+
+resource "aws_lambda_function" "domains" {
+  function_name = "domains"
+  handler       = "domains"
+  runtime       = "go1.x"
+  filename      = "${path.module}/../bin/domains.zip"
+  source_code_hash = filebase64sha256("${path.module}/../bin/domains.zip")
+  role          = aws_iam_role.lambda_exec.arn
+  environment {
+    variables = local.lambda_environment
+  }
+}
+
+resource "aws_lambda_function" "workspaces" {
+  function_name = "workspaces"
+  handler       = "workspaces"
+  runtime       = "go1.x"
+  filename      = "${path.module}/../bin/workspaces.zip"
+  source_code_hash = filebase64sha256("${path.module}/../bin/workspaces.zip")
+  role          = aws_iam_role.lambda_exec.arn
+  environment {
+    variables = local.lambda_environment
+  }
+}
+
+resource "aws_lambda_function" "links" {
+  function_name = "links"
+  handler       = "links"
+  runtime       = "go1.x"
+  filename      = "${path.module}/../bin/links.zip"
+  source_code_hash = filebase64sha256("${path.module}/../bin/links.zip")
+  role          = aws_iam_role.lambda_exec.arn
+  environment {
+    variables = local.lambda_environment
+  }
+}
+
+resource "aws_lambda_function" "apikeys" {
+  function_name = "apikeys"
+  handler       = "apikeys"
+  runtime       = "go1.x"
+  filename      = "${path.module}/../bin/apikeys.zip"
+  source_code_hash = filebase64sha256("${path.module}/../bin/apikeys.zip")
+  role          = aws_iam_role.lambda_exec.arn
+  environment {
+    variables = local.lambda_environment
+  }
+}
+
+resource "aws_lambda_function" "admin" {
+  function_name = "admin"
+  handler       = "admin"
+  runtime       = "go1.x"
+  filename      = "${path.module}/../bin/admin.zip"
+  source_code_hash = filebase64sha256("${path.module}/../bin/admin.zip")
+  role          = aws_iam_role.lambda_exec.arn
+  environment {
+    variables = local.lambda_environment
+  }
+}
+
+resource "aws_lambda_function" "unlock" {
+  function_name = "unlock"
+  handler       = "unlock"
+  runtime       = "go1.x"
+  filename      = "${path.module}/../bin/unlock.zip"
+  source_code_hash = filebase64sha256("${path.module}/../bin/unlock.zip")
+  role          = aws_iam_role.lambda_exec.arn
+  environment {
+    variables = local.lambda_environment
+  }
+}
+
+resource "aws_lambda_function" "verify" {
+  function_name = "verify"
+  handler       = "verify"
+  runtime       = "go1.x"
+  filename      = "${path.module}/../bin/verify.zip"
+  source_code_hash = filebase64sha256("${path.module}/../bin/verify.zip")
+  role          = aws_iam_role.lambda_exec.arn
+  environment {
+    variables = local.lambda_environment
+  }
+}
+
+resource "aws_lambda_function" "forgot" {
+  function_name = "forgot"
+  handler       = "forgot"
+  runtime       = "go1.x"
+  filename      = "${path.module}/../bin/forgot.zip"
+  source_code_hash = filebase64sha256("${path.module}/../bin/forgot.zip")
+  role          = aws_iam_role.lambda_exec.arn
+  # Well above ForgotPasswordResponseTime, the email is sent by the mail worker
+  timeout       = 15
+  environment {
+    variables = local.lambda_environment
+  }
+}
+
+resource "aws_lambda_function" "mailworker" {
+  function_name = "mailworker"
+  handler       = "mailworker"
+  runtime       = "go1.x"
+  filename      = "${path.module}/../bin/mailworker.zip"
+  source_code_hash = filebase64sha256("${path.module}/../bin/mailworker.zip")
+  role          = aws_iam_role.lambda_exec.arn
+  timeout       = 300
+  # Runs never overlap, so an email isn't sent twice at once
+  reserved_concurrent_executions = 1
+  environment {
+    variables = local.lambda_environment
+  }
+}
+
+# Sends the queued emails, such as password reset links, every minute
+resource "aws_cloudwatch_event_rule" "mail_send" {
+  name                = "shorty_mail_send"
+  schedule_expression = "rate(1 minute)"
+}
+
+resource "aws_cloudwatch_event_target" "mail_send" {
+  rule = aws_cloudwatch_event_rule.mail_send.name
+  arn  = aws_lambda_function.mailworker.arn
+}
+
+resource "aws_lambda_permission" "mail_send" {
+  statement_id  = "AllowEventBridgeInvoke"
+  action        = "lambda:InvokeFunction"
+  function_name = aws_lambda_function.mailworker.function_name
+  principal     = "events.amazonaws.com"
+  source_arn    = aws_cloudwatch_event_rule.mail_send.arn
+}
+
+resource "aws_lambda_function" "reset" {
+  function_name = "reset"
+  handler       = "reset"
+  runtime       = "go1.x"
+  filename      = "${path.module}/../bin/reset.zip"
+  source_code_hash = filebase64sha256("${path.module}/../bin/reset.zip")
+  role          = aws_iam_role.lambda_exec.arn
+  environment {
+    variables = local.lambda_environment
+  }
+}
+
+resource "aws_lambda_function" "mfa" {
+  function_name = "mfa"
+  handler       = "mfa"
+  runtime       = "go1.x"
+  filename      = "${path.module}/../bin/mfa.zip"
+  source_code_hash = filebase64sha256("${path.module}/../bin/mfa.zip")
+  role          = aws_iam_role.lambda_exec.arn
+  environment {
+    variables = local.lambda_environment
+  }
+}
+
+resource "aws_lambda_function" "twofactor" {
+  function_name = "twofactor"
+  handler       = "twofactor"
+  runtime       = "go1.x"
+  filename      = "${path.module}/../bin/twofactor.zip"
+  source_code_hash = filebase64sha256("${path.module}/../bin/twofactor.zip")
+  role          = aws_iam_role.lambda_exec.arn
+  environment {
+    variables = local.lambda_environment
+  }
+}
+
+resource "aws_lambda_function" "sso" {
+  function_name = "sso"
+  handler       = "sso"
+  runtime       = "go1.x"
+  filename      = "${path.module}/../bin/sso.zip"
+  source_code_hash = filebase64sha256("${path.module}/../bin/sso.zip")
+  role          = aws_iam_role.lambda_exec.arn
+  environment {
+    variables = local.lambda_environment
+  }
+}
+
+resource "aws_lambda_function" "rescan" {
+  function_name = "rescan"
+  handler       = "rescan"
+  runtime       = "go1.x"
+  filename      = "${path.module}/../bin/rescan.zip"
+  source_code_hash = filebase64sha256("${path.module}/../bin/rescan.zip")
+  role          = aws_iam_role.lambda_exec.arn
+  timeout       = 900
+  environment {
+    variables = local.lambda_environment
+  }
+}
+
+# Screens existing links again every day, taking down those flagged since.
+# Runs hourly so a pass too long for one run is resumed by the next.
+resource "aws_cloudwatch_event_rule" "rescan" {
+  name                = "shorty_rescan"
+  schedule_expression = "rate(1 hour)"
+}
+
+resource "aws_cloudwatch_event_target" "rescan" {
+  rule = aws_cloudwatch_event_rule.rescan.name
+  arn  = aws_lambda_function.rescan.arn
+}
+
+resource "aws_lambda_permission" "rescan" {
+  statement_id  = "AllowEventBridgeInvoke"
+  action        = "lambda:InvokeFunction"
+  function_name = aws_lambda_function.rescan.function_name
+  principal     = "events.amazonaws.com"
+  source_arn    = aws_cloudwatch_event_rule.rescan.arn
+}
+
+resource "aws_lambda_function" "stats" {
+  function_name = "stats"
+  handler       = "stats"
+  runtime       = "go1.x"
+  filename      = "${path.module}/../bin/stats.zip"
+  source_code_hash = filebase64sha256("${path.module}/../bin/stats.zip")
+  role          = aws_iam_role.lambda_exec.arn
+  timeout       = 900
+  environment {
+    variables = local.lambda_environment
+  }
+}
+
+# Counts users, links and clicks for the admin stats every 15 minutes, as
+# it scans the users and links tables
+resource "aws_cloudwatch_event_rule" "stats" {
+  name                = "shorty_stats"
+  schedule_expression = "rate(15 minutes)"
+}
+
+resource "aws_cloudwatch_event_target" "stats" {
+  rule = aws_cloudwatch_event_rule.stats.name
+  arn  = aws_lambda_function.stats.arn
+}
+
+resource "aws_lambda_permission" "stats" {
+  statement_id  = "AllowEventBridgeInvoke"
+  action        = "lambda:InvokeFunction"
+  function_name = aws_lambda_function.stats.function_name
+  principal     = "events.amazonaws.com"
+  source_arn    = aws_cloudwatch_event_rule.stats.arn
+}
+
+resource "aws_lambda_function" "report" {
+  function_name = "report"
+  handler       = "report"
+  runtime       = "go1.x"
+  filename      = "${path.module}/../bin/report.zip"
+  source_code_hash = filebase64sha256("${path.module}/../bin/report.zip")
+  role          = aws_iam_role.lambda_exec.arn
+  environment {
+    variables = local.lambda_environment
+  }
+}
+
+resource "aws_lambda_function" "qr" {
+  function_name = "qr"
+  handler       = "qr"
+  runtime       = "go1.x"
+  filename      = "${path.module}/../bin/qr.zip"
+  source_code_hash = filebase64sha256("${path.module}/../bin/qr.zip")
+  role          = aws_iam_role.lambda_exec.arn
+  environment {
+    variables = local.lambda_environment
+  }
+}
+
+resource "aws_lambda_function" "webhooks" {
+  function_name = "webhooks"
+  handler       = "webhooks"
+  runtime       = "go1.x"
+  filename      = "${path.module}/../bin/webhooks.zip"
+  source_code_hash = filebase64sha256("${path.module}/../bin/webhooks.zip")
+  role          = aws_iam_role.lambda_exec.arn
+  environment {
+    variables = local.lambda_environment
+  }
+}
+
+resource "aws_lambda_function" "webhookworker" {
+  function_name = "webhookworker"
+  handler       = "webhookworker"
+  runtime       = "go1.x"
+  filename      = "${path.module}/../bin/webhookworker.zip"
+  source_code_hash = filebase64sha256("${path.module}/../bin/webhookworker.zip")
+  role          = aws_iam_role.lambda_exec.arn
+  timeout       = 300
+  # Runs never overlap, so a delivery isn't attempted twice at once
+  reserved_concurrent_executions = 1
+  environment {
+    variables = local.lambda_environment
+  }
+}
+
+# Sends due webhook deliveries every minute
+resource "aws_cloudwatch_event_rule" "webhook_deliver" {
+  name                = "shorty_webhook_deliver"
+  schedule_expression = "rate(1 minute)"
+}
+
+resource "aws_cloudwatch_event_target" "webhook_deliver" {
+  rule  = aws_cloudwatch_event_rule.webhook_deliver.name
+  arn   = aws_lambda_function.webhookworker.arn
+  input = jsonencode({ job = "deliver" })
+}
+
+resource "aws_lambda_permission" "webhook_deliver" {
+  statement_id  = "AllowEventBridgeInvokeDeliver"
+  action        = "lambda:InvokeFunction"
+  function_name = aws_lambda_function.webhookworker.function_name
+  principal     = "events.amazonaws.com"
+  source_arn    = aws_cloudwatch_event_rule.webhook_deliver.arn
+}
+
+# Looks for expired links to send link.expired for every hour
+resource "aws_cloudwatch_event_rule" "webhook_expire" {
+  name                = "shorty_webhook_expire"
+  schedule_expression = "rate(1 hour)"
+}
+
+resource "aws_cloudwatch_event_target" "webhook_expire" {
+  rule  = aws_cloudwatch_event_rule.webhook_expire.name
+  arn   = aws_lambda_function.webhookworker.arn
+  input = jsonencode({ job = "expire" })
+}
+
+resource "aws_lambda_permission" "webhook_expire" {
+  statement_id  = "AllowEventBridgeInvokeExpire"
+  action        = "lambda:InvokeFunction"
+  function_name = aws_lambda_function.webhookworker.function_name
+  principal     = "events.amazonaws.com"
+  source_arn    = aws_cloudwatch_event_rule.webhook_expire.arn
 }
@@ -27,7 +27,7 @@ resource "aws_lambda_permission" "api_gateway_permission" {
   action        = "lambda:InvokeFunction"
   function_name = var.lambda_function_name
   principal     = "apigateway.amazonaws.com"
-  source_arn    = "arn:aws:apigateway:${data.aws_region.current.name}::/restapis/${var.rest_api_id}/stages/*/${var.http_method}${aws_api_gateway_resource.endpoint_resource.path}"
+  source_arn    = "arn:aws:apigateway:${data.aws_region.current.name}::/restapis/${var.rest_api_id}/stages/*/${var.http_method == "ANY" ? "*" : var.http_method}${aws_api_gateway_resource.endpoint_resource.path}"
 }
 
 resource "aws_api_gateway_method" "options_method" {
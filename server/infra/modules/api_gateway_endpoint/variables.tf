@@ -9,7 +9,7 @@ variable "path_part" {
 }
 
 variable "http_method" {
-  description = "The HTTP method (GET, POST, PUT, DELETE, etc.)."
+  description = "The HTTP method (GET, POST, PUT, DELETE, etc.). ANY routes every method to the Lambda, which then has to answer preflight requests itself."
   type        = string
 }
 
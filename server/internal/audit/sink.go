@@ -0,0 +1,77 @@
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+
+	"github.com/SunPodder/shorty/internal/db"
+)
+
+// Sink stores audit log entries. It is an interface so deployments can
+// choose where the log is kept and tests can capture what was recorded.
+type Sink interface {
+	Write(ctx context.Context, entry db.AuditEntry) error
+}
+
+// DynamoSink appends entries to the audit log table, which is what the
+// audit endpoints read from
+type DynamoSink struct{}
+
+func NewDynamoSink() *DynamoSink {
+	return &DynamoSink{}
+}
+
+func (s *DynamoSink) Write(ctx context.Context, entry db.AuditEntry) error {
+	return db.PutAuditEntry(ctx, entry)
+}
+
+// LogSink writes entries to the log as JSON, for local development or
+// deployments shipping their logs to a separate store
+type LogSink struct{}
+
+func NewLogSink() *LogSink {
+	return &LogSink{}
+}
+
+func (s *LogSink) Write(ctx context.Context, entry db.AuditEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	log.Printf("audit %s", data)
+	return nil
+}
+
+// MultiSink writes every entry to each of its sinks, so entries can be
+// kept in the table and shipped elsewhere at once
+type MultiSink []Sink
+
+func (s MultiSink) Write(ctx context.Context, entry db.AuditEntry) error {
+	var errs []error
+	for _, sink := range s {
+		if err := sink.Write(ctx, entry); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+var ErrInvalidSink = errors.New("invalid audit sink: must be dynamodb, log or both")
+
+// NewFromEnv creates the sink selected by AUDIT_SINK, which defaults to
+// dynamodb. Entries only written to the log aren't returned by the audit
+// endpoints.
+func NewFromEnv() (Sink, error) {
+	switch os.Getenv("AUDIT_SINK") {
+	case "", "dynamodb":
+		return NewDynamoSink(), nil
+	case "log":
+		return NewLogSink(), nil
+	case "both":
+		return MultiSink{NewDynamoSink(), NewLogSink()}, nil
+	}
+	return nil, ErrInvalidSink
+}
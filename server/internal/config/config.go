@@ -0,0 +1,530 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/SunPodder/shorty/internal/db"
+	"github.com/SunPodder/shorty/internal/handler"
+	"github.com/SunPodder/shorty/internal/middleware"
+	"github.com/SunPodder/shorty/internal/webhook"
+	"github.com/SunPodder/shorty/utils"
+	"gopkg.in/yaml.v3"
+)
+
+var ErrInvalidConfig = errors.New("invalid configuration")
+
+// The JWT secret the code used to ship with, which must never sign
+// tokens in production
+const insecureJWTSecret = "your-secret-key"
+
+// Shortest JWT secret accepted, the size of an HS256 key
+const minJWTSecretLength = 32
+
+// Config holds the settings shared by every function of the service
+type Config struct {
+	Tables   Tables   `yaml:"tables" json:"tables"`
+	DynamoDB DynamoDB `yaml:"dynamodb" json:"dynamodb"`
+	Secrets  Secrets  `yaml:"secrets" json:"secrets"`
+	Tokens   Tokens   `yaml:"tokens" json:"tokens"`
+	CORS     CORS     `yaml:"cors" json:"cors"`
+	Links    Links    `yaml:"links" json:"links"`
+	SSO      SSO      `yaml:"sso" json:"sso"`
+	Abuse    Abuse    `yaml:"abuse" json:"abuse"`
+	Webhooks Webhooks `yaml:"webhooks" json:"webhooks"`
+	Features Features `yaml:"features" json:"features"`
+}
+
+// Tables names the DynamoDB tables
+type Tables struct {
+	URLs              string `yaml:"urls" json:"urls"`
+	Users             string `yaml:"users" json:"users"`
+	Domains           string `yaml:"domains" json:"domains"`
+	Workspaces        string `yaml:"workspaces" json:"workspaces"`
+	WorkspaceMembers  string `yaml:"workspace_members" json:"workspace_members"`
+	WorkspaceInvites  string `yaml:"workspace_invites" json:"workspace_invites"`
+	APIKeys           string `yaml:"api_keys" json:"api_keys"`
+	RateLimits        string `yaml:"rate_limits" json:"rate_limits"`
+	Identities        string `yaml:"identities" json:"identities"`
+	UserEmails        string `yaml:"user_emails" json:"user_emails"`
+	AuditLog          string `yaml:"audit_log" json:"audit_log"`
+	Reports           string `yaml:"reports" json:"reports"`
+	Webhooks          string `yaml:"webhooks" json:"webhooks"`
+	WebhookDeliveries string `yaml:"webhook_deliveries" json:"webhook_deliveries"`
+	MailOutbox        string `yaml:"mail_outbox" json:"mail_outbox"`
+	Jobs              string `yaml:"jobs" json:"jobs"`
+}
+
+type DynamoDB struct {
+	// Endpoint used instead of the regional one, like a DynamoDB Local
+	// instance
+	Endpoint string `yaml:"endpoint" json:"endpoint"`
+}
+
+type Secrets struct {
+	// Signs session tokens and the tokens of emailed links
+	JWTSecret string `yaml:"jwt_secret" json:"jwt_secret"`
+	// Keys the hashes of backup codes and reporter IPs, the JWT secret when
+	// empty. Keeping it apart lets the JWT secret be rotated without
+	// voiding the codes.
+	HashKey string `yaml:"hash_key" json:"hash_key"`
+}
+
+// Tokens holds how long each kind of token stays valid
+type Tokens struct {
+	Session       Duration `yaml:"session_ttl" json:"session_ttl"`
+	Verification  Duration `yaml:"verification_ttl" json:"verification_ttl"`
+	PasswordReset Duration `yaml:"password_reset_ttl" json:"password_reset_ttl"`
+	MFAChallenge  Duration `yaml:"mfa_challenge_ttl" json:"mfa_challenge_ttl"`
+	SSOState      Duration `yaml:"sso_state_ttl" json:"sso_state_ttl"`
+}
+
+type CORS struct {
+	// Origins browsers may call the API from, or "*" for any
+	AllowedOrigins []string `yaml:"allowed_origins" json:"allowed_origins"`
+}
+
+type Links struct {
+	// Public base URL of the API, used in emailed links and QR codes
+	BaseURL string `yaml:"base_url" json:"base_url"`
+	// Length of generated short codes
+	CodeLength int `yaml:"code_length" json:"code_length"`
+	// Status of redirects of links without their own
+	RedirectStatus int `yaml:"redirect_status" json:"redirect_status"`
+}
+
+type SSO struct {
+	// Web app page receiving the session token after a login
+	RedirectURL string `yaml:"redirect_url" json:"redirect_url"`
+}
+
+type Abuse struct {
+	// Reports from distinct visitors that disable a link
+	ReportThreshold int `yaml:"report_threshold" json:"report_threshold"`
+	// What happens to new links flagged as unsafe, reject or quarantine
+	ScreeningAction string `yaml:"screening_action" json:"screening_action"`
+}
+
+type Webhooks struct {
+	// Share of clicks sent as link.clicked events
+	ClickSampleRate float64 `yaml:"click_sample_rate" json:"click_sample_rate"`
+	// Lets webhooks deliver to plain HTTP and private addresses, such as
+	// a receiver on localhost. Only meant for development.
+	AllowPrivateReceivers bool `yaml:"allow_private_receivers" json:"allow_private_receivers"`
+}
+
+type Features struct {
+	// Users have to verify their email before creating links
+	RequireEmailVerification bool `yaml:"require_email_verification" json:"require_email_verification"`
+	// Anyone can create an account
+	Registration bool `yaml:"registration" json:"registration"`
+}
+
+// Duration is a time.Duration written like 24h or 15m in config files
+type Duration time.Duration
+
+func (d *Duration) UnmarshalText(text []byte) error {
+	value, err := time.ParseDuration(string(text))
+	if err != nil {
+		return fmt.Errorf("invalid duration %q: must look like 24h or 15m", text)
+	}
+	*d = Duration(value)
+	return nil
+}
+
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(time.Duration(d).String()), nil
+}
+
+// Default returns the settings the service runs with when nothing is
+// configured. The JWT secret has no default and must always be set.
+func Default() *Config {
+	return &Config{
+		Tables: Tables{
+			URLs:              db.DefaultTables.URLs,
+			Users:             db.DefaultTables.Users,
+			Domains:           db.DefaultTables.Domains,
+			Workspaces:        db.DefaultTables.Workspaces,
+			WorkspaceMembers:  db.DefaultTables.WorkspaceMembers,
+			WorkspaceInvites:  db.DefaultTables.WorkspaceInvites,
+			APIKeys:           db.DefaultTables.APIKeys,
+			RateLimits:        db.DefaultTables.RateLimits,
+			Identities:        db.DefaultTables.Identities,
+			UserEmails:        db.DefaultTables.UserEmails,
+			AuditLog:          db.DefaultTables.AuditLog,
+			Reports:           db.DefaultTables.Reports,
+			Webhooks:          db.DefaultTables.Webhooks,
+			WebhookDeliveries: db.DefaultTables.WebhookDeliveries,
+			MailOutbox:        db.DefaultTables.MailOutbox,
+			Jobs:              db.DefaultTables.Jobs,
+		},
+		Tokens: Tokens{
+			Session:       Duration(24 * time.Hour),
+			Verification:  Duration(48 * time.Hour),
+			PasswordReset: Duration(time.Hour),
+			MFAChallenge:  Duration(5 * time.Minute),
+			SSOState:      Duration(10 * time.Minute),
+		},
+		CORS:     CORS{AllowedOrigins: []string{"*"}},
+		Links:    Links{CodeLength: 6, RedirectStatus: 302},
+		Abuse:    Abuse{ReportThreshold: 5, ScreeningAction: handler.ScreenReject},
+		Webhooks: Webhooks{ClickSampleRate: 1},
+		Features: Features{Registration: true},
+	}
+}
+
+// Load reads the configuration from the YAML or JSON file named by
+// CONFIG_FILE, if any, then from environment variables, which take
+// precedence over the file. The result is validated, so a service
+// started with a bad configuration stops before serving anything.
+func Load() (*Config, error) {
+	cfg := Default()
+	if path := os.Getenv("CONFIG_FILE"); path != "" {
+		if err := cfg.loadFile(path); err != nil {
+			return nil, fmt.Errorf("%w: %s: %v", ErrInvalidConfig, path, err)
+		}
+	}
+	if err := cfg.loadEnv(); err != nil {
+		return nil, err
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// Reads a config file over the current settings. Unknown keys are
+// rejected, as they are most likely typos of settings.
+func (c *Config) loadFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		decoder := yaml.NewDecoder(bytes.NewReader(data))
+		decoder.KnownFields(true)
+		// An empty file has no document at all
+		if err := decoder.Decode(c); err != nil && !errors.Is(err, io.EOF) {
+			return err
+		}
+	case ".json":
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(c); err != nil {
+			return err
+		}
+	default:
+		return errors.New("unknown format: the file must end in .yaml, .yml or .json")
+	}
+	return nil
+}
+
+// An environment variable overriding a setting
+type binding struct {
+	name  string
+	parse func(value string) error
+}
+
+func stringVar(p *string) func(string) error {
+	return func(value string) error {
+		*p = value
+		return nil
+	}
+}
+
+func intVar(p *int) func(string) error {
+	return func(value string) error {
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return errors.New("must be a whole number")
+		}
+		*p = n
+		return nil
+	}
+}
+
+func floatVar(p *float64) func(string) error {
+	return func(value string) error {
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return errors.New("must be a number")
+		}
+		*p = f
+		return nil
+	}
+}
+
+func boolVar(p *bool) func(string) error {
+	return func(value string) error {
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return errors.New("must be true or false")
+		}
+		*p = b
+		return nil
+	}
+}
+
+func durationVar(p *Duration) func(string) error {
+	return func(value string) error {
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return errors.New("must be a duration like 24h or 15m")
+		}
+		*p = Duration(d)
+		return nil
+	}
+}
+
+// Reads a comma separated list
+func listVar(p *[]string) func(string) error {
+	return func(value string) error {
+		*p = nil
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				*p = append(*p, item)
+			}
+		}
+		return nil
+	}
+}
+
+// Returns the environment variables of the settings
+func (c *Config) bindings() []binding {
+	return []binding{
+		{"TABLE_URLS", stringVar(&c.Tables.URLs)},
+		{"TABLE_USERS", stringVar(&c.Tables.Users)},
+		{"TABLE_DOMAINS", stringVar(&c.Tables.Domains)},
+		{"TABLE_WORKSPACES", stringVar(&c.Tables.Workspaces)},
+		{"TABLE_WORKSPACE_MEMBERS", stringVar(&c.Tables.WorkspaceMembers)},
+		{"TABLE_WORKSPACE_INVITES", stringVar(&c.Tables.WorkspaceInvites)},
+		{"TABLE_API_KEYS", stringVar(&c.Tables.APIKeys)},
+		{"TABLE_RATE_LIMITS", stringVar(&c.Tables.RateLimits)},
+		{"TABLE_IDENTITIES", stringVar(&c.Tables.Identities)},
+		{"TABLE_USER_EMAILS", stringVar(&c.Tables.UserEmails)},
+		{"TABLE_AUDIT_LOG", stringVar(&c.Tables.AuditLog)},
+		{"TABLE_REPORTS", stringVar(&c.Tables.Reports)},
+		{"TABLE_WEBHOOKS", stringVar(&c.Tables.Webhooks)},
+		{"TABLE_WEBHOOK_DELIVERIES", stringVar(&c.Tables.WebhookDeliveries)},
+		{"TABLE_MAIL_OUTBOX", stringVar(&c.Tables.MailOutbox)},
+		{"TABLE_JOBS", stringVar(&c.Tables.Jobs)},
+		{"DYNAMODB_ENDPOINT", stringVar(&c.DynamoDB.Endpoint)},
+		{"JWT_SECRET", stringVar(&c.Secrets.JWTSecret)},
+		{"HASH_KEY", stringVar(&c.Secrets.HashKey)},
+		{"SESSION_TTL", durationVar(&c.Tokens.Session)},
+		{"VERIFICATION_TTL", durationVar(&c.Tokens.Verification)},
+		{"PASSWORD_RESET_TTL", durationVar(&c.Tokens.PasswordReset)},
+		{"MFA_CHALLENGE_TTL", durationVar(&c.Tokens.MFAChallenge)},
+		{"SSO_STATE_TTL", durationVar(&c.Tokens.SSOState)},
+		{"CORS_ALLOWED_ORIGINS", listVar(&c.CORS.AllowedOrigins)},
+		{"PUBLIC_URL", stringVar(&c.Links.BaseURL)},
+		{"SHORT_CODE_LENGTH", intVar(&c.Links.CodeLength)},
+		{"REDIRECT_STATUS", intVar(&c.Links.RedirectStatus)},
+		{"SSO_REDIRECT_URL", stringVar(&c.SSO.RedirectURL)},
+		{"REPORT_THRESHOLD", intVar(&c.Abuse.ReportThreshold)},
+		{"SCREENING_ACTION", stringVar(&c.Abuse.ScreeningAction)},
+		{"WEBHOOK_CLICK_SAMPLE_RATE", floatVar(&c.Webhooks.ClickSampleRate)},
+		{"WEBHOOK_ALLOW_PRIVATE_RECEIVERS", boolVar(&c.Webhooks.AllowPrivateReceivers)},
+		{"REQUIRE_EMAIL_VERIFICATION", boolVar(&c.Features.RequireEmailVerification)},
+		{"REGISTRATION_ENABLED", boolVar(&c.Features.Registration)},
+	}
+}
+
+// Overrides the settings whose environment variable is set
+func (c *Config) loadEnv() error {
+	var errs []error
+	for _, b := range c.bindings() {
+		value, ok := os.LookupEnv(b.name)
+		if !ok || value == "" {
+			continue
+		}
+		if err := b.parse(value); err != nil {
+			errs = append(errs, fmt.Errorf("%s %q: %v", b.name, value, err))
+		}
+	}
+	return joinProblems(errs)
+}
+
+// Valid DynamoDB table names
+var tableNamePattern = regexp.MustCompile(`^[A-Za-z0-9_.-]{3,255}$`)
+
+// Validate checks every setting and reports all the problems at once
+func (c *Config) Validate() error {
+	var errs []error
+	check := func(ok bool, setting, format string, args ...interface{}) {
+		if !ok {
+			errs = append(errs, fmt.Errorf("%s: "+format, append([]interface{}{setting}, args...)...))
+		}
+	}
+
+	tables := []struct{ setting, value string }{
+		{"tables.urls (TABLE_URLS)", c.Tables.URLs},
+		{"tables.users (TABLE_USERS)", c.Tables.Users},
+		{"tables.domains (TABLE_DOMAINS)", c.Tables.Domains},
+		{"tables.workspaces (TABLE_WORKSPACES)", c.Tables.Workspaces},
+		{"tables.workspace_members (TABLE_WORKSPACE_MEMBERS)", c.Tables.WorkspaceMembers},
+		{"tables.workspace_invites (TABLE_WORKSPACE_INVITES)", c.Tables.WorkspaceInvites},
+		{"tables.api_keys (TABLE_API_KEYS)", c.Tables.APIKeys},
+		{"tables.rate_limits (TABLE_RATE_LIMITS)", c.Tables.RateLimits},
+		{"tables.identities (TABLE_IDENTITIES)", c.Tables.Identities},
+		{"tables.user_emails (TABLE_USER_EMAILS)", c.Tables.UserEmails},
+		{"tables.audit_log (TABLE_AUDIT_LOG)", c.Tables.AuditLog},
+		{"tables.reports (TABLE_REPORTS)", c.Tables.Reports},
+		{"tables.webhooks (TABLE_WEBHOOKS)", c.Tables.Webhooks},
+		{"tables.webhook_deliveries (TABLE_WEBHOOK_DELIVERIES)", c.Tables.WebhookDeliveries},
+		{"tables.mail_outbox (TABLE_MAIL_OUTBOX)", c.Tables.MailOutbox},
+		{"tables.jobs (TABLE_JOBS)", c.Tables.Jobs},
+	}
+	for _, table := range tables {
+		check(tableNamePattern.MatchString(table.value), table.setting,
+			"%q isn't a valid table name: use 3 to 255 letters, digits, '_', '-' or '.'", table.value)
+	}
+
+	if c.DynamoDB.Endpoint != "" {
+		check(isHTTPURL(c.DynamoDB.Endpoint), "dynamodb.endpoint (DYNAMODB_ENDPOINT)",
+			"%q must be an http or https URL", c.DynamoDB.Endpoint)
+	}
+
+	switch {
+	case c.Secrets.JWTSecret == "":
+		check(false, "secrets.jwt_secret (JWT_SECRET)", "must be set")
+	case c.Secrets.JWTSecret == insecureJWTSecret:
+		check(false, "secrets.jwt_secret (JWT_SECRET)", "must not be the example secret")
+	default:
+		check(len(c.Secrets.JWTSecret) >= minJWTSecretLength, "secrets.jwt_secret (JWT_SECRET)",
+			"must be at least %d characters long", minJWTSecretLength)
+	}
+	if c.Secrets.HashKey != "" {
+		check(len(c.Secrets.HashKey) >= minJWTSecretLength, "secrets.hash_key (HASH_KEY)",
+			"must be at least %d characters long", minJWTSecretLength)
+	}
+
+	ttls := []struct {
+		setting string
+		value   Duration
+		min     time.Duration
+	}{
+		{"tokens.session_ttl (SESSION_TTL)", c.Tokens.Session, time.Minute},
+		{"tokens.verification_ttl (VERIFICATION_TTL)", c.Tokens.Verification, time.Minute},
+		{"tokens.password_reset_ttl (PASSWORD_RESET_TTL)", c.Tokens.PasswordReset, time.Minute},
+		{"tokens.mfa_challenge_ttl (MFA_CHALLENGE_TTL)", c.Tokens.MFAChallenge, time.Minute},
+		{"tokens.sso_state_ttl (SSO_STATE_TTL)", c.Tokens.SSOState, time.Minute},
+	}
+	for _, ttl := range ttls {
+		check(time.Duration(ttl.value) >= ttl.min, ttl.setting, "must be at least %s", ttl.min)
+	}
+
+	check(len(c.CORS.AllowedOrigins) > 0, "cors.allowed_origins (CORS_ALLOWED_ORIGINS)", "must list at least one origin, or *")
+	for _, origin := range c.CORS.AllowedOrigins {
+		if origin == "*" {
+			check(len(c.CORS.AllowedOrigins) == 1, "cors.allowed_origins (CORS_ALLOWED_ORIGINS)", "* can't be combined with other origins")
+			continue
+		}
+		check(isOrigin(origin), "cors.allowed_origins (CORS_ALLOWED_ORIGINS)",
+			"%q must be an origin like https://app.example.com, without a path", origin)
+	}
+
+	if c.Links.BaseURL != "" {
+		check(isHTTPURL(c.Links.BaseURL), "links.base_url (PUBLIC_URL)", "%q must be an http or https URL", c.Links.BaseURL)
+	}
+	check(c.Links.CodeLength >= 4 && c.Links.CodeLength <= 32, "links.code_length (SHORT_CODE_LENGTH)",
+		"%d must be between 4 and 32", c.Links.CodeLength)
+	check(handler.ValidRedirectStatus(c.Links.RedirectStatus), "links.redirect_status (REDIRECT_STATUS)",
+		"%d must be one of 301, 302, 307 or 308", c.Links.RedirectStatus)
+
+	if c.SSO.RedirectURL != "" {
+		check(isHTTPURL(c.SSO.RedirectURL), "sso.redirect_url (SSO_REDIRECT_URL)", "%q must be an http or https URL", c.SSO.RedirectURL)
+	}
+
+	check(c.Abuse.ReportThreshold >= 1, "abuse.report_threshold (REPORT_THRESHOLD)", "must be a positive number")
+	_, err := handler.ParseScreeningAction(c.Abuse.ScreeningAction)
+	check(err == nil, "abuse.screening_action (SCREENING_ACTION)", "%q must be reject or quarantine", c.Abuse.ScreeningAction)
+
+	check(c.Webhooks.ClickSampleRate > 0 && c.Webhooks.ClickSampleRate <= 1, "webhooks.click_sample_rate (WEBHOOK_CLICK_SAMPLE_RATE)",
+		"%v must be above 0 and at most 1", c.Webhooks.ClickSampleRate)
+
+	return joinProblems(errs)
+}
+
+// Apply hands the settings to the packages using them. It has to be
+// called at startup, before any request is served.
+func (c *Config) Apply() {
+	db.SetTables(db.Tables{
+		URLs:              c.Tables.URLs,
+		Users:             c.Tables.Users,
+		Domains:           c.Tables.Domains,
+		Workspaces:        c.Tables.Workspaces,
+		WorkspaceMembers:  c.Tables.WorkspaceMembers,
+		WorkspaceInvites:  c.Tables.WorkspaceInvites,
+		APIKeys:           c.Tables.APIKeys,
+		RateLimits:        c.Tables.RateLimits,
+		Identities:        c.Tables.Identities,
+		UserEmails:        c.Tables.UserEmails,
+		AuditLog:          c.Tables.AuditLog,
+		Reports:           c.Tables.Reports,
+		Webhooks:          c.Tables.Webhooks,
+		WebhookDeliveries: c.Tables.WebhookDeliveries,
+		MailOutbox:        c.Tables.MailOutbox,
+		Jobs:              c.Tables.Jobs,
+	})
+	db.Endpoint = c.DynamoDB.Endpoint
+
+	utils.JWTSecret = []byte(c.Secrets.JWTSecret)
+	utils.HashKey = []byte(c.Secrets.HashKey)
+	if c.Secrets.HashKey == "" {
+		utils.HashKey = utils.JWTSecret
+	}
+	utils.SessionTTL = time.Duration(c.Tokens.Session)
+	utils.VerificationTokenTTL = time.Duration(c.Tokens.Verification)
+	utils.MFAChallengeTTL = time.Duration(c.Tokens.MFAChallenge)
+	utils.SSOStateTTL = time.Duration(c.Tokens.SSOState)
+	handler.PasswordResetTTL = time.Duration(c.Tokens.PasswordReset)
+
+	middleware.AllowedOrigins = c.CORS.AllowedOrigins
+
+	handler.PublicURL = c.Links.BaseURL
+	handler.ShortCodeLength = c.Links.CodeLength
+	handler.DefaultRedirectStatus = c.Links.RedirectStatus
+	handler.SSORedirectURL = c.SSO.RedirectURL
+	handler.ReportThreshold = c.Abuse.ReportThreshold
+	handler.ScreeningAction, _ = handler.ParseScreeningAction(c.Abuse.ScreeningAction)
+	handler.WebhookClickSampleRate = c.Webhooks.ClickSampleRate
+	webhook.AllowPrivateReceivers = c.Webhooks.AllowPrivateReceivers
+	handler.RequireVerifiedEmail = c.Features.RequireEmailVerification
+	handler.RegistrationEnabled = c.Features.Registration
+}
+
+// Combines problems into one error listing them all
+func joinProblems(errs []error) error {
+	if len(errs) == 0 {
+		return nil
+	}
+	problems := make([]string, len(errs))
+	for i, err := range errs {
+		problems[i] = "\n  - " + err.Error()
+	}
+	return fmt.Errorf("%w:%s", ErrInvalidConfig, strings.Join(problems, ""))
+}
+
+func isHTTPURL(value string) bool {
+	u, err := url.Parse(value)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+// Reports whether value is a bare origin, a scheme and host without path
+func isOrigin(value string) bool {
+	u, err := url.Parse(value)
+	return err == nil && isHTTPURL(value) && u.Path == "" && u.RawQuery == "" && u.Fragment == "" && u.User == nil
+}
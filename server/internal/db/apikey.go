@@ -0,0 +1,170 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// Scopes that can be granted to an API key
+const (
+	ScopeLinksRead  = "links:read"
+	ScopeLinksWrite = "links:write"
+	ScopeStatsRead  = "stats:read"
+)
+
+// APIKey is a personal API key. Only the hash of the key is stored,
+// along with a prefix that lets the user recognise it.
+type APIKey struct {
+	ID         string   `dynamodbav:"id,pk" json:"id"`
+	UserID     string   `dynamodbav:"user_id" json:"user_id"`
+	Name       string   `dynamodbav:"name" json:"name"`
+	Prefix     string   `dynamodbav:"prefix" json:"prefix"`
+	KeyHash    string   `dynamodbav:"key_hash" json:"-"`
+	Scopes     []string `dynamodbav:"scopes,stringset" json:"scopes"`
+	ExpiresAt  *int64   `dynamodbav:"expires_at,omitempty" json:"expires_at,omitempty"`
+	LastUsedAt *string  `dynamodbav:"last_used_at,omitempty" json:"last_used_at,omitempty"`
+	RevokedAt  *string  `dynamodbav:"revoked_at,omitempty" json:"revoked_at,omitempty"`
+	CreatedAt  string   `dynamodbav:"created_at" json:"created_at"`
+}
+
+var ErrAPIKeyNotFound = errors.New("api key not found")
+
+// ValidScope reports whether scope is a known API key scope
+func ValidScope(scope string) bool {
+	return scope == ScopeLinksRead || scope == ScopeLinksWrite || scope == ScopeStatsRead
+}
+
+// HasScope reports whether the key was granted scope
+func (k *APIKey) HasScope(scope string) bool {
+	for _, s := range k.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// Active reports whether the key is neither revoked nor expired
+func (k *APIKey) Active() bool {
+	if k.RevokedAt != nil {
+		return false
+	}
+	return k.ExpiresAt == nil || *k.ExpiresAt > time.Now().Unix()
+}
+
+// CreateAPIKey stores a new API key
+func CreateAPIKey(ctx context.Context, key APIKey) error {
+	item, err := attributevalue.MarshalMap(key)
+	if err != nil {
+		return err
+	}
+
+	_, err = client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName:           aws.String(apiKeyTableName),
+		Item:                item,
+		ConditionExpression: aws.String("attribute_not_exists(id)"),
+	})
+	return err
+}
+
+// GetAPIKey retrieves an API key by ID
+// If the key is not found, it returns ErrAPIKeyNotFound
+func GetAPIKey(ctx context.Context, id string) (*APIKey, error) {
+	result, err := client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(apiKeyTableName),
+		Key: map[string]types.AttributeValue{
+			"id": &types.AttributeValueMemberS{Value: id},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if result.Item == nil {
+		return nil, ErrAPIKeyNotFound
+	}
+
+	var key APIKey
+	if err := attributevalue.UnmarshalMap(result.Item, &key); err != nil {
+		return nil, err
+	}
+
+	return &key, nil
+}
+
+// ListUserAPIKeys retrieves all API keys of a user, including revoked ones
+func ListUserAPIKeys(ctx context.Context, userID string) ([]APIKey, error) {
+	items, err := queryAll(ctx, &dynamodb.QueryInput{
+		TableName:              aws.String(apiKeyTableName),
+		IndexName:              aws.String("user_id-index"),
+		KeyConditionExpression: aws.String("user_id = :uid"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":uid": &types.AttributeValueMemberS{Value: userID},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []APIKey
+	if err := attributevalue.UnmarshalListOfMaps(items, &keys); err != nil {
+		return nil, err
+	}
+
+	return keys, nil
+}
+
+// RevokeAPIKey marks an API key of the user as revoked
+// If the key doesn't exist or belongs to someone else, it returns ErrAPIKeyNotFound
+func RevokeAPIKey(ctx context.Context, userID, id string) error {
+	_, err := client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(apiKeyTableName),
+		Key: map[string]types.AttributeValue{
+			"id": &types.AttributeValueMemberS{Value: id},
+		},
+		UpdateExpression:    aws.String("SET revoked_at = if_not_exists(revoked_at, :now)"),
+		ConditionExpression: aws.String("user_id = :uid"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":now": &types.AttributeValueMemberS{Value: time.Now().Format(time.RFC3339)},
+			":uid": &types.AttributeValueMemberS{Value: userID},
+		},
+	})
+
+	var conditionErr *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionErr) {
+		return ErrAPIKeyNotFound
+	}
+	return err
+}
+
+// TouchAPIKey records that an API key was just used
+func TouchAPIKey(ctx context.Context, id string) error {
+	_, err := client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(apiKeyTableName),
+		Key: map[string]types.AttributeValue{
+			"id": &types.AttributeValueMemberS{Value: id},
+		},
+		UpdateExpression: aws.String("SET last_used_at = :now"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":now": &types.AttributeValueMemberS{Value: time.Now().Format(time.RFC3339)},
+		},
+	})
+	return err
+}
+
+// DeleteAPIKey removes an API key for good
+func DeleteAPIKey(ctx context.Context, id string) error {
+	_, err := client.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName: aws.String(apiKeyTableName),
+		Key: map[string]types.AttributeValue{
+			"id": &types.AttributeValueMemberS{Value: id},
+		},
+	})
+	return err
+}
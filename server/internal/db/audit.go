@@ -0,0 +1,152 @@
+package db
+
+import (
+	"context"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// AuditEntry records an action taken by a user. Entries are only ever
+// appended, never updated or deleted.
+type AuditEntry struct {
+	ID string `dynamodbav:"id,pk" json:"id"`
+	// User who took the action, empty for anonymous requests
+	ActorID string `dynamodbav:"actor_id,omitempty" json:"actor_id,omitempty"`
+	// API key the action was taken with, empty for sessions
+	APIKeyID string `dynamodbav:"api_key_id,omitempty" json:"api_key_id,omitempty"`
+	Action   string `dynamodbav:"action" json:"action"`
+	// Kind and ID of what the action was taken on
+	TargetType string            `dynamodbav:"target_type" json:"target_type"`
+	TargetID   string            `dynamodbav:"target_id" json:"target_id"`
+	Details    map[string]string `dynamodbav:"details,omitempty" json:"details,omitempty"`
+	// Fields of the target changed by the action
+	Changes   map[string]AuditChange `dynamodbav:"changes,omitempty" json:"changes,omitempty"`
+	IP        string                 `dynamodbav:"ip,omitempty" json:"ip,omitempty"`
+	RequestID string                 `dynamodbav:"request_id,omitempty" json:"request_id,omitempty"`
+	CreatedAt string                 `dynamodbav:"created_at" json:"created_at"`
+}
+
+// AuditChange is the value of a field before and after an action, as
+// JSON. A field that didn't exist on one side is empty there.
+type AuditChange struct {
+	Before string `dynamodbav:"before,omitempty" json:"before,omitempty"`
+	After  string `dynamodbav:"after,omitempty" json:"after,omitempty"`
+}
+
+// AuditFilter selects the entries returned by ListAuditEntries. Empty
+// fields match every entry.
+type AuditFilter struct {
+	ActorID    string
+	Action     string
+	TargetType string
+	TargetID   string
+}
+
+// PutAuditEntry appends an entry to the audit log
+func PutAuditEntry(ctx context.Context, entry AuditEntry) error {
+	item, err := attributevalue.MarshalMap(entry)
+	if err != nil {
+		return err
+	}
+
+	_, err = client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName:           aws.String(auditTableName),
+		Item:                item,
+		ConditionExpression: aws.String("attribute_not_exists(id)"),
+	})
+	return err
+}
+
+// ListAuditEntries returns a page of up to limit entries matching filter,
+// starting at cursor, and the cursor of the next page. Entries of an actor
+// or a target are read from an index newest first, other filters scan the
+// whole log in no particular order.
+func ListAuditEntries(ctx context.Context, filter AuditFilter, limit int32, cursor string) ([]AuditEntry, string, error) {
+	names := map[string]string{}
+	values := map[string]types.AttributeValue{}
+	condition := func(attribute, value string) string {
+		names["#"+attribute] = attribute
+		values[":"+attribute] = &types.AttributeValueMemberS{Value: value}
+		return "#" + attribute + " = :" + attribute
+	}
+
+	// The actor or target picks the index, the other attributes filter it
+	var index, keyCondition string
+	switch {
+	case filter.ActorID != "":
+		index, keyCondition = "actor_id-index", condition("actor_id", filter.ActorID)
+	case filter.TargetID != "":
+		index, keyCondition = "target_id-index", condition("target_id", filter.TargetID)
+	}
+
+	var conditions []string
+	for attribute, value := range map[string]string{
+		"actor_id":    filter.ActorID,
+		"target_id":   filter.TargetID,
+		"action":      filter.Action,
+		"target_type": filter.TargetType,
+	} {
+		if value != "" && !strings.HasPrefix(keyCondition, "#"+attribute+" ") {
+			conditions = append(conditions, condition(attribute, value))
+		}
+	}
+	sort.Strings(conditions)
+
+	var filterExpression *string
+	if len(conditions) > 0 {
+		filterExpression = aws.String(strings.Join(conditions, " AND "))
+	}
+	if len(names) == 0 {
+		names, values = nil, nil
+	}
+
+	fetch := func(start map[string]types.AttributeValue, max int32) ([]map[string]types.AttributeValue, map[string]types.AttributeValue, error) {
+		if index == "" {
+			result, err := client.Scan(ctx, &dynamodb.ScanInput{
+				TableName:                 aws.String(auditTableName),
+				FilterExpression:          filterExpression,
+				ExpressionAttributeNames:  names,
+				ExpressionAttributeValues: values,
+				ExclusiveStartKey:         start,
+				Limit:                     aws.Int32(max),
+			})
+			if err != nil {
+				return nil, nil, err
+			}
+			return result.Items, result.LastEvaluatedKey, nil
+		}
+
+		result, err := client.Query(ctx, &dynamodb.QueryInput{
+			TableName:                 aws.String(auditTableName),
+			IndexName:                 aws.String(index),
+			KeyConditionExpression:    aws.String(keyCondition),
+			FilterExpression:          filterExpression,
+			ExpressionAttributeNames:  names,
+			ExpressionAttributeValues: values,
+			ExclusiveStartKey:         start,
+			Limit:                     aws.Int32(max),
+			ScanIndexForward:          aws.Bool(false),
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+		return result.Items, result.LastEvaluatedKey, nil
+	}
+
+	items, next, err := readPage(cursor, limit, fetch)
+	if err != nil {
+		return nil, "", err
+	}
+
+	var entries []AuditEntry
+	if err := attributevalue.UnmarshalListOfMaps(items, &entries); err != nil {
+		return nil, "", err
+	}
+
+	return entries, next, nil
+}
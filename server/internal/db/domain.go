@@ -0,0 +1,159 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// Domain is a custom domain attached by a user to serve their links
+type Domain struct {
+	Domain            string  `dynamodbav:"domain,pk" json:"domain"`
+	UserID            string  `dynamodbav:"user_id" json:"user_id"`
+	VerificationToken string  `dynamodbav:"verification_token" json:"verification_token"`
+	Verified          bool    `dynamodbav:"verified" json:"verified"`
+	CreatedAt         string  `dynamodbav:"created_at" json:"created_at"`
+	VerifiedAt        *string `dynamodbav:"verified_at,omitempty" json:"verified_at,omitempty"`
+	// Unix time a claim that wasn't verified by then is released at
+	ExpiresAt *int64 `dynamodbav:"expires_at,omitempty" json:"expires_at,omitempty"`
+}
+
+// Expired reports whether the domain is an unverified claim past its
+// expiry. DynamoDB deletes those lazily, so they can still be read.
+func (d *Domain) Expired() bool {
+	return !d.Verified && d.ExpiresAt != nil && *d.ExpiresAt <= time.Now().Unix()
+}
+
+var (
+	ErrDomainNotFound  = errors.New("domain not found")
+	ErrDuplicateDomain = errors.New("domain already registered")
+)
+
+// CreateDomain registers a new custom domain, replacing an expired claim
+// If the domain is already registered, it returns ErrDuplicateDomain
+func CreateDomain(ctx context.Context, domain Domain) error {
+	item, err := attributevalue.MarshalMap(domain)
+	if err != nil {
+		return err
+	}
+
+	_, err = client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName:           aws.String(domainTableName),
+		Item:                item,
+		ConditionExpression: aws.String("attribute_not_exists(#d) OR (verified = :false AND expires_at <= :now)"),
+		ExpressionAttributeNames: map[string]string{
+			"#d": "domain",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":false": &types.AttributeValueMemberBOOL{Value: false},
+			":now":   &types.AttributeValueMemberN{Value: strconv.FormatInt(time.Now().Unix(), 10)},
+		},
+	})
+
+	var conditionErr *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionErr) {
+		return ErrDuplicateDomain
+	}
+	return err
+}
+
+// GetDomain retrieves a custom domain by name
+// If the domain is not found or its claim expired, it returns ErrDomainNotFound
+func GetDomain(ctx context.Context, domain string) (*Domain, error) {
+	result, err := client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(domainTableName),
+		Key: map[string]types.AttributeValue{
+			"domain": &types.AttributeValueMemberS{Value: domain},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if result.Item == nil {
+		return nil, ErrDomainNotFound
+	}
+
+	var d Domain
+	if err := attributevalue.UnmarshalMap(result.Item, &d); err != nil {
+		return nil, err
+	}
+	if d.Expired() {
+		return nil, ErrDomainNotFound
+	}
+
+	return &d, nil
+}
+
+// ListUserDomains retrieves the custom domains attached by a user,
+// leaving out expired claims
+func ListUserDomains(ctx context.Context, userID string) ([]Domain, error) {
+	items, err := queryAll(ctx, &dynamodb.QueryInput{
+		TableName:              aws.String(domainTableName),
+		IndexName:              aws.String("user_id-index"),
+		KeyConditionExpression: aws.String("user_id = :uid"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":uid": &types.AttributeValueMemberS{Value: userID},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var all []Domain
+	if err := attributevalue.UnmarshalListOfMaps(items, &all); err != nil {
+		return nil, err
+	}
+
+	var domains []Domain
+	for _, domain := range all {
+		if !domain.Expired() {
+			domains = append(domains, domain)
+		}
+	}
+	return domains, nil
+}
+
+// MarkDomainVerified records that the ownership of a domain was proven,
+// which keeps the claim from expiring
+// If the claim was released in the meantime, it returns ErrDomainNotFound
+func MarkDomainVerified(ctx context.Context, domain string) error {
+	_, err := client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(domainTableName),
+		Key: map[string]types.AttributeValue{
+			"domain": &types.AttributeValueMemberS{Value: domain},
+		},
+		UpdateExpression:    aws.String("SET verified = :v, verified_at = :at REMOVE expires_at"),
+		ConditionExpression: aws.String("attribute_exists(#d)"),
+		ExpressionAttributeNames: map[string]string{
+			"#d": "domain",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":v":  &types.AttributeValueMemberBOOL{Value: true},
+			":at": &types.AttributeValueMemberS{Value: time.Now().Format(time.RFC3339)},
+		},
+	})
+
+	var conditionErr *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionErr) {
+		return ErrDomainNotFound
+	}
+	return err
+}
+
+// DeleteDomain releases a custom domain so it can be attached again
+func DeleteDomain(ctx context.Context, domain string) error {
+	_, err := client.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName: aws.String(domainTableName),
+		Key: map[string]types.AttributeValue{
+			"domain": &types.AttributeValueMemberS{Value: domain},
+		},
+	})
+	return err
+}
@@ -2,28 +2,225 @@ package db
 
 import (
 	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log/slog"
 	"sync"
 
+	"github.com/SunPodder/shorty/internal/telemetry"
+	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
 )
 
-const (
-	urlTableName  = "shorty_urls"
-	userTableName = "shorty_users"
+// Tables names the DynamoDB tables of the service
+type Tables struct {
+	URLs              string
+	Users             string
+	Domains           string
+	Workspaces        string
+	WorkspaceMembers  string
+	WorkspaceInvites  string
+	APIKeys           string
+	RateLimits        string
+	Identities        string
+	UserEmails        string
+	AuditLog          string
+	Reports           string
+	Webhooks          string
+	WebhookDeliveries string
+	MailOutbox        string
+	Jobs              string
+}
+
+// DefaultTables are the table names created by the Terraform config
+var DefaultTables = Tables{
+	URLs:              "shorty_links",
+	Users:             "shorty_users",
+	Domains:           "shorty_domains",
+	Workspaces:        "shorty_workspaces",
+	WorkspaceMembers:  "shorty_workspace_members",
+	WorkspaceInvites:  "shorty_workspace_invites",
+	APIKeys:           "shorty_api_keys",
+	RateLimits:        "shorty_rate_limits",
+	Identities:        "shorty_identities",
+	UserEmails:        "shorty_user_emails",
+	AuditLog:          "shorty_audit_log",
+	Reports:           "shorty_reports",
+	Webhooks:          "shorty_webhooks",
+	WebhookDeliveries: "shorty_webhook_deliveries",
+	MailOutbox:        "shorty_mail_outbox",
+	Jobs:              "shorty_jobs",
+}
+
+var (
+	urlTableName             = DefaultTables.URLs
+	userTableName            = DefaultTables.Users
+	domainTableName          = DefaultTables.Domains
+	workspaceTableName       = DefaultTables.Workspaces
+	workspaceMemberTableName = DefaultTables.WorkspaceMembers
+	workspaceInviteTableName = DefaultTables.WorkspaceInvites
+	apiKeyTableName          = DefaultTables.APIKeys
+	rateLimitTableName       = DefaultTables.RateLimits
+	identityTableName        = DefaultTables.Identities
+	emailTableName           = DefaultTables.UserEmails
+	auditTableName           = DefaultTables.AuditLog
+	reportTableName          = DefaultTables.Reports
+	webhookTableName         = DefaultTables.Webhooks
+	deliveryTableName        = DefaultTables.WebhookDeliveries
+	mailTableName            = DefaultTables.MailOutbox
+	jobTableName             = DefaultTables.Jobs
 )
 
+// SetTables makes the client use the given table names. It has to be
+// called at startup, before any request is served.
+func SetTables(tables Tables) {
+	urlTableName = tables.URLs
+	userTableName = tables.Users
+	domainTableName = tables.Domains
+	workspaceTableName = tables.Workspaces
+	workspaceMemberTableName = tables.WorkspaceMembers
+	workspaceInviteTableName = tables.WorkspaceInvites
+	apiKeyTableName = tables.APIKeys
+	rateLimitTableName = tables.RateLimits
+	identityTableName = tables.Identities
+	emailTableName = tables.UserEmails
+	auditTableName = tables.AuditLog
+	reportTableName = tables.Reports
+	webhookTableName = tables.Webhooks
+	deliveryTableName = tables.WebhookDeliveries
+	mailTableName = tables.MailOutbox
+	jobTableName = tables.Jobs
+}
+
+// Endpoint overrides the DynamoDB endpoint the client connects to, such
+// as a DynamoDB Local instance at http://localhost:8000. The regional
+// endpoint is used when empty.
+var Endpoint = ""
+
 var (
 	client *dynamodb.Client
 	once   sync.Once
 )
 
+var ErrInvalidCursor = errors.New("invalid cursor")
+
 func InitDynamoDBClient() {
 	once.Do(func() {
 		cfg, err := config.LoadDefaultConfig(context.TODO())
 		if err != nil {
+			slog.Error("load AWS SDK config", "error", err)
 			panic("unable to load SDK config, " + err.Error())
 		}
-		client = dynamodb.NewFromConfig(cfg)
+		cfg.APIOptions = append(cfg.APIOptions, telemetry.InstrumentDynamoDB)
+		client = dynamodb.NewFromConfig(cfg, func(o *dynamodb.Options) {
+			if Endpoint != "" {
+				o.BaseEndpoint = aws.String(Endpoint)
+			}
+		})
+	})
+}
+
+// Runs a query and calls fn with the items of every result page, so
+// queries over large indexes aren't cut off at the first page
+func queryPages(ctx context.Context, input *dynamodb.QueryInput, fn func(items []map[string]types.AttributeValue) error) error {
+	paginator := dynamodb.NewQueryPaginator(client, input)
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return err
+		}
+		if err := fn(page.Items); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Runs a query and returns the items of all result pages
+func queryAll(ctx context.Context, input *dynamodb.QueryInput) ([]map[string]types.AttributeValue, error) {
+	var items []map[string]types.AttributeValue
+	err := queryPages(ctx, input, func(page []map[string]types.AttributeValue) error {
+		items = append(items, page...)
+		return nil
 	})
+	return items, err
+}
+
+// Reports whether err is a canceled transaction whose item at index
+// failed its condition
+func transactionConditionFailed(err error, index int) bool {
+	var canceled *types.TransactionCanceledException
+	if !errors.As(err, &canceled) || index >= len(canceled.CancellationReasons) {
+		return false
+	}
+	return aws.ToString(canceled.CancellationReasons[index].Code) == "ConditionalCheckFailed"
+}
+
+// Encodes the key a paginated read stopped at as an opaque cursor
+func encodeCursor(key map[string]types.AttributeValue) (string, error) {
+	if len(key) == 0 {
+		return "", nil
+	}
+	var values map[string]interface{}
+	if err := attributevalue.UnmarshalMap(key, &values); err != nil {
+		return "", err
+	}
+	data, err := json.Marshal(values)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+// Decodes a cursor from encodeCursor, an empty cursor starts from the top
+func decodeCursor(cursor string) (map[string]types.AttributeValue, error) {
+	if cursor == "" {
+		return nil, nil
+	}
+	data, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	var values map[string]interface{}
+	if err := json.Unmarshal(data, &values); err != nil {
+		return nil, ErrInvalidCursor
+	}
+	key, err := attributevalue.MarshalMap(values)
+	if err != nil || len(key) == 0 {
+		return nil, ErrInvalidCursor
+	}
+	return key, nil
+}
+
+// Reads one page of up to limit items starting at cursor. fetch reads
+// from start at most max items and returns those passing its filter with
+// the key it stopped at. Filtered reads can come back short, so fetch is
+// called until the page is full or the items run out.
+func readPage(cursor string, limit int32, fetch func(start map[string]types.AttributeValue, max int32) ([]map[string]types.AttributeValue, map[string]types.AttributeValue, error)) ([]map[string]types.AttributeValue, string, error) {
+	start, err := decodeCursor(cursor)
+	if err != nil {
+		return nil, "", err
+	}
+
+	var items []map[string]types.AttributeValue
+	for {
+		// Never read more than the page has room for, so no item is
+		// skipped when the next page resumes from the returned key
+		page, last, err := fetch(start, limit-int32(len(items)))
+		if err != nil {
+			return nil, "", err
+		}
+		items = append(items, page...)
+		start = last
+		if len(start) == 0 || int32(len(items)) >= limit {
+			break
+		}
+	}
+
+	next, err := encodeCursor(start)
+	return items, next, err
 }
@@ -0,0 +1,112 @@
+package db
+
+import (
+	"context"
+	"errors"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// Identity links an account at an external identity provider to a user
+type Identity struct {
+	// Provider name and subject, see IdentityID
+	ID        string `dynamodbav:"id,pk" json:"-"`
+	UserID    string `dynamodbav:"user_id" json:"user_id"`
+	Provider  string `dynamodbav:"provider" json:"provider"`
+	Subject   string `dynamodbav:"subject" json:"subject"`
+	Email     string `dynamodbav:"email,omitempty" json:"email,omitempty"`
+	CreatedAt string `dynamodbav:"created_at" json:"created_at"`
+}
+
+var (
+	ErrIdentityNotFound  = errors.New("identity not found")
+	ErrDuplicateIdentity = errors.New("identity already linked")
+)
+
+// IdentityID returns the key of the identity of subject at provider
+func IdentityID(provider, subject string) string {
+	return provider + "|" + subject
+}
+
+// CreateIdentity links an identity to a user. Each identity can only be
+// linked once.
+func CreateIdentity(ctx context.Context, identity Identity) error {
+	identity.ID = IdentityID(identity.Provider, identity.Subject)
+
+	item, err := attributevalue.MarshalMap(identity)
+	if err != nil {
+		return err
+	}
+
+	_, err = client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName:           aws.String(identityTableName),
+		Item:                item,
+		ConditionExpression: aws.String("attribute_not_exists(id)"),
+	})
+
+	var conditionErr *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionErr) {
+		return ErrDuplicateIdentity
+	}
+	return err
+}
+
+// GetIdentity retrieves the identity of subject at provider
+func GetIdentity(ctx context.Context, provider, subject string) (*Identity, error) {
+	result, err := client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(identityTableName),
+		Key: map[string]types.AttributeValue{
+			"id": &types.AttributeValueMemberS{Value: IdentityID(provider, subject)},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if result.Item == nil {
+		return nil, ErrIdentityNotFound
+	}
+
+	var identity Identity
+	if err := attributevalue.UnmarshalMap(result.Item, &identity); err != nil {
+		return nil, err
+	}
+
+	return &identity, nil
+}
+
+// ListUserIdentities retrieves the identities linked to a user
+func ListUserIdentities(ctx context.Context, userID string) ([]Identity, error) {
+	items, err := queryAll(ctx, &dynamodb.QueryInput{
+		TableName:              aws.String(identityTableName),
+		IndexName:              aws.String("user_id-index"),
+		KeyConditionExpression: aws.String("user_id = :uid"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":uid": &types.AttributeValueMemberS{Value: userID},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var identities []Identity
+	if err := attributevalue.UnmarshalListOfMaps(items, &identities); err != nil {
+		return nil, err
+	}
+
+	return identities, nil
+}
+
+// DeleteIdentity unlinks an identity from its user
+func DeleteIdentity(ctx context.Context, id string) error {
+	_, err := client.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName: aws.String(identityTableName),
+		Key: map[string]types.AttributeValue{
+			"id": &types.AttributeValueMemberS{Value: id},
+		},
+	})
+	return err
+}
@@ -0,0 +1,58 @@
+package db
+
+import (
+	"context"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// Job is the progress of a scheduled job that may take more than one run
+type Job struct {
+	Name string `dynamodbav:"name"`
+	// Where the next run resumes, empty once a pass is complete
+	Cursor string `dynamodbav:"cursor,omitempty"`
+	// Unix time the current or last pass started
+	StartedAt int64 `dynamodbav:"started_at,omitempty"`
+	// Unix time a job that runs once, such as a migration, completed, or
+	// the last complete pass of a recurring job finished
+	CompletedAt int64 `dynamodbav:"completed_at,omitempty"`
+	// Unix time the last complete pass started
+	CompletedPassStartedAt int64 `dynamodbav:"completed_pass_started_at,omitempty"`
+}
+
+// GetJob returns the progress of a job, a job that never ran has none
+func GetJob(ctx context.Context, name string) (*Job, error) {
+	result, err := client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(jobTableName),
+		Key: map[string]types.AttributeValue{
+			"name": &types.AttributeValueMemberS{Value: name},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	job := Job{Name: name}
+	if result.Item != nil {
+		if err := attributevalue.UnmarshalMap(result.Item, &job); err != nil {
+			return nil, err
+		}
+	}
+	return &job, nil
+}
+
+// SaveJob stores the progress of a job
+func SaveJob(ctx context.Context, job Job) error {
+	item, err := attributevalue.MarshalMap(job)
+	if err != nil {
+		return err
+	}
+	_, err = client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(jobTableName),
+		Item:      item,
+	})
+	return err
+}
@@ -0,0 +1,71 @@
+package db
+
+import (
+	"context"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// QueuedMail is an email waiting in the outbox to be sent by the mail
+// worker
+type QueuedMail struct {
+	ID      string `dynamodbav:"id,pk"`
+	To      string `dynamodbav:"to"`
+	Subject string `dynamodbav:"subject"`
+	Body    string `dynamodbav:"body"`
+	// Failed attempts to send it so far
+	Attempts  int    `dynamodbav:"attempts,omitempty"`
+	CreatedAt string `dynamodbav:"created_at"`
+	// Unix time the email is dropped if still unsent, also the TTL of the
+	// item. Emails carrying a token expire along with it.
+	ExpiresAt int64 `dynamodbav:"expires_at"`
+}
+
+// PutQueuedMail adds an email to the outbox, or stores the outcome of a
+// failed attempt to send it
+func PutQueuedMail(ctx context.Context, mail QueuedMail) error {
+	item, err := attributevalue.MarshalMap(mail)
+	if err != nil {
+		return err
+	}
+
+	_, err = client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(mailTableName),
+		Item:      item,
+	})
+	return err
+}
+
+// ForEachQueuedMail calls fn with every page of the emails in the outbox,
+// including expired ones the TTL hasn't removed yet
+func ForEachQueuedMail(ctx context.Context, fn func(mails []QueuedMail) error) error {
+	paginator := dynamodb.NewScanPaginator(client, &dynamodb.ScanInput{
+		TableName: aws.String(mailTableName),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return err
+		}
+		var mails []QueuedMail
+		if err := attributevalue.UnmarshalListOfMaps(page.Items, &mails); err != nil {
+			return err
+		}
+		if err := fn(mails); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DeleteQueuedMail removes a sent or dropped email from the outbox
+func DeleteQueuedMail(ctx context.Context, id string) error {
+	_, err := client.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName: aws.String(mailTableName),
+		Key:       map[string]types.AttributeValue{"id": &types.AttributeValueMemberS{Value: id}},
+	})
+	return err
+}
@@ -0,0 +1,162 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+var (
+	ErrTOTPAlreadyEnabled = errors.New("two-factor authentication is already enabled")
+	ErrTOTPNotPending     = errors.New("two-factor enrollment not started")
+	ErrCodeAlreadyUsed    = errors.New("code already used")
+	ErrInvalidChallenge   = errors.New("invalid or used MFA challenge")
+)
+
+// StartTOTPEnrollment stores the secret of a pending TOTP enrollment,
+// replacing any earlier pending one
+func StartTOTPEnrollment(ctx context.Context, id, secret string) error {
+	_, err := client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:           aws.String(userTableName),
+		Key:                 userKey(id),
+		UpdateExpression:    aws.String("SET totp_secret = :secret"),
+		ConditionExpression: aws.String("attribute_exists(id) AND (attribute_not_exists(totp_enabled) OR totp_enabled = :false)"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":secret": &types.AttributeValueMemberS{Value: secret},
+			":false":  &types.AttributeValueMemberBOOL{Value: false},
+		},
+	})
+
+	var conditionErr *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionErr) {
+		return ErrTOTPAlreadyEnabled
+	}
+	return err
+}
+
+// EnableTOTP turns on two-factor authentication for the pending secret,
+// storing the backup code hashes and the step of the code that proved it
+func EnableTOTP(ctx context.Context, id, secret string, step int64, backupCodeHashes []string) error {
+	_, err := client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:           aws.String(userTableName),
+		Key:                 userKey(id),
+		UpdateExpression:    aws.String("SET totp_enabled = :true, totp_last_step = :step, backup_code_hashes = :codes"),
+		ConditionExpression: aws.String("totp_secret = :secret AND (attribute_not_exists(totp_enabled) OR totp_enabled = :false)"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":true":   &types.AttributeValueMemberBOOL{Value: true},
+			":false":  &types.AttributeValueMemberBOOL{Value: false},
+			":secret": &types.AttributeValueMemberS{Value: secret},
+			":step":   &types.AttributeValueMemberN{Value: strconv.FormatInt(step, 10)},
+			":codes":  &types.AttributeValueMemberSS{Value: backupCodeHashes},
+		},
+	})
+
+	var conditionErr *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionErr) {
+		return ErrTOTPNotPending
+	}
+	return err
+}
+
+// DisableTOTP removes two-factor authentication from a user
+func DisableTOTP(ctx context.Context, id string) error {
+	_, err := client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:           aws.String(userTableName),
+		Key:                 userKey(id),
+		UpdateExpression:    aws.String("REMOVE totp_enabled, totp_secret, totp_last_step, backup_code_hashes"),
+		ConditionExpression: aws.String("attribute_exists(id)"),
+	})
+
+	var conditionErr *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionErr) {
+		return ErrUserNotFound
+	}
+	return err
+}
+
+// UseTOTPStep records that the code of step was used. It fails with
+// ErrCodeAlreadyUsed unless step is newer than the last recorded one,
+// so every code works only once.
+func UseTOTPStep(ctx context.Context, id string, step int64) error {
+	_, err := client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:           aws.String(userTableName),
+		Key:                 userKey(id),
+		UpdateExpression:    aws.String("SET totp_last_step = :step"),
+		ConditionExpression: aws.String("attribute_not_exists(totp_last_step) OR totp_last_step < :step"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":step": &types.AttributeValueMemberN{Value: strconv.FormatInt(step, 10)},
+		},
+	})
+
+	var conditionErr *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionErr) {
+		return ErrCodeAlreadyUsed
+	}
+	return err
+}
+
+// UseBackupCode removes the hash of a backup code from a user. It fails
+// with ErrCodeAlreadyUsed if the code is unknown or was used before.
+func UseBackupCode(ctx context.Context, id, codeHash string) error {
+	_, err := client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:           aws.String(userTableName),
+		Key:                 userKey(id),
+		UpdateExpression:    aws.String("DELETE backup_code_hashes :codes"),
+		ConditionExpression: aws.String("contains(backup_code_hashes, :code)"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":codes": &types.AttributeValueMemberSS{Value: []string{codeHash}},
+			":code":  &types.AttributeValueMemberS{Value: codeHash},
+		},
+	})
+
+	var conditionErr *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionErr) {
+		return ErrCodeAlreadyUsed
+	}
+	return err
+}
+
+// SetMFAChallenge stores the hash of the challenge issued to a user who
+// entered the right password, replacing any earlier one
+func SetMFAChallenge(ctx context.Context, id, challengeHash string) error {
+	_, err := client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:           aws.String(userTableName),
+		Key:                 userKey(id),
+		UpdateExpression:    aws.String("SET mfa_challenge_hash = :hash"),
+		ConditionExpression: aws.String("attribute_exists(id)"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":hash": &types.AttributeValueMemberS{Value: challengeHash},
+		},
+	})
+
+	var conditionErr *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionErr) {
+		return ErrUserNotFound
+	}
+	return err
+}
+
+// UseMFAChallenge removes the challenge hash of a user. It fails with
+// ErrInvalidChallenge unless challengeHash is the stored one, so every
+// challenge works only once.
+func UseMFAChallenge(ctx context.Context, id, challengeHash string) error {
+	_, err := client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:           aws.String(userTableName),
+		Key:                 userKey(id),
+		UpdateExpression:    aws.String("REMOVE mfa_challenge_hash"),
+		ConditionExpression: aws.String("mfa_challenge_hash = :hash"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":hash": &types.AttributeValueMemberS{Value: challengeHash},
+		},
+	})
+
+	var conditionErr *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionErr) {
+		return ErrInvalidChallenge
+	}
+	return err
+}
@@ -0,0 +1,187 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"github.com/SunPodder/shorty/utils"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// MigrateLegacyURLs copies the links of legacyTable, which is keyed by
+// short code alone as before custom domains, into the links table under
+// DefaultDomain. Links already in the links table are left alone, so it
+// can be run again to pick up links created while it ran.
+func MigrateLegacyURLs(ctx context.Context, legacyTable string) (copied, skipped int, err error) {
+	paginator := dynamodb.NewScanPaginator(client, &dynamodb.ScanInput{
+		TableName: aws.String(legacyTable),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return copied, skipped, err
+		}
+
+		for _, item := range page.Items {
+			item["domain"] = &types.AttributeValueMemberS{Value: DefaultDomain}
+			_, err := client.PutItem(ctx, &dynamodb.PutItemInput{
+				TableName:           aws.String(urlTableName),
+				Item:                item,
+				ConditionExpression: aws.String("attribute_not_exists(short_code)"),
+			})
+
+			var conditionErr *types.ConditionalCheckFailedException
+			if errors.As(err, &conditionErr) {
+				skipped++
+				continue
+			}
+			if err != nil {
+				return copied, skipped, err
+			}
+			copied++
+		}
+	}
+	return copied, skipped, nil
+}
+
+// Job completed once MigrateUserEmails normalized and locked the email of
+// every user
+const emailMigrationJob = "normalize_emails"
+
+// Set once the email migration is known to have completed
+var emailsMigrated atomic.Bool
+
+// EmailsMigrated reports whether MigrateUserEmails has completed, after
+// which every user has a normalized email and an email lock
+func EmailsMigrated(ctx context.Context) (bool, error) {
+	if emailsMigrated.Load() {
+		return true, nil
+	}
+	job, err := GetJob(ctx, emailMigrationJob)
+	if err != nil {
+		return false, err
+	}
+	if job.CompletedAt != 0 {
+		emailsMigrated.Store(true)
+	}
+	return job.CompletedAt != 0, nil
+}
+
+// Email and ID of a user, all the email migration reads
+type userEmail struct {
+	ID    string `dynamodbav:"id"`
+	Email string `dynamodbav:"email"`
+}
+
+// Calls fn with the ID and email of every user
+func forEachUserEmail(ctx context.Context, fn func(users []userEmail) error) error {
+	paginator := dynamodb.NewScanPaginator(client, &dynamodb.ScanInput{
+		TableName:            aws.String(userTableName),
+		ProjectionExpression: aws.String("id, email"),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return err
+		}
+		var users []userEmail
+		if err := attributevalue.UnmarshalListOfMaps(page.Items, &users); err != nil {
+			return err
+		}
+		if err := fn(users); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Finds the user whose email is email in any case by scanning the users
+// table, for users stored before emails were normalized
+func scanUserByEmail(ctx context.Context, email string) (*User, error) {
+	errFound := errors.New("found")
+	var id string
+	err := forEachUserEmail(ctx, func(users []userEmail) error {
+		for _, user := range users {
+			if utils.NormalizeEmail(user.Email) == email {
+				id = user.ID
+				return errFound
+			}
+		}
+		return nil
+	})
+	if err == errFound {
+		return GetUser(ctx, id)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return nil, ErrUserNotFound
+}
+
+// MigrateUserEmails normalizes the email of every user stored before
+// emails were normalized and writes the email locks they lack. Users whose
+// normalized email is held by another user are left alone and returned,
+// to be resolved by hand before running it again. The migration is only
+// recorded as completed once no such conflicts remain.
+func MigrateUserEmails(ctx context.Context) (normalized, locked int, conflicts []string, err error) {
+	err = forEachUserEmail(ctx, func(users []userEmail) error {
+		for _, user := range users {
+			email := utils.NormalizeEmail(user.Email)
+			lock, err := attributevalue.MarshalMap(emailLock{Email: email, UserID: user.ID})
+			if err != nil {
+				return err
+			}
+
+			items := []types.TransactWriteItem{
+				{Put: &types.Put{
+					TableName:           aws.String(emailTableName),
+					Item:                lock,
+					ConditionExpression: aws.String("attribute_not_exists(email) OR user_id = :uid"),
+					ExpressionAttributeValues: map[string]types.AttributeValue{
+						":uid": &types.AttributeValueMemberS{Value: user.ID},
+					},
+				}},
+			}
+			if email != user.Email {
+				items = append(items, types.TransactWriteItem{Update: &types.Update{
+					TableName:           aws.String(userTableName),
+					Key:                 userKey(user.ID),
+					UpdateExpression:    aws.String("SET email = :email"),
+					ConditionExpression: aws.String("email = :old"),
+					ExpressionAttributeValues: map[string]types.AttributeValue{
+						":email": &types.AttributeValueMemberS{Value: email},
+						":old":   &types.AttributeValueMemberS{Value: user.Email},
+					},
+				}})
+			}
+
+			_, err = client.TransactWriteItems(ctx, &dynamodb.TransactWriteItemsInput{TransactItems: items})
+			switch {
+			case transactionConditionFailed(err, 0):
+				conflicts = append(conflicts, user.ID)
+				continue
+			case transactionConditionFailed(err, 1):
+				// The user changed their email meanwhile, which wrote its lock
+				continue
+			case err != nil:
+				return err
+			}
+			locked++
+			if email != user.Email {
+				normalized++
+			}
+		}
+		return nil
+	})
+	if err != nil || len(conflicts) > 0 {
+		return normalized, locked, conflicts, err
+	}
+
+	err = SaveJob(ctx, Job{Name: emailMigrationJob, CompletedAt: time.Now().Unix()})
+	return normalized, locked, conflicts, err
+}
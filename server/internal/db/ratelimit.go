@@ -0,0 +1,85 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// RateLimitBucket is the persisted state of a token bucket
+type RateLimitBucket struct {
+	Key    string  `dynamodbav:"key,pk"`
+	Tokens float64 `dynamodbav:"tokens"`
+	// Unix milliseconds of the last update, also used as a version for
+	// optimistic concurrency
+	UpdatedAt int64 `dynamodbav:"updated_at"`
+	// Unix seconds after which DynamoDB may expire the item
+	ExpiresAt int64 `dynamodbav:"expires_at"`
+}
+
+var (
+	ErrBucketNotFound = errors.New("rate limit bucket not found")
+	ErrBucketConflict = errors.New("rate limit bucket was updated concurrently")
+)
+
+// GetRateLimitBucket retrieves a token bucket with a strongly consistent read
+func GetRateLimitBucket(ctx context.Context, key string) (*RateLimitBucket, error) {
+	result, err := client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(rateLimitTableName),
+		Key: map[string]types.AttributeValue{
+			"key": &types.AttributeValueMemberS{Value: key},
+		},
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if result.Item == nil {
+		return nil, ErrBucketNotFound
+	}
+
+	var bucket RateLimitBucket
+	if err := attributevalue.UnmarshalMap(result.Item, &bucket); err != nil {
+		return nil, err
+	}
+
+	return &bucket, nil
+}
+
+// PutRateLimitBucket stores a token bucket if it wasn't changed since it
+// was read at previousUpdatedAt, 0 meaning the bucket didn't exist.
+// If someone else updated it first, it returns ErrBucketConflict.
+func PutRateLimitBucket(ctx context.Context, bucket RateLimitBucket, previousUpdatedAt int64) error {
+	item, err := attributevalue.MarshalMap(bucket)
+	if err != nil {
+		return err
+	}
+
+	input := &dynamodb.PutItemInput{
+		TableName:                aws.String(rateLimitTableName),
+		Item:                     item,
+		ExpressionAttributeNames: map[string]string{"#k": "key"},
+	}
+	if previousUpdatedAt == 0 {
+		input.ConditionExpression = aws.String("attribute_not_exists(#k)")
+	} else {
+		input.ConditionExpression = aws.String("updated_at = :prev")
+		input.ExpressionAttributeValues = map[string]types.AttributeValue{
+			":prev": &types.AttributeValueMemberN{Value: strconv.FormatInt(previousUpdatedAt, 10)},
+		}
+	}
+
+	_, err = client.PutItem(ctx, input)
+
+	var conditionErr *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionErr) {
+		return ErrBucketConflict
+	}
+	return err
+}
@@ -0,0 +1,143 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// Triage states of an abuse report
+const (
+	ReportStatusOpen = "open"
+	// An admin found nothing wrong with the link
+	ReportStatusDismissed = "dismissed"
+	// An admin took the link down
+	ReportStatusActioned = "actioned"
+)
+
+var ErrDuplicateReport = errors.New("link already reported from this address")
+
+// Report is an abuse report of a link by a visitor. Its ID combines the
+// link and the reporter, so every address reports a link only once.
+type Report struct {
+	ID string `dynamodbav:"id,pk" json:"id"`
+	// Domain and short code of the link as domain/short_code
+	LinkID    string `dynamodbav:"link_id" json:"link_id"`
+	Domain    string `dynamodbav:"domain" json:"domain"`
+	ShortCode string `dynamodbav:"short_code" json:"short_code"`
+	// HMAC of the reporter's IP keyed with a server secret. The address
+	// itself isn't kept and can't be brute-forced from the hash alone.
+	ReporterHash string `dynamodbav:"reporter_hash" json:"-"`
+	Category     string `dynamodbav:"category" json:"category"`
+	Details      string `dynamodbav:"details,omitempty" json:"details,omitempty"`
+	Status       string `dynamodbav:"status" json:"status"`
+	CreatedAt    string `dynamodbav:"created_at" json:"created_at"`
+	ResolvedBy   string `dynamodbav:"resolved_by,omitempty" json:"resolved_by,omitempty"`
+	ResolvedAt   string `dynamodbav:"resolved_at,omitempty" json:"resolved_at,omitempty"`
+}
+
+// CreateReport stores a new report, failing with ErrDuplicateReport when
+// the reporter already reported the link
+func CreateReport(ctx context.Context, report Report) error {
+	item, err := attributevalue.MarshalMap(report)
+	if err != nil {
+		return err
+	}
+
+	_, err = client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName:           aws.String(reportTableName),
+		Item:                item,
+		ConditionExpression: aws.String("attribute_not_exists(id)"),
+	})
+
+	var conditionErr *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionErr) {
+		return ErrDuplicateReport
+	}
+	return err
+}
+
+// ListReports returns a page of up to limit reports in the given status,
+// newest first, starting at cursor, and the cursor of the next page
+func ListReports(ctx context.Context, status string, limit int32, cursor string) ([]Report, string, error) {
+	items, next, err := readPage(cursor, limit, func(start map[string]types.AttributeValue, max int32) ([]map[string]types.AttributeValue, map[string]types.AttributeValue, error) {
+		result, err := client.Query(ctx, &dynamodb.QueryInput{
+			TableName:                aws.String(reportTableName),
+			IndexName:                aws.String("status-index"),
+			KeyConditionExpression:   aws.String("#status = :status"),
+			ExpressionAttributeNames: map[string]string{"#status": "status"},
+			ExpressionAttributeValues: map[string]types.AttributeValue{
+				":status": &types.AttributeValueMemberS{Value: status},
+			},
+			ExclusiveStartKey: start,
+			Limit:             aws.Int32(max),
+			ScanIndexForward:  aws.Bool(false),
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+		return result.Items, result.LastEvaluatedKey, nil
+	})
+	if err != nil {
+		return nil, "", err
+	}
+
+	var reports []Report
+	if err := attributevalue.UnmarshalListOfMaps(items, &reports); err != nil {
+		return nil, "", err
+	}
+
+	return reports, next, nil
+}
+
+// ListLinkReports returns every report of a link
+func ListLinkReports(ctx context.Context, linkID string) ([]Report, error) {
+	items, err := queryAll(ctx, &dynamodb.QueryInput{
+		TableName:              aws.String(reportTableName),
+		IndexName:              aws.String("link_id-index"),
+		KeyConditionExpression: aws.String("link_id = :link"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":link": &types.AttributeValueMemberS{Value: linkID},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var reports []Report
+	if err := attributevalue.UnmarshalListOfMaps(items, &reports); err != nil {
+		return nil, err
+	}
+
+	return reports, nil
+}
+
+// ResolveReport moves an open report to status. Reports resolved in the
+// meantime are left as they are.
+func ResolveReport(ctx context.Context, id, status, resolvedBy, resolvedAt string) error {
+	_, err := client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:                aws.String(reportTableName),
+		Key:                      map[string]types.AttributeValue{"id": &types.AttributeValueMemberS{Value: id}},
+		UpdateExpression:         aws.String("SET #status = :status, resolved_by = :by, resolved_at = :at"),
+		ConditionExpression:      aws.String("#status = :open"),
+		ExpressionAttributeNames: map[string]string{"#status": "status"},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":status": &types.AttributeValueMemberS{Value: status},
+			":by":     &types.AttributeValueMemberS{Value: resolvedBy},
+			":at":     &types.AttributeValueMemberS{Value: resolvedAt},
+			":open":   &types.AttributeValueMemberS{Value: ReportStatusOpen},
+		},
+	})
+
+	var conditionErr *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionErr) {
+		slog.DebugContext(ctx, "report already resolved", "report_id", id)
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,133 @@
+package db
+
+import (
+	"context"
+	"errors"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// Stats are system-wide counts shown to admins
+type Stats struct {
+	Users          int64 `dynamodbav:"users" json:"users"`
+	DisabledUsers  int64 `dynamodbav:"disabled_users" json:"disabled_users"`
+	Admins         int64 `dynamodbav:"admins" json:"admins"`
+	Links          int64 `dynamodbav:"links" json:"links"`
+	TakenDownLinks int64 `dynamodbav:"taken_down_links" json:"taken_down_links"`
+	Clicks         int64 `dynamodbav:"clicks" json:"clicks"`
+	// When the counts were taken
+	ComputedAt string `dynamodbav:"computed_at" json:"computed_at"`
+}
+
+// Item of the jobs table holding the last stats computed
+const statsItemName = "stats"
+
+var ErrStatsNotComputed = errors.New("stats not computed yet")
+
+// Calls fn with every page of a scan that only reads the attributes of
+// projection, whose placeholders are resolved through names
+func scanPages(ctx context.Context, table, projection string, names map[string]string, fn func(items []map[string]types.AttributeValue) error) error {
+	paginator := dynamodb.NewScanPaginator(client, &dynamodb.ScanInput{
+		TableName:                aws.String(table),
+		ProjectionExpression:     aws.String(projection),
+		ExpressionAttributeNames: names,
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return err
+		}
+		if err := fn(page.Items); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CountStats computes the system-wide counts. It scans the users and
+// URLs tables, reading only the attributes it counts.
+func CountStats(ctx context.Context) (*Stats, error) {
+	stats := &Stats{}
+
+	err := scanPages(ctx, userTableName, "disabled_at, #role", map[string]string{"#role": "role"}, func(items []map[string]types.AttributeValue) error {
+		var users []User
+		if err := attributevalue.UnmarshalListOfMaps(items, &users); err != nil {
+			return err
+		}
+		for _, user := range users {
+			stats.Users++
+			if user.Disabled() {
+				stats.DisabledUsers++
+			}
+			if user.IsAdmin() {
+				stats.Admins++
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = scanPages(ctx, urlTableName, "clicks, takedown_reason", nil, func(items []map[string]types.AttributeValue) error {
+		var urls []URL
+		if err := attributevalue.UnmarshalListOfMaps(items, &urls); err != nil {
+			return err
+		}
+		for _, url := range urls {
+			stats.Links++
+			stats.Clicks += url.Clicks
+			if url.TakenDown() {
+				stats.TakenDownLinks++
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return stats, nil
+}
+
+// SaveStats stores stats as the last computed ones
+func SaveStats(ctx context.Context, stats Stats) error {
+	item, err := attributevalue.MarshalMap(stats)
+	if err != nil {
+		return err
+	}
+	item["name"] = &types.AttributeValueMemberS{Value: statsItemName}
+
+	_, err = client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(jobTableName),
+		Item:      item,
+	})
+	return err
+}
+
+// GetStats returns the stats last stored by SaveStats. If none were,
+// it returns ErrStatsNotComputed.
+func GetStats(ctx context.Context) (*Stats, error) {
+	result, err := client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(jobTableName),
+		Key: map[string]types.AttributeValue{
+			"name": &types.AttributeValueMemberS{Value: statsItemName},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if result.Item == nil {
+		return nil, ErrStatsNotComputed
+	}
+
+	var stats Stats
+	if err := attributevalue.UnmarshalMap(result.Item, &stats); err != nil {
+		return nil, err
+	}
+	return &stats, nil
+}
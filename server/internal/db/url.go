@@ -3,6 +3,8 @@ package db
 import (
 	"context"
 	"errors"
+	"strconv"
+	"strings"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
@@ -15,18 +17,56 @@ var (
 	ErrInvalidUserID = errors.New("invalid user ID")
 )
 
+// DefaultDomain is the namespace of links served from the shared API host
+const DefaultDomain = "default"
+
 type URL struct {
-	ShortCode   string  `dynamodbav:"short_code,pk" json:"short_code"`
-	OriginalURL string  `dynamodbav:"original_url" json:"original_url"`
-	UserID      *string `dynamodbav:"user_id,omitempty" json:"user_id,omitempty"`
-	ExpiryDate  *int64  `dynamodbav:"expiry_date,omitempty" json:"expiry_date,omitempty"`
-	ViewOnce    *bool   `dynamodbav:"view_once,omitempty" json:"view_once,omitempty"`
-	CreatedAt   string  `dynamodbav:"created_at" json:"created_at"`
-	Clicks      int64   `dynamodbav:"clicks" json:"clicks"`
+	Domain            string  `dynamodbav:"domain,pk" json:"domain"`
+	ShortCode         string  `dynamodbav:"short_code,sk" json:"short_code"`
+	OriginalURL       string  `dynamodbav:"original_url" json:"original_url"`
+	UserID            *string `dynamodbav:"user_id,omitempty" json:"user_id,omitempty"`
+	WorkspaceID       *string `dynamodbav:"workspace_id,omitempty" json:"workspace_id,omitempty"`
+	ExpiryDate        *int64  `dynamodbav:"expiry_date,omitempty" json:"expiry_date,omitempty"`
+	ViewOnce          *bool   `dynamodbav:"view_once,omitempty" json:"view_once,omitempty"`
+	ForwardQuery      *bool   `dynamodbav:"forward_query,omitempty" json:"forward_query,omitempty"`
+	QueryPrecedence   *string `dynamodbav:"query_precedence,omitempty" json:"query_precedence,omitempty"`
+	RedirectStatus    *int    `dynamodbav:"redirect_status,omitempty" json:"redirect_status,omitempty"`
+	Interstitial      *bool   `dynamodbav:"interstitial,omitempty" json:"interstitial,omitempty"`
+	InterstitialDelay *int    `dynamodbav:"interstitial_delay,omitempty" json:"interstitial_delay,omitempty"`
+	Title             *string `dynamodbav:"title,omitempty" json:"title,omitempty"`
+	ShowOwner         *bool   `dynamodbav:"show_owner,omitempty" json:"show_owner,omitempty"`
+	CreatedAt         string  `dynamodbav:"created_at" json:"created_at"`
+	Clicks            int64   `dynamodbav:"clicks" json:"clicks"`
+	// Clicks that came from scanning the link's QR code, also counted in Clicks
+	QRClicks int64 `dynamodbav:"qr_clicks,omitempty" json:"qr_clicks,omitempty"`
+	// Set when an admin took the link down, the reason is shown instead
+	// of redirecting
+	TakedownReason *string `dynamodbav:"takedown_reason,omitempty" json:"takedown_reason,omitempty"`
+	TakenDownAt    *string `dynamodbav:"taken_down_at,omitempty" json:"taken_down_at,omitempty"`
+	// Abuse reports received since the link was last reviewed
+	ReportCount int `dynamodbav:"report_count,omitempty" json:"report_count,omitempty"`
+	// When the current destination was screened as the link was created
+	// or edited, unset if no screening was configured
+	ScreenedAt *string `dynamodbav:"screened_at,omitempty" json:"-"`
+	// Destination an admin restored the link with, which rescans don't
+	// flag again until the destination changes
+	ScreeningReviewedURL *string `dynamodbav:"screening_reviewed_url,omitempty" json:"-"`
+	// Set once the link.expired event of the link was sent
+	ExpiryNotifiedAt *string `dynamodbav:"expiry_notified_at,omitempty" json:"-"`
+}
+
+// TakenDown reports whether an admin took the link down
+func (u *URL) TakenDown() bool {
+	return u.TakedownReason != nil
 }
 
 // Creates a new URL in DynamoDB
+// URLs without a domain are created in DefaultDomain
 func CreateURL(ctx context.Context, url *URL) error {
+	if url.Domain == "" {
+		url.Domain = DefaultDomain
+	}
+
 	item, err := attributevalue.MarshalMap(url)
 	if err != nil {
 		return err
@@ -39,19 +79,20 @@ func CreateURL(ctx context.Context, url *URL) error {
 	return err
 }
 
-// Retrieves a URL by its shortcode
-// If the URL is not found, it returns ErrURLNotFound
-func GetURL(ctx context.Context, shortCode string) (*URL, error) {
-	key, err := attributevalue.MarshalMap(map[string]string{
-		"short_code": shortCode,
-	})
-	if err != nil {
-		return nil, err
+// Builds the primary key of a URL, which is scoped by domain
+func urlKey(domain, shortCode string) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		"domain":     &types.AttributeValueMemberS{Value: domain},
+		"short_code": &types.AttributeValueMemberS{Value: shortCode},
 	}
+}
 
+// Retrieves a URL by its domain and shortcode
+// If the URL is not found, it returns ErrURLNotFound
+func GetURL(ctx context.Context, domain, shortCode string) (*URL, error) {
 	result, err := client.GetItem(ctx, &dynamodb.GetItemInput{
 		TableName: aws.String(urlTableName),
-		Key:       key,
+		Key:       urlKey(domain, shortCode),
 	})
 	if err != nil {
 		return nil, err
@@ -71,6 +112,21 @@ func GetURL(ctx context.Context, shortCode string) (*URL, error) {
 
 // Retrieves all URLs created by a specific user
 func ListUserURLs(ctx context.Context, userID string) ([]URL, error) {
+	var urls []URL
+	err := ForEachUserURL(ctx, userID, func(page []URL) error {
+		urls = append(urls, page...)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return urls, nil
+}
+
+// Calls fn with every page of URLs created by a user, going through the
+// whole user_id-index
+func ForEachUserURL(ctx context.Context, userID string, fn func(urls []URL) error) error {
 	input := &dynamodb.QueryInput{
 		TableName:              aws.String(urlTableName),
 		IndexName:              aws.String("user_id-index"),
@@ -80,26 +136,144 @@ func ListUserURLs(ctx context.Context, userID string) ([]URL, error) {
 		},
 	}
 
-	result, err := client.Query(ctx, input)
-	if err != nil {
-		return nil, err
+	return queryPages(ctx, input, func(items []map[string]types.AttributeValue) error {
+		var urls []URL
+		if err := attributevalue.UnmarshalListOfMaps(items, &urls); err != nil {
+			return err
+		}
+		return fn(urls)
+	})
+}
+
+// Retrieves all URLs that belong to a workspace
+func ListWorkspaceURLs(ctx context.Context, workspaceID string) ([]URL, error) {
+	input := &dynamodb.QueryInput{
+		TableName:              aws.String(urlTableName),
+		IndexName:              aws.String("workspace_id-index"),
+		KeyConditionExpression: aws.String("workspace_id = :wid"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":wid": &types.AttributeValueMemberS{Value: workspaceID},
+		},
 	}
 
 	var urls []URL
-	if err := attributevalue.UnmarshalListOfMaps(result.Items, &urls); err != nil {
+	err := queryPages(ctx, input, func(items []map[string]types.AttributeValue) error {
+		var page []URL
+		if err := attributevalue.UnmarshalListOfMaps(items, &page); err != nil {
+			return err
+		}
+		urls = append(urls, page...)
+		return nil
+	})
+	if err != nil {
 		return nil, err
 	}
 
 	return urls, nil
 }
 
+// URLUpdate holds the attributes of a URL to change, nil fields are
+// left as they are
+type URLUpdate struct {
+	OriginalURL    *string
+	Title          *string
+	ExpiryDate     *int64
+	RedirectStatus *int
+	Interstitial   *bool
+	TakedownReason *string
+	TakenDownAt    *string
+	// Set along with a screened OriginalURL. A new destination without it
+	// wasn't screened, so the screening date of the old one is dropped.
+	ScreenedAt *string
+}
+
+// Changes only the given attributes of a URL, so counters updated in the
+// meantime such as clicks aren't overwritten. A new expiry date is
+// notified again once it passes.
+// If the URL does not exist, it returns ErrURLNotFound
+func UpdateURL(ctx context.Context, domain, shortCode string, update URLUpdate) (*URL, error) {
+	var sets []string
+	names := map[string]string{}
+	values := map[string]types.AttributeValue{}
+	set := func(name string, value interface{}) error {
+		av, err := attributevalue.Marshal(value)
+		if err != nil {
+			return err
+		}
+		sets = append(sets, "#"+name+" = :"+name)
+		names["#"+name] = name
+		values[":"+name] = av
+		return nil
+	}
+
+	fields := []struct {
+		name  string
+		isSet bool
+		value interface{}
+	}{
+		{"original_url", update.OriginalURL != nil, update.OriginalURL},
+		{"title", update.Title != nil, update.Title},
+		{"expiry_date", update.ExpiryDate != nil, update.ExpiryDate},
+		{"redirect_status", update.RedirectStatus != nil, update.RedirectStatus},
+		{"interstitial", update.Interstitial != nil, update.Interstitial},
+		{"takedown_reason", update.TakedownReason != nil, update.TakedownReason},
+		{"taken_down_at", update.TakenDownAt != nil, update.TakenDownAt},
+		{"screened_at", update.ScreenedAt != nil, update.ScreenedAt},
+	}
+	for _, field := range fields {
+		if !field.isSet {
+			continue
+		}
+		if err := set(field.name, field.value); err != nil {
+			return nil, err
+		}
+	}
+	if len(sets) == 0 {
+		return GetURL(ctx, domain, shortCode)
+	}
+
+	var removes []string
+	if update.ExpiryDate != nil {
+		removes = append(removes, "expiry_notified_at")
+	}
+	if update.OriginalURL != nil && update.ScreenedAt == nil {
+		removes = append(removes, "screened_at")
+	}
+	expression := "SET " + strings.Join(sets, ", ")
+	if len(removes) > 0 {
+		expression += " REMOVE " + strings.Join(removes, ", ")
+	}
+
+	result, err := client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:                 aws.String(urlTableName),
+		Key:                       urlKey(domain, shortCode),
+		UpdateExpression:          aws.String(expression),
+		ConditionExpression:       aws.String("attribute_exists(short_code)"),
+		ExpressionAttributeNames:  names,
+		ExpressionAttributeValues: values,
+		ReturnValues:              types.ReturnValueAllNew,
+	})
+
+	var conditionErr *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionErr) {
+		return nil, ErrURLNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var url URL
+	if err := attributevalue.UnmarshalMap(result.Attributes, &url); err != nil {
+		return nil, err
+	}
+	return &url, nil
+}
+
 // Increments the click count for a URL
-func IncrementClicks(ctx context.Context, shortCode string) error {
+func IncrementClicks(ctx context.Context, domain, shortCode string) error {
 	input := &dynamodb.UpdateItemInput{
-		TableName: aws.String(urlTableName),
-		Key: map[string]types.AttributeValue{
-			"short_code": &types.AttributeValueMemberS{Value: shortCode},
-		},
+		TableName:        aws.String(urlTableName),
+		Key:              urlKey(domain, shortCode),
 		UpdateExpression: aws.String("SET clicks = clicks + :inc"),
 		ExpressionAttributeValues: map[string]types.AttributeValue{
 			":inc": &types.AttributeValueMemberN{Value: "1"},
@@ -110,18 +284,287 @@ func IncrementClicks(ctx context.Context, shortCode string) error {
 	return err
 }
 
-// Deletes a URL by its shortcode
-func DeleteURL(ctx context.Context, shortCode string) error {
-	key, err := attributevalue.MarshalMap(map[string]string{
-		"short_code": shortCode,
+// Counts a click from a QR code scan, both as a click and as a QR click
+func IncrementQRClicks(ctx context.Context, domain, shortCode string) error {
+	input := &dynamodb.UpdateItemInput{
+		TableName:        aws.String(urlTableName),
+		Key:              urlKey(domain, shortCode),
+		UpdateExpression: aws.String("SET clicks = clicks + :inc, qr_clicks = if_not_exists(qr_clicks, :zero) + :inc"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":inc":  &types.AttributeValueMemberN{Value: "1"},
+			":zero": &types.AttributeValueMemberN{Value: "0"},
+		},
+	}
+
+	_, err := client.UpdateItem(ctx, input)
+	return err
+}
+
+// Deletes a URL by its domain and shortcode
+func DeleteURL(ctx context.Context, domain, shortCode string) error {
+	_, err := client.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName: aws.String(urlTableName),
+		Key:       urlKey(domain, shortCode),
+	})
+	return err
+}
+
+// Detaches a URL from the user who created it, keeping the link working
+func AnonymizeURL(ctx context.Context, domain, shortCode string) error {
+	_, err := client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:           aws.String(urlTableName),
+		Key:                 urlKey(domain, shortCode),
+		UpdateExpression:    aws.String("REMOVE user_id, show_owner"),
+		ConditionExpression: aws.String("attribute_exists(short_code)"),
 	})
+
+	var conditionErr *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionErr) {
+		return ErrURLNotFound
+	}
+	return err
+}
+
+// ListURLs returns a page of up to limit URLs, starting at cursor, and the
+// cursor of the next page. Only URLs created by userID are listed when it
+// is set, and a non-empty query only keeps URLs whose short code or
+// destination contains it.
+func ListURLs(ctx context.Context, userID, query string, limit int32, cursor string) ([]URL, string, error) {
+	var filter *string
+	values := map[string]types.AttributeValue{}
+	if query = strings.TrimSpace(query); query != "" {
+		filter = aws.String("contains(short_code, :query) OR contains(original_url, :query)")
+		values[":query"] = &types.AttributeValueMemberS{Value: query}
+	}
+
+	var fetch func(start map[string]types.AttributeValue, max int32) ([]map[string]types.AttributeValue, map[string]types.AttributeValue, error)
+	if userID != "" {
+		values[":uid"] = &types.AttributeValueMemberS{Value: userID}
+		fetch = func(start map[string]types.AttributeValue, max int32) ([]map[string]types.AttributeValue, map[string]types.AttributeValue, error) {
+			result, err := client.Query(ctx, &dynamodb.QueryInput{
+				TableName:                 aws.String(urlTableName),
+				IndexName:                 aws.String("user_id-index"),
+				KeyConditionExpression:    aws.String("user_id = :uid"),
+				FilterExpression:          filter,
+				ExpressionAttributeValues: values,
+				ExclusiveStartKey:         start,
+				Limit:                     aws.Int32(max),
+			})
+			if err != nil {
+				return nil, nil, err
+			}
+			return result.Items, result.LastEvaluatedKey, nil
+		}
+	} else {
+		if len(values) == 0 {
+			values = nil
+		}
+		fetch = func(start map[string]types.AttributeValue, max int32) ([]map[string]types.AttributeValue, map[string]types.AttributeValue, error) {
+			result, err := client.Scan(ctx, &dynamodb.ScanInput{
+				TableName:                 aws.String(urlTableName),
+				FilterExpression:          filter,
+				ExpressionAttributeValues: values,
+				ExclusiveStartKey:         start,
+				Limit:                     aws.Int32(max),
+			})
+			if err != nil {
+				return nil, nil, err
+			}
+			return result.Items, result.LastEvaluatedKey, nil
+		}
+	}
+
+	items, next, err := readPage(cursor, limit, fetch)
 	if err != nil {
-		return err
+		return nil, "", err
 	}
 
-	_, err = client.DeleteItem(ctx, &dynamodb.DeleteItemInput{
-		TableName: aws.String(urlTableName),
-		Key:       key,
+	var urls []URL
+	if err := attributevalue.UnmarshalListOfMaps(items, &urls); err != nil {
+		return nil, "", err
+	}
+
+	return urls, next, nil
+}
+
+// ScanURLs returns a page of up to limit URLs starting at cursor, with
+// the cursor of the next page. Only the attributes needed to screen a URL
+// are read: its key, destination and takedown.
+func ScanURLs(ctx context.Context, cursor string, limit int32) ([]URL, string, error) {
+	start, err := decodeCursor(cursor)
+	if err != nil {
+		return nil, "", err
+	}
+
+	result, err := client.Scan(ctx, &dynamodb.ScanInput{
+		TableName:                aws.String(urlTableName),
+		ProjectionExpression:     aws.String("#domain, short_code, original_url, takedown_reason"),
+		ExpressionAttributeNames: map[string]string{"#domain": "domain"},
+		ExclusiveStartKey:        start,
+		Limit:                    aws.Int32(limit),
 	})
+	if err != nil {
+		return nil, "", err
+	}
+
+	var urls []URL
+	if err := attributevalue.UnmarshalListOfMaps(result.Items, &urls); err != nil {
+		return nil, "", err
+	}
+	next, err := encodeCursor(result.LastEvaluatedKey)
+	return urls, next, err
+}
+
+// Calls fn with every page of URLs that expired at now and whose expiry
+// wasn't notified yet
+func ForEachExpiredURL(ctx context.Context, now int64, fn func(urls []URL) error) error {
+	paginator := dynamodb.NewScanPaginator(client, &dynamodb.ScanInput{
+		TableName:        aws.String(urlTableName),
+		FilterExpression: aws.String("expiry_date <= :now AND attribute_not_exists(expiry_notified_at)"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":now": &types.AttributeValueMemberN{Value: strconv.FormatInt(now, 10)},
+		},
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return err
+		}
+		var urls []URL
+		if err := attributevalue.UnmarshalListOfMaps(page.Items, &urls); err != nil {
+			return err
+		}
+		if err := fn(urls); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// MarkURLExpiryNotified records that the expiry of a URL was notified
+func MarkURLExpiryNotified(ctx context.Context, domain, shortCode, at string) error {
+	_, err := client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:           aws.String(urlTableName),
+		Key:                 urlKey(domain, shortCode),
+		UpdateExpression:    aws.String("SET expiry_notified_at = :at"),
+		ConditionExpression: aws.String("attribute_exists(short_code)"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":at": &types.AttributeValueMemberS{Value: at},
+		},
+	})
+
+	var conditionErr *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionErr) {
+		return ErrURLNotFound
+	}
+	return err
+}
+
+// TakeDownURL stops a URL from redirecting, showing reason instead
+func TakeDownURL(ctx context.Context, domain, shortCode, reason, at string) error {
+	_, err := client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:           aws.String(urlTableName),
+		Key:                 urlKey(domain, shortCode),
+		UpdateExpression:    aws.String("SET takedown_reason = :reason, taken_down_at = :at"),
+		ConditionExpression: aws.String("attribute_exists(short_code)"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":reason": &types.AttributeValueMemberS{Value: reason},
+			":at":     &types.AttributeValueMemberS{Value: at},
+		},
+	})
+
+	var conditionErr *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionErr) {
+		return ErrURLNotFound
+	}
+	return err
+}
+
+// ScreeningReviewed reports whether an admin restored the link with its
+// current destination, which screening then doesn't flag again
+func (u *URL) ScreeningReviewed() bool {
+	return u.ScreeningReviewedURL != nil && *u.ScreeningReviewedURL == u.OriginalURL
+}
+
+// RestoreURL lets a URL that was taken down redirect again. An admin
+// reviewed its destination, so rescans leave it alone until it changes.
+func RestoreURL(ctx context.Context, domain, shortCode string) error {
+	_, err := client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:           aws.String(urlTableName),
+		Key:                 urlKey(domain, shortCode),
+		UpdateExpression:    aws.String("SET screening_reviewed_url = original_url REMOVE takedown_reason, taken_down_at"),
+		ConditionExpression: aws.String("attribute_exists(short_code)"),
+	})
+
+	var conditionErr *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionErr) {
+		return ErrURLNotFound
+	}
+	return err
+}
+
+// AddURLReport counts a new abuse report of a URL and returns the number
+// of reports since the URL was last reviewed
+func AddURLReport(ctx context.Context, domain, shortCode string) (int, error) {
+	result, err := client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:           aws.String(urlTableName),
+		Key:                 urlKey(domain, shortCode),
+		UpdateExpression:    aws.String("ADD report_count :one"),
+		ConditionExpression: aws.String("attribute_exists(short_code)"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":one": &types.AttributeValueMemberN{Value: "1"},
+		},
+		ReturnValues: types.ReturnValueUpdatedNew,
+	})
+
+	var conditionErr *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionErr) {
+		return 0, ErrURLNotFound
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	var updated struct {
+		ReportCount int `dynamodbav:"report_count"`
+	}
+	if err := attributevalue.UnmarshalMap(result.Attributes, &updated); err != nil {
+		return 0, err
+	}
+	return updated.ReportCount, nil
+}
+
+// ResetURLReports starts counting the abuse reports of a reviewed URL anew
+func ResetURLReports(ctx context.Context, domain, shortCode string) error {
+	_, err := client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:           aws.String(urlTableName),
+		Key:                 urlKey(domain, shortCode),
+		UpdateExpression:    aws.String("REMOVE report_count"),
+		ConditionExpression: aws.String("attribute_exists(short_code)"),
+	})
+
+	var conditionErr *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionErr) {
+		return ErrURLNotFound
+	}
+	return err
+}
+
+// SetURLOwner makes userID the creator of a URL
+func SetURLOwner(ctx context.Context, domain, shortCode, userID string) error {
+	_, err := client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:           aws.String(urlTableName),
+		Key:                 urlKey(domain, shortCode),
+		UpdateExpression:    aws.String("SET user_id = :uid"),
+		ConditionExpression: aws.String("attribute_exists(short_code)"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":uid": &types.AttributeValueMemberS{Value: userID},
+		},
+	})
+
+	var conditionErr *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionErr) {
+		return ErrURLNotFound
+	}
 	return err
 }
@@ -3,7 +3,10 @@ package db
 import (
 	"context"
 	"errors"
+	"strconv"
+	"strings"
 
+	"github.com/SunPodder/shorty/utils"
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
@@ -12,34 +15,117 @@ import (
 
 // User represents a user in DynamoDB
 type User struct {
-	ID        string `dynamodbav:"id,pk" json:"id"`
-	Email     string `dynamodbav:"email" json:"email"`
-	Password  string `dynamodbav:"password" json:"password"`
-	CreatedAt string `dynamodbav:"created_at" json:"created_at"`
+	ID          string `dynamodbav:"id,pk" json:"id"`
+	Email       string `dynamodbav:"email" json:"email"`
+	Password    string `dynamodbav:"password" json:"password"`
+	DisplayName string `dynamodbav:"display_name,omitempty" json:"display_name,omitempty"`
+	CreatedAt   string `dynamodbav:"created_at" json:"created_at"`
+	// Whether the user proved owning Email
+	Verified bool `dynamodbav:"verified" json:"verified"`
+	// Role of the user across the whole service, empty for regular users.
+	// Admins are promoted by setting the attribute directly in the table.
+	Role string `dynamodbav:"role,omitempty" json:"role,omitempty"`
+	// Unix time an admin disabled the account at, zero while enabled
+	DisabledAt     int64  `dynamodbav:"disabled_at,omitempty" json:"disabled_at,omitempty"`
+	DisabledReason string `dynamodbav:"disabled_reason,omitempty" json:"disabled_reason,omitempty"`
+
+	// Consecutive failed logins since the last successful one
+	FailedLogins int `dynamodbav:"failed_logins,omitempty" json:"-"`
+	// Unix time until which logins are refused
+	LockedUntil int64 `dynamodbav:"locked_until,omitempty" json:"-"`
+	// Hash of the token emailed to unlock the account
+	UnlockTokenHash string `dynamodbav:"unlock_token_hash,omitempty" json:"-"`
+
+	// Hash and unix expiry of the pending password reset token
+	PasswordResetHash    string `dynamodbav:"password_reset_hash,omitempty" json:"-"`
+	PasswordResetExpires int64  `dynamodbav:"password_reset_expires,omitempty" json:"-"`
+	// Unix time before which issued sessions are no longer accepted
+	SessionsValidAfter int64 `dynamodbav:"sessions_valid_after,omitempty" json:"-"`
+
+	// Whether logins require a TOTP or backup code after the password
+	TOTPEnabled bool `dynamodbav:"totp_enabled,omitempty" json:"totp_enabled"`
+	// TOTP secret, set once enrollment starts
+	TOTPSecret string `dynamodbav:"totp_secret,omitempty" json:"-"`
+	// Last TOTP step used to log in, older codes are refused
+	TOTPLastStep int64 `dynamodbav:"totp_last_step,omitempty" json:"-"`
+	// Hashes of the unused backup codes
+	BackupCodeHashes []string `dynamodbav:"backup_code_hashes,stringset,omitempty" json:"-"`
+	// Hash of the pending login challenge, removed once it is used
+	MFAChallengeHash string `dynamodbav:"mfa_challenge_hash,omitempty" json:"-"`
+}
+
+const UserRoleAdmin = "admin"
+
+// IsAdmin reports whether the user administers the service
+func (u *User) IsAdmin() bool {
+	return u.Role == UserRoleAdmin
+}
+
+// Disabled reports whether an admin disabled the account
+func (u *User) Disabled() bool {
+	return u.DisabledAt != 0
 }
 
 var (
-	ErrUserNotFound   = errors.New("user not found")
-	ErrDuplicateEmail = errors.New("duplicate email")
+	ErrUserNotFound      = errors.New("user not found")
+	ErrDuplicateEmail    = errors.New("duplicate email")
+	ErrInvalidResetToken = errors.New("invalid or expired password reset token")
 )
 
-// CreateUser creates a new user in DynamoDB
+// Item reserving an email for a user. It is written in the same
+// transaction as the user, so no two users can ever hold the same email.
+type emailLock struct {
+	Email  string `dynamodbav:"email,pk"`
+	UserID string `dynamodbav:"user_id"`
+}
+
+func emailLockKey(email string) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		"email": &types.AttributeValueMemberS{Value: email},
+	}
+}
+
+// CreateUser creates a new user in DynamoDB with a normalized email
+// If another user has the email, it returns ErrDuplicateEmail
 func CreateUser(ctx context.Context, user User) error {
+	user.Email = utils.NormalizeEmail(user.Email)
+
 	item, err := attributevalue.MarshalMap(user)
 	if err != nil {
 		return err
 	}
+	lock, err := attributevalue.MarshalMap(emailLock{Email: user.Email, UserID: user.ID})
+	if err != nil {
+		return err
+	}
 
-	// check if the email already exists
-	existingUser, err := GetUserByEmail(ctx, user.Email)
+	// Users created before email locks existed can only be found through
+	// the index, or by a scan while their emails may differ in case
+	existingUser, err := findUserByEmailFold(ctx, user.Email)
 	if err == nil && existingUser != nil {
 		return ErrDuplicateEmail
 	}
+	if err != nil && err != ErrUserNotFound {
+		return err
+	}
 
-	_, err = client.PutItem(ctx, &dynamodb.PutItemInput{
-		TableName: aws.String(userTableName),
-		Item:      item,
+	_, err = client.TransactWriteItems(ctx, &dynamodb.TransactWriteItemsInput{
+		TransactItems: []types.TransactWriteItem{
+			{Put: &types.Put{
+				TableName:           aws.String(userTableName),
+				Item:                item,
+				ConditionExpression: aws.String("attribute_not_exists(id)"),
+			}},
+			{Put: &types.Put{
+				TableName:           aws.String(emailTableName),
+				Item:                lock,
+				ConditionExpression: aws.String("attribute_not_exists(email)"),
+			}},
+		},
 	})
+	if transactionConditionFailed(err, 1) {
+		return ErrDuplicateEmail
+	}
 	return err
 }
 
@@ -72,8 +158,37 @@ func GetUser(ctx context.Context, id string) (*User, error) {
 	return &user, nil
 }
 
-// GetUserByEmail retrieves a user by email using the email-index GSI
+// GetUserByEmail retrieves a user by email using the email-index GSI.
+// The email is normalized first, falling back to the email as given for
+// users stored before emails were normalized.
 func GetUserByEmail(ctx context.Context, email string) (*User, error) {
+	normalized := utils.NormalizeEmail(email)
+	user, err := queryUserByEmail(ctx, normalized)
+	if err == ErrUserNotFound && strings.TrimSpace(email) != normalized {
+		return queryUserByEmail(ctx, strings.TrimSpace(email))
+	}
+	return user, err
+}
+
+// Returns the user holding the normalized email. Until MigrateUserEmails
+// has completed, users stored with the email in another case are found as
+// well, so they can't be duplicated.
+func findUserByEmailFold(ctx context.Context, email string) (*User, error) {
+	user, err := GetUserByEmail(ctx, email)
+	if err != ErrUserNotFound {
+		return user, err
+	}
+	migrated, err := EmailsMigrated(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if migrated {
+		return nil, ErrUserNotFound
+	}
+	return scanUserByEmail(ctx, email)
+}
+
+func queryUserByEmail(ctx context.Context, email string) (*User, error) {
 	input := &dynamodb.QueryInput{
 		TableName:              aws.String(userTableName),
 		IndexName:              aws.String("email-index"),
@@ -100,3 +215,397 @@ func GetUserByEmail(ctx context.Context, email string) (*User, error) {
 
 	return &user, nil
 }
+
+func userKey(id string) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		"id": &types.AttributeValueMemberS{Value: id},
+	}
+}
+
+// RecordFailedLogin increments the failed login counter of a user and
+// returns the new count
+func RecordFailedLogin(ctx context.Context, id string) (int, error) {
+	result, err := client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:           aws.String(userTableName),
+		Key:                 userKey(id),
+		UpdateExpression:    aws.String("ADD failed_logins :one"),
+		ConditionExpression: aws.String("attribute_exists(id)"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":one": &types.AttributeValueMemberN{Value: "1"},
+		},
+		ReturnValues: types.ReturnValueUpdatedNew,
+	})
+
+	var conditionErr *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionErr) {
+		return 0, ErrUserNotFound
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	var updated struct {
+		FailedLogins int `dynamodbav:"failed_logins"`
+	}
+	if err := attributevalue.UnmarshalMap(result.Attributes, &updated); err != nil {
+		return 0, err
+	}
+
+	return updated.FailedLogins, nil
+}
+
+// LockUser refuses logins of a user until the given unix time. If
+// unlockTokenHash is set, the matching token unlocks the account early.
+func LockUser(ctx context.Context, id string, until int64, unlockTokenHash string) error {
+	update := "SET locked_until = :until"
+	values := map[string]types.AttributeValue{
+		":until": &types.AttributeValueMemberN{Value: strconv.FormatInt(until, 10)},
+	}
+	if unlockTokenHash != "" {
+		update += ", unlock_token_hash = :hash"
+		values[":hash"] = &types.AttributeValueMemberS{Value: unlockTokenHash}
+	}
+
+	_, err := client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:                 aws.String(userTableName),
+		Key:                       userKey(id),
+		UpdateExpression:          aws.String(update),
+		ConditionExpression:       aws.String("attribute_exists(id)"),
+		ExpressionAttributeValues: values,
+	})
+
+	var conditionErr *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionErr) {
+		return ErrUserNotFound
+	}
+	return err
+}
+
+// UnlockUser clears the failed login counter and any lock of a user
+func UnlockUser(ctx context.Context, id string) error {
+	_, err := client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:           aws.String(userTableName),
+		Key:                 userKey(id),
+		UpdateExpression:    aws.String("REMOVE failed_logins, locked_until, unlock_token_hash"),
+		ConditionExpression: aws.String("attribute_exists(id)"),
+	})
+
+	var conditionErr *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionErr) {
+		return ErrUserNotFound
+	}
+	return err
+}
+
+// MarkUserVerified flags the email of a user as verified, as long as the
+// user still has that email
+func MarkUserVerified(ctx context.Context, id, email string) error {
+	_, err := client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:           aws.String(userTableName),
+		Key:                 userKey(id),
+		UpdateExpression:    aws.String("SET verified = :true"),
+		ConditionExpression: aws.String("email = :email"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":true":  &types.AttributeValueMemberBOOL{Value: true},
+			":email": &types.AttributeValueMemberS{Value: email},
+		},
+	})
+
+	var conditionErr *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionErr) {
+		return ErrUserNotFound
+	}
+	return err
+}
+
+// UpdatePassword replaces the password hash of a user
+func UpdatePassword(ctx context.Context, id, passwordHash string) error {
+	_, err := client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:           aws.String(userTableName),
+		Key:                 userKey(id),
+		UpdateExpression:    aws.String("SET password = :password"),
+		ConditionExpression: aws.String("attribute_exists(id)"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":password": &types.AttributeValueMemberS{Value: passwordHash},
+		},
+	})
+
+	var conditionErr *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionErr) {
+		return ErrUserNotFound
+	}
+	return err
+}
+
+// SetPasswordReset stores the hash of a password reset token for a user,
+// replacing any pending one
+func SetPasswordReset(ctx context.Context, id, tokenHash string, expires int64) error {
+	_, err := client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:           aws.String(userTableName),
+		Key:                 userKey(id),
+		UpdateExpression:    aws.String("SET password_reset_hash = :hash, password_reset_expires = :expires"),
+		ConditionExpression: aws.String("attribute_exists(id)"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":hash":    &types.AttributeValueMemberS{Value: tokenHash},
+			":expires": &types.AttributeValueMemberN{Value: strconv.FormatInt(expires, 10)},
+		},
+	})
+
+	var conditionErr *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionErr) {
+		return ErrUserNotFound
+	}
+	return err
+}
+
+// ResetPassword consumes a pending password reset token and sets the new
+// password hash. Sessions issued before now are revoked and any login
+// lock is lifted. The condition makes the token single-use even when it
+// is redeemed concurrently.
+func ResetPassword(ctx context.Context, id, tokenHash, passwordHash string, now int64) error {
+	_, err := client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(userTableName),
+		Key:       userKey(id),
+		UpdateExpression: aws.String("SET password = :password, sessions_valid_after = :now " +
+			"REMOVE password_reset_hash, password_reset_expires, failed_logins, locked_until, unlock_token_hash"),
+		ConditionExpression: aws.String("password_reset_hash = :hash AND password_reset_expires > :now"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":password": &types.AttributeValueMemberS{Value: passwordHash},
+			":hash":     &types.AttributeValueMemberS{Value: tokenHash},
+			":now":      &types.AttributeValueMemberN{Value: strconv.FormatInt(now, 10)},
+		},
+	})
+
+	var conditionErr *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionErr) {
+		return ErrInvalidResetToken
+	}
+	return err
+}
+
+// UpdateProfile sets the display name of a user, removing it when empty
+func UpdateProfile(ctx context.Context, id, displayName string) error {
+	input := &dynamodb.UpdateItemInput{
+		TableName:           aws.String(userTableName),
+		Key:                 userKey(id),
+		UpdateExpression:    aws.String("REMOVE display_name"),
+		ConditionExpression: aws.String("attribute_exists(id)"),
+	}
+	if displayName != "" {
+		input.UpdateExpression = aws.String("SET display_name = :name")
+		input.ExpressionAttributeValues = map[string]types.AttributeValue{
+			":name": &types.AttributeValueMemberS{Value: displayName},
+		}
+	}
+
+	_, err := client.UpdateItem(ctx, input)
+
+	var conditionErr *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionErr) {
+		return ErrUserNotFound
+	}
+	return err
+}
+
+// ChangeEmail moves a user from oldEmail to a new normalized email, which
+// has to be verified again. The email locks move in the same transaction.
+// If another user has the email, it returns ErrDuplicateEmail.
+func ChangeEmail(ctx context.Context, id, oldEmail, email string) error {
+	email = utils.NormalizeEmail(email)
+
+	existingUser, err := findUserByEmailFold(ctx, email)
+	if err == nil && existingUser.ID != id {
+		return ErrDuplicateEmail
+	}
+	if err != nil && err != ErrUserNotFound {
+		return err
+	}
+
+	lock, err := attributevalue.MarshalMap(emailLock{Email: email, UserID: id})
+	if err != nil {
+		return err
+	}
+	owned := map[string]types.AttributeValue{
+		":uid": &types.AttributeValueMemberS{Value: id},
+	}
+
+	items := []types.TransactWriteItem{
+		{Update: &types.Update{
+			TableName:           aws.String(userTableName),
+			Key:                 userKey(id),
+			UpdateExpression:    aws.String("SET email = :email, verified = :false"),
+			ConditionExpression: aws.String("email = :old"),
+			ExpressionAttributeValues: map[string]types.AttributeValue{
+				":email": &types.AttributeValueMemberS{Value: email},
+				":false": &types.AttributeValueMemberBOOL{Value: false},
+				":old":   &types.AttributeValueMemberS{Value: oldEmail},
+			},
+		}},
+		{Put: &types.Put{
+			TableName:                 aws.String(emailTableName),
+			Item:                      lock,
+			ConditionExpression:       aws.String("attribute_not_exists(email) OR user_id = :uid"),
+			ExpressionAttributeValues: owned,
+		}},
+	}
+	// Emails stored before normalization may differ only in case and
+	// then share the lock
+	if old := utils.NormalizeEmail(oldEmail); old != email {
+		items = append(items, types.TransactWriteItem{Delete: &types.Delete{
+			TableName:                 aws.String(emailTableName),
+			Key:                       emailLockKey(old),
+			ConditionExpression:       aws.String("attribute_not_exists(email) OR user_id = :uid"),
+			ExpressionAttributeValues: owned,
+		}})
+	}
+
+	_, err = client.TransactWriteItems(ctx, &dynamodb.TransactWriteItemsInput{TransactItems: items})
+	switch {
+	case transactionConditionFailed(err, 0):
+		return ErrUserNotFound
+	case transactionConditionFailed(err, 1):
+		return ErrDuplicateEmail
+	}
+	return err
+}
+
+// ChangePassword sets the password hash of a user and revokes sessions
+// issued before now
+func ChangePassword(ctx context.Context, id, passwordHash string, now int64) error {
+	_, err := client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:           aws.String(userTableName),
+		Key:                 userKey(id),
+		UpdateExpression:    aws.String("SET password = :password, sessions_valid_after = :now REMOVE password_reset_hash, password_reset_expires"),
+		ConditionExpression: aws.String("attribute_exists(id)"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":password": &types.AttributeValueMemberS{Value: passwordHash},
+			":now":      &types.AttributeValueMemberN{Value: strconv.FormatInt(now, 10)},
+		},
+	})
+
+	var conditionErr *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionErr) {
+		return ErrUserNotFound
+	}
+	return err
+}
+
+// DeleteUser removes a user and releases their email. Data referencing
+// the user must be cleaned up beforehand.
+func DeleteUser(ctx context.Context, id, email string) error {
+	_, err := client.TransactWriteItems(ctx, &dynamodb.TransactWriteItemsInput{
+		TransactItems: []types.TransactWriteItem{
+			{Delete: &types.Delete{
+				TableName: aws.String(userTableName),
+				Key:       userKey(id),
+			}},
+			{Delete: &types.Delete{
+				TableName:           aws.String(emailTableName),
+				Key:                 emailLockKey(utils.NormalizeEmail(email)),
+				ConditionExpression: aws.String("attribute_not_exists(email) OR user_id = :uid"),
+				ExpressionAttributeValues: map[string]types.AttributeValue{
+					":uid": &types.AttributeValueMemberS{Value: id},
+				},
+			}},
+		},
+	})
+	return err
+}
+
+// ListUsers returns a page of up to limit users, starting at cursor, and
+// the cursor of the next page. A non-empty query only keeps users whose
+// ID is the query or whose email or display name contains it.
+func ListUsers(ctx context.Context, query string, limit int32, cursor string) ([]User, string, error) {
+	input := &dynamodb.ScanInput{
+		TableName: aws.String(userTableName),
+	}
+	if query = strings.TrimSpace(query); query != "" {
+		input.FilterExpression = aws.String("id = :query OR contains(email, :email) OR contains(display_name, :query)")
+		input.ExpressionAttributeValues = map[string]types.AttributeValue{
+			":query": &types.AttributeValueMemberS{Value: query},
+			":email": &types.AttributeValueMemberS{Value: utils.NormalizeEmail(query)},
+		}
+	}
+
+	items, next, err := readPage(cursor, limit, func(start map[string]types.AttributeValue, max int32) ([]map[string]types.AttributeValue, map[string]types.AttributeValue, error) {
+		input.ExclusiveStartKey = start
+		input.Limit = aws.Int32(max)
+		result, err := client.Scan(ctx, input)
+		if err != nil {
+			return nil, nil, err
+		}
+		return result.Items, result.LastEvaluatedKey, nil
+	})
+	if err != nil {
+		return nil, "", err
+	}
+
+	var users []User
+	if err := attributevalue.UnmarshalListOfMaps(items, &users); err != nil {
+		return nil, "", err
+	}
+
+	return users, next, nil
+}
+
+// ListAdmins returns every user with the admin role. It scans the users
+// table, so it is only meant for rare events such as abuse escalations.
+func ListAdmins(ctx context.Context) ([]User, error) {
+	var admins []User
+	paginator := dynamodb.NewScanPaginator(client, &dynamodb.ScanInput{
+		TableName:                aws.String(userTableName),
+		FilterExpression:         aws.String("#role = :admin"),
+		ExpressionAttributeNames: map[string]string{"#role": "role"},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":admin": &types.AttributeValueMemberS{Value: UserRoleAdmin},
+		},
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		var users []User
+		if err := attributevalue.UnmarshalListOfMaps(page.Items, &users); err != nil {
+			return nil, err
+		}
+		admins = append(admins, users...)
+	}
+	return admins, nil
+}
+
+// DisableUser blocks a user from logging in and revokes their sessions
+func DisableUser(ctx context.Context, id, reason string, now int64) error {
+	_, err := client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:           aws.String(userTableName),
+		Key:                 userKey(id),
+		UpdateExpression:    aws.String("SET disabled_at = :now, disabled_reason = :reason, sessions_valid_after = :now"),
+		ConditionExpression: aws.String("attribute_exists(id)"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":now":    &types.AttributeValueMemberN{Value: strconv.FormatInt(now, 10)},
+			":reason": &types.AttributeValueMemberS{Value: reason},
+		},
+	})
+
+	var conditionErr *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionErr) {
+		return ErrUserNotFound
+	}
+	return err
+}
+
+// EnableUser lets a disabled user log in again
+func EnableUser(ctx context.Context, id string) error {
+	_, err := client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:           aws.String(userTableName),
+		Key:                 userKey(id),
+		UpdateExpression:    aws.String("REMOVE disabled_at, disabled_reason"),
+		ConditionExpression: aws.String("attribute_exists(id)"),
+	})
+
+	var conditionErr *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionErr) {
+		return ErrUserNotFound
+	}
+	return err
+}
@@ -0,0 +1,265 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// States of a webhook delivery
+const (
+	// Waiting for its first attempt or a retry
+	DeliveryStatusPending   = "pending"
+	DeliveryStatusDelivered = "delivered"
+	// Ran out of attempts, it stays in the delivery log until redelivered
+	DeliveryStatusDead = "dead"
+)
+
+var (
+	ErrWebhookNotFound  = errors.New("webhook not found")
+	ErrDeliveryNotFound = errors.New("webhook delivery not found")
+)
+
+// Webhook is an endpoint of a user that receives events of their links
+type Webhook struct {
+	ID     string `dynamodbav:"id,pk" json:"id"`
+	UserID string `dynamodbav:"user_id" json:"user_id"`
+	URL    string `dynamodbav:"url" json:"url"`
+	// Key deliveries are signed with. It is only shown when the webhook
+	// is created.
+	Secret    string   `dynamodbav:"secret" json:"-"`
+	Events    []string `dynamodbav:"events,stringset" json:"events"`
+	CreatedAt string   `dynamodbav:"created_at" json:"created_at"`
+}
+
+// Subscribed reports whether the webhook receives events of type event
+func (w *Webhook) Subscribed(event string) bool {
+	for _, e := range w.Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// WebhookDelivery is a single event sent to a webhook, along with the
+// outcome of its attempts so far
+type WebhookDelivery struct {
+	ID        string `dynamodbav:"id,pk" json:"id"`
+	WebhookID string `dynamodbav:"webhook_id" json:"webhook_id"`
+	UserID    string `dynamodbav:"user_id" json:"-"`
+	Event     string `dynamodbav:"event" json:"event"`
+	EventID   string `dynamodbav:"event_id" json:"event_id"`
+	// JSON body sent to the receiver
+	Payload  string `dynamodbav:"payload" json:"payload"`
+	Status   string `dynamodbav:"status" json:"status"`
+	Attempts int    `dynamodbav:"attempts" json:"attempts"`
+	// Unix time of the next attempt of a pending delivery
+	NextAttemptAt  int64  `dynamodbav:"next_attempt_at,omitempty" json:"next_attempt_at,omitempty"`
+	LastAttemptAt  string `dynamodbav:"last_attempt_at,omitempty" json:"last_attempt_at,omitempty"`
+	LastStatusCode int    `dynamodbav:"last_status_code,omitempty" json:"last_status_code,omitempty"`
+	LastError      string `dynamodbav:"last_error,omitempty" json:"last_error,omitempty"`
+	CreatedAt      string `dynamodbav:"created_at" json:"created_at"`
+}
+
+// CreateWebhook stores a new webhook
+func CreateWebhook(ctx context.Context, hook Webhook) error {
+	item, err := attributevalue.MarshalMap(hook)
+	if err != nil {
+		return err
+	}
+
+	_, err = client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName:           aws.String(webhookTableName),
+		Item:                item,
+		ConditionExpression: aws.String("attribute_not_exists(id)"),
+	})
+	return err
+}
+
+// GetWebhook retrieves a webhook by ID
+// If the webhook is not found, it returns ErrWebhookNotFound
+func GetWebhook(ctx context.Context, id string) (*Webhook, error) {
+	result, err := client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(webhookTableName),
+		Key:       map[string]types.AttributeValue{"id": &types.AttributeValueMemberS{Value: id}},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if result.Item == nil {
+		return nil, ErrWebhookNotFound
+	}
+
+	var hook Webhook
+	if err := attributevalue.UnmarshalMap(result.Item, &hook); err != nil {
+		return nil, err
+	}
+
+	return &hook, nil
+}
+
+// ListUserWebhooks retrieves all webhooks of a user
+func ListUserWebhooks(ctx context.Context, userID string) ([]Webhook, error) {
+	items, err := queryAll(ctx, &dynamodb.QueryInput{
+		TableName:              aws.String(webhookTableName),
+		IndexName:              aws.String("user_id-index"),
+		KeyConditionExpression: aws.String("user_id = :uid"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":uid": &types.AttributeValueMemberS{Value: userID},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var hooks []Webhook
+	if err := attributevalue.UnmarshalListOfMaps(items, &hooks); err != nil {
+		return nil, err
+	}
+
+	return hooks, nil
+}
+
+// DeleteWebhook deletes a webhook. Its pending deliveries are dropped by
+// the worker once it finds the webhook gone.
+func DeleteWebhook(ctx context.Context, id string) error {
+	_, err := client.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName: aws.String(webhookTableName),
+		Key:       map[string]types.AttributeValue{"id": &types.AttributeValueMemberS{Value: id}},
+	})
+	return err
+}
+
+// DeleteWebhookDeliveries deletes the whole delivery log of a webhook
+func DeleteWebhookDeliveries(ctx context.Context, webhookID string) error {
+	return queryPages(ctx, &dynamodb.QueryInput{
+		TableName:              aws.String(deliveryTableName),
+		IndexName:              aws.String("webhook_id-index"),
+		KeyConditionExpression: aws.String("webhook_id = :hook"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":hook": &types.AttributeValueMemberS{Value: webhookID},
+		},
+		ProjectionExpression: aws.String("id"),
+	}, func(items []map[string]types.AttributeValue) error {
+		for _, item := range items {
+			_, err := client.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+				TableName: aws.String(deliveryTableName),
+				Key:       map[string]types.AttributeValue{"id": item["id"]},
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// PutWebhookDelivery creates or replaces a delivery
+func PutWebhookDelivery(ctx context.Context, delivery WebhookDelivery) error {
+	item, err := attributevalue.MarshalMap(delivery)
+	if err != nil {
+		return err
+	}
+
+	_, err = client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(deliveryTableName),
+		Item:      item,
+	})
+	return err
+}
+
+// GetWebhookDelivery retrieves a delivery by ID
+// If the delivery is not found, it returns ErrDeliveryNotFound
+func GetWebhookDelivery(ctx context.Context, id string) (*WebhookDelivery, error) {
+	result, err := client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(deliveryTableName),
+		Key:       map[string]types.AttributeValue{"id": &types.AttributeValueMemberS{Value: id}},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if result.Item == nil {
+		return nil, ErrDeliveryNotFound
+	}
+
+	var delivery WebhookDelivery
+	if err := attributevalue.UnmarshalMap(result.Item, &delivery); err != nil {
+		return nil, err
+	}
+
+	return &delivery, nil
+}
+
+// ListWebhookDeliveries returns a page of up to limit deliveries of a
+// webhook, newest first, starting at cursor, and the cursor of the next
+// page. An empty status lists deliveries in every state.
+func ListWebhookDeliveries(ctx context.Context, webhookID, status string, limit int32, cursor string) ([]WebhookDelivery, string, error) {
+	items, next, err := readPage(cursor, limit, func(start map[string]types.AttributeValue, max int32) ([]map[string]types.AttributeValue, map[string]types.AttributeValue, error) {
+		input := &dynamodb.QueryInput{
+			TableName:              aws.String(deliveryTableName),
+			IndexName:              aws.String("webhook_id-index"),
+			KeyConditionExpression: aws.String("webhook_id = :hook"),
+			ExpressionAttributeValues: map[string]types.AttributeValue{
+				":hook": &types.AttributeValueMemberS{Value: webhookID},
+			},
+			ExclusiveStartKey: start,
+			Limit:             aws.Int32(max),
+			ScanIndexForward:  aws.Bool(false),
+		}
+		if status != "" {
+			input.FilterExpression = aws.String("#status = :status")
+			input.ExpressionAttributeNames = map[string]string{"#status": "status"}
+			input.ExpressionAttributeValues[":status"] = &types.AttributeValueMemberS{Value: status}
+		}
+
+		result, err := client.Query(ctx, input)
+		if err != nil {
+			return nil, nil, err
+		}
+		return result.Items, result.LastEvaluatedKey, nil
+	})
+	if err != nil {
+		return nil, "", err
+	}
+
+	var deliveries []WebhookDelivery
+	if err := attributevalue.UnmarshalListOfMaps(items, &deliveries); err != nil {
+		return nil, "", err
+	}
+
+	return deliveries, next, nil
+}
+
+// ListDueWebhookDeliveries returns up to limit pending deliveries whose
+// next attempt is due at now, oldest first
+func ListDueWebhookDeliveries(ctx context.Context, now int64, limit int32) ([]WebhookDelivery, error) {
+	result, err := client.Query(ctx, &dynamodb.QueryInput{
+		TableName:                aws.String(deliveryTableName),
+		IndexName:                aws.String("status-index"),
+		KeyConditionExpression:   aws.String("#status = :pending AND next_attempt_at <= :now"),
+		ExpressionAttributeNames: map[string]string{"#status": "status"},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":pending": &types.AttributeValueMemberS{Value: DeliveryStatusPending},
+			":now":     &types.AttributeValueMemberN{Value: strconv.FormatInt(now, 10)},
+		},
+		Limit: aws.Int32(limit),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var deliveries []WebhookDelivery
+	if err := attributevalue.UnmarshalListOfMaps(result.Items, &deliveries); err != nil {
+		return nil, err
+	}
+
+	return deliveries, nil
+}
@@ -0,0 +1,190 @@
+package db
+
+import (
+	"context"
+	"errors"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// Roles a member can hold in a workspace, from most to least privileged
+const (
+	RoleOwner  = "owner"
+	RoleEditor = "editor"
+	RoleViewer = "viewer"
+)
+
+// Workspace groups users that share ownership of links
+type Workspace struct {
+	ID        string `dynamodbav:"id,pk" json:"id"`
+	Name      string `dynamodbav:"name" json:"name"`
+	CreatedBy string `dynamodbav:"created_by" json:"created_by"`
+	CreatedAt string `dynamodbav:"created_at" json:"created_at"`
+}
+
+// WorkspaceMember is the membership of a user in a workspace
+type WorkspaceMember struct {
+	WorkspaceID string `dynamodbav:"workspace_id,pk" json:"workspace_id"`
+	UserID      string `dynamodbav:"user_id,sk" json:"user_id"`
+	Role        string `dynamodbav:"role" json:"role"`
+	JoinedAt    string `dynamodbav:"joined_at" json:"joined_at"`
+}
+
+var (
+	ErrWorkspaceNotFound = errors.New("workspace not found")
+	ErrMemberNotFound    = errors.New("workspace member not found")
+)
+
+// ValidRole reports whether role is a known workspace role
+func ValidRole(role string) bool {
+	return role == RoleOwner || role == RoleEditor || role == RoleViewer
+}
+
+// CreateWorkspace creates a workspace and makes owner its first owner
+func CreateWorkspace(ctx context.Context, workspace Workspace, owner WorkspaceMember) error {
+	workspaceItem, err := attributevalue.MarshalMap(workspace)
+	if err != nil {
+		return err
+	}
+	memberItem, err := attributevalue.MarshalMap(owner)
+	if err != nil {
+		return err
+	}
+
+	_, err = client.TransactWriteItems(ctx, &dynamodb.TransactWriteItemsInput{
+		TransactItems: []types.TransactWriteItem{
+			{Put: &types.Put{
+				TableName:           aws.String(workspaceTableName),
+				Item:                workspaceItem,
+				ConditionExpression: aws.String("attribute_not_exists(id)"),
+			}},
+			{Put: &types.Put{
+				TableName: aws.String(workspaceMemberTableName),
+				Item:      memberItem,
+			}},
+		},
+	})
+	return err
+}
+
+// GetWorkspace retrieves a workspace by ID
+func GetWorkspace(ctx context.Context, id string) (*Workspace, error) {
+	result, err := client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(workspaceTableName),
+		Key: map[string]types.AttributeValue{
+			"id": &types.AttributeValueMemberS{Value: id},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if result.Item == nil {
+		return nil, ErrWorkspaceNotFound
+	}
+
+	var workspace Workspace
+	if err := attributevalue.UnmarshalMap(result.Item, &workspace); err != nil {
+		return nil, err
+	}
+
+	return &workspace, nil
+}
+
+// GetWorkspaceMember retrieves the membership of a user in a workspace
+// If the user is not a member, it returns ErrMemberNotFound
+func GetWorkspaceMember(ctx context.Context, workspaceID, userID string) (*WorkspaceMember, error) {
+	result, err := client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(workspaceMemberTableName),
+		Key: map[string]types.AttributeValue{
+			"workspace_id": &types.AttributeValueMemberS{Value: workspaceID},
+			"user_id":      &types.AttributeValueMemberS{Value: userID},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if result.Item == nil {
+		return nil, ErrMemberNotFound
+	}
+
+	var member WorkspaceMember
+	if err := attributevalue.UnmarshalMap(result.Item, &member); err != nil {
+		return nil, err
+	}
+
+	return &member, nil
+}
+
+// PutWorkspaceMember adds a member to a workspace or changes their role
+func PutWorkspaceMember(ctx context.Context, member WorkspaceMember) error {
+	item, err := attributevalue.MarshalMap(member)
+	if err != nil {
+		return err
+	}
+
+	_, err = client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(workspaceMemberTableName),
+		Item:      item,
+	})
+	return err
+}
+
+// DeleteWorkspaceMember removes a member from a workspace
+func DeleteWorkspaceMember(ctx context.Context, workspaceID, userID string) error {
+	_, err := client.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName: aws.String(workspaceMemberTableName),
+		Key: map[string]types.AttributeValue{
+			"workspace_id": &types.AttributeValueMemberS{Value: workspaceID},
+			"user_id":      &types.AttributeValueMemberS{Value: userID},
+		},
+	})
+	return err
+}
+
+// ListWorkspaceMembers retrieves all members of a workspace
+func ListWorkspaceMembers(ctx context.Context, workspaceID string) ([]WorkspaceMember, error) {
+	items, err := queryAll(ctx, &dynamodb.QueryInput{
+		TableName:              aws.String(workspaceMemberTableName),
+		KeyConditionExpression: aws.String("workspace_id = :wid"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":wid": &types.AttributeValueMemberS{Value: workspaceID},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var members []WorkspaceMember
+	if err := attributevalue.UnmarshalListOfMaps(items, &members); err != nil {
+		return nil, err
+	}
+
+	return members, nil
+}
+
+// ListUserMemberships retrieves the workspaces a user belongs to
+func ListUserMemberships(ctx context.Context, userID string) ([]WorkspaceMember, error) {
+	items, err := queryAll(ctx, &dynamodb.QueryInput{
+		TableName:              aws.String(workspaceMemberTableName),
+		IndexName:              aws.String("user_id-index"),
+		KeyConditionExpression: aws.String("user_id = :uid"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":uid": &types.AttributeValueMemberS{Value: userID},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var members []WorkspaceMember
+	if err := attributevalue.UnmarshalListOfMaps(items, &members); err != nil {
+		return nil, err
+	}
+
+	return members, nil
+}
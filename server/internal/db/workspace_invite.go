@@ -0,0 +1,118 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// WorkspaceInvite is an invitation of a user to a workspace. The user
+// only becomes a member once they accept it with the emailed token.
+type WorkspaceInvite struct {
+	WorkspaceID string `dynamodbav:"workspace_id,pk" json:"workspace_id"`
+	UserID      string `dynamodbav:"user_id,sk" json:"user_id"`
+	Role        string `dynamodbav:"role" json:"role"`
+	InvitedBy   string `dynamodbav:"invited_by" json:"invited_by"`
+	TokenHash   string `dynamodbav:"token_hash" json:"-"`
+	InvitedAt   string `dynamodbav:"invited_at" json:"invited_at"`
+	// Unix time the invitation expires, also the TTL of the item
+	ExpiresAt int64 `dynamodbav:"expires_at" json:"expires_at"`
+}
+
+var ErrInviteNotFound = errors.New("workspace invitation not found")
+
+func workspaceInviteKey(workspaceID, userID string) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		"workspace_id": &types.AttributeValueMemberS{Value: workspaceID},
+		"user_id":      &types.AttributeValueMemberS{Value: userID},
+	}
+}
+
+// PutWorkspaceInvite stores an invitation, replacing any earlier one of
+// the same user to the same workspace
+func PutWorkspaceInvite(ctx context.Context, invite WorkspaceInvite) error {
+	item, err := attributevalue.MarshalMap(invite)
+	if err != nil {
+		return err
+	}
+
+	_, err = client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(workspaceInviteTableName),
+		Item:      item,
+	})
+	return err
+}
+
+// GetWorkspaceInvite retrieves the pending invitation of a user to a
+// workspace. Expired invitations the TTL hasn't removed yet aren't found.
+func GetWorkspaceInvite(ctx context.Context, workspaceID, userID string) (*WorkspaceInvite, error) {
+	result, err := client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(workspaceInviteTableName),
+		Key:       workspaceInviteKey(workspaceID, userID),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if result.Item == nil {
+		return nil, ErrInviteNotFound
+	}
+
+	var invite WorkspaceInvite
+	if err := attributevalue.UnmarshalMap(result.Item, &invite); err != nil {
+		return nil, err
+	}
+	if invite.ExpiresAt <= time.Now().Unix() {
+		return nil, ErrInviteNotFound
+	}
+
+	return &invite, nil
+}
+
+// DeleteWorkspaceInvite withdraws the invitation of a user to a workspace
+func DeleteWorkspaceInvite(ctx context.Context, workspaceID, userID string) error {
+	_, err := client.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName: aws.String(workspaceInviteTableName),
+		Key:       workspaceInviteKey(workspaceID, userID),
+	})
+	return err
+}
+
+// AcceptWorkspaceInvite turns the invitation with tokenHash into member.
+// The invitation is removed in the same transaction, so it can only be
+// used once. If it was withdrawn, replaced or expired, it returns
+// ErrInviteNotFound.
+func AcceptWorkspaceInvite(ctx context.Context, tokenHash string, member WorkspaceMember) error {
+	item, err := attributevalue.MarshalMap(member)
+	if err != nil {
+		return err
+	}
+
+	_, err = client.TransactWriteItems(ctx, &dynamodb.TransactWriteItemsInput{
+		TransactItems: []types.TransactWriteItem{
+			{Delete: &types.Delete{
+				TableName:           aws.String(workspaceInviteTableName),
+				Key:                 workspaceInviteKey(member.WorkspaceID, member.UserID),
+				ConditionExpression: aws.String("token_hash = :hash AND expires_at > :now"),
+				ExpressionAttributeValues: map[string]types.AttributeValue{
+					":hash": &types.AttributeValueMemberS{Value: tokenHash},
+					":now":  &types.AttributeValueMemberN{Value: strconv.FormatInt(time.Now().Unix(), 10)},
+				},
+			}},
+			{Put: &types.Put{
+				TableName: aws.String(workspaceMemberTableName),
+				Item:      item,
+			}},
+		},
+	})
+	if transactionConditionFailed(err, 0) {
+		return ErrInviteNotFound
+	}
+	return err
+}
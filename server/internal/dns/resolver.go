@@ -0,0 +1,58 @@
+package dns
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+)
+
+const (
+	// Prefix of the TXT record name checked for domain ownership
+	recordPrefix = "_shorty-verification."
+	// Prefix of the TXT record value holding the verification token
+	valuePrefix = "shorty-verification="
+)
+
+var ErrVerificationFailed = errors.New("verification record not found")
+
+// Resolver looks up DNS TXT records. It is an interface so ownership
+// checks can run against a fake in tests.
+type Resolver interface {
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+}
+
+// NewNetResolver returns a Resolver backed by the system DNS resolver
+func NewNetResolver() Resolver {
+	return net.DefaultResolver
+}
+
+// RecordName returns the name of the TXT record proving ownership of domain
+func RecordName(domain string) string {
+	return recordPrefix + domain
+}
+
+// RecordValue returns the value of the TXT record for the given token
+func RecordValue(token string) string {
+	return valuePrefix + token
+}
+
+// VerifyOwnership checks that domain publishes the TXT record for token
+func VerifyOwnership(ctx context.Context, resolver Resolver, domain, token string) error {
+	records, err := resolver.LookupTXT(ctx, RecordName(domain))
+	if err != nil {
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+			return ErrVerificationFailed
+		}
+		return err
+	}
+
+	expected := RecordValue(token)
+	for _, record := range records {
+		if strings.TrimSpace(record) == expected {
+			return nil
+		}
+	}
+	return ErrVerificationFailed
+}
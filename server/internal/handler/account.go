@@ -0,0 +1,477 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/SunPodder/shorty/internal/db"
+	"github.com/SunPodder/shorty/internal/mail"
+	"github.com/SunPodder/shorty/utils"
+	"github.com/aws/aws-lambda-go/events"
+)
+
+const maxDisplayNameLength = 100
+
+// What happens to the links of a deleted account
+const (
+	// Links are deleted along with the account, except for those in
+	// workspaces, which are anonymized
+	DeleteLinksDelete = "delete"
+	// Links keep working but no longer point back to the account
+	DeleteLinksAnonymize = "anonymize"
+)
+
+type ProfileResponse struct {
+	ID          string `json:"id"`
+	Email       string `json:"email"`
+	DisplayName string `json:"display_name,omitempty"`
+	Verified    bool   `json:"verified"`
+	TOTPEnabled bool   `json:"totp_enabled"`
+	// False for accounts created through single sign-on until they set one
+	HasPassword bool   `json:"has_password"`
+	CreatedAt   string `json:"created_at"`
+}
+
+type UpdateProfileRequest struct {
+	DisplayName *string `json:"display_name"`
+	Email       *string `json:"email"`
+	// Required to change the email of accounts with a password
+	CurrentPassword string `json:"current_password"`
+}
+
+type ChangePasswordRequest struct {
+	// Required unless the account has no password yet
+	CurrentPassword string `json:"current_password"`
+	NewPassword     string `json:"new_password"`
+}
+
+type DeleteAccountRequest struct {
+	// Required unless the account has no password
+	Password string `json:"password"`
+	// TOTP or backup code, required with two-factor authentication on
+	Code string `json:"code"`
+	// DeleteLinksDelete or DeleteLinksAnonymize
+	Links string `json:"links"`
+}
+
+// Routes the /me endpoints to their handlers
+func Account(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	switch {
+	case strings.HasSuffix(request.Resource, "/me/profile") && request.HTTPMethod == "GET":
+		return GetProfile(ctx, request)
+	case strings.HasSuffix(request.Resource, "/me/profile") && request.HTTPMethod == "PATCH":
+		return UpdateProfile(ctx, request)
+	case strings.HasSuffix(request.Resource, "/me/password") && request.HTTPMethod == "POST":
+		return ChangePassword(ctx, request)
+	case strings.HasSuffix(request.Resource, "/me/audit") && request.HTTPMethod == "GET":
+		return MyAudit(ctx, request)
+	case strings.HasSuffix(request.Resource, "/me") && request.HTTPMethod == "GET":
+		return Me(ctx, request)
+	case strings.HasSuffix(request.Resource, "/me") && request.HTTPMethod == "DELETE":
+		return DeleteAccount(ctx, request)
+	}
+	return events.APIGatewayProxyResponse{
+		StatusCode: 405,
+		Body:       `{"error": "Method not allowed"}`,
+	}, nil
+}
+
+func newProfileResponse(user *db.User) ProfileResponse {
+	return ProfileResponse{
+		ID:          user.ID,
+		Email:       user.Email,
+		DisplayName: user.DisplayName,
+		Verified:    user.Verified,
+		TOTPEnabled: user.TOTPEnabled,
+		HasPassword: user.Password != "",
+		CreatedAt:   user.CreatedAt,
+	}
+}
+
+func profileResponse(user *db.User) (events.APIGatewayProxyResponse, error) {
+	body, _ := json.Marshal(newProfileResponse(user))
+	return events.APIGatewayProxyResponse{
+		StatusCode: 200,
+		Headers:    map[string]string{"Content-Type": "application/json"},
+		Body:       string(body),
+	}, nil
+}
+
+// Checks the current password of a user before a sensitive change.
+// Accounts without a password have nothing to check. Wrong passwords
+// count as failed logins so a stolen session can't be used to guess it.
+func checkCurrentPassword(ctx context.Context, user *db.User, password string) (events.APIGatewayProxyResponse, bool) {
+	if user.Password == "" {
+		return events.APIGatewayProxyResponse{}, true
+	}
+	locked := user.LockedUntil > time.Now().Unix()
+	if locked || !utils.CheckPasswordHash(password, user.Password) {
+		if !locked {
+			recordFailedLogin(ctx, user)
+		}
+		return events.APIGatewayProxyResponse{
+			StatusCode: 403,
+			Body:       `{"error": "Current password is incorrect"}`,
+		}, false
+	}
+	return events.APIGatewayProxyResponse{}, true
+}
+
+// GetProfile returns the account of the logged-in user
+func GetProfile(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	user, resp, ok := currentUser(ctx)
+	if !ok {
+		return resp, nil
+	}
+	return profileResponse(user)
+}
+
+// UpdateProfile changes the display name and email of the logged-in user.
+// A new email has to be verified again.
+func UpdateProfile(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	user, resp, ok := currentUser(ctx)
+	if !ok {
+		return resp, nil
+	}
+
+	var req UpdateProfileRequest
+	if err := json.Unmarshal([]byte(request.Body), &req); err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 400,
+			Body:       `{"error": "Invalid request body"}`,
+		}, nil
+	}
+
+	if req.DisplayName != nil {
+		displayName := strings.TrimSpace(*req.DisplayName)
+		if utf8.RuneCountInString(displayName) > maxDisplayNameLength {
+			return events.APIGatewayProxyResponse{
+				StatusCode: 400,
+				Body:       `{"error": "Display name is too long"}`,
+			}, nil
+		}
+		if err := db.UpdateProfile(ctx, user.ID, displayName); err != nil {
+			return events.APIGatewayProxyResponse{
+				StatusCode: 500,
+				Body:       `{"error": "Failed to update profile"}`,
+			}, nil
+		}
+		if displayName != user.DisplayName {
+			entry := auditEntry(ctx, request, user.ID, AuditProfileUpdate, AuditTargetUser, user.ID)
+			entry.Changes = map[string]db.AuditChange{"display_name": {Before: user.DisplayName, After: displayName}}
+			recordAudit(ctx, entry)
+		}
+		user.DisplayName = displayName
+	}
+
+	if req.Email != nil {
+		email, err := utils.ValidateEmail(*req.Email)
+		if err != nil {
+			return events.APIGatewayProxyResponse{
+				StatusCode: 400,
+				Body:       `{"error": "Invalid email address"}`,
+			}, nil
+		}
+
+		if email != user.Email {
+			if resp, ok := checkCurrentPassword(ctx, user, req.CurrentPassword); !ok {
+				return resp, nil
+			}
+
+			err = db.ChangeEmail(ctx, user.ID, user.Email, email)
+			if err == db.ErrDuplicateEmail {
+				return events.APIGatewayProxyResponse{
+					StatusCode: 409,
+					Body:       `{"error": "Email already exists"}`,
+				}, nil
+			}
+			if err != nil {
+				return events.APIGatewayProxyResponse{
+					StatusCode: 500,
+					Body:       `{"error": "Failed to change email"}`,
+				}, nil
+			}
+			entry := auditEntry(ctx, request, user.ID, AuditEmailChange, AuditTargetUser, user.ID)
+			entry.Changes = map[string]db.AuditChange{"email": {Before: user.Email, After: email}}
+			recordAudit(ctx, entry)
+
+			// Let the previous address know in case the change wasn't theirs
+			err = Mailer.Send(ctx, mail.Message{
+				To:      user.Email,
+				Subject: "Your Shorty email was changed",
+				Body: "The email address of your Shorty account was changed to " + email + ".\n" +
+					"If you didn't do this, reset your password and contact support.\n",
+			})
+			if err != nil {
+				slog.ErrorContext(ctx, "send email change notice", "target_user_id", user.ID, "error", err)
+			}
+
+			user.Email = email
+			user.Verified = false
+			if err := sendVerificationEmail(ctx, user); err != nil {
+				slog.ErrorContext(ctx, "send verification email", "target_user_id", user.ID, "error", err)
+			}
+		}
+	}
+
+	return profileResponse(user)
+}
+
+// ChangePassword sets a new password for the logged-in user. Every other
+// session is revoked and a fresh token is returned for this one.
+func ChangePassword(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	user, resp, ok := currentUser(ctx)
+	if !ok {
+		return resp, nil
+	}
+
+	var req ChangePasswordRequest
+	if err := json.Unmarshal([]byte(request.Body), &req); err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 400,
+			Body:       `{"error": "Invalid request body"}`,
+		}, nil
+	}
+
+	if resp, ok := checkCurrentPassword(ctx, user, req.CurrentPassword); !ok {
+		return resp, nil
+	}
+
+	if err := PasswordPolicy.Check(req.NewPassword); err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 400,
+			Body:       `{"error": "` + err.Error() + `"}`,
+		}, nil
+	}
+
+	hashedPassword, err := utils.HashPassword(req.NewPassword)
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 500,
+			Body:       `{"error": "Failed to hash password"}`,
+		}, nil
+	}
+
+	if err := db.ChangePassword(ctx, user.ID, hashedPassword, time.Now().Unix()); err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 500,
+			Body:       `{"error": "Failed to change password"}`,
+		}, nil
+	}
+	recordAudit(ctx, auditEntry(ctx, request, user.ID, AuditPasswordChange, AuditTargetUser, user.ID))
+
+	token, err := utils.GenerateJWT(user.ID)
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 500,
+			Body:       `{"error": "Failed to generate token"}`,
+		}, nil
+	}
+
+	return events.APIGatewayProxyResponse{
+		StatusCode: 200,
+		Headers: map[string]string{
+			"Content-Type":  "application/json",
+			"Authorization": "Bearer " + token,
+		},
+		Body: `{"message": "Password changed", "token": "` + token + `"}`,
+	}, nil
+}
+
+// DeleteAccount deletes the logged-in user along with their API keys,
+// linked identities and workspace memberships. Their links are deleted or
+// anonymized as requested, and custom domains are released when links
+// are deleted.
+func DeleteAccount(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	user, resp, ok := currentUser(ctx)
+	if !ok {
+		return resp, nil
+	}
+
+	var req DeleteAccountRequest
+	if err := json.Unmarshal([]byte(request.Body), &req); err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 400,
+			Body:       `{"error": "Invalid request body"}`,
+		}, nil
+	}
+
+	if req.Links != DeleteLinksDelete && req.Links != DeleteLinksAnonymize {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 400,
+			Body:       `{"error": "links must be delete or anonymize"}`,
+		}, nil
+	}
+
+	if resp, ok := checkCurrentPassword(ctx, user, req.Password); !ok {
+		return resp, nil
+	}
+	if user.TOTPEnabled {
+		valid, err := checkSecondFactor(ctx, user, req.Code)
+		if err != nil {
+			slog.ErrorContext(ctx, "check second factor", "target_user_id", user.ID, "error", err)
+		}
+		if !valid {
+			return events.APIGatewayProxyResponse{
+				StatusCode: 403,
+				Body:       `{"error": "Invalid two-factor code"}`,
+			}, nil
+		}
+	}
+
+	memberships, err := db.ListUserMemberships(ctx, user.ID)
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 500,
+			Body:       `{"error": "` + err.Error() + `"}`,
+		}, nil
+	}
+	if resp, ok := keepWorkspaceOwners(ctx, user.ID, memberships); !ok {
+		return resp, nil
+	}
+
+	// The user goes last, so a failure halfway can be retried
+	if err := deleteAccountData(ctx, user.ID, req.Links, memberships); err != nil {
+		slog.ErrorContext(ctx, "delete account", "target_user_id", user.ID, "error", err)
+		return events.APIGatewayProxyResponse{
+			StatusCode: 500,
+			Body:       `{"error": "Failed to delete account, please try again"}`,
+		}, nil
+	}
+	if err := db.DeleteUser(ctx, user.ID, user.Email); err != nil {
+		slog.ErrorContext(ctx, "delete account", "target_user_id", user.ID, "error", err)
+		return events.APIGatewayProxyResponse{
+			StatusCode: 500,
+			Body:       `{"error": "Failed to delete account, please try again"}`,
+		}, nil
+	}
+	entry := auditEntry(ctx, request, user.ID, AuditAccountDelete, AuditTargetUser, user.ID)
+	entry.Details = map[string]string{"links": req.Links}
+	recordAudit(ctx, entry)
+
+	return events.APIGatewayProxyResponse{StatusCode: 204}, nil
+}
+
+// Refuses to delete the last owner of a workspace that has other members.
+// Workspaces where the user is alone are left without members.
+func keepWorkspaceOwners(ctx context.Context, userID string, memberships []db.WorkspaceMember) (events.APIGatewayProxyResponse, bool) {
+	for _, membership := range memberships {
+		if membership.Role != db.RoleOwner {
+			continue
+		}
+
+		members, err := db.ListWorkspaceMembers(ctx, membership.WorkspaceID)
+		if err != nil {
+			return events.APIGatewayProxyResponse{
+				StatusCode: 500,
+				Body:       `{"error": "` + err.Error() + `"}`,
+			}, false
+		}
+
+		otherMembers, otherOwners := 0, 0
+		for _, member := range members {
+			if member.UserID == userID {
+				continue
+			}
+			otherMembers++
+			if member.Role == db.RoleOwner {
+				otherOwners++
+			}
+		}
+		if otherMembers > 0 && otherOwners == 0 {
+			return events.APIGatewayProxyResponse{
+				StatusCode: 409,
+				Body:       `{"error": "Transfer the ownership of your workspaces before deleting your account"}`,
+			}, false
+		}
+	}
+	return events.APIGatewayProxyResponse{}, true
+}
+
+// Deletes or anonymizes everything that references a user
+func deleteAccountData(ctx context.Context, userID, links string, memberships []db.WorkspaceMember) error {
+	// Domains still serving workspace links
+	keptDomains := map[string]bool{}
+	err := db.ForEachUserURL(ctx, userID, func(urls []db.URL) error {
+		for _, url := range urls {
+			var err error
+			// Workspace links belong to the workspace, they are only
+			// detached from the account
+			if links == DeleteLinksDelete && url.WorkspaceID == nil {
+				err = db.DeleteURL(ctx, url.Domain, url.ShortCode)
+			} else {
+				keptDomains[url.Domain] = true
+				err = db.AnonymizeURL(ctx, url.Domain, url.ShortCode)
+			}
+			if err != nil && err != db.ErrURLNotFound {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	keys, err := db.ListUserAPIKeys(ctx, userID)
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if err := db.DeleteAPIKey(ctx, key.ID); err != nil {
+			return err
+		}
+	}
+
+	identities, err := db.ListUserIdentities(ctx, userID)
+	if err != nil {
+		return err
+	}
+	for _, identity := range identities {
+		if err := db.DeleteIdentity(ctx, identity.ID); err != nil {
+			return err
+		}
+	}
+
+	// Along with their signing secrets and the events they were sent
+	hooks, err := db.ListUserWebhooks(ctx, userID)
+	if err != nil {
+		return err
+	}
+	for _, hook := range hooks {
+		if err := db.DeleteWebhook(ctx, hook.ID); err != nil {
+			return err
+		}
+		if err := db.DeleteWebhookDeliveries(ctx, hook.ID); err != nil {
+			return err
+		}
+	}
+
+	for _, membership := range memberships {
+		if err := db.DeleteWorkspaceMember(ctx, membership.WorkspaceID, userID); err != nil {
+			return err
+		}
+	}
+
+	// Anonymized links on custom domains keep being served from them
+	if links == DeleteLinksDelete {
+		domains, err := db.ListUserDomains(ctx, userID)
+		if err != nil {
+			return err
+		}
+		for _, domain := range domains {
+			if keptDomains[domain.Domain] {
+				continue
+			}
+			if err := db.DeleteDomain(ctx, domain.Domain); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,532 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/SunPodder/shorty/internal/db"
+	"github.com/SunPodder/shorty/internal/middleware"
+	"github.com/aws/aws-lambda-go/events"
+)
+
+const (
+	defaultAdminPageSize = 50
+	maxAdminPageSize     = 100
+	maxAdminReasonLength = 500
+)
+
+// AdminUserResponse is a user as seen by admins, without their secrets
+type AdminUserResponse struct {
+	ProfileResponse
+	Role           string `json:"role,omitempty"`
+	DisabledAt     int64  `json:"disabled_at,omitempty"`
+	DisabledReason string `json:"disabled_reason,omitempty"`
+	FailedLogins   int    `json:"failed_logins,omitempty"`
+	LockedUntil    int64  `json:"locked_until,omitempty"`
+}
+
+type AdminUsersResponse struct {
+	Users      []AdminUserResponse `json:"users"`
+	NextCursor string              `json:"next_cursor,omitempty"`
+}
+
+type AdminLinksResponse struct {
+	Links      []db.URL `json:"links"`
+	NextCursor string   `json:"next_cursor,omitempty"`
+}
+
+// AdminReasonRequest is the body of admin actions that need a reason
+type AdminReasonRequest struct {
+	Reason string `json:"reason"`
+}
+
+type ReassignLinkRequest struct {
+	UserID string `json:"user_id"`
+}
+
+// Routes the /admin endpoints to their handlers
+func Admin(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	switch {
+	case strings.HasSuffix(request.Resource, "/users") && request.HTTPMethod == "GET":
+		return AdminListUsers(ctx, request)
+	case strings.HasSuffix(request.Resource, "/users/{user_id}") && request.HTTPMethod == "GET":
+		return AdminGetUser(ctx, request)
+	case strings.HasSuffix(request.Resource, "/users/{user_id}/unlock") && request.HTTPMethod == "POST":
+		return UnlockUser(ctx, request)
+	case strings.HasSuffix(request.Resource, "/users/{user_id}/disable") && request.HTTPMethod == "POST":
+		return DisableUser(ctx, request)
+	case strings.HasSuffix(request.Resource, "/users/{user_id}/disable") && request.HTTPMethod == "DELETE":
+		return EnableUser(ctx, request)
+	case strings.HasSuffix(request.Resource, "/links") && request.HTTPMethod == "GET":
+		return AdminListLinks(ctx, request)
+	case strings.HasSuffix(request.Resource, "/links/{short_code}/takedown") && request.HTTPMethod == "POST":
+		return TakeDownLink(ctx, request)
+	case strings.HasSuffix(request.Resource, "/links/{short_code}/takedown") && request.HTTPMethod == "DELETE":
+		return RestoreLink(ctx, request)
+	case strings.HasSuffix(request.Resource, "/links/{short_code}/owner") && request.HTTPMethod == "PUT":
+		return ReassignLink(ctx, request)
+	case strings.HasSuffix(request.Resource, "/links/{short_code}/reports") && request.HTTPMethod == "GET":
+		return AdminLinkReports(ctx, request)
+	case strings.HasSuffix(request.Resource, "/links/{short_code}/reports") && request.HTTPMethod == "POST":
+		return ResolveLinkReports(ctx, request)
+	case strings.HasSuffix(request.Resource, "/reports") && request.HTTPMethod == "GET":
+		return AdminListReports(ctx, request)
+	case strings.HasSuffix(request.Resource, "/stats") && request.HTTPMethod == "GET":
+		return AdminStats(ctx, request)
+	case strings.HasSuffix(request.Resource, "/audit") && request.HTTPMethod == "GET":
+		return AdminAudit(ctx, request)
+	}
+	return events.APIGatewayProxyResponse{
+		StatusCode: 405,
+		Body:       `{"error": "Method not allowed"}`,
+	}, nil
+}
+
+// Returns the principal if it is a logged-in admin, the error response otherwise
+func requireAdmin(ctx context.Context) (*middleware.Principal, events.APIGatewayProxyResponse, bool) {
+	principal, resp, ok := requirePrincipal(ctx, sessionOnly)
+	if !ok {
+		return nil, resp, false
+	}
+
+	user, err := db.GetUser(ctx, principal.UserID)
+	if err != nil && err != db.ErrUserNotFound {
+		return nil, events.APIGatewayProxyResponse{
+			StatusCode: 500,
+			Body:       `{"error": "Failed to get user"}`,
+		}, false
+	}
+	if err != nil || !user.IsAdmin() {
+		return nil, events.APIGatewayProxyResponse{
+			StatusCode: 403,
+			Body:       `{"error": "Admin access required"}`,
+		}, false
+	}
+
+	return principal, events.APIGatewayProxyResponse{}, true
+}
+
+func newAdminUserResponse(user *db.User) AdminUserResponse {
+	return AdminUserResponse{
+		ProfileResponse: newProfileResponse(user),
+		Role:            user.Role,
+		DisabledAt:      user.DisabledAt,
+		DisabledReason:  user.DisabledReason,
+		FailedLogins:    user.FailedLogins,
+		LockedUntil:     user.LockedUntil,
+	}
+}
+
+// Returns the page size asked for with ?limit=, or the error response
+func adminPageSize(request events.APIGatewayProxyRequest) (int32, events.APIGatewayProxyResponse, bool) {
+	value := request.QueryStringParameters["limit"]
+	if value == "" {
+		return defaultAdminPageSize, events.APIGatewayProxyResponse{}, true
+	}
+	limit, err := strconv.Atoi(value)
+	if err != nil || limit < 1 || limit > maxAdminPageSize {
+		return 0, events.APIGatewayProxyResponse{
+			StatusCode: 400,
+			Body:       `{"error": "limit must be between 1 and ` + strconv.Itoa(maxAdminPageSize) + `"}`,
+		}, false
+	}
+	return int32(limit), events.APIGatewayProxyResponse{}, true
+}
+
+// Returns the reason of an admin action from the request body, or the
+// error response
+func adminReason(request events.APIGatewayProxyRequest) (string, events.APIGatewayProxyResponse, bool) {
+	var req AdminReasonRequest
+	if err := json.Unmarshal([]byte(request.Body), &req); err != nil {
+		return "", events.APIGatewayProxyResponse{
+			StatusCode: 400,
+			Body:       `{"error": "Invalid request body"}`,
+		}, false
+	}
+	reason := strings.TrimSpace(req.Reason)
+	if reason == "" || utf8.RuneCountInString(reason) > maxAdminReasonLength {
+		return "", events.APIGatewayProxyResponse{
+			StatusCode: 400,
+			Body:       `{"error": "reason is required and must be at most ` + strconv.Itoa(maxAdminReasonLength) + ` characters"}`,
+		}, false
+	}
+	return reason, events.APIGatewayProxyResponse{}, true
+}
+
+// Returns the domain of the link addressed by ?domain=
+func adminLinkDomain(request events.APIGatewayProxyRequest) string {
+	if d := request.QueryStringParameters["domain"]; d != "" {
+		return normalizeDomain(d)
+	}
+	return db.DefaultDomain
+}
+
+func jsonResponse(status int, v interface{}) (events.APIGatewayProxyResponse, error) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 500,
+			Body:       `{"error": "` + err.Error() + `"}`,
+		}, nil
+	}
+	return events.APIGatewayProxyResponse{
+		StatusCode: status,
+		Headers:    map[string]string{"Content-Type": "application/json"},
+		Body:       string(body),
+	}, nil
+}
+
+// Lists users, optionally searched with ?q= by ID, email or display name
+func AdminListUsers(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	if _, resp, ok := requireAdmin(ctx); !ok {
+		return resp, nil
+	}
+	limit, resp, ok := adminPageSize(request)
+	if !ok {
+		return resp, nil
+	}
+
+	users, next, err := db.ListUsers(ctx, request.QueryStringParameters["q"], limit, request.QueryStringParameters["cursor"])
+	if err == db.ErrInvalidCursor {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 400,
+			Body:       `{"error": "Invalid cursor"}`,
+		}, nil
+	}
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 500,
+			Body:       `{"error": "` + err.Error() + `"}`,
+		}, nil
+	}
+
+	response := AdminUsersResponse{Users: []AdminUserResponse{}, NextCursor: next}
+	for i := range users {
+		response.Users = append(response.Users, newAdminUserResponse(&users[i]))
+	}
+	return jsonResponse(200, response)
+}
+
+// Returns a single user
+func AdminGetUser(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	if _, resp, ok := requireAdmin(ctx); !ok {
+		return resp, nil
+	}
+
+	user, err := db.GetUser(ctx, request.PathParameters["user_id"])
+	if err == db.ErrUserNotFound {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 404,
+			Body:       `{"error": "User not found"}`,
+		}, nil
+	}
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 500,
+			Body:       `{"error": "Failed to get user"}`,
+		}, nil
+	}
+
+	return jsonResponse(200, newAdminUserResponse(user))
+}
+
+// Clears the failed logins and lock of an account
+func UnlockUser(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	admin, resp, ok := requireAdmin(ctx)
+	if !ok {
+		return resp, nil
+	}
+	userID := request.PathParameters["user_id"]
+
+	err := db.UnlockUser(ctx, userID)
+	if err == db.ErrUserNotFound {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 404,
+			Body:       `{"error": "User not found"}`,
+		}, nil
+	}
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 500,
+			Body:       `{"error": "Failed to unlock account"}`,
+		}, nil
+	}
+
+	recordAudit(ctx, auditEntry(ctx, request, admin.UserID, AuditAdminUnlockUser, AuditTargetUser, userID))
+	return events.APIGatewayProxyResponse{StatusCode: 204}, nil
+}
+
+// Disables an account. Its sessions are revoked at once and its API keys
+// are revoked for good, enabling the account again doesn't bring them back.
+func DisableUser(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	admin, resp, ok := requireAdmin(ctx)
+	if !ok {
+		return resp, nil
+	}
+	userID := request.PathParameters["user_id"]
+
+	reason, resp, ok := adminReason(request)
+	if !ok {
+		return resp, nil
+	}
+	if userID == admin.UserID {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 400,
+			Body:       `{"error": "Admins can't disable their own account"}`,
+		}, nil
+	}
+
+	err := db.DisableUser(ctx, userID, reason, time.Now().Unix())
+	if err == db.ErrUserNotFound {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 404,
+			Body:       `{"error": "User not found"}`,
+		}, nil
+	}
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 500,
+			Body:       `{"error": "Failed to disable account"}`,
+		}, nil
+	}
+	entry := auditEntry(ctx, request, admin.UserID, AuditAdminDisableUser, AuditTargetUser, userID)
+	entry.Details = map[string]string{"reason": reason}
+	recordAudit(ctx, entry)
+
+	keys, err := db.ListUserAPIKeys(ctx, userID)
+	if err == nil {
+		for _, key := range keys {
+			if !key.Active() {
+				continue
+			}
+			if err = db.RevokeAPIKey(ctx, userID, key.ID); err != nil {
+				break
+			}
+		}
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "revoke API keys of disabled user", "target_user_id", userID, "error", err)
+		return events.APIGatewayProxyResponse{
+			StatusCode: 500,
+			Body:       `{"error": "Account disabled but its API keys couldn't all be revoked, please try again"}`,
+		}, nil
+	}
+
+	return events.APIGatewayProxyResponse{StatusCode: 204}, nil
+}
+
+// Lets a disabled account log in again
+func EnableUser(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	admin, resp, ok := requireAdmin(ctx)
+	if !ok {
+		return resp, nil
+	}
+	userID := request.PathParameters["user_id"]
+
+	err := db.EnableUser(ctx, userID)
+	if err == db.ErrUserNotFound {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 404,
+			Body:       `{"error": "User not found"}`,
+		}, nil
+	}
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 500,
+			Body:       `{"error": "Failed to enable account"}`,
+		}, nil
+	}
+
+	recordAudit(ctx, auditEntry(ctx, request, admin.UserID, AuditAdminEnableUser, AuditTargetUser, userID))
+	return events.APIGatewayProxyResponse{StatusCode: 204}, nil
+}
+
+// Lists links across all users, optionally only those of ?user_id= and
+// searched with ?q= by short code or destination
+func AdminListLinks(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	if _, resp, ok := requireAdmin(ctx); !ok {
+		return resp, nil
+	}
+	limit, resp, ok := adminPageSize(request)
+	if !ok {
+		return resp, nil
+	}
+
+	query := request.QueryStringParameters
+	urls, next, err := db.ListURLs(ctx, query["user_id"], query["q"], limit, query["cursor"])
+	if err == db.ErrInvalidCursor {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 400,
+			Body:       `{"error": "Invalid cursor"}`,
+		}, nil
+	}
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 500,
+			Body:       `{"error": "` + err.Error() + `"}`,
+		}, nil
+	}
+	if urls == nil {
+		urls = []db.URL{}
+	}
+
+	return jsonResponse(200, AdminLinksResponse{Links: urls, NextCursor: next})
+}
+
+// Takes a link down, visitors see the reason instead of being redirected
+func TakeDownLink(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	admin, resp, ok := requireAdmin(ctx)
+	if !ok {
+		return resp, nil
+	}
+	domain, shortCode := adminLinkDomain(request), request.PathParameters["short_code"]
+
+	reason, resp, ok := adminReason(request)
+	if !ok {
+		return resp, nil
+	}
+
+	err := db.TakeDownURL(ctx, domain, shortCode, reason, time.Now().Format(time.RFC3339))
+	if err == db.ErrURLNotFound {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 404,
+			Body:       "URL not found",
+		}, nil
+	}
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 500,
+			Body:       `{"error": "Failed to take down link"}`,
+		}, nil
+	}
+
+	entry := auditEntry(ctx, request, admin.UserID, AuditAdminTakeDown, AuditTargetLink, domain+"/"+shortCode)
+	entry.Details = map[string]string{"reason": reason}
+	recordAudit(ctx, entry)
+	return events.APIGatewayProxyResponse{StatusCode: 204}, nil
+}
+
+// Lets a link that was taken down redirect again
+func RestoreLink(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	admin, resp, ok := requireAdmin(ctx)
+	if !ok {
+		return resp, nil
+	}
+	domain, shortCode := adminLinkDomain(request), request.PathParameters["short_code"]
+
+	err := db.RestoreURL(ctx, domain, shortCode)
+	if err == db.ErrURLNotFound {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 404,
+			Body:       "URL not found",
+		}, nil
+	}
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 500,
+			Body:       `{"error": "Failed to restore link"}`,
+		}, nil
+	}
+
+	recordAudit(ctx, auditEntry(ctx, request, admin.UserID, AuditAdminRestoreLink, AuditTargetLink, domain+"/"+shortCode))
+	return events.APIGatewayProxyResponse{StatusCode: 204}, nil
+}
+
+// Makes another user the creator of a link
+func ReassignLink(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	admin, resp, ok := requireAdmin(ctx)
+	if !ok {
+		return resp, nil
+	}
+	domain, shortCode := adminLinkDomain(request), request.PathParameters["short_code"]
+
+	var req ReassignLinkRequest
+	if err := json.Unmarshal([]byte(request.Body), &req); err != nil || req.UserID == "" {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 400,
+			Body:       `{"error": "user_id is required"}`,
+		}, nil
+	}
+
+	url, err := db.GetURL(ctx, domain, shortCode)
+	if err == db.ErrURLNotFound {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 404,
+			Body:       "URL not found",
+		}, nil
+	}
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 500,
+			Body:       `{"error": "` + err.Error() + `"}`,
+		}, nil
+	}
+
+	if _, err := db.GetUser(ctx, req.UserID); err == db.ErrUserNotFound {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 404,
+			Body:       `{"error": "User not found"}`,
+		}, nil
+	} else if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 500,
+			Body:       `{"error": "Failed to get user"}`,
+		}, nil
+	}
+
+	if err := db.SetURLOwner(ctx, domain, shortCode, req.UserID); err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 500,
+			Body:       `{"error": "Failed to reassign link"}`,
+		}, nil
+	}
+
+	previous := ""
+	if url.UserID != nil {
+		previous = *url.UserID
+	}
+	entry := auditEntry(ctx, request, admin.UserID, AuditAdminReassign, AuditTargetLink, domain+"/"+shortCode)
+	entry.Details = map[string]string{"from": previous, "to": req.UserID}
+	recordAudit(ctx, entry)
+	return events.APIGatewayProxyResponse{StatusCode: 204}, nil
+}
+
+// Returns system-wide counts of users, links and clicks, as last
+// computed by RefreshStats
+func AdminStats(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	if _, resp, ok := requireAdmin(ctx); !ok {
+		return resp, nil
+	}
+
+	stats, err := db.GetStats(ctx)
+	if err == db.ErrStatsNotComputed {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 503,
+			Body:       `{"error": "Stats haven't been computed yet, try again later"}`,
+		}, nil
+	}
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 500,
+			Body:       `{"error": "` + err.Error() + `"}`,
+		}, nil
+	}
+	return jsonResponse(200, stats)
+}
+
+// RefreshStats counts the users, links and clicks and stores the counts
+// for AdminStats. It scans the users and links tables, so it runs on a
+// schedule rather than on every request.
+func RefreshStats(ctx context.Context) error {
+	stats, err := db.CountStats(ctx)
+	if err != nil {
+		return err
+	}
+	stats.ComputedAt = time.Now().Format(time.RFC3339)
+	return db.SaveStats(ctx, *stats)
+}
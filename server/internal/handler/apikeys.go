@@ -0,0 +1,184 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/SunPodder/shorty/internal/db"
+	"github.com/SunPodder/shorty/utils"
+	"github.com/aws/aws-lambda-go/events"
+)
+
+type CreateAPIKeyRequest struct {
+	Name      string   `json:"name"`
+	Scopes    []string `json:"scopes"`
+	ExpiresAt *int64   `json:"expires_at,omitempty"`
+}
+
+// CreateAPIKeyResponse carries the plaintext key, which is only ever
+// shown once when the key is created
+type CreateAPIKeyResponse struct {
+	db.APIKey
+	Key string `json:"key"`
+}
+
+// Routes the /me/keys endpoints to their handlers
+func APIKeys(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	switch request.HTTPMethod {
+	case "GET":
+		return ListAPIKeys(ctx, request)
+	case "POST":
+		return CreateAPIKey(ctx, request)
+	case "DELETE":
+		return RevokeAPIKey(ctx, request)
+	}
+	return events.APIGatewayProxyResponse{
+		StatusCode: 405,
+		Body:       `{"error": "Method not allowed"}`,
+	}, nil
+}
+
+// Creates a personal API key for the authenticated user
+func CreateAPIKey(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	principal, resp, ok := requirePrincipal(ctx, sessionOnly)
+	if !ok {
+		return resp, nil
+	}
+	userID := principal.UserID
+
+	var req CreateAPIKeyRequest
+	if err := json.Unmarshal([]byte(request.Body), &req); err != nil || strings.TrimSpace(req.Name) == "" {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 400,
+			Body:       `{"error": "Invalid request body"}`,
+		}, nil
+	}
+
+	if len(req.Scopes) == 0 {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 400,
+			Body:       `{"error": "At least one scope is required"}`,
+		}, nil
+	}
+	for _, scope := range req.Scopes {
+		if !db.ValidScope(scope) {
+			return events.APIGatewayProxyResponse{
+				StatusCode: 400,
+				Body:       `{"error": "Unknown scope"}`,
+			}, nil
+		}
+	}
+
+	if req.ExpiresAt != nil && *req.ExpiresAt <= time.Now().Unix() {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 400,
+			Body:       `{"error": "expires_at must be in the future"}`,
+		}, nil
+	}
+
+	id, plaintext, err := utils.GenerateAPIKey()
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 500,
+			Body:       `{"error": "Failed to generate API key"}`,
+		}, nil
+	}
+
+	key := db.APIKey{
+		ID:        id,
+		UserID:    userID,
+		Name:      strings.TrimSpace(req.Name),
+		Prefix:    utils.APIKeyPrefix + id,
+		KeyHash:   utils.HashAPIKey(plaintext),
+		Scopes:    req.Scopes,
+		ExpiresAt: req.ExpiresAt,
+		CreatedAt: time.Now().Format(time.RFC3339),
+	}
+
+	if err := db.CreateAPIKey(ctx, key); err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 500,
+			Body:       `{"error": "` + err.Error() + `"}`,
+		}, nil
+	}
+
+	entry := auditEntry(ctx, request, userID, AuditAPIKeyCreate, AuditTargetAPIKey, key.ID)
+	entry.Details = map[string]string{"name": key.Name, "scopes": strings.Join(key.Scopes, " ")}
+	recordAudit(ctx, entry)
+
+	responseBody, err := json.Marshal(CreateAPIKeyResponse{APIKey: key, Key: plaintext})
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 500,
+			Body:       `{"error": "` + err.Error() + `"}`,
+		}, nil
+	}
+	return events.APIGatewayProxyResponse{
+		StatusCode: 201,
+		Headers:    map[string]string{"Content-Type": "application/json"},
+		Body:       string(responseBody),
+	}, nil
+}
+
+// Lists the API keys of the authenticated user without their secrets
+func ListAPIKeys(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	principal, resp, ok := requirePrincipal(ctx, sessionOnly)
+	if !ok {
+		return resp, nil
+	}
+	userID := principal.UserID
+
+	keys, err := db.ListUserAPIKeys(ctx, userID)
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 500,
+			Body:       `{"error": "` + err.Error() + `"}`,
+		}, nil
+	}
+	if keys == nil {
+		keys = []db.APIKey{}
+	}
+
+	responseBody, err := json.Marshal(keys)
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 500,
+			Body:       `{"error": "` + err.Error() + `"}`,
+		}, nil
+	}
+	return events.APIGatewayProxyResponse{
+		StatusCode: 200,
+		Headers:    map[string]string{"Content-Type": "application/json"},
+		Body:       string(responseBody),
+	}, nil
+}
+
+// Revokes one of the API keys of the authenticated user
+func RevokeAPIKey(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	principal, resp, ok := requirePrincipal(ctx, sessionOnly)
+	if !ok {
+		return resp, nil
+	}
+	userID := principal.UserID
+
+	keyID := request.PathParameters["key_id"]
+	if err := db.RevokeAPIKey(ctx, userID, keyID); err != nil {
+		if err == db.ErrAPIKeyNotFound {
+			return events.APIGatewayProxyResponse{
+				StatusCode: 404,
+				Body:       `{"error": "API key not found"}`,
+			}, nil
+		}
+		return events.APIGatewayProxyResponse{
+			StatusCode: 500,
+			Body:       `{"error": "` + err.Error() + `"}`,
+		}, nil
+	}
+
+	recordAudit(ctx, auditEntry(ctx, request, userID, AuditAPIKeyRevoke, AuditTargetAPIKey, keyID))
+	return events.APIGatewayProxyResponse{
+		StatusCode: 204,
+	}, nil
+}
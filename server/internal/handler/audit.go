@@ -0,0 +1,184 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"time"
+
+	"github.com/SunPodder/shorty/internal/audit"
+	"github.com/SunPodder/shorty/internal/db"
+	"github.com/SunPodder/shorty/internal/middleware"
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/google/uuid"
+)
+
+// AuditSink stores the audit log of link and account mutations. Lambdas
+// select it at startup, the log sink only serves local development.
+var AuditSink audit.Sink = audit.NewLogSink()
+
+// Actions written to the audit log
+const (
+	AuditLinkCreate          = "link.create"
+	AuditLinkUpdate          = "link.update"
+	AuditLinkDelete          = "link.delete"
+	AuditLinkFlagged         = "link.flagged"
+	AuditLinkReportDisabled  = "link.report_disabled"
+	AuditLogin               = "auth.login"
+	AuditLoginFailed         = "auth.login_failed"
+	AuditProfileUpdate       = "account.profile_update"
+	AuditEmailChange         = "account.email_change"
+	AuditPasswordChange      = "account.password_change"
+	AuditPasswordReset       = "account.password_reset"
+	AuditAccountDelete       = "account.delete"
+	AuditTwoFactorEnroll     = "account.2fa_enroll"
+	AuditTwoFactorEnable     = "account.2fa_enable"
+	AuditTwoFactorDisable    = "account.2fa_disable"
+	AuditAPIKeyCreate        = "api_key.create"
+	AuditAPIKeyRevoke        = "api_key.revoke"
+	AuditWebhookCreate       = "webhook.create"
+	AuditWebhookDelete       = "webhook.delete"
+	AuditAdminUnlockUser     = "admin.user.unlock"
+	AuditAdminDisableUser    = "admin.user.disable"
+	AuditAdminEnableUser     = "admin.user.enable"
+	AuditAdminTakeDown       = "admin.link.takedown"
+	AuditAdminRestoreLink    = "admin.link.restore"
+	AuditAdminReassign       = "admin.link.reassign"
+	AuditAdminDismissReports = "admin.link.dismiss_reports"
+)
+
+// Kinds of audit log targets
+const (
+	AuditTargetUser    = "user"
+	AuditTargetLink    = "link"
+	AuditTargetAPIKey  = "api_key"
+	AuditTargetWebhook = "webhook"
+)
+
+type AuditResponse struct {
+	Entries    []db.AuditEntry `json:"entries"`
+	NextCursor string          `json:"next_cursor,omitempty"`
+}
+
+// Returns a new audit log entry of an action Shorty took by itself
+func systemAuditEntry(action, targetType, targetID string) db.AuditEntry {
+	return db.AuditEntry{
+		ID:         uuid.NewString(),
+		Action:     action,
+		TargetType: targetType,
+		TargetID:   targetID,
+		CreatedAt:  time.Now().UTC().Format(time.RFC3339Nano),
+	}
+}
+
+// Returns a new audit log entry of an action taken by actorID in request,
+// recording the API key it was taken with if any
+func auditEntry(ctx context.Context, request events.APIGatewayProxyRequest, actorID, action, targetType, targetID string) db.AuditEntry {
+	entry := systemAuditEntry(action, targetType, targetID)
+	entry.ActorID = actorID
+	entry.IP = middleware.ClientIP(request)
+	entry.RequestID = request.RequestContext.RequestID
+	if principal, ok := middleware.PrincipalFromContext(ctx); ok && principal.UserID == actorID {
+		entry.APIKeyID = principal.APIKeyID
+	}
+	return entry
+}
+
+// Writes an entry to the audit log. The action already happened, so a
+// failed write is logged rather than reported to the caller.
+func recordAudit(ctx context.Context, entry db.AuditEntry) {
+	if err := AuditSink.Write(ctx, entry); err != nil {
+		slog.ErrorContext(ctx, "audit write failed", "action", entry.Action, "actor_id", entry.ActorID, "target_type", entry.TargetType, "target_id", entry.TargetID, "error", err)
+	}
+}
+
+// Returns the JSON fields of a link that differ between before and after,
+// with their values on both sides. A nil link counts as having no fields.
+func auditChanges(before, after *db.URL) map[string]db.AuditChange {
+	fields := func(url *db.URL) map[string]json.RawMessage {
+		m := map[string]json.RawMessage{}
+		if url != nil {
+			if data, err := json.Marshal(url); err == nil {
+				json.Unmarshal(data, &m)
+			}
+		}
+		return m
+	}
+	was, now := fields(before), fields(after)
+
+	changes := map[string]db.AuditChange{}
+	for name, value := range was {
+		if string(now[name]) != string(value) {
+			changes[name] = db.AuditChange{Before: string(value), After: string(now[name])}
+		}
+	}
+	for name, value := range now {
+		if _, ok := was[name]; !ok {
+			changes[name] = db.AuditChange{After: string(value)}
+		}
+	}
+	if len(changes) == 0 {
+		return nil
+	}
+	return changes
+}
+
+// Returns the ID of a link in the audit log
+func auditLinkID(url *db.URL) string {
+	return url.Domain + "/" + url.ShortCode
+}
+
+// Returns a page of audit log entries matching filter as the response
+func auditPage(ctx context.Context, request events.APIGatewayProxyRequest, filter db.AuditFilter) (events.APIGatewayProxyResponse, error) {
+	limit, resp, ok := adminPageSize(request)
+	if !ok {
+		return resp, nil
+	}
+
+	entries, next, err := db.ListAuditEntries(ctx, filter, limit, request.QueryStringParameters["cursor"])
+	if err == db.ErrInvalidCursor {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 400,
+			Body:       `{"error": "Invalid cursor"}`,
+		}, nil
+	}
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 500,
+			Body:       `{"error": "` + err.Error() + `"}`,
+		}, nil
+	}
+	if entries == nil {
+		entries = []db.AuditEntry{}
+	}
+
+	return jsonResponse(200, AuditResponse{Entries: entries, NextCursor: next})
+}
+
+// Lists the actions taken by the caller, newest first, optionally only
+// those of ?action=
+func MyAudit(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	principal, resp, ok := requirePrincipal(ctx, sessionOnly)
+	if !ok {
+		return resp, nil
+	}
+	return auditPage(ctx, request, db.AuditFilter{
+		ActorID: principal.UserID,
+		Action:  request.QueryStringParameters["action"],
+	})
+}
+
+// Lists the whole audit log, optionally only the entries matching
+// ?actor_id=, ?action=, ?target_type= and ?target_id=
+func AdminAudit(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	if _, resp, ok := requireAdmin(ctx); !ok {
+		return resp, nil
+	}
+	query := request.QueryStringParameters
+	return auditPage(ctx, request, db.AuditFilter{
+		ActorID:    query["actor_id"],
+		Action:     query["action"],
+		TargetType: query["target_type"],
+		TargetID:   query["target_id"],
+	})
+}
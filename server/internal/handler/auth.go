@@ -0,0 +1,39 @@
+package handler
+
+import (
+	"context"
+
+	"github.com/SunPodder/shorty/internal/middleware"
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// Scope required by endpoints that only accept a logged-in session,
+// such as managing API keys. API keys never satisfy it.
+const sessionOnly = ""
+
+// Returns the principal stored by middleware.WithAuth and checks that it
+// holds scope, returning the error response otherwise
+func requirePrincipal(ctx context.Context, scope string) (*middleware.Principal, events.APIGatewayProxyResponse, bool) {
+	principal, ok := middleware.PrincipalFromContext(ctx)
+	if !ok {
+		return nil, events.APIGatewayProxyResponse{
+			StatusCode: 401,
+			Body:       `{"error": "Authentication required"}`,
+		}, false
+	}
+
+	if scope == sessionOnly && !principal.IsSession() {
+		return nil, events.APIGatewayProxyResponse{
+			StatusCode: 403,
+			Body:       `{"error": "API keys can't be used for this endpoint"}`,
+		}, false
+	}
+	if !principal.HasScope(scope) {
+		return nil, events.APIGatewayProxyResponse{
+			StatusCode: 403,
+			Body:       `{"error": "API key lacks the ` + scope + ` scope"}`,
+		}, false
+	}
+
+	return principal, events.APIGatewayProxyResponse{}, true
+}
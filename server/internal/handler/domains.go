@@ -0,0 +1,333 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/SunPodder/shorty/internal/db"
+	"github.com/SunPodder/shorty/internal/dns"
+	"github.com/SunPodder/shorty/utils"
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// DNSResolver is used to verify the ownership of custom domains
+var DNSResolver dns.Resolver = dns.NewNetResolver()
+
+// PendingDomainTTL is how long a domain stays claimed without being
+// verified, after which anyone can attach it again
+var PendingDomainTTL = 7 * 24 * time.Hour
+
+var (
+	domainPattern = regexp.MustCompile(`^([a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?\.)+[a-z]{2,63}$`)
+	// Hosts API Gateway serves the API on when no custom domain is set up
+	apiGatewayHostPattern = regexp.MustCompile(`\.execute-api\.[a-z0-9.-]+\.(amazonaws\.com|localstack\.cloud)$`)
+)
+
+type AddDomainRequest struct {
+	Domain string `json:"domain"`
+}
+
+// DomainResponse describes a custom domain along with the TXT record
+// that has to be published to verify it
+type DomainResponse struct {
+	db.Domain
+	RecordName  string `json:"record_name"`
+	RecordValue string `json:"record_value"`
+}
+
+func newDomainResponse(domain db.Domain) DomainResponse {
+	return DomainResponse{
+		Domain:      domain,
+		RecordName:  dns.RecordName(domain.Domain),
+		RecordValue: dns.RecordValue(domain.VerificationToken),
+	}
+}
+
+// Routes the /domains endpoints to their handlers
+func Domains(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	switch {
+	case request.HTTPMethod == "GET":
+		return ListDomains(ctx, request)
+	case request.HTTPMethod == "DELETE" && request.PathParameters["domain"] != "":
+		return RemoveDomain(ctx, request)
+	case request.HTTPMethod == "POST" && request.PathParameters["domain"] != "":
+		return VerifyDomain(ctx, request)
+	case request.HTTPMethod == "POST":
+		return AddDomain(ctx, request)
+	}
+	return events.APIGatewayProxyResponse{
+		StatusCode: 405,
+		Body:       `{"error": "Method not allowed"}`,
+	}, nil
+}
+
+// Attaches a new custom domain to the authenticated user.
+// The domain can't serve links until its ownership is verified, and is
+// released if that doesn't happen within PendingDomainTTL.
+func AddDomain(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	principal, resp, ok := requirePrincipal(ctx, db.ScopeLinksWrite)
+	if !ok {
+		return resp, nil
+	}
+	userID := principal.UserID
+
+	var req AddDomainRequest
+	if err := json.Unmarshal([]byte(request.Body), &req); err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 400,
+			Body:       `{"error": "Invalid request body"}`,
+		}, nil
+	}
+
+	name := normalizeDomain(req.Domain)
+	if !domainPattern.MatchString(name) {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 400,
+			Body:       `{"error": "Invalid domain"}`,
+		}, nil
+	}
+	// The hosts the service is reached on serve the default domain
+	requestHost, _ := utils.GetHeader(request.Headers, "Host")
+	if serviceHost(name) || name == normalizeDomain(requestHost) {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 409,
+			Body:       `{"error": "Domain already registered"}`,
+		}, nil
+	}
+
+	token, err := utils.RandomToken(16)
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 500,
+			Body:       `{"error": "Failed to generate verification token"}`,
+		}, nil
+	}
+
+	now := time.Now()
+	expiresAt := now.Add(PendingDomainTTL).Unix()
+	domain := db.Domain{
+		Domain:            name,
+		UserID:            userID,
+		VerificationToken: token,
+		CreatedAt:         now.Format(time.RFC3339),
+		ExpiresAt:         &expiresAt,
+	}
+
+	if err := db.CreateDomain(ctx, domain); err != nil {
+		if err == db.ErrDuplicateDomain {
+			return events.APIGatewayProxyResponse{
+				StatusCode: 409,
+				Body:       `{"error": "Domain already registered"}`,
+			}, nil
+		}
+		return events.APIGatewayProxyResponse{
+			StatusCode: 500,
+			Body:       `{"error": "` + err.Error() + `"}`,
+		}, nil
+	}
+
+	responseBody, err := json.Marshal(newDomainResponse(domain))
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 500,
+			Body:       `{"error": "` + err.Error() + `"}`,
+		}, nil
+	}
+	return events.APIGatewayProxyResponse{
+		StatusCode: 201,
+		Headers:    map[string]string{"Content-Type": "application/json"},
+		Body:       string(responseBody),
+	}, nil
+}
+
+// Lists the custom domains of the authenticated user
+func ListDomains(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	principal, resp, ok := requirePrincipal(ctx, db.ScopeLinksRead)
+	if !ok {
+		return resp, nil
+	}
+	userID := principal.UserID
+
+	domains, err := db.ListUserDomains(ctx, userID)
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 500,
+			Body:       `{"error": "` + err.Error() + `"}`,
+		}, nil
+	}
+
+	response := make([]DomainResponse, 0, len(domains))
+	for _, domain := range domains {
+		response = append(response, newDomainResponse(domain))
+	}
+
+	responseBody, err := json.Marshal(response)
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 500,
+			Body:       `{"error": "` + err.Error() + `"}`,
+		}, nil
+	}
+	return events.APIGatewayProxyResponse{
+		StatusCode: 200,
+		Headers:    map[string]string{"Content-Type": "application/json"},
+		Body:       string(responseBody),
+	}, nil
+}
+
+// Checks the DNS TXT record of a custom domain and marks it verified
+func VerifyDomain(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	principal, resp, ok := requirePrincipal(ctx, db.ScopeLinksWrite)
+	if !ok {
+		return resp, nil
+	}
+	userID := principal.UserID
+
+	domain, err := db.GetDomain(ctx, normalizeDomain(request.PathParameters["domain"]))
+	if err != nil {
+		if err == db.ErrDomainNotFound {
+			return events.APIGatewayProxyResponse{
+				StatusCode: 404,
+				Body:       `{"error": "Domain not found"}`,
+			}, nil
+		}
+		return events.APIGatewayProxyResponse{
+			StatusCode: 500,
+			Body:       `{"error": "` + err.Error() + `"}`,
+		}, nil
+	}
+
+	if domain.UserID != userID {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 404,
+			Body:       `{"error": "Domain not found"}`,
+		}, nil
+	}
+
+	if !domain.Verified {
+		if err := dns.VerifyOwnership(ctx, DNSResolver, domain.Domain, domain.VerificationToken); err != nil {
+			if err == dns.ErrVerificationFailed {
+				return events.APIGatewayProxyResponse{
+					StatusCode: 422,
+					Body:       `{"error": "TXT record ` + dns.RecordName(domain.Domain) + ` not found or does not match"}`,
+				}, nil
+			}
+			return events.APIGatewayProxyResponse{
+				StatusCode: 502,
+				Body:       `{"error": "DNS lookup failed"}`,
+			}, nil
+		}
+
+		if err := db.MarkDomainVerified(ctx, domain.Domain); err != nil {
+			if err == db.ErrDomainNotFound {
+				return events.APIGatewayProxyResponse{
+					StatusCode: 404,
+					Body:       `{"error": "Domain not found"}`,
+				}, nil
+			}
+			return events.APIGatewayProxyResponse{
+				StatusCode: 500,
+				Body:       `{"error": "` + err.Error() + `"}`,
+			}, nil
+		}
+		domain.Verified = true
+		domain.ExpiresAt = nil
+	}
+
+	responseBody, err := json.Marshal(newDomainResponse(*domain))
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 500,
+			Body:       `{"error": "` + err.Error() + `"}`,
+		}, nil
+	}
+	return events.APIGatewayProxyResponse{
+		StatusCode: 200,
+		Headers:    map[string]string{"Content-Type": "application/json"},
+		Body:       string(responseBody),
+	}, nil
+}
+
+// Detaches a custom domain from the authenticated user, pending or
+// verified. Links in its namespace stop resolving until it is attached
+// and verified again.
+func RemoveDomain(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	principal, resp, ok := requirePrincipal(ctx, db.ScopeLinksWrite)
+	if !ok {
+		return resp, nil
+	}
+
+	domain, err := db.GetDomain(ctx, normalizeDomain(request.PathParameters["domain"]))
+	if err != nil && err != db.ErrDomainNotFound {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 500,
+			Body:       `{"error": "` + err.Error() + `"}`,
+		}, nil
+	}
+	if err == db.ErrDomainNotFound || domain.UserID != principal.UserID {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 404,
+			Body:       `{"error": "Domain not found"}`,
+		}, nil
+	}
+
+	if err := db.DeleteDomain(ctx, domain.Domain); err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 500,
+			Body:       `{"error": "` + err.Error() + `"}`,
+		}, nil
+	}
+
+	return events.APIGatewayProxyResponse{StatusCode: 204}, nil
+}
+
+// Lowercases a host name and strips any port and trailing dot
+func normalizeDomain(host string) string {
+	host = strings.ToLower(strings.TrimSpace(host))
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.TrimSuffix(host, ".")
+}
+
+// Reports whether host is one the service itself is reached on: the host
+// of PublicURL or an API Gateway host. They can't be claimed as custom
+// domains.
+func serviceHost(host string) bool {
+	if apiGatewayHostPattern.MatchString(host) {
+		return true
+	}
+	if PublicURL == "" {
+		return false
+	}
+	public, err := url.Parse(PublicURL)
+	return err == nil && normalizeDomain(public.Host) == host
+}
+
+// Returns the link namespace served on the Host of the request.
+// Hosts that aren't verified custom domains serve DefaultDomain, so a
+// pending claim can't take a host over.
+func namespaceFor(ctx context.Context, request events.APIGatewayProxyRequest) (string, error) {
+	host, _ := utils.GetHeader(request.Headers, "Host")
+	host = normalizeDomain(host)
+	if host == "" || serviceHost(host) {
+		return db.DefaultDomain, nil
+	}
+
+	domain, err := db.GetDomain(ctx, host)
+	if err == db.ErrDomainNotFound {
+		return db.DefaultDomain, nil
+	}
+	if err != nil {
+		return "", err
+	}
+	if !domain.Verified {
+		return db.DefaultDomain, nil
+	}
+	return domain.Domain, nil
+}
@@ -0,0 +1,244 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/SunPodder/shorty/internal/db"
+	"github.com/SunPodder/shorty/internal/middleware"
+	"github.com/SunPodder/shorty/internal/webhook"
+	"github.com/SunPodder/shorty/utils"
+	"github.com/aws/aws-lambda-go/events"
+)
+
+type UpdateLinkRequest struct {
+	OriginalURL    *string `json:"original_url,omitempty"`
+	Title          *string `json:"title,omitempty"`
+	ExpiryDate     *int64  `json:"expiry_date,omitempty"`
+	RedirectStatus *int    `json:"redirect_status,omitempty"`
+	Interstitial   *bool   `json:"interstitial,omitempty"`
+}
+
+// Routes the /links/{short_code} endpoints to their handlers.
+// The domain of the link is passed as ?domain= and defaults to DefaultDomain.
+func Links(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	switch request.HTTPMethod {
+	case "GET":
+		return GetLink(ctx, request)
+	case "PATCH":
+		return UpdateLink(ctx, request)
+	case "DELETE":
+		return DeleteLink(ctx, request)
+	}
+	return events.APIGatewayProxyResponse{
+		StatusCode: 405,
+		Body:       `{"error": "Method not allowed"}`,
+	}, nil
+}
+
+// Returns a link, visible to its creator and any member of its workspace
+func GetLink(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	url, _, resp, ok := authorizeLink(ctx, request, db.RoleViewer)
+	if !ok {
+		return resp, nil
+	}
+
+	responseBody, err := json.Marshal(url)
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 500,
+			Body:       `{"error": "` + err.Error() + `"}`,
+		}, nil
+	}
+	return events.APIGatewayProxyResponse{
+		StatusCode: 200,
+		Headers:    map[string]string{"Content-Type": "application/json"},
+		Body:       string(responseBody),
+	}, nil
+}
+
+// Updates the destination and options of a link, requires the editor role
+func UpdateLink(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	var req UpdateLinkRequest
+	if err := json.Unmarshal([]byte(request.Body), &req); err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 400,
+			Body:       `{"error": "Invalid request body"}`,
+		}, nil
+	}
+
+	url, principal, resp, ok := authorizeLink(ctx, request, db.RoleEditor)
+	if !ok {
+		return resp, nil
+	}
+	if url.TakenDown() {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 403,
+			Body:       `{"error": "This link was taken down by an admin and can't be edited"}`,
+		}, nil
+	}
+
+	// Only the edited attributes are written, url is kept up to date to
+	// record the changes
+	before := *url
+	var update db.URLUpdate
+	if req.OriginalURL != nil {
+		if _, err := utils.ValidateURL(*req.OriginalURL); err != nil {
+			return events.APIGatewayProxyResponse{
+				StatusCode: 400,
+				Body:       `{"error": "` + err.Error() + `"}`,
+			}, nil
+		}
+		if *req.OriginalURL != url.OriginalURL {
+			verdict, screenedAt := screenURL(ctx, *req.OriginalURL)
+			if verdict.Flagged && ScreeningAction == ScreenReject {
+				return events.APIGatewayProxyResponse{
+					StatusCode: 400,
+					Body:       `{"error": "original_url was flagged as unsafe"}`,
+				}, nil
+			}
+			if verdict.Flagged {
+				quarantine(url, verdict)
+				update.TakedownReason, update.TakenDownAt = url.TakedownReason, url.TakenDownAt
+			}
+			url.ScreenedAt, update.ScreenedAt = screenedAt, screenedAt
+		}
+		url.OriginalURL = *req.OriginalURL
+		update.OriginalURL = req.OriginalURL
+	}
+	if req.RedirectStatus != nil {
+		if !ValidRedirectStatus(*req.RedirectStatus) {
+			return events.APIGatewayProxyResponse{
+				StatusCode: 400,
+				Body:       `{"error": "redirect_status must be one of 301, 302, 307 or 308"}`,
+			}, nil
+		}
+		url.RedirectStatus = req.RedirectStatus
+		update.RedirectStatus = req.RedirectStatus
+	}
+	if req.Title != nil {
+		url.Title = req.Title
+		update.Title = req.Title
+	}
+	if req.ExpiryDate != nil {
+		url.ExpiryDate = req.ExpiryDate
+		update.ExpiryDate = req.ExpiryDate
+	}
+	if req.Interstitial != nil {
+		url.Interstitial = req.Interstitial
+		update.Interstitial = req.Interstitial
+	}
+
+	updated, err := db.UpdateURL(ctx, url.Domain, url.ShortCode, update)
+	if err != nil {
+		if err == db.ErrURLNotFound {
+			return events.APIGatewayProxyResponse{
+				StatusCode: 404,
+				Body:       "URL not found",
+			}, nil
+		}
+		return events.APIGatewayProxyResponse{
+			StatusCode: 500,
+			Body:       `{"error": "` + err.Error() + `"}`,
+		}, nil
+	}
+
+	if changes := auditChanges(&before, url); changes != nil {
+		entry := auditEntry(ctx, request, principal.UserID, AuditLinkUpdate, AuditTargetLink, auditLinkID(url))
+		entry.Changes = changes
+		recordAudit(ctx, entry)
+	}
+
+	responseBody, err := json.Marshal(updated)
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 500,
+			Body:       `{"error": "` + err.Error() + `"}`,
+		}, nil
+	}
+	return events.APIGatewayProxyResponse{
+		StatusCode: 200,
+		Headers:    map[string]string{"Content-Type": "application/json"},
+		Body:       string(responseBody),
+	}, nil
+}
+
+// Deletes a link, requires the editor role
+func DeleteLink(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	url, principal, resp, ok := authorizeLink(ctx, request, db.RoleEditor)
+	if !ok {
+		return resp, nil
+	}
+
+	if err := db.DeleteURL(ctx, url.Domain, url.ShortCode); err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 500,
+			Body:       `{"error": "` + err.Error() + `"}`,
+		}, nil
+	}
+
+	entry := auditEntry(ctx, request, principal.UserID, AuditLinkDelete, AuditTargetLink, auditLinkID(url))
+	entry.Changes = auditChanges(url, nil)
+	recordAudit(ctx, entry)
+	dispatchLinkEvent(ctx, webhook.EventLinkDeleted, url, webhook.LinkData{Clicks: url.Clicks})
+
+	return events.APIGatewayProxyResponse{
+		StatusCode: 204,
+	}, nil
+}
+
+// Loads the link addressed by the request and checks that the caller
+// holds at least the min role on it, returning the link and the caller or
+// the error response.
+// Links the caller can't see are reported as not found.
+func authorizeLink(ctx context.Context, request events.APIGatewayProxyRequest, min string) (*db.URL, *middleware.Principal, events.APIGatewayProxyResponse, bool) {
+	scope := db.ScopeLinksWrite
+	if min == db.RoleViewer {
+		scope = db.ScopeLinksRead
+	}
+	principal, resp, ok := requirePrincipal(ctx, scope)
+	if !ok {
+		return nil, nil, resp, false
+	}
+
+	domain := db.DefaultDomain
+	if d := request.QueryStringParameters["domain"]; d != "" {
+		domain = normalizeDomain(d)
+	}
+
+	url, err := db.GetURL(ctx, domain, request.PathParameters["short_code"])
+	if err == db.ErrURLNotFound {
+		return nil, nil, events.APIGatewayProxyResponse{
+			StatusCode: 404,
+			Body:       "URL not found",
+		}, false
+	}
+	if err != nil {
+		return nil, nil, events.APIGatewayProxyResponse{
+			StatusCode: 500,
+			Body:       `{"error": "` + err.Error() + `"}`,
+		}, false
+	}
+
+	role, err := linkRole(ctx, principal.UserID, url)
+	if err != nil {
+		return nil, nil, events.APIGatewayProxyResponse{
+			StatusCode: 500,
+			Body:       `{"error": "` + err.Error() + `"}`,
+		}, false
+	}
+	if role == "" {
+		return nil, nil, events.APIGatewayProxyResponse{
+			StatusCode: 404,
+			Body:       "URL not found",
+		}, false
+	}
+	if !roleAtLeast(role, min) {
+		return nil, nil, events.APIGatewayProxyResponse{
+			StatusCode: 403,
+			Body:       `{"error": "Insufficient role for this link"}`,
+		}, false
+	}
+
+	return url, principal, events.APIGatewayProxyResponse{}, true
+}
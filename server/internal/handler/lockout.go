@@ -0,0 +1,183 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/SunPodder/shorty/internal/db"
+	"github.com/SunPodder/shorty/internal/mail"
+	"github.com/SunPodder/shorty/utils"
+	"github.com/aws/aws-lambda-go/events"
+)
+
+const (
+	// Failed logins allowed before further attempts are delayed
+	freeLoginAttempts = 3
+	// Failed logins after which the account is locked and its owner is
+	// emailed an unlock link
+	maxFailedLogins = 10
+	lockoutDuration = time.Hour
+)
+
+// Returns how long logins are refused after the given number of
+// consecutive failures. The delay doubles with every failure past the
+// free attempts until the account is locked.
+func loginBackoff(failures int) time.Duration {
+	switch {
+	case failures >= maxFailedLogins:
+		return lockoutDuration
+	case failures < freeLoginAttempts:
+		return 0
+	}
+	return time.Second << (failures - freeLoginAttempts)
+}
+
+var (
+	dummyHashOnce sync.Once
+	dummyHash     string
+)
+
+// Compares password against a throwaway hash so requests for unknown or
+// locked accounts take as long as those for real ones
+func checkDummyPassword(password string) {
+	dummyHashOnce.Do(func() {
+		dummyHash, _ = utils.HashPassword("shorty-dummy-password")
+	})
+	utils.CheckPasswordHash(password, dummyHash)
+}
+
+// Records a failed login of user and refuses logins for the resulting
+// backoff. When the account gets locked, its owner receives an unlock link.
+func recordFailedLogin(ctx context.Context, user *db.User) {
+	failures, err := db.RecordFailedLogin(ctx, user.ID)
+	if err != nil {
+		slog.ErrorContext(ctx, "record failed login", "target_user_id", user.ID, "error", err)
+		return
+	}
+
+	backoff := loginBackoff(failures)
+	if backoff == 0 {
+		return
+	}
+
+	var token, tokenHash string
+	if failures == maxFailedLogins {
+		secret, err := utils.RandomToken(32)
+		if err != nil {
+			slog.ErrorContext(ctx, "generate unlock token", "target_user_id", user.ID, "error", err)
+		} else {
+			token = user.ID + "." + secret
+			tokenHash = utils.HashToken(secret)
+		}
+	}
+
+	if err := db.LockUser(ctx, user.ID, time.Now().Add(backoff).Unix(), tokenHash); err != nil {
+		slog.ErrorContext(ctx, "lock user", "target_user_id", user.ID, "error", err)
+		return
+	}
+
+	if token != "" {
+		sendUnlockEmail(ctx, user, token)
+	}
+}
+
+func sendUnlockEmail(ctx context.Context, user *db.User, token string) {
+	link := publicLink("/unlock", url.Values{"token": {token}})
+	err := Mailer.Send(ctx, mail.Message{
+		To:      user.Email,
+		Subject: "Your Shorty account has been locked",
+		Body: "We locked your account after too many failed login attempts.\n\n" +
+			"If this was you, you can unlock it right away by opening the link below.\n" +
+			"Otherwise it unlocks by itself in an hour, but consider changing your password.\n\n" +
+			link + "\n",
+	})
+	if err != nil {
+		slog.ErrorContext(ctx, "send unlock email", "target_user_id", user.ID, "error", err)
+	}
+}
+
+type UnlockRequest struct {
+	Token string `json:"token"`
+}
+
+const unlockTitle = "Unlock your account"
+
+// Unlock unlocks an account with the token emailed when it was locked.
+// The emailed link opens a page confirming the unlock by POST.
+func Unlock(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	switch request.HTTPMethod {
+	case "GET":
+		return unlockPage(request)
+	case "POST":
+		return ConfirmUnlock(ctx, request)
+	}
+	return events.APIGatewayProxyResponse{
+		StatusCode: 405,
+		Body:       `{"error": "Method not allowed"}`,
+	}, nil
+}
+
+// Shows the page of an emailed unlock link
+func unlockPage(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	token := request.QueryStringParameters["token"]
+	if _, _, ok := splitUserToken(token); !ok {
+		return renderPage(400, formPage{Title: unlockTitle, Message: "This unlock link is invalid or has expired."})
+	}
+	return renderPage(200, formPage{
+		Title:   unlockTitle,
+		Message: "Your account was locked after too many failed login attempts.",
+		Token:   token,
+		Submit:  "Unlock my account",
+	})
+}
+
+// ConfirmUnlock unlocks the account of the token posted by the unlock
+// page or an API client
+func ConfirmUnlock(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	form := isFormPost(request)
+	var req UnlockRequest
+	if form {
+		values, err := parseForm(request)
+		if err != nil {
+			return formResult(form, unlockTitle, 400, "Invalid request body")
+		}
+		req.Token = values.Get("token")
+	} else if err := json.Unmarshal([]byte(request.Body), &req); err != nil {
+		return formResult(form, unlockTitle, 400, "Invalid request body")
+	}
+
+	invalid := "Invalid or expired unlock link"
+	userID, secret, ok := splitUserToken(req.Token)
+	if !ok {
+		return formResult(form, unlockTitle, 400, invalid)
+	}
+
+	user, err := db.GetUser(ctx, userID)
+	if err == db.ErrUserNotFound {
+		return formResult(form, unlockTitle, 400, invalid)
+	}
+	if err != nil {
+		return formResult(form, unlockTitle, 500, "Failed to get user")
+	}
+
+	if user.UnlockTokenHash == "" || !utils.CheckTokenHash(secret, user.UnlockTokenHash) {
+		return formResult(form, unlockTitle, 400, invalid)
+	}
+
+	if err := db.UnlockUser(ctx, user.ID); err != nil {
+		return formResult(form, unlockTitle, 500, "Failed to unlock account")
+	}
+
+	return formResult(form, unlockTitle, 200, "Account unlocked")
+}
+
+// Splits an emailed "<user id>.<secret>" token
+func splitUserToken(token string) (userID, secret string, ok bool) {
+	userID, secret, ok = strings.Cut(token, ".")
+	return userID, secret, ok && userID != "" && secret != ""
+}
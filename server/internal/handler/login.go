@@ -3,18 +3,26 @@ package handler
 import (
 	"context"
 	"encoding/json"
+	"log/slog"
+	"time"
 
 	"github.com/SunPodder/shorty/internal/db"
 	"github.com/SunPodder/shorty/utils"
 	"github.com/aws/aws-lambda-go/events"
 )
 
+// FailedLoginResponseTime is the least time failed logins take to be
+// answered. Wrong passwords are recorded, which can lock the account and
+// email its owner, while unknown and locked accounts only check a dummy
+// hash, so answering right away would tell which accounts exist.
+var FailedLoginResponseTime = time.Second
+
 type LoginRequest struct {
 	Email    string `json:"email"`
 	Password string `json:"password"`
 }
 
-func Login(context context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+func Login(context context.Context, request events.APIGatewayProxyRequest) (response events.APIGatewayProxyResponse, err error) {
 	// Parse the request body
 	var req LoginRequest
 	if err := json.Unmarshal([]byte(request.Body), &req); err != nil {
@@ -24,22 +32,84 @@ func Login(context context.Context, request events.APIGatewayProxyRequest) (even
 		}, nil
 	}
 
+	// Every failure gets the same response after the same time, so callers
+	// can't tell unknown accounts, wrong passwords and locked accounts apart
+	start := time.Now()
+	invalidCredentials := events.APIGatewayProxyResponse{
+		StatusCode: 401,
+		Body:       `{"error": "Invalid email or password"}`,
+	}
+	defer func() {
+		if response.StatusCode == invalidCredentials.StatusCode {
+			time.Sleep(time.Until(start.Add(FailedLoginResponseTime)))
+		}
+	}()
+
 	// Validate the user credentials
 	user, err := db.GetUserByEmail(context, req.Email)
 	if err != nil {
-		return events.APIGatewayProxyResponse{
-			StatusCode: 401,
-			Body:       `{"error": "Invalid email or password"}`,
-		}, nil
+		checkDummyPassword(req.Password)
+		return invalidCredentials, nil
+	}
+
+	if user.LockedUntil > time.Now().Unix() {
+		checkDummyPassword(req.Password)
+		return invalidCredentials, nil
 	}
 
 	hashedPassword := user.Password
 
 	if !utils.CheckPasswordHash(req.Password, hashedPassword) {
-		return events.APIGatewayProxyResponse{
-			StatusCode: 401,
-			Body:       `{"error": "Invalid email or password"}`,
-		}, nil
+		recordFailedLogin(context, user)
+		recordLoginAudit(context, request, user, AuditLoginFailed, "password")
+		return invalidCredentials, nil
+	}
+
+	// Upgrade bcrypt hashes and hashes with outdated parameters now that
+	// the plain password is at hand
+	if utils.NeedsRehash(hashedPassword) {
+		if rehashed, err := utils.HashPassword(req.Password); err == nil {
+			if err := db.UpdatePassword(context, user.ID, rehashed); err != nil {
+				slog.ErrorContext(context, "rehash password", "target_user_id", user.ID, "error", err)
+			}
+		}
+	}
+
+	// The password alone isn't enough with two-factor authentication on
+	if user.TOTPEnabled {
+		return mfaChallenge(context, user)
+	}
+
+	return completeLogin(context, request, user, "password")
+}
+
+// Returns the response refusing to log in a disabled account
+func accountDisabled() events.APIGatewayProxyResponse {
+	return events.APIGatewayProxyResponse{
+		StatusCode: 403,
+		Body:       `{"error": "This account has been disabled"}`,
+	}
+}
+
+// Writes a login attempt of user with the given method to the audit log
+func recordLoginAudit(ctx context.Context, request events.APIGatewayProxyRequest, user *db.User, action, method string) {
+	entry := auditEntry(ctx, request, user.ID, action, AuditTargetUser, user.ID)
+	entry.Details = map[string]string{"method": method}
+	recordAudit(ctx, entry)
+}
+
+// Issues a session to a user who passed every login step with method and
+// clears the failed login counter
+func completeLogin(ctx context.Context, request events.APIGatewayProxyRequest, user *db.User, method string) (events.APIGatewayProxyResponse, error) {
+	// Only told to whoever knows the password
+	if user.Disabled() {
+		return accountDisabled(), nil
+	}
+
+	if user.FailedLogins > 0 || user.LockedUntil != 0 {
+		if err := db.UnlockUser(ctx, user.ID); err != nil {
+			slog.ErrorContext(ctx, "reset failed logins", "target_user_id", user.ID, "error", err)
+		}
 	}
 
 	// Generate JWT token
@@ -51,6 +121,7 @@ func Login(context context.Context, request events.APIGatewayProxyRequest) (even
 		}, nil
 	}
 
+	recordLoginAudit(ctx, request, user, AuditLogin, method)
 	return events.APIGatewayProxyResponse{
 		StatusCode: 200,
 		Headers: map[string]string{
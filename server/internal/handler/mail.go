@@ -0,0 +1,107 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/SunPodder/shorty/internal/db"
+	"github.com/SunPodder/shorty/internal/mail"
+	"github.com/google/uuid"
+)
+
+// Mailer sends the emails of account related flows
+var Mailer mail.Mailer = mail.NewLogMailer()
+
+// PublicURL is the base URL of the API used in links sent to users,
+// such as https://sho.rt. It can be overridden at startup.
+var PublicURL = ""
+
+// Returns the public link to path with the given query parameters
+func publicLink(path string, query url.Values) string {
+	return strings.TrimSuffix(PublicURL, "/") + path + "?" + query.Encode()
+}
+
+// Describes how long a link stays valid in an email, like "48 hours"
+func describeTTL(ttl time.Duration) string {
+	switch {
+	case ttl == time.Hour:
+		return "an hour"
+	case ttl%time.Hour == 0:
+		return fmt.Sprintf("%d hours", ttl/time.Hour)
+	case ttl <= time.Minute:
+		return "a minute"
+	}
+	return fmt.Sprintf("%d minutes", ttl/time.Minute)
+}
+
+const (
+	// Queued emails still failing after this many attempts are dropped
+	maxMailAttempts = 5
+	// Time left to a run of the mail worker when it stops sending
+	mailDeadlineMargin = 30 * time.Second
+)
+
+// Adds msg to the outbox for the mail worker to send, so the request
+// doesn't wait for the mail server. It is dropped if still unsent after
+// ttl, such as when the link it carries expired.
+func queueMail(ctx context.Context, msg mail.Message, ttl time.Duration) error {
+	now := time.Now()
+	return db.PutQueuedMail(ctx, db.QueuedMail{
+		ID:        uuid.NewString(),
+		To:        msg.To,
+		Subject:   msg.Subject,
+		Body:      msg.Body,
+		CreatedAt: now.Format(time.RFC3339),
+		ExpiresAt: now.Add(ttl).Unix(),
+	})
+}
+
+// SendQueuedMail sends the emails waiting in the outbox with Mailer.
+// Emails that fail are retried by the next run, until they run out of
+// attempts or expire.
+func SendQueuedMail(ctx context.Context) error {
+	var sent, failed int
+	err := db.ForEachQueuedMail(ctx, func(mails []db.QueuedMail) error {
+		for i := range mails {
+			if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < mailDeadlineMargin {
+				return nil
+			}
+			queued := &mails[i]
+			if queued.ExpiresAt <= time.Now().Unix() {
+				if err := db.DeleteQueuedMail(ctx, queued.ID); err != nil {
+					return err
+				}
+				continue
+			}
+
+			err := Mailer.Send(ctx, mail.Message{To: queued.To, Subject: queued.Subject, Body: queued.Body})
+			if err == nil {
+				sent++
+				if err := db.DeleteQueuedMail(ctx, queued.ID); err != nil {
+					return err
+				}
+				continue
+			}
+
+			failed++
+			queued.Attempts++
+			if queued.Attempts >= maxMailAttempts {
+				slog.ErrorContext(ctx, "drop queued mail", "mail_id", queued.ID, "subject", queued.Subject, "error", err)
+				err = db.DeleteQueuedMail(ctx, queued.ID)
+			} else {
+				slog.WarnContext(ctx, "send queued mail", "mail_id", queued.ID, "attempts", queued.Attempts, "error", err)
+				err = db.PutQueuedMail(ctx, *queued)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	slog.InfoContext(ctx, "queued mail sent", "sent", sent, "failed", failed)
+	return err
+}
@@ -3,58 +3,21 @@ package handler
 import (
 	"context"
 	"encoding/json"
-	"log"
-	"strings"
 
 	"github.com/SunPodder/shorty/internal/db"
-	"github.com/SunPodder/shorty/utils" // Added utils package
 	"github.com/aws/aws-lambda-go/events"
 )
 
-// Returns the list of URLs for the authenticated user
-// throws an error if the user is not authenticated
+// Returns the URLs of the authenticated user and of the workspaces they
+// belong to, grouped by domain
+// Expects the request to be authenticated by middleware.WithAuth
 func Me(context context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
-	authHeader, ok := request.Headers["Authorization"]
+	principal, resp, ok := requirePrincipal(context, db.ScopeLinksRead)
 	if !ok {
-		authHeader, ok = request.Headers["authorization"]
+		return resp, nil
 	}
 
-	if !ok {
-		log.Println("Authorization header not found")
-		return events.APIGatewayProxyResponse{
-			StatusCode: 401,
-			Body:       `{"error": "Authorization header missing"}`,
-		}, nil
-	}
-
-	if !strings.HasPrefix(authHeader, "Bearer ") {
-		log.Println("Invalid Authorization header format")
-		return events.APIGatewayProxyResponse{
-			StatusCode: 401,
-			Body:       `{"error": "Invalid Authorization header format"}`,
-		}, nil
-	}
-
-	tokenString := strings.TrimPrefix(authHeader, "Bearer ")
-
-	userIDString, err := utils.ValidateJWT(tokenString)
-	if err != nil {
-		log.Printf("Failed to validate JWT: %v", err)
-		return events.APIGatewayProxyResponse{
-			StatusCode: 401,
-			Body:       `{"error": "Invalid or expired token"}`,
-		}, nil
-	}
-
-	if userIDString == "" {
-		log.Println("User ID from JWT is empty")
-		return events.APIGatewayProxyResponse{
-			StatusCode: 401,
-			Body:       `{"error": "User ID not found in token"}`,
-		}, nil
-	}
-
-	urls, err := db.ListUserURLs(context, userIDString)
+	urls, err := listAccessibleURLs(context, principal.UserID)
 	if err != nil {
 		return events.APIGatewayProxyResponse{
 			StatusCode: 500,
@@ -62,7 +25,12 @@ func Me(context context.Context, request events.APIGatewayProxyRequest) (events.
 		}, nil
 	}
 
-	responseBody, err := json.Marshal(urls)
+	grouped := make(map[string][]db.URL)
+	for _, url := range urls {
+		grouped[url.Domain] = append(grouped[url.Domain], url)
+	}
+
+	responseBody, err := json.Marshal(grouped)
 	if err != nil {
 		return events.APIGatewayProxyResponse{
 			StatusCode: 500,
@@ -74,3 +42,35 @@ func Me(context context.Context, request events.APIGatewayProxyRequest) (events.
 		Body:       string(responseBody),
 	}, nil
 }
+
+// Collects the URLs a user created outside of workspaces along with those
+// of every workspace they currently belong to. Links they created in
+// workspaces they have left stay with the workspace.
+func listAccessibleURLs(ctx context.Context, userID string) ([]db.URL, error) {
+	created, err := db.ListUserURLs(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	memberships, err := db.ListUserMemberships(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	var urls []db.URL
+	for _, url := range created {
+		if url.WorkspaceID == nil {
+			urls = append(urls, url)
+		}
+	}
+
+	for _, membership := range memberships {
+		workspaceURLs, err := db.ListWorkspaceURLs(ctx, membership.WorkspaceID)
+		if err != nil {
+			return nil, err
+		}
+		urls = append(urls, workspaceURLs...)
+	}
+
+	return urls, nil
+}
@@ -0,0 +1,107 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/base64"
+	"html/template"
+	"mime"
+	"net/url"
+
+	"github.com/SunPodder/shorty/utils"
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// Emailed links open a page whose form submits the token by POST, so
+// fetching a link, as mail scanners do, changes nothing.
+var formPageTemplate = template.Must(template.New("form").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<meta name="robots" content="noindex">
+<title>{{.Title}}</title>
+</head>
+<body>
+<h1>{{.Title}}</h1>
+<p>{{.Message}}</p>
+{{- if .Token}}
+<form method="post">
+<input type="hidden" name="token" value="{{.Token}}">
+{{- if .Password}}
+<p><label>New password <input type="password" name="password" autocomplete="new-password" required></label></p>
+{{- end}}
+<button type="submit">{{.Submit}}</button>
+</form>
+{{- end}}
+</body>
+</html>
+`))
+
+// formPage is a page of an emailed link. Without a token it only shows
+// its message.
+type formPage struct {
+	Title   string
+	Message string
+	Token   string
+	Submit  string
+	// Asks for a new password along with the token
+	Password bool
+}
+
+// Renders page with the given status
+func renderPage(status int, page formPage) (events.APIGatewayProxyResponse, error) {
+	var buf bytes.Buffer
+	if err := formPageTemplate.Execute(&buf, page); err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 500,
+			Body:       `{"error": "` + err.Error() + `"}`,
+		}, nil
+	}
+	return events.APIGatewayProxyResponse{
+		StatusCode: status,
+		Headers: map[string]string{
+			"Content-Type":  "text/html; charset=utf-8",
+			"Cache-Control": "no-store",
+			// The page URL carries the token
+			"Referrer-Policy": "no-referrer",
+		},
+		Body: buf.String(),
+	}, nil
+}
+
+// Reports whether the request was submitted by the form of a page
+func isFormPost(request events.APIGatewayProxyRequest) bool {
+	contentType, _ := utils.GetHeader(request.Headers, "Content-Type")
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	return request.HTTPMethod == "POST" && mediaType == "application/x-www-form-urlencoded"
+}
+
+// Parses the body of a form post
+func parseForm(request events.APIGatewayProxyRequest) (url.Values, error) {
+	body := request.Body
+	if request.IsBase64Encoded {
+		decoded, err := base64.StdEncoding.DecodeString(body)
+		if err != nil {
+			return nil, err
+		}
+		body = string(decoded)
+	}
+	return url.ParseQuery(body)
+}
+
+// Answers a form post with a page showing message, and API clients with
+// message as JSON
+func formResult(form bool, title string, status int, message string) (events.APIGatewayProxyResponse, error) {
+	if form {
+		return renderPage(status, formPage{Title: title, Message: message})
+	}
+	key := "message"
+	if status >= 400 {
+		key = "error"
+	}
+	return events.APIGatewayProxyResponse{
+		StatusCode: status,
+		Headers:    map[string]string{"Content-Type": "application/json"},
+		Body:       `{"` + key + `": "` + message + `"}`,
+	}, nil
+}
@@ -0,0 +1,197 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/url"
+	"time"
+
+	"github.com/SunPodder/shorty/internal/db"
+	"github.com/SunPodder/shorty/internal/mail"
+	"github.com/SunPodder/shorty/utils"
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// PasswordResetTTL is how long a password reset link stays valid. It can
+// be overridden at startup.
+var PasswordResetTTL = time.Hour
+
+// ForgotPasswordResponseTime is the least time ForgotPassword takes to
+// answer. Only real accounts get a reset token stored and emailed, so
+// answering right away would tell which addresses have an account.
+var ForgotPasswordResponseTime = 2 * time.Second
+
+// PasswordPolicy applies to every password users choose. It can be
+// overridden at startup.
+var PasswordPolicy = utils.DefaultPasswordPolicy
+
+type ForgotPasswordRequest struct {
+	Email string `json:"email"`
+}
+
+type ResetPasswordRequest struct {
+	Token    string `json:"token"`
+	Password string `json:"password"`
+}
+
+// ForgotPassword queues an email with a password reset link to the given
+// address. The response is the same whether or not an account uses the
+// address.
+func ForgotPassword(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	var req ForgotPasswordRequest
+	if err := json.Unmarshal([]byte(request.Body), &req); err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 400,
+			Body:       `{"error": "Invalid request body"}`,
+		}, nil
+	}
+
+	accepted := events.APIGatewayProxyResponse{
+		StatusCode: 202,
+		Headers:    map[string]string{"Content-Type": "application/json"},
+		Body:       `{"message": "If an account uses this email, a reset link has been sent to it"}`,
+	}
+	start := time.Now()
+	defer func() { time.Sleep(time.Until(start.Add(ForgotPasswordResponseTime))) }()
+
+	email, err := utils.ValidateEmail(req.Email)
+	if err != nil {
+		return accepted, nil
+	}
+
+	user, err := db.GetUserByEmail(ctx, email)
+	if err != nil {
+		if err != db.ErrUserNotFound {
+			slog.ErrorContext(ctx, "get user for password reset", "error", err)
+		}
+		return accepted, nil
+	}
+
+	if err := sendPasswordReset(ctx, user); err != nil {
+		slog.ErrorContext(ctx, "send password reset", "target_user_id", user.ID, "error", err)
+	}
+	return accepted, nil
+}
+
+// Issues a password reset token for user, replacing any pending one,
+// and emails it to them
+func sendPasswordReset(ctx context.Context, user *db.User) error {
+	secret, err := utils.RandomToken(32)
+	if err != nil {
+		return err
+	}
+
+	expires := time.Now().Add(PasswordResetTTL).Unix()
+	if err := db.SetPasswordReset(ctx, user.ID, utils.HashToken(secret), expires); err != nil {
+		return err
+	}
+
+	// The link opens a page that posts the new password along with the token.
+	// The email is sent by the mail worker, the mail server could take
+	// longer to answer than the response time hides.
+	link := publicLink("/password/reset", url.Values{"token": {user.ID + "." + secret}})
+	return queueMail(ctx, mail.Message{
+		To:      user.Email,
+		Subject: "Reset your Shorty password",
+		Body: "Someone asked to reset the password of your Shorty account.\n\n" +
+			"If this was you, open the link below to choose a new password. It expires in " + describeTTL(PasswordResetTTL) + "\n" +
+			"and can only be used once. Otherwise you can safely ignore this email.\n\n" +
+			link + "\n",
+	}, PasswordResetTTL)
+}
+
+const resetPasswordTitle = "Reset your password"
+
+// ResetPassword sets a new password with a token from ForgotPassword,
+// logs out every existing session of the user and revokes their API
+// keys. The emailed link opens a page posting the new password.
+func ResetPassword(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	if request.HTTPMethod == "GET" {
+		return resetPasswordPage(request)
+	}
+
+	form := isFormPost(request)
+	var req ResetPasswordRequest
+	if form {
+		values, err := parseForm(request)
+		if err != nil {
+			return formResult(form, resetPasswordTitle, 400, "Invalid request body")
+		}
+		req.Token, req.Password = values.Get("token"), values.Get("password")
+	} else if err := json.Unmarshal([]byte(request.Body), &req); err != nil {
+		return formResult(form, resetPasswordTitle, 400, "Invalid request body")
+	}
+
+	invalid := "Invalid or expired reset token"
+	userID, secret, ok := splitUserToken(req.Token)
+	if !ok {
+		return formResult(form, resetPasswordTitle, 400, invalid)
+	}
+
+	if err := PasswordPolicy.Check(req.Password); err != nil {
+		if form {
+			// Lets the user pick another password
+			return renderPage(400, resetPasswordForm(req.Token, err.Error()))
+		}
+		return formResult(form, resetPasswordTitle, 400, err.Error())
+	}
+
+	hashedPassword, err := utils.HashPassword(req.Password)
+	if err != nil {
+		return formResult(form, resetPasswordTitle, 500, "Failed to hash password")
+	}
+
+	err = db.ResetPassword(ctx, userID, utils.HashToken(secret), hashedPassword, time.Now().Unix())
+	if err == db.ErrInvalidResetToken {
+		return formResult(form, resetPasswordTitle, 400, invalid)
+	}
+	if err != nil {
+		return formResult(form, resetPasswordTitle, 500, "Failed to reset password")
+	}
+	recordAudit(ctx, auditEntry(ctx, request, userID, AuditPasswordReset, AuditTargetUser, userID))
+
+	// Whoever knew the old password may have created keys with it
+	if err := revokeAPIKeys(ctx, userID); err != nil {
+		slog.ErrorContext(ctx, "revoke API keys after password reset", "target_user_id", userID, "error", err)
+		return formResult(form, resetPasswordTitle, 500, "Password reset, but revoking your API keys failed. Please revoke them from your account")
+	}
+
+	return formResult(form, resetPasswordTitle, 200, "Password reset, please log in again")
+}
+
+// Shows the page of an emailed password reset link
+func resetPasswordPage(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	token := request.QueryStringParameters["token"]
+	if _, _, ok := splitUserToken(token); !ok {
+		return renderPage(400, formPage{Title: resetPasswordTitle, Message: "This reset link is invalid or has expired."})
+	}
+	return renderPage(200, resetPasswordForm(token, "Choose a new password for your Shorty account."))
+}
+
+func resetPasswordForm(token, message string) formPage {
+	return formPage{
+		Title:    resetPasswordTitle,
+		Message:  message,
+		Token:    token,
+		Submit:   "Reset password",
+		Password: true,
+	}
+}
+
+// Revokes every active API key of a user
+func revokeAPIKeys(ctx context.Context, userID string) error {
+	keys, err := db.ListUserAPIKeys(ctx, userID)
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if !key.Active() {
+			continue
+		}
+		if err := db.RevokeAPIKey(ctx, userID, key.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,44 @@
+package handler
+
+import (
+	"context"
+
+	"github.com/SunPodder/shorty/internal/db"
+)
+
+// Rank of each workspace role, higher ranks include the lower ones
+var roleRank = map[string]int{
+	db.RoleViewer: 1,
+	db.RoleEditor: 2,
+	db.RoleOwner:  3,
+}
+
+// Reports whether role grants at least the permissions of min
+func roleAtLeast(role, min string) bool {
+	return roleRank[role] >= roleRank[min]
+}
+
+// Returns the role of a user in a workspace, or "" if they aren't a member
+func workspaceRole(ctx context.Context, workspaceID, userID string) (string, error) {
+	member, err := db.GetWorkspaceMember(ctx, workspaceID, userID)
+	if err == db.ErrMemberNotFound {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return member.Role, nil
+}
+
+// Returns the role of a user on a link, or "" if they have none.
+// Links in a workspace are governed by the workspace roles, personal
+// links only by their creator who is treated as their owner.
+func linkRole(ctx context.Context, userID string, url *db.URL) (string, error) {
+	if url.WorkspaceID != nil {
+		return workspaceRole(ctx, *url.WorkspaceID, userID)
+	}
+	if url.UserID != nil && *url.UserID == userID {
+		return db.RoleOwner, nil
+	}
+	return "", nil
+}
@@ -0,0 +1,192 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"html/template"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/SunPodder/shorty/internal/db"
+	"github.com/SunPodder/shorty/utils"
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// Suffix appended to a short code to preview it instead of following it
+const previewSuffix = "+"
+
+type PreviewResponse struct {
+	ShortCode   string  `json:"short_code"`
+	Destination string  `json:"destination"`
+	Title       *string `json:"title,omitempty"`
+	CreatedAt   string  `json:"created_at"`
+	Owner       *string `json:"owner,omitempty"`
+	Expired     bool    `json:"expired"`
+	ViewOnce    bool    `json:"view_once"`
+	// Screening state of the destination, see the Safety constants
+	Safety string `json:"safety"`
+	// When the destination was last screened
+	ScreenedAt *string `json:"screened_at,omitempty"`
+	// The destination isn't served over https
+	Insecure bool `json:"insecure"`
+}
+
+// Screening states of a previewed destination
+const (
+	// Screened when the link was created or edited, or by a rescan since
+	SafetyScreened = "screened"
+	// Restored by an admin after being flagged
+	SafetyReviewed = "reviewed"
+	// No screening was configured since the destination was set
+	SafetyUnscreened = "unscreened"
+)
+
+// Shows where a short link goes without following it.
+// Previewing never counts as a click and never consumes view-once links.
+func Preview(context context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	shortCode := strings.TrimSuffix(request.PathParameters["short_code"], previewSuffix)
+
+	domain, err := namespaceFor(context, request)
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 500,
+			Body:       `{"error": "` + err.Error() + `"}`,
+		}, nil
+	}
+
+	url, err := db.GetURL(context, domain, shortCode)
+	if err != nil && err != db.ErrURLNotFound {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 500,
+			Body:       `{"error": "` + err.Error() + `"}`,
+		}, nil
+	}
+
+	if url == nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 404,
+			Body:       "URL not found",
+		}, nil
+	}
+
+	// The destination of a link taken down is not shown either
+	if url.TakenDown() {
+		return takedownResponse(url)
+	}
+
+	preview := PreviewResponse{
+		ShortCode:   url.ShortCode,
+		Destination: url.OriginalURL,
+		Title:       url.Title,
+		CreatedAt:   url.CreatedAt,
+		Expired:     url.ExpiryDate != nil && *url.ExpiryDate <= time.Now().Unix(),
+		ViewOnce:    url.ViewOnce != nil && *url.ViewOnce,
+		Insecure:    strings.HasPrefix(url.OriginalURL, "http://"),
+	}
+	preview.Safety, preview.ScreenedAt = screeningStatus(context, url)
+
+	// The owner is only shown when they opted in on the link
+	if url.ShowOwner != nil && *url.ShowOwner && url.UserID != nil {
+		owner, err := db.GetUser(context, *url.UserID)
+		if err == nil && owner.DisplayName != "" {
+			preview.Owner = &owner.DisplayName
+		}
+	}
+
+	if wantsJSON(request) {
+		responseBody, err := json.Marshal(preview)
+		if err != nil {
+			return events.APIGatewayProxyResponse{
+				StatusCode: 500,
+				Body:       `{"error": "` + err.Error() + `"}`,
+			}, nil
+		}
+		return events.APIGatewayProxyResponse{
+			StatusCode: 200,
+			Headers: map[string]string{
+				"Content-Type":  "application/json",
+				"Cache-Control": "no-store",
+			},
+			Body: string(responseBody),
+		}, nil
+	}
+
+	var buf bytes.Buffer
+	if err := previewTemplate.Execute(&buf, preview); err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 500,
+			Body:       `{"error": "` + err.Error() + `"}`,
+		}, nil
+	}
+	return events.APIGatewayProxyResponse{
+		StatusCode: 200,
+		Headers: map[string]string{
+			"Content-Type":  "text/html; charset=utf-8",
+			"Cache-Control": "no-store",
+		},
+		Body: buf.String(),
+	}, nil
+}
+
+// Returns the screening state of the destination of url and when it was
+// last screened. A complete rescan that started after the destination
+// was set screened it again.
+func screeningStatus(ctx context.Context, url *db.URL) (string, *string) {
+	if url.ScreeningReviewed() {
+		return SafetyReviewed, nil
+	}
+
+	setAt := url.CreatedAt
+	if url.ScreenedAt != nil {
+		setAt = *url.ScreenedAt
+	}
+	job, err := db.GetJob(ctx, rescanJob)
+	if err != nil {
+		slog.WarnContext(ctx, "get rescan job", "error", err)
+	} else if set, err := time.Parse(time.RFC3339, setAt); err == nil && job.CompletedAt != 0 &&
+		!set.After(time.Unix(job.CompletedPassStartedAt, 0)) {
+		rescannedAt := time.Unix(job.CompletedAt, 0).Format(time.RFC3339)
+		return SafetyScreened, &rescannedAt
+	}
+
+	if url.ScreenedAt != nil {
+		return SafetyScreened, url.ScreenedAt
+	}
+	return SafetyUnscreened, nil
+}
+
+// Reports whether the client asked for a JSON preview, either through
+// ?format=json or an Accept header preferring application/json
+func wantsJSON(request events.APIGatewayProxyRequest) bool {
+	if request.QueryStringParameters["format"] == "json" {
+		return true
+	}
+	accept, _ := utils.GetHeader(request.Headers, "Accept")
+	return strings.Contains(accept, "application/json")
+}
+
+var previewTemplate = template.Must(template.New("preview").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<meta name="robots" content="noindex">
+<title>Preview of {{.ShortCode}}</title>
+</head>
+<body>
+<h1>{{if .Title}}{{.Title}}{{else}}{{.ShortCode}}{{end}}</h1>
+<p>This short link goes to:</p>
+<p><a href="{{.Destination}}" rel="noopener noreferrer">{{.Destination}}</a></p>
+<ul>
+<li>Created: {{.CreatedAt}}</li>
+{{if .Owner}}<li>Owner: {{.Owner}}</li>{{end}}
+<li>Safety: {{.Safety}}{{if .ScreenedAt}} on {{.ScreenedAt}}{{end}}</li>
+{{if .Insecure}}<li>The destination isn't served over https.</li>{{end}}
+{{if .Expired}}<li>This link has expired.</li>{{end}}
+{{if .ViewOnce}}<li>This link can only be opened once.</li>{{end}}
+</ul>
+</body>
+</html>
+`))
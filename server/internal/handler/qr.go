@@ -0,0 +1,199 @@
+package handler
+
+import (
+	"context"
+	"encoding/base64"
+	"image"
+	"image/color"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/SunPodder/shorty/internal/db"
+	"github.com/SunPodder/shorty/internal/qr"
+	"github.com/SunPodder/shorty/utils"
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/skip2/go-qrcode"
+)
+
+// Query parameter marking clicks that came from scanning a QR code.
+// It is stripped before query strings are forwarded to the destination.
+const (
+	qrSourceParam = "src"
+	qrSource      = "qr"
+)
+
+const (
+	defaultQRSize   = 256
+	minQRSize       = 64
+	maxQRSize       = 2048
+	defaultQRMargin = 4
+	maxQRMargin     = 16
+)
+
+// QRLogo is drawn over the centre of codes requested with ?logo=true.
+// It can be set at startup.
+var QRLogo image.Image
+
+// Returns the short URL of url, served on the custom domain it belongs
+// to or on PublicURL for the default domain
+func shortURLFor(request events.APIGatewayProxyRequest, url *db.URL) string {
+	if url.Domain != "" && url.Domain != db.DefaultDomain {
+		return "https://" + url.Domain + "/" + url.ShortCode
+	}
+	if PublicURL != "" {
+		return strings.TrimSuffix(PublicURL, "/") + "/" + url.ShortCode
+	}
+	host, _ := utils.GetHeader(request.Headers, "Host")
+	return "https://" + host + "/" + url.ShortCode
+}
+
+// Parses the rendering options of a QR code from the query string
+func qrOptions(query map[string]string) (qr.Options, string, bool) {
+	opts := qr.Options{
+		Size:       defaultQRSize,
+		Level:      qrcode.Medium,
+		Margin:     defaultQRMargin,
+		Foreground: color.RGBA{A: 0xff},
+		Background: color.RGBA{R: 0xff, G: 0xff, B: 0xff, A: 0xff},
+	}
+
+	if value := query["size"]; value != "" {
+		size, err := strconv.Atoi(value)
+		if err != nil || size < minQRSize || size > maxQRSize {
+			return opts, "size must be between " + strconv.Itoa(minQRSize) + " and " + strconv.Itoa(maxQRSize), false
+		}
+		opts.Size = size
+	}
+
+	if value := query["ecc"]; value != "" {
+		level, ok := qr.ParseLevel(value)
+		if !ok {
+			return opts, "ecc must be one of L, M, Q or H", false
+		}
+		opts.Level = level
+	}
+
+	if value := query["margin"]; value != "" {
+		margin, err := strconv.Atoi(value)
+		if err != nil || margin < 0 || margin > maxQRMargin {
+			return opts, "margin must be between 0 and " + strconv.Itoa(maxQRMargin), false
+		}
+		opts.Margin = margin
+	}
+
+	for name, target := range map[string]*color.RGBA{"fg": &opts.Foreground, "bg": &opts.Background} {
+		if value := query[name]; value != "" {
+			c, err := qr.ParseColor(value)
+			if err != nil {
+				return opts, name + " must be a hex color such as 000000", false
+			}
+			*target = c
+		}
+	}
+
+	if value := query["logo"]; value != "" {
+		logo, err := strconv.ParseBool(value)
+		if err != nil {
+			return opts, "logo must be true or false", false
+		}
+		if logo {
+			if QRLogo == nil {
+				return opts, "No logo is configured", false
+			}
+			opts.Logo = QRLogo
+		}
+	}
+
+	return opts, "", true
+}
+
+// Renders a QR code of a short link as PNG or SVG. Scanning the code
+// opens the short link with ?src=qr so the click is counted as a scan.
+func QR(context context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	shortCode := request.PathParameters["short_code"]
+
+	format := request.QueryStringParameters["format"]
+	if format == "" {
+		format = "png"
+	}
+	if format != "png" && format != "svg" {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 400,
+			Body:       `{"error": "format must be png or svg"}`,
+		}, nil
+	}
+
+	opts, message, ok := qrOptions(request.QueryStringParameters)
+	if !ok {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 400,
+			Body:       `{"error": "` + message + `"}`,
+		}, nil
+	}
+
+	domain, err := namespaceFor(context, request)
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 500,
+			Body:       `{"error": "` + err.Error() + `"}`,
+		}, nil
+	}
+
+	link, err := db.GetURL(context, domain, shortCode)
+	if err != nil && err != db.ErrURLNotFound {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 500,
+			Body:       `{"error": "` + err.Error() + `"}`,
+		}, nil
+	}
+	if link == nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 404,
+			Body:       `{"error": "URL not found"}`,
+		}, nil
+	}
+	if link.TakenDown() {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 410,
+			Body:       `{"error": "This link has been taken down"}`,
+		}, nil
+	}
+
+	content := shortURLFor(request, link) + "?" + url.Values{qrSourceParam: {qrSource}}.Encode()
+
+	if format == "svg" {
+		svg, err := qr.SVG(content, opts)
+		if err != nil {
+			return events.APIGatewayProxyResponse{
+				StatusCode: 500,
+				Body:       `{"error": "` + err.Error() + `"}`,
+			}, nil
+		}
+		return events.APIGatewayProxyResponse{
+			StatusCode: 200,
+			Headers: map[string]string{
+				"Content-Type":  "image/svg+xml",
+				"Cache-Control": "public, max-age=" + permanentRedirectMaxAge,
+			},
+			Body: string(svg),
+		}, nil
+	}
+
+	png, err := qr.PNG(content, opts)
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 500,
+			Body:       `{"error": "` + err.Error() + `"}`,
+		}, nil
+	}
+	return events.APIGatewayProxyResponse{
+		StatusCode: 200,
+		Headers: map[string]string{
+			"Content-Type":  "image/png",
+			"Cache-Control": "public, max-age=" + permanentRedirectMaxAge,
+		},
+		Body:            base64.StdEncoding.EncodeToString(png),
+		IsBase64Encoded: true,
+	}, nil
+}
@@ -0,0 +1,139 @@
+package handler
+
+import (
+	"bytes"
+	"html/template"
+
+	"github.com/SunPodder/shorty/internal/db"
+	"github.com/aws/aws-lambda-go/events"
+)
+
+const (
+	defaultInterstitialDelay = 5
+	maxInterstitialDelay     = 30
+
+	// How long browsers may cache a permanent redirect. Links can be edited,
+	// so permanent redirects are never cached indefinitely.
+	permanentRedirectMaxAge = "3600"
+)
+
+// DefaultRedirectStatus is used for links that don't set their own
+// redirect status. It can be overridden at startup.
+var DefaultRedirectStatus = 302
+
+// ValidRedirectStatus reports whether status is a supported redirect code
+func ValidRedirectStatus(status int) bool {
+	switch status {
+	case 301, 302, 307, 308:
+		return true
+	}
+	return false
+}
+
+// Returns the redirect status to use for the given URL
+func redirectStatusFor(url *db.URL) int {
+	if url.RedirectStatus != nil && ValidRedirectStatus(*url.RedirectStatus) {
+		return *url.RedirectStatus
+	}
+	return DefaultRedirectStatus
+}
+
+// Returns the Cache-Control header for a redirect of the given status.
+// Temporary redirects are never cached so every click reaches us, and
+// permanent ones are only cached for a bounded time unless the link can
+// still change state through expiry or view-once.
+func cacheControlFor(url *db.URL, status int) string {
+	if status != 301 && status != 308 {
+		return "no-store"
+	}
+	if url.ExpiryDate != nil || (url.ViewOnce != nil && *url.ViewOnce) {
+		return "no-store"
+	}
+	return "public, max-age=" + permanentRedirectMaxAge
+}
+
+// Returns the number of seconds the interstitial page waits before continuing
+func interstitialDelayFor(url *db.URL) int {
+	if url.InterstitialDelay == nil {
+		return defaultInterstitialDelay
+	}
+	return *url.InterstitialDelay
+}
+
+var interstitialTemplate = template.Must(template.New("interstitial").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<meta name="robots" content="noindex">
+<meta http-equiv="refresh" content="{{.Delay}};url={{.Destination}}">
+<title>Redirecting...</title>
+</head>
+<body>
+<p>You are being redirected to:</p>
+<p><a href="{{.Destination}}" rel="noopener noreferrer">{{.Destination}}</a></p>
+<p>Continuing in <span id="countdown">{{.Delay}}</span> seconds.</p>
+<script>
+(function () {
+	var remaining = {{.Delay}};
+	var el = document.getElementById("countdown");
+	var timer = setInterval(function () {
+		remaining -= 1;
+		if (remaining <= 0) {
+			clearInterval(timer);
+			return;
+		}
+		el.textContent = remaining;
+	}, 1000);
+})();
+</script>
+</body>
+</html>
+`))
+
+// Renders the interstitial page that previews the destination before redirecting
+func renderInterstitial(destination string, delay int) (string, error) {
+	var buf bytes.Buffer
+	err := interstitialTemplate.Execute(&buf, struct {
+		Destination string
+		Delay       int
+	}{destination, delay})
+	if err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+var takedownTemplate = template.Must(template.New("takedown").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<meta name="robots" content="noindex">
+<title>Link unavailable</title>
+</head>
+<body>
+<p>This link has been taken down.</p>
+<p>Reason: {{.}}</p>
+</body>
+</html>
+`))
+
+// Returns the page shown instead of redirecting for a link taken down
+func takedownResponse(url *db.URL) (events.APIGatewayProxyResponse, error) {
+	var buf bytes.Buffer
+	if err := takedownTemplate.Execute(&buf, *url.TakedownReason); err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 500,
+			Body:       `{"error": "` + err.Error() + `"}`,
+		}, nil
+	}
+	return events.APIGatewayProxyResponse{
+		StatusCode: 410,
+		Headers: map[string]string{
+			"Content-Type":  "text/html; charset=utf-8",
+			"Cache-Control": "no-store",
+		},
+		Body: buf.String(),
+	}, nil
+}
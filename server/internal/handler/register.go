@@ -3,6 +3,7 @@ package handler
 import (
 	"context"
 	"encoding/json"
+	"log/slog"
 	"time"
 
 	"github.com/SunPodder/shorty/internal/db"
@@ -11,12 +12,23 @@ import (
 	"github.com/google/uuid"
 )
 
+// RegistrationEnabled lets anyone create an account, by registering or
+// through single sign-on. It can be overridden at startup.
+var RegistrationEnabled = true
+
 type RegisterRequest struct {
 	Email    string `json:"email"`
 	Password string `json:"password"`
 }
 
 func Register(context context.Context, event events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	if !RegistrationEnabled {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 403,
+			Body:       `{"error": "Registration is disabled"}`,
+		}, nil
+	}
+
 	var request RegisterRequest
 	if err := json.Unmarshal([]byte(event.Body), &request); err != nil {
 		return events.APIGatewayProxyResponse{
@@ -25,6 +37,21 @@ func Register(context context.Context, event events.APIGatewayProxyRequest) (eve
 		}, nil
 	}
 
+	email, err := utils.ValidateEmail(request.Email)
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 400,
+			Body:       `{"error": "Invalid email address"}`,
+		}, nil
+	}
+
+	if err := PasswordPolicy.Check(request.Password); err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 400,
+			Body:       `{"error": "` + err.Error() + `"}`,
+		}, nil
+	}
+
 	hashedPassword, err := utils.HashPassword(request.Password)
 	if err != nil {
 		return events.APIGatewayProxyResponse{
@@ -35,7 +62,7 @@ func Register(context context.Context, event events.APIGatewayProxyRequest) (eve
 
 	user := db.User{
 		ID:        uuid.NewString(),
-		Email:     request.Email,
+		Email:     email,
 		Password:  hashedPassword,
 		CreatedAt: time.Now().Format(time.RFC3339),
 	}
@@ -53,6 +80,12 @@ func Register(context context.Context, event events.APIGatewayProxyRequest) (eve
 		}, nil
 	}
 
+	// The account works without verification, so a failed email can be
+	// fixed later and must not fail the registration
+	if err := sendVerificationEmail(context, &user); err != nil {
+		slog.ErrorContext(context, "send verification email", "target_user_id", user.ID, "error", err)
+	}
+
 	token, err := utils.GenerateJWT(user.ID)
 	if err != nil {
 		return events.APIGatewayProxyResponse{
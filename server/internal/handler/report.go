@@ -0,0 +1,360 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/SunPodder/shorty/internal/db"
+	"github.com/SunPodder/shorty/internal/mail"
+	"github.com/SunPodder/shorty/internal/middleware"
+	"github.com/SunPodder/shorty/utils"
+	"github.com/aws/aws-lambda-go/events"
+)
+
+const maxReportDetailsLength = 1000
+
+// Categories visitors can report links under
+var ReportCategories = []string{"phishing", "malware", "spam", "illegal", "other"}
+
+// ReportThreshold is the number of reports after which a link is taken
+// down until an admin reviews it. It can be overridden at startup.
+var ReportThreshold = 5
+
+// Takedown reason of links disabled by reports, which tells them apart
+// from links an admin took down
+const reportTakedownReason = "Disabled pending review after multiple abuse reports"
+
+// Resolutions of the reports of a link
+const (
+	ReportDismiss  = "dismiss"
+	ReportTakeDown = "takedown"
+)
+
+type ReportRequest struct {
+	Category string `json:"category"`
+	Details  string `json:"details,omitempty"`
+}
+
+type ResolveReportsRequest struct {
+	Resolution string `json:"resolution"`
+	// Shown on the link when it is taken down
+	Reason string `json:"reason,omitempty"`
+}
+
+type ReportsResponse struct {
+	Reports    []db.Report `json:"reports"`
+	NextCursor string      `json:"next_cursor,omitempty"`
+}
+
+func validReportCategory(category string) bool {
+	for _, c := range ReportCategories {
+		if c == category {
+			return true
+		}
+	}
+	return false
+}
+
+// ReportLink records a visitor's abuse report of a link. Every address
+// reports a link once, and repeated reports get the same response without
+// being counted again.
+func ReportLink(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	var req ReportRequest
+	if err := json.Unmarshal([]byte(request.Body), &req); err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 400,
+			Body:       `{"error": "Invalid request body"}`,
+		}, nil
+	}
+	if !validReportCategory(req.Category) {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 400,
+			Body:       `{"error": "category must be one of ` + strings.Join(ReportCategories, ", ") + `"}`,
+		}, nil
+	}
+	details := strings.TrimSpace(req.Details)
+	if utf8.RuneCountInString(details) > maxReportDetailsLength {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 400,
+			Body:       fmt.Sprintf(`{"error": "details must be at most %d characters"}`, maxReportDetailsLength),
+		}, nil
+	}
+
+	domain, err := namespaceFor(ctx, request)
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 500,
+			Body:       `{"error": "` + err.Error() + `"}`,
+		}, nil
+	}
+
+	url, err := db.GetURL(ctx, domain, request.PathParameters["short_code"])
+	if err != nil && err != db.ErrURLNotFound {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 500,
+			Body:       `{"error": "` + err.Error() + `"}`,
+		}, nil
+	}
+	if url == nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 404,
+			Body:       "URL not found",
+		}, nil
+	}
+
+	received := events.APIGatewayProxyResponse{
+		StatusCode: 202,
+		Headers:    map[string]string{"Content-Type": "application/json"},
+		Body:       `{"message": "Report received, thank you"}`,
+	}
+
+	linkID := auditLinkID(url)
+	reporter := utils.KeyedHash("reporter_ip", middleware.ClientIP(request))
+	err = db.CreateReport(ctx, db.Report{
+		ID:           linkID + "#" + reporter,
+		LinkID:       linkID,
+		Domain:       url.Domain,
+		ShortCode:    url.ShortCode,
+		ReporterHash: reporter,
+		Category:     req.Category,
+		Details:      details,
+		Status:       db.ReportStatusOpen,
+		CreatedAt:    time.Now().UTC().Format(time.RFC3339Nano),
+	})
+	if err == db.ErrDuplicateReport {
+		return received, nil
+	}
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 500,
+			Body:       `{"error": "Failed to save report"}`,
+		}, nil
+	}
+
+	count, err := db.AddURLReport(ctx, url.Domain, url.ShortCode)
+	if err != nil {
+		slog.ErrorContext(ctx, "count report", "link_id", linkID, "error", err)
+		return received, nil
+	}
+
+	// Only the report reaching the threshold takes the link down, so
+	// concurrent reports don't do it twice
+	if count == ReportThreshold && !url.TakenDown() {
+		disableReportedLink(ctx, url, count)
+	}
+
+	return received, nil
+}
+
+// Takes down a link that reached the report threshold and tells its
+// owner and the admins
+func disableReportedLink(ctx context.Context, url *db.URL, count int) {
+	linkID := auditLinkID(url)
+	err := db.TakeDownURL(ctx, url.Domain, url.ShortCode, reportTakedownReason, time.Now().Format(time.RFC3339))
+	if err != nil {
+		slog.ErrorContext(ctx, "take down reported link", "link_id", linkID, "error", err)
+		return
+	}
+
+	entry := systemAuditEntry(AuditLinkReportDisabled, AuditTargetLink, linkID)
+	entry.Details = map[string]string{"reports": fmt.Sprint(count)}
+	recordAudit(ctx, entry)
+
+	if url.UserID != nil {
+		owner, err := db.GetUser(ctx, *url.UserID)
+		if err != nil {
+			slog.ErrorContext(ctx, "notify owner of reported link", "link_id", linkID, "error", err)
+		} else if err := Mailer.Send(ctx, mail.Message{
+			To:      owner.Email,
+			Subject: "Your Shorty link was disabled after abuse reports",
+			Body: "Your link " + url.ShortCode + " to " + url.OriginalURL + " was reported as abusive " +
+				"by several visitors and has been disabled until we review it.\n\n" +
+				"If the reports are mistaken, it will be enabled again after the review.\n",
+		}); err != nil {
+			slog.ErrorContext(ctx, "notify owner of reported link", "link_id", linkID, "error", err)
+		}
+	}
+
+	admins, err := db.ListAdmins(ctx)
+	if err != nil {
+		slog.ErrorContext(ctx, "notify admins of reported link", "link_id", linkID, "error", err)
+		return
+	}
+	for _, admin := range admins {
+		err := Mailer.Send(ctx, mail.Message{
+			To:      admin.Email,
+			Subject: "Link " + linkID + " disabled after abuse reports",
+			Body: fmt.Sprintf("The link %s to %s received %d abuse reports and was disabled pending review.\n\n"+
+				"Review its reports with GET /admin/links/%s/reports?domain=%s\n",
+				linkID, url.OriginalURL, count, url.ShortCode, url.Domain),
+		})
+		if err != nil {
+			slog.ErrorContext(ctx, "notify admin of reported link", "target_user_id", admin.ID, "link_id", linkID, "error", err)
+		}
+	}
+}
+
+// Lists reports in ?status=, open ones by default, newest first
+func AdminListReports(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	if _, resp, ok := requireAdmin(ctx); !ok {
+		return resp, nil
+	}
+	limit, resp, ok := adminPageSize(request)
+	if !ok {
+		return resp, nil
+	}
+
+	status := request.QueryStringParameters["status"]
+	switch status {
+	case "":
+		status = db.ReportStatusOpen
+	case db.ReportStatusOpen, db.ReportStatusDismissed, db.ReportStatusActioned:
+	default:
+		return events.APIGatewayProxyResponse{
+			StatusCode: 400,
+			Body:       `{"error": "status must be open, dismissed or actioned"}`,
+		}, nil
+	}
+
+	reports, next, err := db.ListReports(ctx, status, limit, request.QueryStringParameters["cursor"])
+	if err == db.ErrInvalidCursor {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 400,
+			Body:       `{"error": "Invalid cursor"}`,
+		}, nil
+	}
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 500,
+			Body:       `{"error": "` + err.Error() + `"}`,
+		}, nil
+	}
+	if reports == nil {
+		reports = []db.Report{}
+	}
+
+	return jsonResponse(200, ReportsResponse{Reports: reports, NextCursor: next})
+}
+
+// Lists every report of a link
+func AdminLinkReports(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	if _, resp, ok := requireAdmin(ctx); !ok {
+		return resp, nil
+	}
+
+	linkID := adminLinkDomain(request) + "/" + request.PathParameters["short_code"]
+	reports, err := db.ListLinkReports(ctx, linkID)
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 500,
+			Body:       `{"error": "` + err.Error() + `"}`,
+		}, nil
+	}
+	if reports == nil {
+		reports = []db.Report{}
+	}
+
+	return jsonResponse(200, ReportsResponse{Reports: reports})
+}
+
+// Resolves the open reports of a link. Dismissing them enables the link
+// again if the reports disabled it, taking it down keeps it down with the
+// given reason.
+func ResolveLinkReports(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	admin, resp, ok := requireAdmin(ctx)
+	if !ok {
+		return resp, nil
+	}
+	domain, shortCode := adminLinkDomain(request), request.PathParameters["short_code"]
+
+	var req ResolveReportsRequest
+	if err := json.Unmarshal([]byte(request.Body), &req); err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 400,
+			Body:       `{"error": "Invalid request body"}`,
+		}, nil
+	}
+
+	url, err := db.GetURL(ctx, domain, shortCode)
+	if err == db.ErrURLNotFound {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 404,
+			Body:       "URL not found",
+		}, nil
+	}
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 500,
+			Body:       `{"error": "` + err.Error() + `"}`,
+		}, nil
+	}
+
+	now := time.Now()
+	var status, action string
+	details := map[string]string{}
+	switch req.Resolution {
+	case ReportDismiss:
+		status, action = db.ReportStatusDismissed, AuditAdminDismissReports
+		if url.TakenDown() && *url.TakedownReason == reportTakedownReason {
+			err = db.RestoreURL(ctx, domain, shortCode)
+		}
+	case ReportTakeDown:
+		reason := strings.TrimSpace(req.Reason)
+		if reason == "" || utf8.RuneCountInString(reason) > maxAdminReasonLength {
+			return events.APIGatewayProxyResponse{
+				StatusCode: 400,
+				Body:       fmt.Sprintf(`{"error": "reason is required and must be at most %d characters"}`, maxAdminReasonLength),
+			}, nil
+		}
+		status, action = db.ReportStatusActioned, AuditAdminTakeDown
+		details["reason"] = reason
+		err = db.TakeDownURL(ctx, domain, shortCode, reason, now.Format(time.RFC3339))
+	default:
+		return events.APIGatewayProxyResponse{
+			StatusCode: 400,
+			Body:       `{"error": "resolution must be dismiss or takedown"}`,
+		}, nil
+	}
+	if err == nil {
+		err = db.ResetURLReports(ctx, domain, shortCode)
+	}
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 500,
+			Body:       `{"error": "Failed to update link"}`,
+		}, nil
+	}
+
+	reports, err := db.ListLinkReports(ctx, auditLinkID(url))
+	resolved := 0
+	if err == nil {
+		for _, report := range reports {
+			if report.Status != db.ReportStatusOpen {
+				continue
+			}
+			if err = db.ResolveReport(ctx, report.ID, status, admin.UserID, now.UTC().Format(time.RFC3339Nano)); err != nil {
+				break
+			}
+			resolved++
+		}
+	}
+	details["reports"] = fmt.Sprint(resolved)
+
+	entry := auditEntry(ctx, request, admin.UserID, action, AuditTargetLink, auditLinkID(url))
+	entry.Details = details
+	recordAudit(ctx, entry)
+
+	if err != nil {
+		slog.ErrorContext(ctx, "resolve reports", "link_id", auditLinkID(url), "error", err)
+		return events.APIGatewayProxyResponse{
+			StatusCode: 500,
+			Body:       `{"error": "Link updated but its reports couldn't all be resolved, please try again"}`,
+		}, nil
+	}
+	return events.APIGatewayProxyResponse{StatusCode: 204}, nil
+}
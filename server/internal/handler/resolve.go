@@ -2,15 +2,32 @@ package handler
 
 import (
 	"context"
+	"log/slog"
+	"net/url"
+	"strings"
 
 	"github.com/SunPodder/shorty/internal/db"
+	"github.com/SunPodder/shorty/utils"
 	"github.com/aws/aws-lambda-go/events"
 )
 
 func Resolve(context context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
 	shortCode := request.PathParameters["short_code"]
 
-	url, err := db.GetURL(context, shortCode)
+	// A trailing "+" asks for a preview instead of a redirect
+	if strings.HasSuffix(shortCode, previewSuffix) {
+		return Preview(context, request)
+	}
+
+	domain, err := namespaceFor(context, request)
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 500,
+			Body:       `{"error": "` + err.Error() + `"}`,
+		}, nil
+	}
+
+	url, err := db.GetURL(context, domain, shortCode)
 	if err != nil {
 		return events.APIGatewayProxyResponse{
 			StatusCode: 500,
@@ -25,20 +42,85 @@ func Resolve(context context.Context, request events.APIGatewayProxyRequest) (ev
 		}, nil
 	}
 
-	// Increment the click count
-	err = db.IncrementClicks(context, shortCode)
+	if url.TakenDown() {
+		slog.InfoContext(context, "link taken down", "domain", domain, "short_code", shortCode)
+		return takedownResponse(url)
+	}
+
+	// Increment the click count, attributing scans of the link's QR code
+	query := incomingQuery(request)
+	fromQR := query.Get(qrSourceParam) == qrSource
+	if fromQR {
+		query.Del(qrSourceParam)
+		err = db.IncrementQRClicks(context, domain, shortCode)
+	} else {
+		err = db.IncrementClicks(context, domain, shortCode)
+	}
 	if err != nil {
 		return events.APIGatewayProxyResponse{
 			StatusCode: 500,
 			Body:       `{"error": "` + err.Error() + `"}`,
 		}, nil
 	}
+	dispatchClick(context, url)
+	slog.InfoContext(context, "link resolved", "domain", domain, "short_code", shortCode, "qr", fromQR)
+
+	location := url.OriginalURL
+	if url.ForwardQuery != nil && *url.ForwardQuery {
+		var precedence string
+		if url.QueryPrecedence != nil {
+			precedence = *url.QueryPrecedence
+		}
+		location, err = utils.MergeQuery(location, query, precedence)
+		if err != nil {
+			return events.APIGatewayProxyResponse{
+				StatusCode: 500,
+				Body:       `{"error": "` + err.Error() + `"}`,
+			}, nil
+		}
+	}
 
+	if url.Interstitial != nil && *url.Interstitial {
+		page, err := renderInterstitial(location, interstitialDelayFor(url))
+		if err != nil {
+			return events.APIGatewayProxyResponse{
+				StatusCode: 500,
+				Body:       `{"error": "` + err.Error() + `"}`,
+			}, nil
+		}
+		return events.APIGatewayProxyResponse{
+			StatusCode: 200,
+			Headers: map[string]string{
+				"Content-Type":  "text/html; charset=utf-8",
+				"Cache-Control": "no-store",
+			},
+			Body: page,
+		}, nil
+	}
+
+	status := redirectStatusFor(url)
 	return events.APIGatewayProxyResponse{
-		StatusCode: 302,
+		StatusCode: status,
 		Headers: map[string]string{
-			"Location": url.OriginalURL,
+			"Location":      location,
+			"Cache-Control": cacheControlFor(url, status),
 		},
 	}, nil
 
 }
+
+// Collects the query string of the incoming request, preferring the
+// multi-value form so repeated keys are preserved
+func incomingQuery(request events.APIGatewayProxyRequest) url.Values {
+	query := url.Values{}
+	if len(request.MultiValueQueryStringParameters) > 0 {
+		for key, values := range request.MultiValueQueryStringParameters {
+			query[key] = append([]string(nil), values...)
+		}
+		return query
+	}
+	for key, value := range request.QueryStringParameters {
+		query.Set(key, value)
+	}
+	return query
+}
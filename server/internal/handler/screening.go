@@ -0,0 +1,189 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"time"
+
+	"github.com/SunPodder/shorty/internal/db"
+	"github.com/SunPodder/shorty/internal/reputation"
+)
+
+// What happens to links whose destination is flagged as unsafe
+const (
+	// Refuse to create or edit the link
+	ScreenReject = "reject"
+	// Keep the link, but take it down until an admin restores it
+	ScreenQuarantine = "quarantine"
+)
+
+var ErrInvalidScreeningAction = errors.New("invalid screening action: must be reject or quarantine")
+
+// URLChecker screens the destinations of new and edited links. It flags
+// nothing unless configured at startup.
+var URLChecker reputation.Checker = reputation.Multi{}
+
+// ScreeningAction is ScreenReject or ScreenQuarantine. It can be
+// overridden at startup.
+var ScreeningAction = ScreenReject
+
+// ParseScreeningAction validates a screening action, where empty means
+// ScreenReject
+func ParseScreeningAction(value string) (string, error) {
+	switch value {
+	case "", ScreenReject:
+		return ScreenReject, nil
+	case ScreenQuarantine:
+		return ScreenQuarantine, nil
+	}
+	return "", ErrInvalidScreeningAction
+}
+
+// Reports whether URLChecker was configured with any checker
+func screeningEnabled() bool {
+	checkers, ok := URLChecker.(reputation.Multi)
+	return !ok || len(checkers) > 0
+}
+
+// Checks a destination with URLChecker and returns when it was screened,
+// nil if it wasn't. A failing checker doesn't keep links from being
+// created, so its errors are logged and the destination is let through,
+// to be caught by the next rescan instead.
+func screenURL(ctx context.Context, destination string) (reputation.Verdict, *string) {
+	verdict, err := URLChecker.Check(ctx, destination)
+	if err != nil {
+		slog.WarnContext(ctx, "screen destination", "original_url", destination, "error", err)
+	}
+	if verdict.Flagged {
+		// Visitors are only told a generic reason
+		slog.InfoContext(ctx, "destination flagged", "original_url", destination, "source", verdict.Source, "threat", verdict.Threat)
+	}
+	if err != nil || !screeningEnabled() {
+		return verdict, nil
+	}
+	at := time.Now().Format(time.RFC3339)
+	return verdict, &at
+}
+
+// Takes url down as quarantined by verdict, without saving it
+func quarantine(url *db.URL, verdict reputation.Verdict) {
+	reason := verdict.Reason()
+	at := time.Now().Format(time.RFC3339)
+	url.TakedownReason, url.TakenDownAt = &reason, &at
+}
+
+const (
+	rescanJob = "rescan"
+	// Links screened at once, as many as one lookup takes
+	rescanBatchSize = reputation.MaxLookupURLs
+	// Time left to a run when it stops to save where it got to
+	rescanDeadlineMargin = time.Minute
+)
+
+// RescanInterval is how often all links are screened again. Runs are
+// scheduled more often, so a pass spanning several runs is resumed.
+var RescanInterval = 24 * time.Hour
+
+// RescanLinks screens the destinations of all links that are still up
+// again and takes down those flagged since they were created. It saves
+// where it got to after each batch and stops before the run times out,
+// the next run resumes from there.
+func RescanLinks(ctx context.Context) error {
+	job, err := db.GetJob(ctx, rescanJob)
+	if err != nil {
+		return err
+	}
+	if job.Cursor == "" {
+		if time.Since(time.Unix(job.StartedAt, 0)) < RescanInterval {
+			slog.InfoContext(ctx, "rescan not due")
+			return nil
+		}
+		job.StartedAt = time.Now().Unix()
+	}
+
+	var flagged, failed int
+	for {
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < rescanDeadlineMargin {
+			slog.InfoContext(ctx, "rescan paused", "flagged", flagged, "failed", failed)
+			return nil
+		}
+
+		urls, next, err := db.ScanURLs(ctx, job.Cursor, rescanBatchSize)
+		if err != nil {
+			return err
+		}
+		batchFlagged, batchFailed, err := rescanBatch(ctx, urls)
+		flagged, failed = flagged+batchFlagged, failed+batchFailed
+		if err != nil {
+			return err
+		}
+
+		job.Cursor = next
+		// Links are only screened when a checker is configured
+		if next == "" && screeningEnabled() {
+			job.CompletedAt, job.CompletedPassStartedAt = time.Now().Unix(), job.StartedAt
+		}
+		if err := db.SaveJob(ctx, *job); err != nil {
+			return err
+		}
+		if next == "" {
+			slog.InfoContext(ctx, "rescan finished", "flagged", flagged, "failed", failed)
+			return nil
+		}
+	}
+}
+
+// Reports whether a rescan should screen the link, which it doesn't when
+// the link is down already or an admin restored it with its destination
+func rescanned(url *db.URL) bool {
+	return !url.TakenDown() && !url.ScreeningReviewed()
+}
+
+// Screens a batch of links and takes down the flagged ones. Links the
+// checker failed on are counted and left for the next pass.
+func rescanBatch(ctx context.Context, urls []db.URL) (flagged, failed int, err error) {
+	var destinations []string
+	for i := range urls {
+		if rescanned(&urls[i]) {
+			destinations = append(destinations, urls[i].OriginalURL)
+		}
+	}
+	if len(destinations) == 0 {
+		return 0, 0, nil
+	}
+
+	verdicts, checkErr := reputation.CheckAll(ctx, URLChecker, destinations)
+	if checkErr != nil {
+		slog.WarnContext(ctx, "rescan links", "error", checkErr)
+	}
+
+	for i := range urls {
+		url := &urls[i]
+		if !rescanned(url) {
+			continue
+		}
+		verdict, ok := verdicts[url.OriginalURL]
+		if !ok {
+			// Unflagged links of a failed check weren't really screened
+			if checkErr != nil {
+				failed++
+			}
+			continue
+		}
+
+		err := db.TakeDownURL(ctx, url.Domain, url.ShortCode, verdict.Reason(), time.Now().Format(time.RFC3339))
+		if err == db.ErrURLNotFound {
+			continue
+		}
+		if err != nil {
+			return flagged, failed, err
+		}
+		flagged++
+
+		entry := systemAuditEntry(AuditLinkFlagged, AuditTargetLink, auditLinkID(url))
+		entry.Details = map[string]string{"source": verdict.Source, "threat": verdict.Threat}
+		recordAudit(ctx, entry)
+	}
+	return flagged, failed, nil
+}
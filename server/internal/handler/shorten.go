@@ -3,20 +3,53 @@ package handler
 import (
 	"context"
 	"encoding/json"
+	"log/slog"
+	"regexp"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/SunPodder/shorty/internal/db"
+	"github.com/SunPodder/shorty/internal/middleware"
+	"github.com/SunPodder/shorty/internal/webhook"
 	"github.com/SunPodder/shorty/utils"
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/google/uuid"
 )
 
 type ShortenRequest struct {
-	OriginalURL string  `json:"original_url"`
-	ExpiryDate  *int64  `json:"expiry_date,omitempty"`
-	ViewOnce    *bool   `json:"view_once,omitempty"`
-	Token       *string `json:"token,omitempty"`
-	CustomCode  *string `json:"custom_code,omitempty"`
+	OriginalURL       string  `json:"original_url"`
+	ExpiryDate        *int64  `json:"expiry_date,omitempty"`
+	ViewOnce          *bool   `json:"view_once,omitempty"`
+	Token             *string `json:"token,omitempty"`
+	CustomCode        *string `json:"custom_code,omitempty"`
+	ForwardQuery      *bool   `json:"forward_query,omitempty"`
+	QueryPrecedence   *string `json:"query_precedence,omitempty"`
+	RedirectStatus    *int    `json:"redirect_status,omitempty"`
+	Interstitial      *bool   `json:"interstitial,omitempty"`
+	InterstitialDelay *int    `json:"interstitial_delay,omitempty"`
+	Title             *string `json:"title,omitempty"`
+	ShowOwner         *bool   `json:"show_owner,omitempty"`
+	Domain            *string `json:"domain,omitempty"`
+	WorkspaceID       *string `json:"workspace_id,omitempty"`
+	UTMSource         string  `json:"utm_source,omitempty"`
+	UTMMedium         string  `json:"utm_medium,omitempty"`
+	UTMCampaign       string  `json:"utm_campaign,omitempty"`
+	UTMTerm           string  `json:"utm_term,omitempty"`
+	UTMContent        string  `json:"utm_content,omitempty"`
+}
+
+// Custom codes share the path with the "+" preview suffix and other
+// sub-resources, so they are restricted to a URL-safe alphabet
+var customCodePattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// ShortCodeLength is the length of generated short codes, at most 32.
+// It can be overridden at startup.
+var ShortCodeLength = 6
+
+// Returns a random hex short code of ShortCodeLength characters
+func generateShortCode() string {
+	return strings.ReplaceAll(uuid.New().String(), "-", "")[:ShortCodeLength]
 }
 
 func Shorten(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
@@ -30,11 +63,138 @@ func Shorten(ctx context.Context, request events.APIGatewayProxyRequest) (events
 
 	}
 
+	// Compose the destination with the UTM parameters and validate it
+	originalURL, err := utils.BuildDestination(req.OriginalURL, utils.UTMParams{
+		Source:   req.UTMSource,
+		Medium:   req.UTMMedium,
+		Campaign: req.UTMCampaign,
+		Term:     req.UTMTerm,
+		Content:  req.UTMContent,
+	})
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 400,
+			Body:       `{"error": "` + err.Error() + `"}`,
+		}, nil
+	}
+
+	if req.QueryPrecedence != nil && !utils.ValidQueryPrecedence(*req.QueryPrecedence) {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 400,
+			Body:       `{"error": "` + utils.ErrInvalidQueryPrecedence.Error() + `"}`,
+		}, nil
+	}
+
+	if req.RedirectStatus != nil && !ValidRedirectStatus(*req.RedirectStatus) {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 400,
+			Body:       `{"error": "redirect_status must be one of 301, 302, 307 or 308"}`,
+		}, nil
+	}
+
+	if req.InterstitialDelay != nil && (*req.InterstitialDelay < 0 || *req.InterstitialDelay > maxInterstitialDelay) {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 400,
+			Body:       `{"error": "interstitial_delay must be between 0 and ` + strconv.Itoa(maxInterstitialDelay) + `"}`,
+		}, nil
+	}
+
+	// The caller is authenticated by middleware.WithAuth in optional mode.
+	// The token in the body is deprecated, but still accepted for clients
+	// that don't send an Authorization header.
+	var userId *string = nil
+
+	principal, ok := middleware.PrincipalFromContext(ctx)
+	if !ok && req.Token != nil {
+		principal, err = middleware.Authenticate(ctx, *req.Token)
+		if err != nil {
+			return events.APIGatewayProxyResponse{
+				StatusCode: 401,
+				Body:       `{"error": "` + err.Error() + `"}`,
+			}, nil
+		}
+		ok = true
+	}
+	if ok {
+		if !principal.HasScope(db.ScopeLinksWrite) {
+			return events.APIGatewayProxyResponse{
+				StatusCode: 403,
+				Body:       `{"error": "API key lacks the ` + db.ScopeLinksWrite + ` scope"}`,
+			}, nil
+		}
+		if resp, ok := requireVerifiedUser(ctx, principal.UserID); !ok {
+			return resp, nil
+		}
+		userId = &principal.UserID
+	} else if RequireVerifiedEmail {
+		// Anonymous links would get around the verification
+		return events.APIGatewayProxyResponse{
+			StatusCode: 401,
+			Body:       `{"error": "Log in with a verified email address to create links"}`,
+		}, nil
+	}
+
+	// Links can only be created in a workspace by its editors and owners
+	if req.WorkspaceID != nil && *req.WorkspaceID != "" {
+		if userId == nil {
+			return events.APIGatewayProxyResponse{
+				StatusCode: 401,
+				Body:       `{"error": "Authentication required to use a workspace"}`,
+			}, nil
+		}
+		role, err := workspaceRole(ctx, *req.WorkspaceID, *userId)
+		if err != nil {
+			return events.APIGatewayProxyResponse{
+				StatusCode: 500,
+				Body:       `{"error": "` + err.Error() + `"}`,
+			}, nil
+		}
+		if !roleAtLeast(role, db.RoleEditor) {
+			return events.APIGatewayProxyResponse{
+				StatusCode: 403,
+				Body:       `{"error": "Insufficient role in workspace"}`,
+			}, nil
+		}
+	} else {
+		req.WorkspaceID = nil
+	}
+
+	// Links on a custom domain can only be created by its verified owner
+	domain := db.DefaultDomain
+	if req.Domain != nil && *req.Domain != "" && normalizeDomain(*req.Domain) != db.DefaultDomain {
+		domain = normalizeDomain(*req.Domain)
+		if userId == nil {
+			return events.APIGatewayProxyResponse{
+				StatusCode: 401,
+				Body:       `{"error": "Authentication required to use a custom domain"}`,
+			}, nil
+		}
+		d, err := db.GetDomain(ctx, domain)
+		if err != nil && err != db.ErrDomainNotFound {
+			return events.APIGatewayProxyResponse{
+				StatusCode: 500,
+				Body:       `{"error": "` + err.Error() + `"}`,
+			}, nil
+		}
+		if d == nil || d.UserID != *userId || !d.Verified {
+			return events.APIGatewayProxyResponse{
+				StatusCode: 403,
+				Body:       `{"error": "Domain is not verified for this account"}`,
+			}, nil
+		}
+	}
+
 	// Generate a short code
 	var shortCode string
 	if req.CustomCode != nil && *req.CustomCode != "" {
+		if !customCodePattern.MatchString(*req.CustomCode) {
+			return events.APIGatewayProxyResponse{
+				StatusCode: 400,
+				Body:       `{"error": "custom_code may only contain letters, digits, '-' and '_'"}`,
+			}, nil
+		}
 		// Check if the custom code already exists
-		exists, err := checkIfCodeExists(ctx, *req.CustomCode)
+		exists, err := checkIfCodeExists(ctx, domain, *req.CustomCode)
 		if err != nil {
 			return events.APIGatewayProxyResponse{
 				StatusCode: 500,
@@ -49,38 +209,63 @@ func Shorten(ctx context.Context, request events.APIGatewayProxyRequest) (events
 		}
 		shortCode = *req.CustomCode
 	} else {
-		shortCode = uuid.New().String()[:6]
+		shortCode = generateShortCode()
 	}
 
-	var userId *string = nil
-
-	if req.Token != nil {
-		var token = *req.Token
-		userid, err := utils.ValidateJWT(token)
-		if err != nil {
-			userId = nil
-		} else {
-			userId = &userid
-		}
+	verdict, screenedAt := screenURL(ctx, originalURL)
+	if verdict.Flagged && ScreeningAction == ScreenReject {
+		slog.WarnContext(ctx, "rejected unsafe link", "original_url", originalURL, "source", verdict.Source, "threat", verdict.Threat)
+		return events.APIGatewayProxyResponse{
+			StatusCode: 400,
+			Body:       `{"error": "original_url was flagged as unsafe"}`,
+		}, nil
 	}
 
 	url := db.URL{
-		ShortCode:   shortCode,
-		OriginalURL: req.OriginalURL,
-		ExpiryDate:  req.ExpiryDate,
-		ViewOnce:    req.ViewOnce,
-		UserID:      userId,
-		Clicks:      0,
-		CreatedAt:   time.Now().Format(time.RFC3339),
+		Domain:            domain,
+		ShortCode:         shortCode,
+		OriginalURL:       originalURL,
+		ExpiryDate:        req.ExpiryDate,
+		ViewOnce:          req.ViewOnce,
+		ForwardQuery:      req.ForwardQuery,
+		QueryPrecedence:   req.QueryPrecedence,
+		RedirectStatus:    req.RedirectStatus,
+		Interstitial:      req.Interstitial,
+		InterstitialDelay: req.InterstitialDelay,
+		Title:             req.Title,
+		ShowOwner:         req.ShowOwner,
+		UserID:            userId,
+		WorkspaceID:       req.WorkspaceID,
+		Clicks:            0,
+		CreatedAt:         time.Now().Format(time.RFC3339),
+		ScreenedAt:        screenedAt,
+	}
+	if verdict.Flagged {
+		quarantine(&url, verdict)
 	}
 
-	if db.CreateURL(ctx, &url) != nil {
+	if err := db.CreateURL(ctx, &url); err != nil {
+		slog.ErrorContext(ctx, "create link", "domain", url.Domain, "short_code", url.ShortCode, "error", err)
 		return events.APIGatewayProxyResponse{
 			StatusCode: 500,
 			Body:       "Failed to create URL",
 		}, nil
 	}
 
+	actorID := ""
+	if userId != nil {
+		actorID = *userId
+	}
+	entry := auditEntry(ctx, request, actorID, AuditLinkCreate, AuditTargetLink, auditLinkID(&url))
+	if ok {
+		// The principal may come from the token in the body
+		entry.APIKeyID = principal.APIKeyID
+	}
+	entry.Changes = auditChanges(nil, &url)
+	recordAudit(ctx, entry)
+	dispatchLinkEvent(ctx, webhook.EventLinkCreated, &url, webhook.LinkData{})
+	slog.InfoContext(ctx, "link created", "domain", url.Domain, "short_code", url.ShortCode, "quarantined", url.TakenDown())
+
 	responseBody, err := json.Marshal(url)
 	if err != nil {
 		return events.APIGatewayProxyResponse{
@@ -94,9 +279,9 @@ func Shorten(ctx context.Context, request events.APIGatewayProxyRequest) (events
 	}, nil
 }
 
-// Checks if a given short code already exists in the database
-func checkIfCodeExists(ctx context.Context, code string) (bool, error) {
-	_, err := db.GetURL(ctx, code)
+// Checks if a given short code already exists in the domain
+func checkIfCodeExists(ctx context.Context, domain, code string) (bool, error) {
+	_, err := db.GetURL(ctx, domain, code)
 	if err != nil && err == db.ErrURLNotFound {
 		return false, nil
 	}
@@ -0,0 +1,287 @@
+package handler
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/SunPodder/shorty/internal/db"
+	"github.com/SunPodder/shorty/internal/oidc"
+	"github.com/SunPodder/shorty/utils"
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/google/uuid"
+)
+
+// Cookie holding the state of a single sign-on login until the callback
+const ssoCookie = "shorty_sso"
+
+// SSOProviders are the identity providers users can log in with, by name.
+// They are set at startup.
+var SSOProviders = map[string]*oidc.Provider{}
+
+// SSORedirectURL is the page of the web app that receives the session
+// token in its fragment after a single sign-on login. When empty, the
+// callback responds with the token as JSON instead.
+var SSORedirectURL = ""
+
+var (
+	errSSOEmailNotVerified = errors.New("the identity provider didn't share a verified email")
+	errSSOAccountConflict  = errors.New("an account with this email exists but its email isn't verified")
+	errSSONoRegistration   = errors.New("registration of new accounts is disabled")
+)
+
+// Routes the /sso/{provider} endpoints to their handlers
+func SSO(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	switch {
+	case strings.HasSuffix(request.Resource, "/login") && request.HTTPMethod == "GET":
+		return SSOLogin(ctx, request)
+	case strings.HasSuffix(request.Resource, "/callback") && request.HTTPMethod == "GET":
+		return SSOCallback(ctx, request)
+	}
+	return events.APIGatewayProxyResponse{
+		StatusCode: 405,
+		Body:       `{"error": "Method not allowed"}`,
+	}, nil
+}
+
+// Returns the provider named in the path, or the error response
+func ssoProvider(request events.APIGatewayProxyRequest) (*oidc.Provider, events.APIGatewayProxyResponse, bool) {
+	provider, ok := SSOProviders[request.PathParameters["provider"]]
+	if !ok {
+		return nil, events.APIGatewayProxyResponse{
+			StatusCode: 404,
+			Body:       `{"error": "Unknown identity provider"}`,
+		}, false
+	}
+	return provider, events.APIGatewayProxyResponse{}, true
+}
+
+// Returns the Set-Cookie header value of the SSO state cookie. Its path
+// is the root since the API may be served under a stage prefix.
+func ssoCookieHeader(value string, maxAge int) string {
+	cookie := &http.Cookie{
+		Name:     ssoCookie,
+		Value:    value,
+		Path:     "/",
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   true,
+		// Lax lets the cookie through on the top-level redirect back
+		// from the identity provider
+		SameSite: http.SameSiteLaxMode,
+	}
+	return cookie.String()
+}
+
+// SSOLogin sends the user to the identity provider's login page
+func SSOLogin(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	provider, resp, ok := ssoProvider(request)
+	if !ok {
+		return resp, nil
+	}
+
+	authRequest, err := oidc.NewAuthRequest()
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 500,
+			Body:       `{"error": "Failed to start login"}`,
+		}, nil
+	}
+
+	state, err := utils.GenerateSSOState(utils.SSOState{
+		Provider: provider.Config.Name,
+		State:    authRequest.State,
+		Nonce:    authRequest.Nonce,
+		Verifier: authRequest.Verifier,
+	})
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 500,
+			Body:       `{"error": "Failed to start login"}`,
+		}, nil
+	}
+
+	location, err := provider.AuthURL(ctx, authRequest)
+	if err != nil {
+		slog.ErrorContext(ctx, "sso", "provider", provider.Config.Name, "error", err)
+		return events.APIGatewayProxyResponse{
+			StatusCode: 502,
+			Body:       `{"error": "Identity provider unavailable"}`,
+		}, nil
+	}
+
+	return events.APIGatewayProxyResponse{
+		StatusCode: 302,
+		Headers: map[string]string{
+			"Location":      location,
+			"Set-Cookie":    ssoCookieHeader(state, int(utils.SSOStateTTL.Seconds())),
+			"Cache-Control": "no-store",
+		},
+	}, nil
+}
+
+// SSOCallback completes a login when the identity provider sends the
+// user back, and issues a Shorty session
+func SSOCallback(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	provider, resp, ok := ssoProvider(request)
+	if !ok {
+		return resp, nil
+	}
+
+	failed := func(status int, message string) (events.APIGatewayProxyResponse, error) {
+		return events.APIGatewayProxyResponse{
+			StatusCode: status,
+			Headers:    map[string]string{"Set-Cookie": ssoCookieHeader("", -1)},
+			Body:       `{"error": "` + message + `"}`,
+		}, nil
+	}
+
+	query := request.QueryStringParameters
+	if query["error"] != "" {
+		return failed(401, "Login was cancelled or refused by the identity provider")
+	}
+
+	cookieHeader, _ := utils.GetHeader(request.Headers, "Cookie")
+	cookie, err := http.ParseCookie(cookieHeader)
+	state := utils.SSOState{}
+	if err == nil {
+		for _, c := range cookie {
+			if c.Name == ssoCookie {
+				state, err = utils.ValidateSSOState(c.Value)
+				break
+			}
+		}
+	}
+	if err != nil || state.Provider != provider.Config.Name ||
+		subtle.ConstantTimeCompare([]byte(state.State), []byte(query["state"])) != 1 {
+		return failed(400, "Invalid or expired login attempt, please try again")
+	}
+
+	claims, err := provider.Exchange(ctx, query["code"], oidc.AuthRequest{
+		State:    state.State,
+		Nonce:    state.Nonce,
+		Verifier: state.Verifier,
+	})
+	if err != nil {
+		slog.ErrorContext(ctx, "sso", "provider", provider.Config.Name, "error", err)
+		return failed(401, "Login with the identity provider failed")
+	}
+
+	user, err := ssoUser(ctx, provider.Config.Name, claims)
+	switch {
+	case err == errSSOEmailNotVerified || err == errSSOAccountConflict || err == errSSONoRegistration:
+		return failed(403, err.Error())
+	case err != nil:
+		slog.ErrorContext(ctx, "sso", "provider", provider.Config.Name, "error", err)
+		return failed(500, "Failed to log in")
+	}
+
+	if user.Disabled() {
+		return failed(403, "This account has been disabled")
+	}
+
+	headers := map[string]string{
+		"Set-Cookie":    ssoCookieHeader("", -1),
+		"Cache-Control": "no-store",
+	}
+
+	// The identity provider stands in for the password only, the second
+	// factor is asked for like after a password login
+	if user.TOTPEnabled {
+		challenge, err := issueMFAChallenge(ctx, user)
+		if err != nil {
+			return failed(500, "Failed to generate token")
+		}
+		if SSORedirectURL != "" {
+			headers["Location"] = SSORedirectURL + "#" + url.Values{"mfa_required": {"true"}, "challenge": {challenge}}.Encode()
+			return events.APIGatewayProxyResponse{StatusCode: 302, Headers: headers}, nil
+		}
+		headers["Content-Type"] = "application/json"
+		return events.APIGatewayProxyResponse{
+			StatusCode: 200,
+			Headers:    headers,
+			Body:       `{"message": "Two-factor authentication required", "mfa_required": true, "challenge": "` + challenge + `"}`,
+		}, nil
+	}
+
+	token, err := utils.GenerateJWT(user.ID)
+	if err != nil {
+		return failed(500, "Failed to generate token")
+	}
+	recordLoginAudit(ctx, request, user, AuditLogin, "sso:"+provider.Config.Name)
+
+	if SSORedirectURL != "" {
+		headers["Location"] = SSORedirectURL + "#" + url.Values{"token": {token}}.Encode()
+		return events.APIGatewayProxyResponse{StatusCode: 302, Headers: headers}, nil
+	}
+
+	headers["Content-Type"] = "application/json"
+	headers["Authorization"] = "Bearer " + token
+	return events.APIGatewayProxyResponse{
+		StatusCode: 200,
+		Headers:    headers,
+		Body:       `{"message": "Login successful", "token": "` + token + `"}`,
+	}, nil
+}
+
+// Returns the user of an identity, linking the identity first if needed.
+// Identities are linked by subject when seen before, otherwise by email
+// when both the provider and the existing account verified it, and a new
+// user is created when no account uses the email.
+func ssoUser(ctx context.Context, provider string, claims *oidc.Claims) (*db.User, error) {
+	identity, err := db.GetIdentity(ctx, provider, claims.Subject)
+	if err == nil {
+		return db.GetUser(ctx, identity.UserID)
+	}
+	if err != db.ErrIdentityNotFound {
+		return nil, err
+	}
+
+	email, err := utils.ValidateEmail(claims.Email)
+	if err != nil || !claims.EmailVerified {
+		return nil, errSSOEmailNotVerified
+	}
+
+	user, err := db.GetUserByEmail(ctx, email)
+	switch {
+	case err == db.ErrUserNotFound:
+		if !RegistrationEnabled {
+			return nil, errSSONoRegistration
+		}
+		// Accounts created through an identity provider have no password
+		user = &db.User{
+			ID:          uuid.NewString(),
+			Email:       email,
+			DisplayName: claims.Name,
+			Verified:    true,
+			CreatedAt:   time.Now().Format(time.RFC3339),
+		}
+		if err := db.CreateUser(ctx, *user); err != nil {
+			return nil, err
+		}
+	case err != nil:
+		return nil, err
+	case !user.Verified:
+		// Linking would hand the account to whoever registered the email
+		// without proving they own it
+		return nil, errSSOAccountConflict
+	}
+
+	err = db.CreateIdentity(ctx, db.Identity{
+		UserID:    user.ID,
+		Provider:  provider,
+		Subject:   claims.Subject,
+		Email:     email,
+		CreatedAt: time.Now().Format(time.RFC3339),
+	})
+	if err != nil && err != db.ErrDuplicateIdentity {
+		return nil, err
+	}
+
+	return user, nil
+}
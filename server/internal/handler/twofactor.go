@@ -0,0 +1,345 @@
+package handler
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/SunPodder/shorty/internal/db"
+	"github.com/SunPodder/shorty/utils"
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/skip2/go-qrcode"
+)
+
+const (
+	// Issuer shown by authenticator apps
+	totpIssuer      = "Shorty"
+	backupCodeCount = 10
+	// Width and height of the enrollment QR code in pixels
+	totpQRCodeSize = 256
+)
+
+type TwoFactorCodeRequest struct {
+	// A TOTP code, or a backup code where allowed
+	Code string `json:"code"`
+}
+
+type EnrollTwoFactorResponse struct {
+	Secret string `json:"secret"`
+	URI    string `json:"otpauth_uri"`
+	// PNG of the URI as a data URI, ready to be used as an image source
+	QRCode string `json:"qr_code"`
+}
+
+type ConfirmTwoFactorResponse struct {
+	// Shown once, only their hashes are stored
+	BackupCodes []string `json:"backup_codes"`
+}
+
+type MFALoginRequest struct {
+	Challenge string `json:"challenge"`
+	Code      string `json:"code"`
+}
+
+// Routes the /me/2fa endpoints to their handlers
+func TwoFactor(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	switch {
+	case strings.HasSuffix(request.Resource, "/2fa/verify") && request.HTTPMethod == "POST":
+		return ConfirmTwoFactor(ctx, request)
+	case strings.HasSuffix(request.Resource, "/2fa") && request.HTTPMethod == "POST":
+		return EnrollTwoFactor(ctx, request)
+	case strings.HasSuffix(request.Resource, "/2fa") && request.HTTPMethod == "DELETE":
+		return DisableTwoFactor(ctx, request)
+	}
+	return events.APIGatewayProxyResponse{
+		StatusCode: 405,
+		Body:       `{"error": "Method not allowed"}`,
+	}, nil
+}
+
+// Returns the logged-in user, or the error response
+func currentUser(ctx context.Context) (*db.User, events.APIGatewayProxyResponse, bool) {
+	principal, resp, ok := requirePrincipal(ctx, sessionOnly)
+	if !ok {
+		return nil, resp, false
+	}
+
+	user, err := db.GetUser(ctx, principal.UserID)
+	if err != nil {
+		return nil, events.APIGatewayProxyResponse{
+			StatusCode: 500,
+			Body:       `{"error": "Failed to get user"}`,
+		}, false
+	}
+	return user, events.APIGatewayProxyResponse{}, true
+}
+
+// Starts two-factor enrollment by generating a TOTP secret for the user
+func EnrollTwoFactor(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	user, resp, ok := currentUser(ctx)
+	if !ok {
+		return resp, nil
+	}
+
+	alreadyEnabled := events.APIGatewayProxyResponse{
+		StatusCode: 409,
+		Body:       `{"error": "Two-factor authentication is already enabled"}`,
+	}
+	if user.TOTPEnabled {
+		return alreadyEnabled, nil
+	}
+
+	secret, err := utils.GenerateTOTPSecret()
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 500,
+			Body:       `{"error": "Failed to generate secret"}`,
+		}, nil
+	}
+
+	uri := utils.TOTPURI(totpIssuer, user.Email, secret)
+	png, err := qrcode.Encode(uri, qrcode.Medium, totpQRCodeSize)
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 500,
+			Body:       `{"error": "Failed to render QR code"}`,
+		}, nil
+	}
+
+	err = db.StartTOTPEnrollment(ctx, user.ID, secret)
+	if err == db.ErrTOTPAlreadyEnabled {
+		return alreadyEnabled, nil
+	}
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 500,
+			Body:       `{"error": "Failed to start enrollment"}`,
+		}, nil
+	}
+	recordAudit(ctx, auditEntry(ctx, request, user.ID, AuditTwoFactorEnroll, AuditTargetUser, user.ID))
+
+	body, _ := json.Marshal(EnrollTwoFactorResponse{
+		Secret: secret,
+		URI:    uri,
+		QRCode: "data:image/png;base64," + base64.StdEncoding.EncodeToString(png),
+	})
+	return events.APIGatewayProxyResponse{
+		StatusCode: 200,
+		Headers: map[string]string{
+			"Content-Type":  "application/json",
+			"Cache-Control": "no-store",
+		},
+		Body: string(body),
+	}, nil
+}
+
+// Turns two-factor authentication on once the user proves their
+// authenticator works, and returns their backup codes
+func ConfirmTwoFactor(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	user, resp, ok := currentUser(ctx)
+	if !ok {
+		return resp, nil
+	}
+
+	var req TwoFactorCodeRequest
+	if err := json.Unmarshal([]byte(request.Body), &req); err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 400,
+			Body:       `{"error": "Invalid request body"}`,
+		}, nil
+	}
+
+	notPending := events.APIGatewayProxyResponse{
+		StatusCode: 409,
+		Body:       `{"error": "No two-factor enrollment in progress"}`,
+	}
+	if user.TOTPEnabled || user.TOTPSecret == "" {
+		return notPending, nil
+	}
+
+	step, valid := utils.ValidateTOTP(user.TOTPSecret, req.Code, time.Now())
+	if !valid {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 400,
+			Body:       `{"error": "Invalid code"}`,
+		}, nil
+	}
+
+	codes, err := utils.GenerateBackupCodes(backupCodeCount)
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 500,
+			Body:       `{"error": "Failed to generate backup codes"}`,
+		}, nil
+	}
+	hashes := make([]string, len(codes))
+	for i, code := range codes {
+		hashes[i] = utils.HashBackupCode(code)
+	}
+
+	err = db.EnableTOTP(ctx, user.ID, user.TOTPSecret, step, hashes)
+	if err == db.ErrTOTPNotPending {
+		return notPending, nil
+	}
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 500,
+			Body:       `{"error": "Failed to enable two-factor authentication"}`,
+		}, nil
+	}
+	recordAudit(ctx, auditEntry(ctx, request, user.ID, AuditTwoFactorEnable, AuditTargetUser, user.ID))
+
+	body, _ := json.Marshal(ConfirmTwoFactorResponse{BackupCodes: codes})
+	return events.APIGatewayProxyResponse{
+		StatusCode: 200,
+		Headers: map[string]string{
+			"Content-Type":  "application/json",
+			"Cache-Control": "no-store",
+		},
+		Body: string(body),
+	}, nil
+}
+
+// Turns two-factor authentication off, which takes a current code
+func DisableTwoFactor(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	user, resp, ok := currentUser(ctx)
+	if !ok {
+		return resp, nil
+	}
+
+	var req TwoFactorCodeRequest
+	if err := json.Unmarshal([]byte(request.Body), &req); err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 400,
+			Body:       `{"error": "Invalid request body"}`,
+		}, nil
+	}
+
+	if user.TOTPEnabled {
+		valid, err := checkSecondFactor(ctx, user, req.Code)
+		if err != nil {
+			return events.APIGatewayProxyResponse{
+				StatusCode: 500,
+				Body:       `{"error": "Failed to check code"}`,
+			}, nil
+		}
+		if !valid {
+			return events.APIGatewayProxyResponse{
+				StatusCode: 400,
+				Body:       `{"error": "Invalid code"}`,
+			}, nil
+		}
+	}
+
+	if err := db.DisableTOTP(ctx, user.ID); err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 500,
+			Body:       `{"error": "Failed to disable two-factor authentication"}`,
+		}, nil
+	}
+	recordAudit(ctx, auditEntry(ctx, request, user.ID, AuditTwoFactorDisable, AuditTargetUser, user.ID))
+
+	return events.APIGatewayProxyResponse{StatusCode: 204}, nil
+}
+
+// Checks a TOTP or backup code of user and marks it as used
+func checkSecondFactor(ctx context.Context, user *db.User, code string) (bool, error) {
+	if step, ok := utils.ValidateTOTP(user.TOTPSecret, code, time.Now()); ok {
+		err := db.UseTOTPStep(ctx, user.ID, step)
+		if err == db.ErrCodeAlreadyUsed {
+			return false, nil
+		}
+		return err == nil, err
+	}
+
+	if utils.NormalizeBackupCode(code) == "" {
+		return false, nil
+	}
+	err := db.UseBackupCode(ctx, user.ID, utils.HashBackupCode(code))
+	if err == db.ErrCodeAlreadyUsed {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Issues the challenge of a user who passed the first login step, to be
+// exchanged by LoginMFA. Only the latest challenge of a user is valid.
+func issueMFAChallenge(ctx context.Context, user *db.User) (string, error) {
+	challenge, err := utils.GenerateMFAChallenge(user.ID)
+	if err != nil {
+		return "", err
+	}
+	if err := db.SetMFAChallenge(ctx, user.ID, utils.HashToken(challenge)); err != nil {
+		return "", err
+	}
+	return challenge, nil
+}
+
+// Returns the response asking a user who entered the right password
+// for their second factor
+func mfaChallenge(ctx context.Context, user *db.User) (events.APIGatewayProxyResponse, error) {
+	challenge, err := issueMFAChallenge(ctx, user)
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 500,
+			Body:       `{"error": "Failed to generate token"}`,
+		}, nil
+	}
+
+	return events.APIGatewayProxyResponse{
+		StatusCode: 200,
+		Headers:    map[string]string{"Content-Type": "application/json"},
+		Body:       `{"message": "Two-factor authentication required", "mfa_required": true, "challenge": "` + challenge + `"}`,
+	}, nil
+}
+
+// LoginMFA exchanges the challenge returned by Login and a TOTP or
+// backup code for a session. A challenge is good for a single attempt.
+func LoginMFA(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	var req MFALoginRequest
+	if err := json.Unmarshal([]byte(request.Body), &req); err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 400,
+			Body:       `{"error": "Invalid request body"}`,
+		}, nil
+	}
+
+	invalid := events.APIGatewayProxyResponse{
+		StatusCode: 401,
+		Body:       `{"error": "Invalid or expired challenge or code"}`,
+	}
+
+	userID, err := utils.ValidateMFAChallenge(req.Challenge)
+	if err != nil {
+		return invalid, nil
+	}
+
+	user, err := db.GetUser(ctx, userID)
+	if err != nil || !user.TOTPEnabled || user.LockedUntil > time.Now().Unix() {
+		return invalid, nil
+	}
+
+	err = db.UseMFAChallenge(ctx, user.ID, utils.HashToken(req.Challenge))
+	if err != nil {
+		if err != db.ErrInvalidChallenge {
+			slog.ErrorContext(ctx, "use MFA challenge", "target_user_id", user.ID, "error", err)
+		}
+		return invalid, nil
+	}
+
+	valid, err := checkSecondFactor(ctx, user, req.Code)
+	if err != nil {
+		slog.ErrorContext(ctx, "check second factor", "target_user_id", user.ID, "error", err)
+		return invalid, nil
+	}
+	if !valid {
+		recordFailedLogin(ctx, user)
+		recordLoginAudit(ctx, request, user, AuditLoginFailed, "mfa")
+		return invalid, nil
+	}
+
+	return completeLogin(ctx, request, user, "mfa")
+}
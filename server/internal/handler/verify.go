@@ -0,0 +1,127 @@
+package handler
+
+import (
+	"context"
+	"log/slog"
+	"net/url"
+
+	"github.com/SunPodder/shorty/internal/db"
+	"github.com/SunPodder/shorty/internal/mail"
+	"github.com/SunPodder/shorty/utils"
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// RequireVerifiedEmail makes users verify their email before they can
+// create links. It can be overridden at startup.
+var RequireVerifiedEmail = false
+
+// Emails user a link to verify their address
+func sendVerificationEmail(ctx context.Context, user *db.User) error {
+	token, err := utils.GenerateVerificationToken(user.ID, user.Email)
+	if err != nil {
+		return err
+	}
+
+	link := publicLink("/verify", url.Values{"token": {token}})
+	return Mailer.Send(ctx, mail.Message{
+		To:      user.Email,
+		Subject: "Verify your email for Shorty",
+		Body: "Welcome to Shorty! Please confirm your email address by opening the link below.\n" +
+			"The link expires in " + describeTTL(utils.VerificationTokenTTL) + ".\n\n" +
+			link + "\n",
+	})
+}
+
+// Returns an error response if verification is required and the user
+// hasn't verified their email yet
+func requireVerifiedUser(ctx context.Context, userID string) (events.APIGatewayProxyResponse, bool) {
+	if !RequireVerifiedEmail {
+		return events.APIGatewayProxyResponse{}, true
+	}
+
+	user, err := db.GetUser(ctx, userID)
+	if err != nil {
+		slog.ErrorContext(ctx, "get user", "target_user_id", userID, "error", err)
+		return events.APIGatewayProxyResponse{
+			StatusCode: 500,
+			Body:       `{"error": "Failed to get user"}`,
+		}, false
+	}
+	if !user.Verified {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 403,
+			Body:       `{"error": "Verify your email address before creating links"}`,
+		}, false
+	}
+
+	return events.APIGatewayProxyResponse{}, true
+}
+
+// ResendVerification emails the authenticated user a new verification
+// link, for when the first one expired or got lost
+func ResendVerification(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	principal, resp, ok := requirePrincipal(ctx, sessionOnly)
+	if !ok {
+		return resp, nil
+	}
+
+	user, err := db.GetUser(ctx, principal.UserID)
+	if err != nil {
+		slog.ErrorContext(ctx, "get user", "target_user_id", principal.UserID, "error", err)
+		return events.APIGatewayProxyResponse{
+			StatusCode: 500,
+			Body:       `{"error": "Failed to get user"}`,
+		}, nil
+	}
+	if user.Verified {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 409,
+			Body:       `{"error": "Email already verified"}`,
+		}, nil
+	}
+
+	if err := sendVerificationEmail(ctx, user); err != nil {
+		slog.ErrorContext(ctx, "send verification email", "target_user_id", user.ID, "error", err)
+		return events.APIGatewayProxyResponse{
+			StatusCode: 502,
+			Body:       `{"error": "Failed to send verification email"}`,
+		}, nil
+	}
+
+	return events.APIGatewayProxyResponse{
+		StatusCode: 202,
+		Headers:    map[string]string{"Content-Type": "application/json"},
+		Body:       `{"message": "Verification email sent"}`,
+	}, nil
+}
+
+// Verify marks an email as verified with the token emailed at registration
+func Verify(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	invalid := events.APIGatewayProxyResponse{
+		StatusCode: 400,
+		Body:       `{"error": "Invalid or expired verification link"}`,
+	}
+
+	userID, email, err := utils.ValidateVerificationToken(request.QueryStringParameters["token"])
+	if err != nil {
+		return invalid, nil
+	}
+
+	// Fails when the user changed their email since the token was issued
+	err = db.MarkUserVerified(ctx, userID, email)
+	if err == db.ErrUserNotFound {
+		return invalid, nil
+	}
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 500,
+			Body:       `{"error": "Failed to verify email"}`,
+		}, nil
+	}
+
+	return events.APIGatewayProxyResponse{
+		StatusCode: 200,
+		Headers:    map[string]string{"Content-Type": "application/json"},
+		Body:       `{"message": "Email verified"}`,
+	}, nil
+}
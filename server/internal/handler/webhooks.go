@@ -0,0 +1,503 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"math/rand"
+	"net/netip"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/SunPodder/shorty/internal/db"
+	"github.com/SunPodder/shorty/internal/webhook"
+	"github.com/SunPodder/shorty/utils"
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/google/uuid"
+)
+
+const (
+	maxWebhooksPerUser = 10
+
+	// Due deliveries the worker reads at a time and sends in parallel
+	deliveryBatchSize   = 100
+	deliveryConcurrency = 10
+	// The worker stops picking up batches this long before its deadline
+	// so attempts in flight can finish
+	deliveryDeadlineMargin = 30 * time.Second
+)
+
+// WebhookDispatcher receives the events of links. Lambdas select it at
+// startup, the log dispatcher only serves local development.
+var WebhookDispatcher webhook.Dispatcher = webhook.NewLogDispatcher()
+
+// WebhookSender sends deliveries to the receivers
+var WebhookSender = webhook.NewSender()
+
+// WebhookClickSampleRate is the share of clicks sent as link.clicked
+// events. It can be lowered at startup for busy deployments.
+var WebhookClickSampleRate = 1.0
+
+type CreateWebhookRequest struct {
+	URL    string   `json:"url"`
+	Events []string `json:"events"`
+}
+
+// CreateWebhookResponse carries the signing secret, which is only ever
+// shown once when the webhook is created
+type CreateWebhookResponse struct {
+	db.Webhook
+	Secret string `json:"secret"`
+}
+
+type DeliveriesResponse struct {
+	Deliveries []db.WebhookDelivery `json:"deliveries"`
+	NextCursor string               `json:"next_cursor,omitempty"`
+}
+
+// Routes the /webhooks endpoints to their handlers
+func Webhooks(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	switch {
+	case strings.HasSuffix(request.Resource, "/webhooks") && request.HTTPMethod == "GET":
+		return ListWebhooks(ctx, request)
+	case strings.HasSuffix(request.Resource, "/webhooks") && request.HTTPMethod == "POST":
+		return CreateWebhook(ctx, request)
+	case strings.HasSuffix(request.Resource, "/webhooks/{webhook_id}") && request.HTTPMethod == "DELETE":
+		return DeleteWebhook(ctx, request)
+	case strings.HasSuffix(request.Resource, "/webhooks/{webhook_id}/test") && request.HTTPMethod == "POST":
+		return TestWebhook(ctx, request)
+	case strings.HasSuffix(request.Resource, "/webhooks/{webhook_id}/deliveries") && request.HTTPMethod == "GET":
+		return ListWebhookDeliveries(ctx, request)
+	case strings.HasSuffix(request.Resource, "/deliveries/{delivery_id}/redeliver") && request.HTTPMethod == "POST":
+		return RedeliverWebhook(ctx, request)
+	}
+	return events.APIGatewayProxyResponse{
+		StatusCode: 405,
+		Body:       `{"error": "Method not allowed"}`,
+	}, nil
+}
+
+// Reports whether raw is an absolute https URL whose host isn't a
+// loopback, private or otherwise internal address
+func validWebhookURL(raw string) bool {
+	u, err := url.Parse(raw)
+	if err != nil || u.Hostname() == "" {
+		return false
+	}
+	if webhook.AllowPrivateReceivers {
+		return u.Scheme == "https" || u.Scheme == "http"
+	}
+	if u.Scheme != "https" {
+		return false
+	}
+	// Hostnames are checked once resolved, when deliveries are sent
+	if ip, err := netip.ParseAddr(u.Hostname()); err == nil {
+		return webhook.PublicAddr(ip)
+	}
+	return !strings.EqualFold(u.Hostname(), "localhost")
+}
+
+// Registers a webhook for the authenticated user
+func CreateWebhook(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	principal, resp, ok := requirePrincipal(ctx, sessionOnly)
+	if !ok {
+		return resp, nil
+	}
+	userID := principal.UserID
+
+	var req CreateWebhookRequest
+	if err := json.Unmarshal([]byte(request.Body), &req); err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 400,
+			Body:       `{"error": "Invalid request body"}`,
+		}, nil
+	}
+
+	req.URL = strings.TrimSpace(req.URL)
+	if !validWebhookURL(req.URL) {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 400,
+			Body:       `{"error": "url must be an https URL of a public host"}`,
+		}, nil
+	}
+
+	if len(req.Events) == 0 {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 400,
+			Body:       `{"error": "At least one event is required"}`,
+		}, nil
+	}
+	for _, event := range req.Events {
+		if !webhook.ValidEvent(event) {
+			return events.APIGatewayProxyResponse{
+				StatusCode: 400,
+				Body:       `{"error": "Unknown event, must be one of ` + strings.Join(webhook.Events, ", ") + `"}`,
+			}, nil
+		}
+	}
+
+	hooks, err := db.ListUserWebhooks(ctx, userID)
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 500,
+			Body:       `{"error": "` + err.Error() + `"}`,
+		}, nil
+	}
+	if len(hooks) >= maxWebhooksPerUser {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 409,
+			Body:       `{"error": "Webhook limit reached"}`,
+		}, nil
+	}
+
+	secret, err := utils.RandomToken(32)
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 500,
+			Body:       `{"error": "Failed to generate webhook secret"}`,
+		}, nil
+	}
+
+	hook := db.Webhook{
+		ID:        uuid.NewString(),
+		UserID:    userID,
+		URL:       req.URL,
+		Secret:    secret,
+		Events:    req.Events,
+		CreatedAt: time.Now().Format(time.RFC3339),
+	}
+	if err := db.CreateWebhook(ctx, hook); err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 500,
+			Body:       `{"error": "` + err.Error() + `"}`,
+		}, nil
+	}
+
+	entry := auditEntry(ctx, request, userID, AuditWebhookCreate, AuditTargetWebhook, hook.ID)
+	entry.Details = map[string]string{"url": hook.URL, "events": strings.Join(hook.Events, " ")}
+	recordAudit(ctx, entry)
+
+	return jsonResponse(201, CreateWebhookResponse{Webhook: hook, Secret: secret})
+}
+
+// Lists the webhooks of the authenticated user without their secrets
+func ListWebhooks(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	principal, resp, ok := requirePrincipal(ctx, sessionOnly)
+	if !ok {
+		return resp, nil
+	}
+
+	hooks, err := db.ListUserWebhooks(ctx, principal.UserID)
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 500,
+			Body:       `{"error": "` + err.Error() + `"}`,
+		}, nil
+	}
+	if hooks == nil {
+		hooks = []db.Webhook{}
+	}
+	return jsonResponse(200, hooks)
+}
+
+// Loads the webhook addressed by the request if it belongs to the caller,
+// returning it and the caller's ID or the error response.
+// Webhooks of other users are reported as not found.
+func ownWebhook(ctx context.Context, request events.APIGatewayProxyRequest) (*db.Webhook, string, events.APIGatewayProxyResponse, bool) {
+	principal, resp, ok := requirePrincipal(ctx, sessionOnly)
+	if !ok {
+		return nil, "", resp, false
+	}
+
+	hook, err := db.GetWebhook(ctx, request.PathParameters["webhook_id"])
+	if err == db.ErrWebhookNotFound || (err == nil && hook.UserID != principal.UserID) {
+		return nil, "", events.APIGatewayProxyResponse{
+			StatusCode: 404,
+			Body:       `{"error": "Webhook not found"}`,
+		}, false
+	}
+	if err != nil {
+		return nil, "", events.APIGatewayProxyResponse{
+			StatusCode: 500,
+			Body:       `{"error": "` + err.Error() + `"}`,
+		}, false
+	}
+	return hook, principal.UserID, events.APIGatewayProxyResponse{}, true
+}
+
+// Deletes a webhook of the authenticated user
+func DeleteWebhook(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	hook, userID, resp, ok := ownWebhook(ctx, request)
+	if !ok {
+		return resp, nil
+	}
+
+	if err := db.DeleteWebhook(ctx, hook.ID); err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 500,
+			Body:       `{"error": "` + err.Error() + `"}`,
+		}, nil
+	}
+
+	entry := auditEntry(ctx, request, userID, AuditWebhookDelete, AuditTargetWebhook, hook.ID)
+	entry.Details = map[string]string{"url": hook.URL}
+	recordAudit(ctx, entry)
+
+	return events.APIGatewayProxyResponse{
+		StatusCode: 204,
+	}, nil
+}
+
+// Sends a ping event to a webhook right away and returns the delivery,
+// so users can check their receiver while setting it up
+func TestWebhook(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	hook, _, resp, ok := ownWebhook(ctx, request)
+	if !ok {
+		return resp, nil
+	}
+
+	now := time.Now()
+	delivery, err := webhook.NewDelivery(hook, webhook.NewEvent(webhook.EventPing, nil), now)
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 500,
+			Body:       `{"error": "` + err.Error() + `"}`,
+		}, nil
+	}
+	WebhookSender.Attempt(ctx, hook, &delivery, now)
+
+	if err := db.PutWebhookDelivery(ctx, delivery); err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 500,
+			Body:       `{"error": "` + err.Error() + `"}`,
+		}, nil
+	}
+	return jsonResponse(200, delivery)
+}
+
+// Lists the deliveries of a webhook, newest first, optionally only those
+// in ?status=
+func ListWebhookDeliveries(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	hook, _, resp, ok := ownWebhook(ctx, request)
+	if !ok {
+		return resp, nil
+	}
+
+	query := request.QueryStringParameters
+	switch query["status"] {
+	case "", db.DeliveryStatusPending, db.DeliveryStatusDelivered, db.DeliveryStatusDead:
+	default:
+		return events.APIGatewayProxyResponse{
+			StatusCode: 400,
+			Body:       `{"error": "status must be pending, delivered or dead"}`,
+		}, nil
+	}
+
+	limit, resp, ok := adminPageSize(request)
+	if !ok {
+		return resp, nil
+	}
+
+	deliveries, next, err := db.ListWebhookDeliveries(ctx, hook.ID, query["status"], limit, query["cursor"])
+	if err == db.ErrInvalidCursor {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 400,
+			Body:       `{"error": "Invalid cursor"}`,
+		}, nil
+	}
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 500,
+			Body:       `{"error": "` + err.Error() + `"}`,
+		}, nil
+	}
+	if deliveries == nil {
+		deliveries = []db.WebhookDelivery{}
+	}
+	return jsonResponse(200, DeliveriesResponse{Deliveries: deliveries, NextCursor: next})
+}
+
+// Queues a delivery of a webhook again with a fresh set of attempts,
+// typically one that was dead-lettered
+func RedeliverWebhook(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	hook, _, resp, ok := ownWebhook(ctx, request)
+	if !ok {
+		return resp, nil
+	}
+
+	delivery, err := db.GetWebhookDelivery(ctx, request.PathParameters["delivery_id"])
+	if err == db.ErrDeliveryNotFound || (err == nil && delivery.WebhookID != hook.ID) {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 404,
+			Body:       `{"error": "Delivery not found"}`,
+		}, nil
+	}
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 500,
+			Body:       `{"error": "` + err.Error() + `"}`,
+		}, nil
+	}
+	if delivery.Status == db.DeliveryStatusPending {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 409,
+			Body:       `{"error": "Delivery is already pending"}`,
+		}, nil
+	}
+
+	delivery.Status = db.DeliveryStatusPending
+	delivery.Attempts = 0
+	delivery.NextAttemptAt = time.Now().Unix()
+	if err := db.PutWebhookDelivery(ctx, *delivery); err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 500,
+			Body:       `{"error": "` + err.Error() + `"}`,
+		}, nil
+	}
+	return jsonResponse(202, delivery)
+}
+
+// Hands an event about url to the webhooks of its owner. Failures are
+// logged rather than failing the request that caused the event.
+func dispatchLinkEvent(ctx context.Context, eventType string, url *db.URL, data webhook.LinkData) {
+	if url.UserID == nil {
+		return
+	}
+	data.Domain = url.Domain
+	data.ShortCode = url.ShortCode
+	data.OriginalURL = url.OriginalURL
+
+	if err := WebhookDispatcher.Dispatch(ctx, *url.UserID, webhook.NewEvent(eventType, data)); err != nil {
+		slog.ErrorContext(ctx, "dispatch webhook event", "event", eventType, "domain", url.Domain, "short_code", url.ShortCode, "error", err)
+	}
+}
+
+// Sends a link.clicked event for a sample of the clicks of url, after
+// its click count was incremented
+func dispatchClick(ctx context.Context, url *db.URL) {
+	if WebhookClickSampleRate < 1 && rand.Float64() >= WebhookClickSampleRate {
+		return
+	}
+	dispatchLinkEvent(ctx, webhook.EventLinkClicked, url, webhook.LinkData{
+		Clicks:     url.Clicks + 1,
+		SampleRate: WebhookClickSampleRate,
+	})
+}
+
+// Jobs of the webhooks worker
+const (
+	WebhookJobDeliver = "deliver"
+	WebhookJobExpire  = "expire"
+)
+
+// WebhookJob is the scheduled event that starts the webhooks worker
+type WebhookJob struct {
+	Job string `json:"job"`
+}
+
+// RunWebhookJob runs a job of the webhooks worker. Deliveries are sent
+// every minute while expired links are looked for less often, as that
+// scans the links table.
+func RunWebhookJob(ctx context.Context, job WebhookJob) error {
+	switch job.Job {
+	case "", WebhookJobDeliver:
+		return DeliverWebhooks(ctx)
+	case WebhookJobExpire:
+		return NotifyExpiredLinks(ctx)
+	}
+	slog.WarnContext(ctx, "unknown webhook job", "job", job.Job)
+	return nil
+}
+
+// DeliverWebhooks attempts every due delivery once. Deliveries of deleted
+// webhooks are dead-lettered.
+func DeliverWebhooks(ctx context.Context) error {
+	var delivered, failed int
+	for {
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < deliveryDeadlineMargin {
+			break
+		}
+
+		now := time.Now()
+		due, err := db.ListDueWebhookDeliveries(ctx, now.Unix(), deliveryBatchSize)
+		if err != nil {
+			return err
+		}
+
+		var mu sync.Mutex
+		var wg sync.WaitGroup
+		var errs []error
+		slots := make(chan struct{}, deliveryConcurrency)
+		for i := range due {
+			delivery := &due[i]
+			wg.Add(1)
+			slots <- struct{}{}
+			go func() {
+				defer func() { <-slots; wg.Done() }()
+				err := deliverWebhook(ctx, delivery, now)
+
+				mu.Lock()
+				defer mu.Unlock()
+				if err != nil {
+					errs = append(errs, err)
+				} else if delivery.Status == db.DeliveryStatusDelivered {
+					delivered++
+				} else {
+					failed++
+				}
+			}()
+		}
+		wg.Wait()
+
+		if len(errs) > 0 {
+			return errs[0]
+		}
+		if len(due) < deliveryBatchSize {
+			break
+		}
+	}
+	slog.InfoContext(ctx, "webhook deliveries sent", "delivered", delivered, "failed", failed)
+	return nil
+}
+
+// Attempts a single delivery and stores its outcome
+func deliverWebhook(ctx context.Context, delivery *db.WebhookDelivery, now time.Time) error {
+	hook, err := db.GetWebhook(ctx, delivery.WebhookID)
+	switch {
+	case err == db.ErrWebhookNotFound:
+		delivery.Status = db.DeliveryStatusDead
+		delivery.NextAttemptAt = 0
+		delivery.LastError = "webhook was deleted"
+	case err != nil:
+		return err
+	default:
+		WebhookSender.Attempt(ctx, hook, delivery, now)
+	}
+	return db.PutWebhookDelivery(ctx, *delivery)
+}
+
+// NotifyExpiredLinks sends link.expired for every link whose expiry date
+// passed since the last run, once per expiry date
+func NotifyExpiredLinks(ctx context.Context) error {
+	now := time.Now()
+	var notified int
+	err := db.ForEachExpiredURL(ctx, now.Unix(), func(urls []db.URL) error {
+		for i := range urls {
+			url := &urls[i]
+			err := db.MarkURLExpiryNotified(ctx, url.Domain, url.ShortCode, now.Format(time.RFC3339))
+			if err == db.ErrURLNotFound {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			dispatchLinkEvent(ctx, webhook.EventLinkExpired, url, webhook.LinkData{Clicks: url.Clicks})
+			notified++
+		}
+		return nil
+	})
+	slog.InfoContext(ctx, "expired links notified", "notified", notified)
+	return err
+}
@@ -0,0 +1,533 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/SunPodder/shorty/internal/db"
+	"github.com/SunPodder/shorty/internal/mail"
+	"github.com/SunPodder/shorty/utils"
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/google/uuid"
+)
+
+// WorkspaceInviteTTL is how long invitations to workspaces can be
+// accepted
+var WorkspaceInviteTTL = 7 * 24 * time.Hour
+
+type CreateWorkspaceRequest struct {
+	Name string `json:"name"`
+}
+
+type PutMemberRequest struct {
+	UserID *string `json:"user_id,omitempty"`
+	Email  *string `json:"email,omitempty"`
+	Role   string  `json:"role"`
+}
+
+// WorkspaceResponse is a workspace along with the role of the caller in it
+type WorkspaceResponse struct {
+	db.Workspace
+	Role string `json:"role"`
+}
+
+// Routes the /workspaces endpoints to their handlers
+func Workspaces(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	switch {
+	case strings.HasSuffix(request.Resource, "/invitation"):
+		return WorkspaceInvitation(ctx, request)
+	case strings.HasSuffix(request.Resource, "/members/{user_id}") && request.HTTPMethod == "DELETE":
+		return RemoveWorkspaceMember(ctx, request)
+	case strings.HasSuffix(request.Resource, "/members") && request.HTTPMethod == "GET":
+		return ListWorkspaceMembers(ctx, request)
+	case strings.HasSuffix(request.Resource, "/members") && request.HTTPMethod == "POST":
+		return PutWorkspaceMember(ctx, request)
+	case request.HTTPMethod == "GET":
+		return ListWorkspaces(ctx, request)
+	case request.HTTPMethod == "POST":
+		return CreateWorkspace(ctx, request)
+	}
+	return events.APIGatewayProxyResponse{
+		StatusCode: 405,
+		Body:       `{"error": "Method not allowed"}`,
+	}, nil
+}
+
+// Creates a workspace owned by the authenticated user
+func CreateWorkspace(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	principal, resp, ok := requirePrincipal(ctx, db.ScopeLinksWrite)
+	if !ok {
+		return resp, nil
+	}
+	userID := principal.UserID
+
+	var req CreateWorkspaceRequest
+	if err := json.Unmarshal([]byte(request.Body), &req); err != nil || strings.TrimSpace(req.Name) == "" {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 400,
+			Body:       `{"error": "Invalid request body"}`,
+		}, nil
+	}
+
+	now := time.Now().Format(time.RFC3339)
+	workspace := db.Workspace{
+		ID:        uuid.NewString(),
+		Name:      strings.TrimSpace(req.Name),
+		CreatedBy: userID,
+		CreatedAt: now,
+	}
+	owner := db.WorkspaceMember{
+		WorkspaceID: workspace.ID,
+		UserID:      userID,
+		Role:        db.RoleOwner,
+		JoinedAt:    now,
+	}
+
+	if err := db.CreateWorkspace(ctx, workspace, owner); err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 500,
+			Body:       `{"error": "` + err.Error() + `"}`,
+		}, nil
+	}
+
+	responseBody, err := json.Marshal(WorkspaceResponse{Workspace: workspace, Role: owner.Role})
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 500,
+			Body:       `{"error": "` + err.Error() + `"}`,
+		}, nil
+	}
+	return events.APIGatewayProxyResponse{
+		StatusCode: 201,
+		Headers:    map[string]string{"Content-Type": "application/json"},
+		Body:       string(responseBody),
+	}, nil
+}
+
+// Lists the workspaces the authenticated user belongs to
+func ListWorkspaces(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	principal, resp, ok := requirePrincipal(ctx, db.ScopeLinksRead)
+	if !ok {
+		return resp, nil
+	}
+	userID := principal.UserID
+
+	memberships, err := db.ListUserMemberships(ctx, userID)
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 500,
+			Body:       `{"error": "` + err.Error() + `"}`,
+		}, nil
+	}
+
+	workspaces := make([]WorkspaceResponse, 0, len(memberships))
+	for _, membership := range memberships {
+		workspace, err := db.GetWorkspace(ctx, membership.WorkspaceID)
+		if err == db.ErrWorkspaceNotFound {
+			continue
+		}
+		if err != nil {
+			return events.APIGatewayProxyResponse{
+				StatusCode: 500,
+				Body:       `{"error": "` + err.Error() + `"}`,
+			}, nil
+		}
+		workspaces = append(workspaces, WorkspaceResponse{Workspace: *workspace, Role: membership.Role})
+	}
+
+	responseBody, err := json.Marshal(workspaces)
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 500,
+			Body:       `{"error": "` + err.Error() + `"}`,
+		}, nil
+	}
+	return events.APIGatewayProxyResponse{
+		StatusCode: 200,
+		Headers:    map[string]string{"Content-Type": "application/json"},
+		Body:       string(responseBody),
+	}, nil
+}
+
+// Lists the members of a workspace, visible to any of its members
+func ListWorkspaceMembers(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	principal, resp, ok := requirePrincipal(ctx, db.ScopeLinksRead)
+	if !ok {
+		return resp, nil
+	}
+	userID := principal.UserID
+
+	workspaceID := request.PathParameters["workspace_id"]
+	role, err := workspaceRole(ctx, workspaceID, userID)
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 500,
+			Body:       `{"error": "` + err.Error() + `"}`,
+		}, nil
+	}
+	if !roleAtLeast(role, db.RoleViewer) {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 404,
+			Body:       `{"error": "Workspace not found"}`,
+		}, nil
+	}
+
+	members, err := db.ListWorkspaceMembers(ctx, workspaceID)
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 500,
+			Body:       `{"error": "` + err.Error() + `"}`,
+		}, nil
+	}
+
+	responseBody, err := json.Marshal(members)
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 500,
+			Body:       `{"error": "` + err.Error() + `"}`,
+		}, nil
+	}
+	return events.APIGatewayProxyResponse{
+		StatusCode: 200,
+		Headers:    map[string]string{"Content-Type": "application/json"},
+		Body:       string(responseBody),
+	}, nil
+}
+
+// Invites a user to a workspace, or changes the role of a member. Only
+// owners can manage members, and the last owner can't be demoted.
+// Invited users only join once they accept the emailed invitation. The
+// answer for an email is the same whether or not it is registered, so
+// this can't be used to find out who has an account.
+func PutWorkspaceMember(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	principal, resp, ok := requirePrincipal(ctx, db.ScopeLinksWrite)
+	if !ok {
+		return resp, nil
+	}
+	userID := principal.UserID
+
+	var req PutMemberRequest
+	if err := json.Unmarshal([]byte(request.Body), &req); err != nil || !db.ValidRole(req.Role) {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 400,
+			Body:       `{"error": "Invalid request body"}`,
+		}, nil
+	}
+
+	workspaceID := request.PathParameters["workspace_id"]
+	if resp, ok := requireWorkspaceOwner(ctx, workspaceID, userID); !ok {
+		return resp, nil
+	}
+
+	invitationSent := events.APIGatewayProxyResponse{
+		StatusCode: 202,
+		Headers:    map[string]string{"Content-Type": "application/json"},
+		Body:       `{"message": "Invitation sent"}`,
+	}
+
+	var user *db.User
+	var err error
+	switch {
+	case req.UserID != nil && *req.UserID != "":
+		user, err = db.GetUser(ctx, *req.UserID)
+		if err == db.ErrUserNotFound {
+			return events.APIGatewayProxyResponse{
+				StatusCode: 404,
+				Body:       `{"error": "User not found"}`,
+			}, nil
+		}
+	case req.Email != nil && *req.Email != "":
+		user, err = db.GetUserByEmail(ctx, *req.Email)
+		if err == db.ErrUserNotFound {
+			return invitationSent, nil
+		}
+	default:
+		return events.APIGatewayProxyResponse{
+			StatusCode: 400,
+			Body:       `{"error": "user_id or email is required"}`,
+		}, nil
+	}
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 500,
+			Body:       `{"error": "` + err.Error() + `"}`,
+		}, nil
+	}
+
+	member, err := db.GetWorkspaceMember(ctx, workspaceID, user.ID)
+	if err == db.ErrMemberNotFound {
+		if err := inviteToWorkspace(ctx, workspaceID, user, req.Role, userID); err != nil {
+			slog.ErrorContext(ctx, "invite to workspace", "workspace_id", workspaceID, "target_user_id", user.ID, "error", err)
+		}
+		return invitationSent, nil
+	}
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 500,
+			Body:       `{"error": "` + err.Error() + `"}`,
+		}, nil
+	}
+
+	if req.Role != db.RoleOwner {
+		if resp, ok := keepAnOwner(ctx, workspaceID, member.UserID); !ok {
+			return resp, nil
+		}
+	}
+
+	member.Role = req.Role
+	if err := db.PutWorkspaceMember(ctx, *member); err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 500,
+			Body:       `{"error": "` + err.Error() + `"}`,
+		}, nil
+	}
+
+	responseBody, err := json.Marshal(member)
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 500,
+			Body:       `{"error": "` + err.Error() + `"}`,
+		}, nil
+	}
+	return events.APIGatewayProxyResponse{
+		StatusCode: 200,
+		Headers:    map[string]string{"Content-Type": "application/json"},
+		Body:       string(responseBody),
+	}, nil
+}
+
+// Stores an invitation of user to a workspace with role and emails them
+// the link accepting it
+func inviteToWorkspace(ctx context.Context, workspaceID string, user *db.User, role, invitedBy string) error {
+	workspace, err := db.GetWorkspace(ctx, workspaceID)
+	if err != nil {
+		return err
+	}
+
+	secret, err := utils.RandomToken(32)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	invite := db.WorkspaceInvite{
+		WorkspaceID: workspaceID,
+		UserID:      user.ID,
+		Role:        role,
+		InvitedBy:   invitedBy,
+		TokenHash:   utils.HashToken(secret),
+		InvitedAt:   now.Format(time.RFC3339),
+		ExpiresAt:   now.Add(WorkspaceInviteTTL).Unix(),
+	}
+	if err := db.PutWorkspaceInvite(ctx, invite); err != nil {
+		return err
+	}
+
+	token := workspaceID + "." + user.ID + "." + secret
+	link := publicLink("/workspaces/invitation", url.Values{"token": {token}})
+	return Mailer.Send(ctx, mail.Message{
+		To:      user.Email,
+		Subject: "You're invited to a Shorty workspace",
+		Body: "You've been invited to join the workspace \"" + workspace.Name + "\" on Shorty as " + role + ".\n" +
+			"Open the link below to accept. It expires in " + describeTTL(WorkspaceInviteTTL) + ".\n\n" +
+			link + "\n\n" +
+			"If you don't want to join, you can ignore this email.\n",
+	})
+}
+
+// Removes a member from a workspace. Owners can remove anyone and any
+// member can leave, as long as the workspace keeps an owner.
+func RemoveWorkspaceMember(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	principal, resp, ok := requirePrincipal(ctx, db.ScopeLinksWrite)
+	if !ok {
+		return resp, nil
+	}
+	userID := principal.UserID
+
+	workspaceID := request.PathParameters["workspace_id"]
+	memberID := request.PathParameters["user_id"]
+
+	if memberID != userID {
+		if resp, ok := requireWorkspaceOwner(ctx, workspaceID, userID); !ok {
+			return resp, nil
+		}
+	}
+
+	if resp, ok := keepAnOwner(ctx, workspaceID, memberID); !ok {
+		return resp, nil
+	}
+
+	if err := db.DeleteWorkspaceMember(ctx, workspaceID, memberID); err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 500,
+			Body:       `{"error": "` + err.Error() + `"}`,
+		}, nil
+	}
+	// Also withdraws a pending invitation of the user
+	if err := db.DeleteWorkspaceInvite(ctx, workspaceID, memberID); err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 500,
+			Body:       `{"error": "` + err.Error() + `"}`,
+		}, nil
+	}
+
+	return events.APIGatewayProxyResponse{
+		StatusCode: 204,
+	}, nil
+}
+
+// Checks that userID owns the workspace, returning the error response otherwise
+func requireWorkspaceOwner(ctx context.Context, workspaceID, userID string) (events.APIGatewayProxyResponse, bool) {
+	role, err := workspaceRole(ctx, workspaceID, userID)
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 500,
+			Body:       `{"error": "` + err.Error() + `"}`,
+		}, false
+	}
+	if role == "" {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 404,
+			Body:       `{"error": "Workspace not found"}`,
+		}, false
+	}
+	if !roleAtLeast(role, db.RoleOwner) {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 403,
+			Body:       `{"error": "Only workspace owners can manage members"}`,
+		}, false
+	}
+	return events.APIGatewayProxyResponse{}, true
+}
+
+// Checks that the workspace still has an owner once memberID stops being one
+func keepAnOwner(ctx context.Context, workspaceID, memberID string) (events.APIGatewayProxyResponse, bool) {
+	members, err := db.ListWorkspaceMembers(ctx, workspaceID)
+	if err != nil {
+		return events.APIGatewayProxyResponse{
+			StatusCode: 500,
+			Body:       `{"error": "` + err.Error() + `"}`,
+		}, false
+	}
+	for _, member := range members {
+		if member.Role == db.RoleOwner && member.UserID != memberID {
+			return events.APIGatewayProxyResponse{}, true
+		}
+	}
+	for _, member := range members {
+		if member.UserID == memberID && member.Role == db.RoleOwner {
+			return events.APIGatewayProxyResponse{
+				StatusCode: 409,
+				Body:       `{"error": "A workspace must keep at least one owner"}`,
+			}, false
+		}
+	}
+	return events.APIGatewayProxyResponse{}, true
+}
+
+type AcceptInvitationRequest struct {
+	Token string `json:"token"`
+}
+
+const workspaceInvitationTitle = "Join a workspace"
+
+// WorkspaceInvitation accepts an invitation to a workspace with the
+// emailed token. The emailed link opens a page confirming it by POST.
+// The token proves the invitation reached the invited user, so no
+// session is needed.
+func WorkspaceInvitation(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	switch request.HTTPMethod {
+	case "GET":
+		return workspaceInvitationPage(request)
+	case "POST":
+		return AcceptWorkspaceInvitation(ctx, request)
+	}
+	return events.APIGatewayProxyResponse{
+		StatusCode: 405,
+		Body:       `{"error": "Method not allowed"}`,
+	}, nil
+}
+
+// Shows the page of an emailed invitation link
+func workspaceInvitationPage(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	token := request.QueryStringParameters["token"]
+	if _, _, _, ok := splitInviteToken(token); !ok {
+		return renderPage(400, formPage{Title: workspaceInvitationTitle, Message: "This invitation is invalid or has expired."})
+	}
+	return renderPage(200, formPage{
+		Title:   workspaceInvitationTitle,
+		Message: "You've been invited to join a workspace on Shorty.",
+		Token:   token,
+		Submit:  "Join the workspace",
+	})
+}
+
+// AcceptWorkspaceInvitation makes the invited user a member with the
+// invited role, as long as whoever invited them still owns the workspace
+func AcceptWorkspaceInvitation(ctx context.Context, request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	form := isFormPost(request)
+	var req AcceptInvitationRequest
+	if form {
+		values, err := parseForm(request)
+		if err != nil {
+			return formResult(form, workspaceInvitationTitle, 400, "Invalid request body")
+		}
+		req.Token = values.Get("token")
+	} else if err := json.Unmarshal([]byte(request.Body), &req); err != nil {
+		return formResult(form, workspaceInvitationTitle, 400, "Invalid request body")
+	}
+
+	invalid := "Invalid or expired invitation"
+	workspaceID, userID, secret, ok := splitInviteToken(req.Token)
+	if !ok {
+		return formResult(form, workspaceInvitationTitle, 400, invalid)
+	}
+
+	invite, err := db.GetWorkspaceInvite(ctx, workspaceID, userID)
+	if err == db.ErrInviteNotFound {
+		return formResult(form, workspaceInvitationTitle, 400, invalid)
+	}
+	if err != nil {
+		return formResult(form, workspaceInvitationTitle, 500, "Failed to get invitation")
+	}
+	if !utils.CheckTokenHash(secret, invite.TokenHash) {
+		return formResult(form, workspaceInvitationTitle, 400, invalid)
+	}
+
+	role, err := workspaceRole(ctx, workspaceID, invite.InvitedBy)
+	if err != nil {
+		return formResult(form, workspaceInvitationTitle, 500, "Failed to get workspace")
+	}
+	if role != db.RoleOwner {
+		return formResult(form, workspaceInvitationTitle, 400, invalid)
+	}
+
+	member := db.WorkspaceMember{
+		WorkspaceID: workspaceID,
+		UserID:      userID,
+		Role:        invite.Role,
+		JoinedAt:    time.Now().Format(time.RFC3339),
+	}
+	err = db.AcceptWorkspaceInvite(ctx, invite.TokenHash, member)
+	if err == db.ErrInviteNotFound {
+		return formResult(form, workspaceInvitationTitle, 400, invalid)
+	}
+	if err != nil {
+		return formResult(form, workspaceInvitationTitle, 500, "Failed to join workspace")
+	}
+
+	return formResult(form, workspaceInvitationTitle, 200, "You joined the workspace")
+}
+
+// Splits an emailed "<workspace id>.<user id>.<secret>" invitation token
+func splitInviteToken(token string) (workspaceID, userID, secret string, ok bool) {
+	parts := strings.SplitN(token, ".", 3)
+	if len(parts) != 3 || parts[0] == "" || parts[1] == "" || parts[2] == "" {
+		return "", "", "", false
+	}
+	return parts[0], parts[1], parts[2], true
+}
@@ -0,0 +1,187 @@
+package httpapi
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/SunPodder/shorty/internal/middleware"
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/google/uuid"
+)
+
+// Largest request body accepted, the payload limit of API Gateway
+const maxBodySize = 10 << 20
+
+// Route serves an API Gateway resource with the handler of its Lambda
+type Route struct {
+	// HTTP method, or ANY for all of them
+	Method string
+	// Resource as configured in API Gateway, like /links/{short_code}
+	Resource string
+	Handler  middleware.HandlerFunc
+}
+
+// Mux serves routes over plain HTTP, handing each handler the proxy
+// event API Gateway would have sent it
+type Mux struct {
+	routes []Route
+}
+
+func NewMux(routes []Route) *Mux {
+	return &Mux{routes: routes}
+}
+
+// Picks the route of a request like API Gateway does: a literal path
+// segment takes precedence over a parameter, from left to right, so
+// /preview/qr goes to /preview/{short_code} rather than /{short_code}/qr
+func (m *Mux) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	segments := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+
+	var best *Route
+	var params map[string]string
+	pathMatched := false
+	for i := range m.routes {
+		route := &m.routes[i]
+		matched, ok := matchResource(route.Resource, segments)
+		if !ok {
+			continue
+		}
+		pathMatched = true
+		if route.Method != "ANY" && route.Method != r.Method && !(route.Method == "GET" && r.Method == "HEAD") {
+			continue
+		}
+		if best == nil || moreSpecific(route.Resource, best.Resource) {
+			best, params = route, matched
+		}
+	}
+
+	switch {
+	case best != nil:
+		serve(w, r, best.Resource, params, best.Handler)
+	case pathMatched:
+		writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+	default:
+		writeError(w, http.StatusNotFound, "Not found")
+	}
+}
+
+// Returns the path parameters of resource if it matches the segments of
+// a request path
+func matchResource(resource string, segments []string) (map[string]string, bool) {
+	parts := strings.Split(strings.Trim(resource, "/"), "/")
+	if len(parts) != len(segments) {
+		return nil, false
+	}
+	params := make(map[string]string)
+	for i, part := range parts {
+		if name, ok := paramName(part); ok {
+			if segments[i] == "" {
+				return nil, false
+			}
+			params[name] = segments[i]
+		} else if part != segments[i] {
+			return nil, false
+		}
+	}
+	return params, true
+}
+
+// Reports whether resource a takes precedence over b, both matching the
+// same path
+func moreSpecific(a, b string) bool {
+	aParts := strings.Split(strings.Trim(a, "/"), "/")
+	bParts := strings.Split(strings.Trim(b, "/"), "/")
+	for i := range aParts {
+		_, aParam := paramName(aParts[i])
+		_, bParam := paramName(bParts[i])
+		if aParam != bParam {
+			return bParam
+		}
+	}
+	return false
+}
+
+// Returns the name of a {parameter} path segment
+func paramName(part string) (string, bool) {
+	if strings.HasPrefix(part, "{") && strings.HasSuffix(part, "}") {
+		return part[1 : len(part)-1], true
+	}
+	return "", false
+}
+
+// Hands a request to the Lambda handler serving resource
+func serve(w http.ResponseWriter, r *http.Request, resource string, params map[string]string, next middleware.HandlerFunc) {
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxBodySize))
+	if err != nil {
+		writeError(w, http.StatusRequestEntityTooLarge, "Request body too large")
+		return
+	}
+
+	request := events.APIGatewayProxyRequest{
+		Resource:                        resource,
+		Path:                            r.URL.Path,
+		HTTPMethod:                      r.Method,
+		Headers:                         make(map[string]string, len(r.Header)),
+		MultiValueHeaders:               r.Header,
+		QueryStringParameters:           make(map[string]string),
+		MultiValueQueryStringParameters: r.URL.Query(),
+		Body:                            string(body),
+	}
+	for name, values := range r.Header {
+		request.Headers[name] = values[0]
+	}
+	for name, values := range r.URL.Query() {
+		request.QueryStringParameters[name] = values[0]
+	}
+	if len(params) > 0 {
+		request.PathParameters = params
+	}
+	request.RequestContext.RequestID = uuid.NewString()
+	request.RequestContext.ResourcePath = resource
+	request.RequestContext.HTTPMethod = r.Method
+	request.RequestContext.Identity.SourceIP, _, _ = net.SplitHostPort(r.RemoteAddr)
+	request.RequestContext.Identity.UserAgent = r.UserAgent()
+
+	resp, err := next(r.Context(), request)
+	if err != nil {
+		// API Gateway hides the error of a failed invocation too
+		slog.ErrorContext(r.Context(), "handler failed", "resource", resource, "error", err)
+		writeError(w, http.StatusBadGateway, "Internal server error")
+		return
+	}
+
+	for name, value := range resp.Headers {
+		w.Header().Set(name, value)
+	}
+	for name, values := range resp.MultiValueHeaders {
+		for _, value := range values {
+			w.Header().Add(name, value)
+		}
+	}
+	out := []byte(resp.Body)
+	if resp.IsBase64Encoded {
+		if out, err = base64.StdEncoding.DecodeString(resp.Body); err != nil {
+			slog.ErrorContext(r.Context(), "decode response body", "resource", resource, "error", err)
+			writeError(w, http.StatusBadGateway, "Internal server error")
+			return
+		}
+	}
+	status := resp.StatusCode
+	if status == 0 {
+		status = http.StatusOK
+	}
+	w.WriteHeader(status)
+	w.Write(out)
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	body, _ := json.Marshal(map[string]string{"error": message})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(body)
+}
@@ -0,0 +1,120 @@
+package logging
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+var ErrInvalidLevel = errors.New("invalid log level: must be debug, info, warn or error")
+
+// New creates a logger writing JSON lines to w. Lines logged with a
+// request context carry the fields of the request, and sensitive values
+// are redacted.
+func New(w io.Writer, level slog.Level) *slog.Logger {
+	return slog.New(&contextHandler{slog.NewJSONHandler(w, &slog.HandlerOptions{
+		Level:       level,
+		ReplaceAttr: redactAttr,
+	})})
+}
+
+// NewFromEnv creates a logger writing to stdout at the level selected by
+// LOG_LEVEL, which defaults to info
+func NewFromEnv() (*slog.Logger, error) {
+	var level slog.Level
+	switch strings.ToLower(os.Getenv("LOG_LEVEL")) {
+	case "debug":
+		level = slog.LevelDebug
+	case "", "info":
+		level = slog.LevelInfo
+	case "warn":
+		level = slog.LevelWarn
+	case "error":
+		level = slog.LevelError
+	default:
+		return nil, ErrInvalidLevel
+	}
+	return New(os.Stdout, level), nil
+}
+
+// Fields of the request being served. The user is only known once the
+// request is authenticated, so the fields are shared and filled in as
+// the request goes through the middleware.
+type requestFields struct {
+	mu        sync.Mutex
+	requestID string
+	route     string
+	userID    string
+	apiKeyID  string
+}
+
+type fieldsKey struct{}
+
+// WithRequest returns a copy of ctx whose log lines carry the request ID
+// and route of the request
+func WithRequest(ctx context.Context, requestID, route string) context.Context {
+	return context.WithValue(ctx, fieldsKey{}, &requestFields{requestID: requestID, route: route})
+}
+
+// SetUser records the authenticated caller of the request in ctx, so the
+// following log lines carry it
+func SetUser(ctx context.Context, userID, apiKeyID string) {
+	fields, ok := ctx.Value(fieldsKey{}).(*requestFields)
+	if !ok {
+		return
+	}
+	fields.mu.Lock()
+	defer fields.mu.Unlock()
+	fields.userID = userID
+	fields.apiKeyID = apiKeyID
+}
+
+// Returns the attributes of the request in ctx
+func requestAttrs(ctx context.Context) []slog.Attr {
+	if ctx == nil {
+		return nil
+	}
+	fields, ok := ctx.Value(fieldsKey{}).(*requestFields)
+	if !ok {
+		return nil
+	}
+	fields.mu.Lock()
+	defer fields.mu.Unlock()
+
+	attrs := []slog.Attr{slog.String("request_id", fields.requestID), slog.String("route", fields.route)}
+	if fields.userID != "" {
+		attrs = append(attrs, slog.String("user_id", fields.userID))
+	}
+	if fields.apiKeyID != "" {
+		attrs = append(attrs, slog.String("api_key_id", fields.apiKeyID))
+	}
+	return attrs
+}
+
+// Adds the fields of the request and the trace in the context to every
+// record
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h *contextHandler) Handle(ctx context.Context, record slog.Record) error {
+	record.AddAttrs(requestAttrs(ctx)...)
+	if span := trace.SpanContextFromContext(ctx); span.IsValid() {
+		record.AddAttrs(slog.String("trace_id", span.TraceID().String()))
+	}
+	return h.Handler.Handle(ctx, record)
+}
+
+func (h *contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h *contextHandler) WithGroup(name string) slog.Handler {
+	return &contextHandler{h.Handler.WithGroup(name)}
+}
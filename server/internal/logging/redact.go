@@ -0,0 +1,59 @@
+package logging
+
+import (
+	"log/slog"
+	"regexp"
+	"strings"
+
+	"github.com/SunPodder/shorty/utils"
+)
+
+const redacted = "[REDACTED]"
+
+// Keys whose values are never logged
+var sensitiveKeys = map[string]bool{
+	"password":      true,
+	"token":         true,
+	"secret":        true,
+	"authorization": true,
+	"cookie":        true,
+	"api_key":       true,
+	"code":          true,
+}
+
+var (
+	emailPattern  = regexp.MustCompile(`([A-Za-z0-9._%+-])[A-Za-z0-9._%+-]*@([A-Za-z0-9.-]+\.[A-Za-z]{2,})`)
+	bearerPattern = regexp.MustCompile(`(?i)\bbearer\s+\S+`)
+	jwtPattern    = regexp.MustCompile(`\beyJ[\w-]*\.[\w-]+\.[\w-]+`)
+	// API keys look like shorty_<hex id>_<hex secret>, unlike table names
+	apiKeyPattern = regexp.MustCompile(`\b` + regexp.QuoteMeta(utils.APIKeyPrefix) + `[0-9a-f]+_[0-9a-f]+\b`)
+	// Tokens passed in query strings, such as verification and reset links
+	queryTokenPattern = regexp.MustCompile(`(?i)([?&](?:token|code|secret|password)=)[^&\s"]+`)
+)
+
+// Redact masks the emails in s, keeping their first letter and domain,
+// and removes bearer tokens, JWTs, API keys and tokens in query strings
+func Redact(s string) string {
+	s = bearerPattern.ReplaceAllString(s, "Bearer "+redacted)
+	s = jwtPattern.ReplaceAllString(s, redacted)
+	s = apiKeyPattern.ReplaceAllString(s, redacted)
+	s = queryTokenPattern.ReplaceAllString(s, "${1}"+redacted)
+	return emailPattern.ReplaceAllString(s, "${1}***@${2}")
+}
+
+// Redacts the value of an attribute before it's written
+func redactAttr(groups []string, attr slog.Attr) slog.Attr {
+	if sensitiveKeys[strings.ToLower(attr.Key)] {
+		return slog.String(attr.Key, redacted)
+	}
+
+	switch attr.Value.Kind() {
+	case slog.KindString:
+		return slog.String(attr.Key, Redact(attr.Value.String()))
+	case slog.KindAny:
+		if err, ok := attr.Value.Any().(error); ok {
+			return slog.String(attr.Key, Redact(err.Error()))
+		}
+	}
+	return attr
+}
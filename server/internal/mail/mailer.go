@@ -0,0 +1,64 @@
+package mail
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"os"
+)
+
+// Message is a plain text email
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer sends emails. It is an interface so deployments can choose how
+// mail is delivered and tests can capture what would have been sent.
+type Mailer interface {
+	Send(ctx context.Context, msg Message) error
+}
+
+// LogMailer writes messages to the log instead of sending them,
+// which is enough for local development
+type LogMailer struct{}
+
+func NewLogMailer() *LogMailer {
+	return &LogMailer{}
+}
+
+func (m *LogMailer) Send(ctx context.Context, msg Message) error {
+	log.Printf("mail to %s: %s\n%s", msg.To, msg.Subject, msg.Body)
+	return nil
+}
+
+var ErrInvalidMailer = errors.New("invalid mailer: must be log, file or smtp")
+
+// NewFromEnv creates the mailer selected by MAILER, which defaults to log.
+// The file mailer writes to MAIL_FILE, the SMTP mailer sends from
+// MAIL_FROM through SMTP_HOST, SMTP_PORT, SMTP_USERNAME and SMTP_PASSWORD.
+func NewFromEnv() (Mailer, error) {
+	switch os.Getenv("MAILER") {
+	case "", "log":
+		return NewLogMailer(), nil
+	case "file":
+		path := os.Getenv("MAIL_FILE")
+		if path == "" {
+			return nil, errors.New("MAIL_FILE is required for the file mailer")
+		}
+		return NewFileMailer(path), nil
+	case "smtp":
+		host, from := os.Getenv("SMTP_HOST"), os.Getenv("MAIL_FROM")
+		if host == "" || from == "" {
+			return nil, errors.New("SMTP_HOST and MAIL_FROM are required for the smtp mailer")
+		}
+		port := os.Getenv("SMTP_PORT")
+		if port == "" {
+			port = "587"
+		}
+		return NewSMTPMailer(net.JoinHostPort(host, port), os.Getenv("SMTP_USERNAME"), os.Getenv("SMTP_PASSWORD"), from), nil
+	}
+	return nil, ErrInvalidMailer
+}
@@ -0,0 +1,158 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"strings"
+
+	"github.com/SunPodder/shorty/internal/db"
+	"github.com/SunPodder/shorty/internal/logging"
+	"github.com/SunPodder/shorty/utils"
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// AuthMode controls how WithAuth treats requests without credentials
+type AuthMode int
+
+const (
+	// AuthRequired rejects requests without valid credentials
+	AuthRequired AuthMode = iota
+	// AuthOptional lets requests without credentials through anonymously.
+	// Requests with invalid credentials are still rejected.
+	AuthOptional
+)
+
+var (
+	ErrMissingCredentials = errors.New("Authorization header missing")
+	ErrInvalidAuthHeader  = errors.New("Invalid Authorization header format")
+	ErrInvalidToken       = errors.New("Invalid or expired token")
+)
+
+// Principal is the authenticated caller of a request
+type Principal struct {
+	UserID string
+	// ID of the API key used to authenticate, empty for JWT sessions
+	APIKeyID string
+	// Scopes granted to the API key, sessions hold every scope
+	Scopes []string
+}
+
+// IsSession reports whether the principal logged in with a JWT
+// rather than an API key
+func (p *Principal) IsSession() bool {
+	return p.APIKeyID == ""
+}
+
+// HasScope reports whether the principal was granted scope
+func (p *Principal) HasScope(scope string) bool {
+	if p.IsSession() {
+		return true
+	}
+	for _, s := range p.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+type principalKey struct{}
+
+// WithPrincipal returns a copy of ctx carrying the principal
+func WithPrincipal(ctx context.Context, principal *Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, principal)
+}
+
+// PrincipalFromContext returns the principal stored by WithAuth, if any
+func PrincipalFromContext(ctx context.Context) (*Principal, bool) {
+	principal, ok := ctx.Value(principalKey{}).(*Principal)
+	return principal, ok && principal != nil
+}
+
+// WithAuth authenticates the bearer token of the request, which is either
+// a JWT or an API key, and stores the resulting Principal in the context
+func WithAuth(mode AuthMode, next HandlerFunc) HandlerFunc {
+	return func(ctx context.Context, req events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+		token, err := bearerToken(req.Headers)
+		if err == ErrMissingCredentials && mode == AuthOptional {
+			return next(ctx, req)
+		}
+		if err != nil {
+			slog.InfoContext(ctx, "rejected request", "error", err)
+			return unauthorized(err), nil
+		}
+
+		principal, err := Authenticate(ctx, token)
+		if err != nil {
+			slog.InfoContext(ctx, "rejected request", "error", err)
+			return unauthorized(err), nil
+		}
+
+		return next(WithPrincipal(ctx, principal), req)
+	}
+}
+
+// Authenticate validates a JWT or API key and returns its principal
+func Authenticate(ctx context.Context, token string) (*Principal, error) {
+	if !utils.IsAPIKey(token) {
+		userID, issuedAt, err := utils.ParseSessionJWT(token)
+		if err != nil {
+			return nil, ErrInvalidToken
+		}
+
+		// Sessions are revoked by moving the user's cut-off time past them
+		user, err := db.GetUser(ctx, userID)
+		if err != nil || issuedAt.Unix() < user.SessionsValidAfter || user.Disabled() {
+			return nil, ErrInvalidToken
+		}
+		logging.SetUser(ctx, userID, "")
+		return &Principal{UserID: userID}, nil
+	}
+
+	id, ok := utils.ParseAPIKey(token)
+	if !ok {
+		return nil, ErrInvalidToken
+	}
+
+	key, err := db.GetAPIKey(ctx, id)
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	if !utils.CheckAPIKeyHash(token, key.KeyHash) || !key.Active() {
+		return nil, ErrInvalidToken
+	}
+
+	if err := db.TouchAPIKey(ctx, key.ID); err != nil {
+		slog.WarnContext(ctx, "record API key usage", "api_key_id", key.ID, "error", err)
+	}
+
+	logging.SetUser(ctx, key.UserID, key.ID)
+	return &Principal{UserID: key.UserID, APIKeyID: key.ID, Scopes: key.Scopes}, nil
+}
+
+// Extracts the bearer token from the Authorization header, whatever the
+// casing of the header name and of the scheme
+func bearerToken(headers map[string]string) (string, error) {
+	authHeader, ok := utils.GetHeader(headers, "Authorization")
+	if !ok || strings.TrimSpace(authHeader) == "" {
+		return "", ErrMissingCredentials
+	}
+
+	scheme, token, ok := strings.Cut(strings.TrimSpace(authHeader), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") || strings.TrimSpace(token) == "" {
+		return "", ErrInvalidAuthHeader
+	}
+	return strings.TrimSpace(token), nil
+}
+
+func unauthorized(err error) events.APIGatewayProxyResponse {
+	return events.APIGatewayProxyResponse{
+		StatusCode: 401,
+		Headers: map[string]string{
+			"Content-Type":     "application/json",
+			"WWW-Authenticate": "Bearer",
+		},
+		Body: `{"error": "` + err.Error() + `"}`,
+	}
+}
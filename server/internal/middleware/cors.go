@@ -2,23 +2,57 @@ package middleware
 
 import (
 	"context"
+	"strings"
 
+	"github.com/SunPodder/shorty/utils"
 	"github.com/aws/aws-lambda-go/events"
 )
 
 type HandlerFunc func(context.Context, events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error)
 
+// AllowedOrigins are the origins browsers may call the API from, "*"
+// allowing any origin. It can be overridden at startup.
+var AllowedOrigins = []string{"*"}
+
+// Returns the Access-Control-Allow-Origin value for a request from
+// origin, or an empty string when the origin isn't allowed
+func allowOrigin(origin string) string {
+	for _, allowed := range AllowedOrigins {
+		if allowed == "*" {
+			return "*"
+		}
+		if origin != "" && strings.EqualFold(allowed, origin) {
+			return origin
+		}
+	}
+	return ""
+}
+
 func WithCORS(next HandlerFunc) HandlerFunc {
 	return func(ctx context.Context, req events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+		requestOrigin, _ := utils.GetHeader(req.Headers, "Origin")
+		origin := allowOrigin(requestOrigin)
+		setHeaders := func(headers map[string]string) {
+			if origin == "" {
+				return
+			}
+			headers["Access-Control-Allow-Origin"] = origin
+			headers["Access-Control-Allow-Methods"] = "GET,POST,PUT,PATCH,DELETE,OPTIONS"
+			headers["Access-Control-Allow-Headers"] = "Content-Type,Authorization"
+			if origin != "*" {
+				// The response depends on the origin, so caches must
+				// not hand it to another one
+				headers["Vary"] = "Origin"
+			}
+		}
+
 		// Handle OPTIONS preflight
 		if req.HTTPMethod == "OPTIONS" {
+			headers := make(map[string]string)
+			setHeaders(headers)
 			return events.APIGatewayProxyResponse{
 				StatusCode: 200,
-				Headers: map[string]string{
-					"Access-Control-Allow-Origin":  "*",
-					"Access-Control-Allow-Methods": "GET,POST,PUT,DELETE,OPTIONS",
-					"Access-Control-Allow-Headers": "Content-Type,Authorization",
-				},
+				Headers:    headers,
 			}, nil
 		}
 
@@ -29,9 +63,7 @@ func WithCORS(next HandlerFunc) HandlerFunc {
 		if resp.Headers == nil {
 			resp.Headers = make(map[string]string)
 		}
-		resp.Headers["Access-Control-Allow-Origin"] = "*"
-		resp.Headers["Access-Control-Allow-Methods"] = "GET,POST,PUT,DELETE,OPTIONS"
-		resp.Headers["Access-Control-Allow-Headers"] = "Content-Type,Authorization"
+		setHeaders(resp.Headers)
 
 		return resp, err
 	}
@@ -0,0 +1,59 @@
+package middleware
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"time"
+
+	"github.com/SunPodder/shorty/internal/logging"
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// WithLogging tags every log line made while serving a request with the
+// API Gateway request ID and route, and the user once WithAuth has
+// authenticated them. It logs a line for every request with its status,
+// latency and outcome, and returns the request ID in X-Request-Id.
+func WithLogging(next HandlerFunc) HandlerFunc {
+	return func(ctx context.Context, req events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+		start := time.Now()
+		requestID := req.RequestContext.RequestID
+		ctx = logging.WithRequest(ctx, requestID, req.HTTPMethod+" "+req.Resource)
+
+		resp, err := next(ctx, req)
+
+		attrs := []slog.Attr{
+			slog.Int("status", resp.StatusCode),
+			slog.Int64("latency_ms", time.Since(start).Milliseconds()),
+		}
+		level := slog.LevelInfo
+		switch {
+		case err != nil:
+			level = slog.LevelError
+			attrs = append(attrs, slog.String("outcome", "error"), slog.Any("error", err))
+		case resp.StatusCode >= 500:
+			level = slog.LevelError
+			attrs = append(attrs, slog.String("outcome", "server_error"))
+			// Handlers report what went wrong in the body of the response
+			var body struct {
+				Error string `json:"error"`
+			}
+			if json.Unmarshal([]byte(resp.Body), &body) == nil && body.Error != "" {
+				attrs = append(attrs, slog.String("error", body.Error))
+			}
+		case resp.StatusCode >= 400:
+			attrs = append(attrs, slog.String("outcome", "client_error"))
+		default:
+			attrs = append(attrs, slog.String("outcome", "success"))
+		}
+		slog.LogAttrs(ctx, level, "request", attrs...)
+
+		if requestID != "" {
+			if resp.Headers == nil {
+				resp.Headers = make(map[string]string)
+			}
+			resp.Headers["X-Request-Id"] = requestID
+		}
+		return resp, err
+	}
+}
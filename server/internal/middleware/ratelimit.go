@@ -0,0 +1,323 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/SunPodder/shorty/internal/db"
+	"github.com/SunPodder/shorty/utils"
+	"github.com/aws/aws-lambda-go/events"
+)
+
+var (
+	ErrInvalidRateLimit      = errors.New("invalid rate limit: expected <requests>/<duration>, e.g. 5/1m")
+	ErrInvalidRateLimitStore = errors.New("invalid rate limit store: must be memory or dynamodb")
+)
+
+// KeyFunc derives the bucket key of a request. Keys from different
+// functions never collide because each carries its own prefix.
+type KeyFunc func(ctx context.Context, req events.APIGatewayProxyRequest) string
+
+// KeyByIP keys requests by the caller's source IP
+func KeyByIP(ctx context.Context, req events.APIGatewayProxyRequest) string {
+	return "ip:" + ClientIP(req)
+}
+
+// KeyByPrincipal keys requests by the API key or user that made them,
+// falling back to the source IP for anonymous requests. It must run
+// after WithAuth to see the principal.
+func KeyByPrincipal(ctx context.Context, req events.APIGatewayProxyRequest) string {
+	principal, ok := PrincipalFromContext(ctx)
+	switch {
+	case !ok:
+		return KeyByIP(ctx, req)
+	case principal.APIKeyID != "":
+		return "key:" + principal.APIKeyID
+	default:
+		return "user:" + principal.UserID
+	}
+}
+
+// RateLimit is a token bucket holding up to Requests tokens that refills
+// completely over Per. Every request takes one token.
+type RateLimit struct {
+	// Route names the limited endpoint so routes don't share buckets
+	Route    string
+	Requests int
+	Per      time.Duration
+	Key      KeyFunc
+}
+
+// Default limits of the rate limited routes
+var (
+	ShortenRateLimit = RateLimit{Route: "shorten", Requests: 30, Per: time.Minute, Key: KeyByPrincipal}
+	LoginRateLimit   = RateLimit{Route: "login", Requests: 10, Per: 5 * time.Minute, Key: KeyByIP}
+	MFARateLimit     = RateLimit{Route: "login_mfa", Requests: 10, Per: 5 * time.Minute, Key: KeyByIP}
+	ResolveRateLimit = RateLimit{Route: "resolve", Requests: 300, Per: time.Minute, Key: KeyByIP}
+	ReportRateLimit  = RateLimit{Route: "report", Requests: 10, Per: time.Hour, Key: KeyByIP}
+	QRRateLimit      = RateLimit{Route: "qr", Requests: 60, Per: time.Minute, Key: KeyByIP}
+
+	ForgotPasswordRateLimit = RateLimit{Route: "password_forgot", Requests: 5, Per: time.Hour, Key: KeyByIP}
+	ResetPasswordRateLimit  = RateLimit{Route: "password_reset", Requests: 10, Per: time.Hour, Key: KeyByIP}
+
+	ResendVerificationRateLimit = RateLimit{Route: "verify_resend", Requests: 3, Per: time.Hour, Key: KeyByPrincipal}
+)
+
+// ParseRateLimit overrides the size and period of limit from a
+// "<requests>/<duration>" string such as "10/5m"
+func ParseRateLimit(limit RateLimit, value string) (RateLimit, error) {
+	requests, per, ok := strings.Cut(value, "/")
+	if !ok {
+		return limit, ErrInvalidRateLimit
+	}
+
+	n, err := strconv.Atoi(strings.TrimSpace(requests))
+	if err != nil || n <= 0 {
+		return limit, ErrInvalidRateLimit
+	}
+	d, err := time.ParseDuration(strings.TrimSpace(per))
+	if err != nil || d <= 0 {
+		return limit, ErrInvalidRateLimit
+	}
+
+	limit.Requests = n
+	limit.Per = d
+	return limit, nil
+}
+
+// RateLimitFromEnv applies the RATE_LIMIT override to limit and creates
+// the store selected by RATE_LIMIT_STORE, which defaults to dynamodb
+func RateLimitFromEnv(limit RateLimit) (RateLimit, RateLimitStore, error) {
+	if value := os.Getenv("RATE_LIMIT"); value != "" {
+		var err error
+		if limit, err = ParseRateLimit(limit, value); err != nil {
+			return limit, nil, err
+		}
+	}
+
+	switch os.Getenv("RATE_LIMIT_STORE") {
+	case "", "dynamodb":
+		return limit, NewDynamoRateLimitStore(), nil
+	case "memory":
+		return limit, NewMemoryRateLimitStore(), nil
+	}
+	return limit, nil, ErrInvalidRateLimitStore
+}
+
+// Returns the time it takes to regain a single token
+func (l RateLimit) interval() time.Duration {
+	return l.Per / time.Duration(l.Requests)
+}
+
+// Returns how long an idle bucket takes to fill up, after which its
+// state no longer matters
+func (l RateLimit) idle(tokens float64) time.Duration {
+	return time.Duration((float64(l.Requests) - tokens) * float64(l.interval()))
+}
+
+// Refills a bucket last updated at updatedAt and takes one token from it
+// if possible. Returns the new token count and whether a token was taken.
+func (l RateLimit) take(tokens float64, updatedAt, now time.Time) (float64, bool) {
+	elapsed := now.Sub(updatedAt)
+	if elapsed > 0 {
+		tokens += float64(elapsed) / float64(l.interval())
+	}
+	tokens = math.Min(tokens, float64(l.Requests))
+
+	if tokens < 1 {
+		return tokens, false
+	}
+	return tokens - 1, true
+}
+
+// Decision is the outcome of taking a token from a bucket
+type Decision struct {
+	Allowed bool
+	// Whole tokens left in the bucket
+	Remaining int
+	// Time until the next token is available when the request was denied
+	RetryAfter time.Duration
+	// Time until the bucket is full again
+	Reset time.Duration
+}
+
+func decide(limit RateLimit, tokens float64, allowed bool) Decision {
+	decision := Decision{
+		Allowed:   allowed,
+		Remaining: int(tokens),
+		Reset:     limit.idle(tokens),
+	}
+	if !allowed {
+		decision.RetryAfter = time.Duration((1 - tokens) * float64(limit.interval()))
+	}
+	return decision
+}
+
+// RateLimitStore keeps token buckets. Take refills the bucket identified
+// by key and takes one token from it as a single atomic step.
+type RateLimitStore interface {
+	Take(ctx context.Context, key string, limit RateLimit, now time.Time) (Decision, error)
+}
+
+type memoryBucket struct {
+	tokens    float64
+	updatedAt time.Time
+}
+
+// MemoryRateLimitStore keeps buckets in process memory. Limits only hold
+// within a single Lambda instance, which makes it suited for tests and
+// local development.
+type MemoryRateLimitStore struct {
+	mu      sync.Mutex
+	buckets map[string]*memoryBucket
+}
+
+func NewMemoryRateLimitStore() *MemoryRateLimitStore {
+	return &MemoryRateLimitStore{buckets: make(map[string]*memoryBucket)}
+}
+
+func (s *MemoryRateLimitStore) Take(ctx context.Context, key string, limit RateLimit, now time.Time) (Decision, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	bucket, ok := s.buckets[key]
+	if !ok {
+		bucket = &memoryBucket{tokens: float64(limit.Requests), updatedAt: now}
+		s.buckets[key] = bucket
+	}
+
+	tokens, allowed := limit.take(bucket.tokens, bucket.updatedAt, now)
+	bucket.tokens = tokens
+	bucket.updatedAt = now
+
+	return decide(limit, tokens, allowed), nil
+}
+
+// How often DynamoRateLimitStore retries a take that lost a race
+const dynamoRateLimitAttempts = 5
+
+// DynamoRateLimitStore keeps buckets in DynamoDB so limits hold across
+// Lambda instances. Buckets are updated with conditional writes and
+// expire through the table's TTL once they are full again.
+type DynamoRateLimitStore struct{}
+
+func NewDynamoRateLimitStore() *DynamoRateLimitStore {
+	return &DynamoRateLimitStore{}
+}
+
+func (s *DynamoRateLimitStore) Take(ctx context.Context, key string, limit RateLimit, now time.Time) (Decision, error) {
+	for attempt := 0; attempt < dynamoRateLimitAttempts; attempt++ {
+		tokens := float64(limit.Requests)
+		updatedAt := now
+		var previous int64
+
+		bucket, err := db.GetRateLimitBucket(ctx, key)
+		switch {
+		case err == nil:
+			tokens = bucket.Tokens
+			updatedAt = time.UnixMilli(bucket.UpdatedAt)
+			previous = bucket.UpdatedAt
+		case !errors.Is(err, db.ErrBucketNotFound):
+			return Decision{}, err
+		}
+
+		tokens, allowed := limit.take(tokens, updatedAt, now)
+
+		// The update time doubles as the version of the bucket, so it has
+		// to change on every write even within the same millisecond
+		version := now.UnixMilli()
+		if version <= previous {
+			version = previous + 1
+		}
+
+		err = db.PutRateLimitBucket(ctx, db.RateLimitBucket{
+			Key:       key,
+			Tokens:    tokens,
+			UpdatedAt: version,
+			ExpiresAt: now.Add(limit.idle(tokens)).Add(time.Minute).Unix(),
+		}, previous)
+		if errors.Is(err, db.ErrBucketConflict) {
+			continue
+		}
+		if err != nil {
+			return Decision{}, err
+		}
+
+		return decide(limit, tokens, allowed), nil
+	}
+
+	return Decision{}, db.ErrBucketConflict
+}
+
+// ClientIP returns the caller's IP as seen by API Gateway
+func ClientIP(req events.APIGatewayProxyRequest) string {
+	if ip := req.RequestContext.Identity.SourceIP; ip != "" {
+		return ip
+	}
+	if forwarded, ok := utils.GetHeader(req.Headers, "X-Forwarded-For"); ok {
+		first, _, _ := strings.Cut(forwarded, ",")
+		return strings.TrimSpace(first)
+	}
+	return "unknown"
+}
+
+// Rounds d up to whole seconds, as used by the rate limit headers
+func ceilSeconds(d time.Duration) int64 {
+	return int64(math.Ceil(d.Seconds()))
+}
+
+// WithRateLimit rejects requests with 429 once the bucket of the caller
+// is empty and reports the state of the bucket in X-RateLimit-* headers.
+// Errors from the store are logged and the request is let through, so an
+// outage of the store doesn't take the route down with it.
+func WithRateLimit(limit RateLimit, store RateLimitStore, next HandlerFunc) HandlerFunc {
+	return func(ctx context.Context, req events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+		now := time.Now()
+		key := limit.Route + "#" + limit.Key(ctx, req)
+
+		decision, err := store.Take(ctx, key, limit, now)
+		if err != nil {
+			slog.ErrorContext(ctx, "rate limit", "limit", limit.Route, "error", err)
+			return next(ctx, req)
+		}
+
+		headers := map[string]string{
+			"X-RateLimit-Limit":     strconv.Itoa(limit.Requests),
+			"X-RateLimit-Remaining": strconv.Itoa(decision.Remaining),
+			"X-RateLimit-Reset":     strconv.FormatInt(now.Add(decision.Reset).Unix(), 10),
+		}
+
+		if !decision.Allowed {
+			retryAfter := ceilSeconds(decision.RetryAfter)
+			if retryAfter < 1 {
+				retryAfter = 1
+			}
+			headers["Retry-After"] = strconv.FormatInt(retryAfter, 10)
+			headers["Content-Type"] = "application/json"
+			return events.APIGatewayProxyResponse{
+				StatusCode: 429,
+				Headers:    headers,
+				Body:       fmt.Sprintf(`{"error": "Too many requests, retry in %d seconds"}`, retryAfter),
+			}, nil
+		}
+
+		response, err := next(ctx, req)
+		if response.Headers == nil {
+			response.Headers = make(map[string]string)
+		}
+		for name, value := range headers {
+			if _, exists := response.Headers[name]; !exists {
+				response.Headers[name] = value
+			}
+		}
+		return response, err
+	}
+}
@@ -0,0 +1,62 @@
+package middleware
+
+import (
+	"context"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/SunPodder/shorty/internal/telemetry"
+	"github.com/aws/aws-lambda-go/events"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// WithTelemetry traces every request in a span, continuing the trace of
+// the caller when it sends a traceparent header, and records the request
+// count and latency by route and status. It goes outside WithLogging so
+// log lines carry the trace ID.
+func WithTelemetry(next HandlerFunc) HandlerFunc {
+	return func(ctx context.Context, req events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+		start := time.Now()
+
+		// Header names keep the case the client sent them in
+		carrier := propagation.MapCarrier{}
+		for name, value := range req.Headers {
+			carrier[strings.ToLower(name)] = value
+		}
+		ctx = otel.GetTextMapPropagator().Extract(ctx, carrier)
+
+		route := req.HTTPMethod + " " + req.Resource
+		ctx, span := telemetry.Tracer().Start(ctx, route,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				attribute.String("http.request.method", req.HTTPMethod),
+				attribute.String("http.route", req.Resource),
+				attribute.String("aws.request_id", req.RequestContext.RequestID),
+			))
+
+		resp, err := next(ctx, req)
+
+		// A handler returning an error makes API Gateway answer 502
+		status := resp.StatusCode
+		if err != nil {
+			status = 502
+			span.RecordError(err)
+		}
+		span.SetAttributes(attribute.Int("http.response.status_code", status))
+		if status >= 500 {
+			span.SetStatus(codes.Error, "")
+		}
+		span.End()
+		telemetry.RecordRequest(ctx, req.HTTPMethod, req.Resource, status, time.Since(start))
+
+		if err := telemetry.Flush(ctx); err != nil {
+			slog.WarnContext(ctx, "flush telemetry", "error", err)
+		}
+		return resp, err
+	}
+}
@@ -0,0 +1,269 @@
+package oidc
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/SunPodder/shorty/internal/telemetry"
+	"github.com/SunPodder/shorty/utils"
+)
+
+var (
+	ErrDiscovery     = errors.New("oidc discovery failed")
+	ErrTokenExchange = errors.New("oidc token exchange failed")
+	ErrInvalidToken  = errors.New("invalid oidc id token")
+)
+
+// Config describes an OIDC provider users can log in with
+type Config struct {
+	// Name identifies the provider in URLs, such as /sso/{name}/login
+	Name         string   `json:"name"`
+	Issuer       string   `json:"issuer"`
+	ClientID     string   `json:"client_id"`
+	ClientSecret string   `json:"client_secret"`
+	Scopes       []string `json:"scopes,omitempty"`
+	// Callback URL registered with the provider
+	RedirectURL string `json:"redirect_url"`
+}
+
+// Claims are the claims of a verified ID token used to identify users
+type Claims struct {
+	Subject       string `json:"sub"`
+	Email         string `json:"email"`
+	EmailVerified bool   `json:"email_verified"`
+	Name          string `json:"name"`
+	Nonce         string `json:"nonce"`
+}
+
+// Endpoints published by a provider's discovery document
+type metadata struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// How long discovery documents and keys are cached
+const cacheTTL = time.Hour
+
+// Provider runs the authorization code flow with PKCE against an issuer
+type Provider struct {
+	Config Config
+	// Client used to reach the provider, http.DefaultClient if nil
+	HTTPClient *http.Client
+
+	mu        sync.Mutex
+	metadata  *metadata
+	keys      *keySet
+	fetchedAt time.Time
+}
+
+func NewProvider(config Config) *Provider {
+	if len(config.Scopes) == 0 {
+		config.Scopes = []string{"openid", "email", "profile"}
+	}
+	return &Provider{Config: config}
+}
+
+func (p *Provider) client() *http.Client {
+	if p.HTTPClient != nil {
+		return p.HTTPClient
+	}
+	return http.DefaultClient
+}
+
+// Returns the discovery document and keys of the provider, fetching
+// them when they aren't cached or refresh is set
+func (p *Provider) discover(ctx context.Context, refresh bool) (*metadata, *keySet, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if !refresh && p.metadata != nil && time.Since(p.fetchedAt) < cacheTTL {
+		telemetry.RecordCacheLookup(ctx, "oidc_discovery", true)
+		return p.metadata, p.keys, nil
+	}
+	telemetry.RecordCacheLookup(ctx, "oidc_discovery", false)
+
+	var meta metadata
+	wellKnown := strings.TrimSuffix(p.Config.Issuer, "/") + "/.well-known/openid-configuration"
+	if err := p.getJSON(ctx, wellKnown, &meta); err != nil {
+		return nil, nil, err
+	}
+	if meta.Issuer != p.Config.Issuer || meta.AuthorizationEndpoint == "" || meta.TokenEndpoint == "" || meta.JWKSURI == "" {
+		return nil, nil, fmt.Errorf("%w: incomplete discovery document", ErrDiscovery)
+	}
+
+	var keys keySet
+	if err := p.getJSON(ctx, meta.JWKSURI, &keys); err != nil {
+		return nil, nil, err
+	}
+
+	p.metadata, p.keys, p.fetchedAt = &meta, &keys, time.Now()
+	return p.metadata, p.keys, nil
+}
+
+func (p *Provider) getJSON(ctx context.Context, url string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := p.client().Do(req)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrDiscovery, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%w: %s returned %d", ErrDiscovery, url, resp.StatusCode)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(v)
+}
+
+// AuthRequest holds the values of an authorization request that have to
+// be kept until the callback
+type AuthRequest struct {
+	State    string
+	Nonce    string
+	Verifier string
+}
+
+// NewAuthRequest generates the random state, nonce and PKCE verifier of
+// a new login attempt
+func NewAuthRequest() (AuthRequest, error) {
+	var values [3]string
+	for i := range values {
+		token, err := utils.RandomToken(32)
+		if err != nil {
+			return AuthRequest{}, err
+		}
+		values[i] = token
+	}
+	return AuthRequest{State: values[0], Nonce: values[1], Verifier: values[2]}, nil
+}
+
+// CodeChallenge returns the S256 PKCE challenge of verifier
+func CodeChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// AuthURL returns the URL of the provider's login page for req
+func (p *Provider) AuthURL(ctx context.Context, req AuthRequest) (string, error) {
+	meta, _, err := p.discover(ctx, false)
+	if err != nil {
+		return "", err
+	}
+
+	query := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {p.Config.ClientID},
+		"redirect_uri":          {p.Config.RedirectURL},
+		"scope":                 {strings.Join(p.Config.Scopes, " ")},
+		"state":                 {req.State},
+		"nonce":                 {req.Nonce},
+		"code_challenge":        {CodeChallenge(req.Verifier)},
+		"code_challenge_method": {"S256"},
+	}
+
+	separator := "?"
+	if strings.Contains(meta.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+	return meta.AuthorizationEndpoint + separator + query.Encode(), nil
+}
+
+// Exchange redeems an authorization code and returns the claims of the
+// verified ID token, which must carry the nonce of req
+func (p *Provider) Exchange(ctx context.Context, code string, req AuthRequest) (*Claims, error) {
+	meta, _, err := p.discover(ctx, false)
+	if err != nil {
+		return nil, err
+	}
+
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {p.Config.RedirectURL},
+		"client_id":     {p.Config.ClientID},
+		"code_verifier": {req.Verifier},
+	}
+	if p.Config.ClientSecret != "" {
+		form.Set("client_secret", p.Config.ClientSecret)
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, meta.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	httpReq.Header.Set("Accept", "application/json")
+
+	resp, err := p.client().Do(httpReq)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrTokenExchange, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%w: token endpoint returned %d", ErrTokenExchange, resp.StatusCode)
+	}
+
+	var tokens struct {
+		IDToken string `json:"id_token"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&tokens); err != nil || tokens.IDToken == "" {
+		return nil, fmt.Errorf("%w: no id token in response", ErrTokenExchange)
+	}
+
+	claims, err := p.verify(ctx, tokens.IDToken)
+	if err != nil {
+		return nil, err
+	}
+	if claims.Nonce != req.Nonce {
+		return nil, fmt.Errorf("%w: nonce mismatch", ErrInvalidToken)
+	}
+	return claims, nil
+}
+
+// ProvidersFromEnv creates the providers configured in OIDC_PROVIDERS,
+// a JSON array of Config. Providers without a redirect_url get
+// <publicURL>/sso/<name>/callback.
+func ProvidersFromEnv(publicURL string) (map[string]*Provider, error) {
+	providers := make(map[string]*Provider)
+
+	value := os.Getenv("OIDC_PROVIDERS")
+	if value == "" {
+		return providers, nil
+	}
+
+	var configs []Config
+	if err := json.Unmarshal([]byte(value), &configs); err != nil {
+		return nil, fmt.Errorf("invalid OIDC_PROVIDERS: %v", err)
+	}
+
+	for _, config := range configs {
+		if config.Name == "" || config.Issuer == "" || config.ClientID == "" {
+			return nil, errors.New("invalid OIDC_PROVIDERS: name, issuer and client_id are required")
+		}
+		if _, exists := providers[config.Name]; exists {
+			return nil, fmt.Errorf("invalid OIDC_PROVIDERS: duplicate provider %q", config.Name)
+		}
+		if config.RedirectURL == "" {
+			config.RedirectURL = strings.TrimSuffix(publicURL, "/") + "/sso/" + url.PathEscape(config.Name) + "/callback"
+		}
+		providers[config.Name] = NewProvider(config)
+	}
+
+	return providers, nil
+}
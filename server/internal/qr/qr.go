@@ -0,0 +1,250 @@
+package qr
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	_ "image/jpeg"
+	"image/png"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/skip2/go-qrcode"
+)
+
+// Share of the code's width a logo may cover. Covered modules have to be
+// recovered through error correction, so logos need level Q or higher.
+const logoRatio = 0.2
+
+var ErrInvalidColor = errors.New("invalid color: expected RGB, RRGGBB or RRGGBBAA in hex")
+
+// Options control how a code is drawn
+type Options struct {
+	// Width and height of the image in pixels. PNG codes are never drawn
+	// smaller than one pixel per module.
+	Size  int
+	Level qrcode.RecoveryLevel
+	// Width of the quiet zone around the code in modules
+	Margin     int
+	Foreground color.RGBA
+	Background color.RGBA
+	// Drawn over the centre of the code when set
+	Logo image.Image
+}
+
+// ParseLevel parses an error correction level from L, M, Q or H
+func ParseLevel(value string) (qrcode.RecoveryLevel, bool) {
+	switch strings.ToUpper(value) {
+	case "L":
+		return qrcode.Low, true
+	case "M":
+		return qrcode.Medium, true
+	case "Q":
+		return qrcode.High, true
+	case "H":
+		return qrcode.Highest, true
+	}
+	return 0, false
+}
+
+// ParseColor parses a hex color with an optional leading #
+func ParseColor(value string) (color.RGBA, error) {
+	value = strings.TrimPrefix(value, "#")
+	if len(value) == 3 {
+		value = string([]byte{value[0], value[0], value[1], value[1], value[2], value[2]})
+	}
+	if len(value) == 6 {
+		value += "ff"
+	}
+	if len(value) != 8 {
+		return color.RGBA{}, ErrInvalidColor
+	}
+	n, err := strconv.ParseUint(value, 16, 32)
+	if err != nil {
+		return color.RGBA{}, ErrInvalidColor
+	}
+	return color.RGBA{R: uint8(n >> 24), G: uint8(n >> 16), B: uint8(n >> 8), A: uint8(n)}, nil
+}
+
+// Returns the modules of the code for content, true for dark ones,
+// surrounded by the margin
+func modules(content string, opts Options) ([][]bool, error) {
+	level := opts.Level
+	if opts.Logo != nil && level < qrcode.High {
+		level = qrcode.High
+	}
+	code, err := qrcode.New(content, level)
+	if err != nil {
+		return nil, err
+	}
+	code.DisableBorder = true
+	bitmap := code.Bitmap()
+
+	total := len(bitmap) + 2*opts.Margin
+	grid := make([][]bool, total)
+	for y := range grid {
+		grid[y] = make([]bool, total)
+	}
+	for y, row := range bitmap {
+		copy(grid[y+opts.Margin][opts.Margin:], row)
+	}
+	return grid, nil
+}
+
+// Returns the side of the square covered by the logo in a code of total
+// modules, keeping its parity so the square stays centred
+func logoModules(total int) int {
+	side := int(float64(total) * logoRatio)
+	if side%2 != total%2 {
+		side++
+	}
+	return side
+}
+
+// PNG draws the code for content as a PNG image
+func PNG(content string, opts Options) ([]byte, error) {
+	grid, err := modules(content, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	total := len(grid)
+	scale := opts.Size / total
+	if scale < 1 {
+		scale = 1
+	}
+	size := opts.Size
+	if size < total*scale {
+		size = total * scale
+	}
+	offset := (size - total*scale) / 2
+
+	img := image.NewRGBA(image.Rect(0, 0, size, size))
+	draw.Draw(img, img.Bounds(), &image.Uniform{opts.Background}, image.Point{}, draw.Src)
+	fg := &image.Uniform{opts.Foreground}
+	for y, row := range grid {
+		for x, dark := range row {
+			if dark {
+				rect := image.Rect(offset+x*scale, offset+y*scale, offset+(x+1)*scale, offset+(y+1)*scale)
+				draw.Draw(img, rect, fg, image.Point{}, draw.Src)
+			}
+		}
+	}
+
+	if opts.Logo != nil {
+		side := logoModules(total) * scale
+		start := offset + (total*scale-side)/2
+		box := image.Rect(start, start, start+side, start+side)
+		draw.Draw(img, box, &image.Uniform{opts.Background}, image.Point{}, draw.Src)
+		// Keep a module of padding between the code and the logo
+		draw.Draw(img, box.Inset(scale), fitLogo(opts.Logo, side-2*scale), image.Point{}, draw.Over)
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Scales logo with nearest neighbour sampling to fit a square of side
+// pixels, centred and keeping its aspect ratio
+func fitLogo(logo image.Image, side int) image.Image {
+	bounds := logo.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	out := image.NewRGBA(image.Rect(0, 0, side, side))
+	if w == 0 || h == 0 || side <= 0 {
+		return out
+	}
+
+	scale := float64(side) / float64(max(w, h))
+	dw, dh := int(float64(w)*scale), int(float64(h)*scale)
+	ox, oy := (side-dw)/2, (side-dh)/2
+	for y := 0; y < dh; y++ {
+		for x := 0; x < dw; x++ {
+			src := logo.At(bounds.Min.X+int(float64(x)/scale), bounds.Min.Y+int(float64(y)/scale))
+			out.Set(ox+x, oy+y, src)
+		}
+	}
+	return out
+}
+
+// SVG draws the code for content as an SVG image, one unit per module
+func SVG(content string, opts Options) ([]byte, error) {
+	grid, err := modules(content, opts)
+	if err != nil {
+		return nil, err
+	}
+	total := len(grid)
+
+	var logo []byte
+	side := 0
+	if opts.Logo != nil {
+		side = logoModules(total)
+		var buf bytes.Buffer
+		if err := png.Encode(&buf, opts.Logo); err != nil {
+			return nil, err
+		}
+		logo = buf.Bytes()
+	}
+	start := (total - side) / 2
+
+	var path strings.Builder
+	for y, row := range grid {
+		for x, dark := range row {
+			if !dark || (side > 0 && x >= start && x < start+side && y >= start && y < start+side) {
+				continue
+			}
+			fmt.Fprintf(&path, "M%d %dh1v1h-1z", x, y)
+		}
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d" shape-rendering="crispEdges">`,
+		opts.Size, opts.Size, total, total)
+	fmt.Fprintf(&buf, `<rect width="%d" height="%d"%s/>`, total, total, svgFill(opts.Background))
+	fmt.Fprintf(&buf, `<path d="%s"%s/>`, path.String(), svgFill(opts.Foreground))
+	if logo != nil {
+		fmt.Fprintf(&buf, `<image x="%d" y="%d" width="%d" height="%d" preserveAspectRatio="xMidYMid meet" href="data:image/png;base64,%s"/>`,
+			start+1, start+1, side-2, side-2, base64.StdEncoding.EncodeToString(logo))
+	}
+	buf.WriteString(`</svg>`)
+	return buf.Bytes(), nil
+}
+
+func svgFill(c color.RGBA) string {
+	fill := fmt.Sprintf(` fill="#%02x%02x%02x"`, c.R, c.G, c.B)
+	if c.A != 0xff {
+		fill += fmt.Sprintf(` fill-opacity="%.3f"`, float64(c.A)/0xff)
+	}
+	return fill
+}
+
+// LoadLogo decodes the PNG or JPEG logo at path
+func LoadLogo(path string) (image.Image, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	logo, _, err := image.Decode(file)
+	if err != nil {
+		return nil, fmt.Errorf("qr logo %s: %w", path, err)
+	}
+	return logo, nil
+}
+
+// LogoFromEnv loads the logo at QR_LOGO_FILE, if any
+func LogoFromEnv() (image.Image, error) {
+	path := os.Getenv("QR_LOGO_FILE")
+	if path == "" {
+		return nil, nil
+	}
+	return LoadLogo(path)
+}
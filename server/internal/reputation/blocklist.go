@@ -0,0 +1,87 @@
+package reputation
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// Blocklist flags URLs on a blocked domain or any of its subdomains, and
+// URLs matching a blocked pattern
+type Blocklist struct {
+	domains  map[string]bool
+	patterns []*regexp.Regexp
+}
+
+// ParseBlocklist reads a blocklist with one entry per line. Entries are
+// domains, or regular expressions matched against the whole URL when
+// prefixed with "re:". Blank lines and lines starting with # are ignored.
+func ParseBlocklist(r io.Reader) (*Blocklist, error) {
+	blocklist := &Blocklist{domains: make(map[string]bool)}
+
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		entry := strings.TrimSpace(scanner.Text())
+		if entry == "" || strings.HasPrefix(entry, "#") {
+			continue
+		}
+
+		if pattern, ok := strings.CutPrefix(entry, "re:"); ok {
+			re, err := regexp.Compile(strings.TrimSpace(pattern))
+			if err != nil {
+				return nil, fmt.Errorf("blocklist line %d: %w", line, err)
+			}
+			blocklist.patterns = append(blocklist.patterns, re)
+			continue
+		}
+		blocklist.domains[normalizeHost(entry)] = true
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return blocklist, nil
+}
+
+// LoadBlocklist reads the blocklist file at path
+func LoadBlocklist(path string) (*Blocklist, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return ParseBlocklist(file)
+}
+
+func (b *Blocklist) Check(ctx context.Context, rawURL string) (Verdict, error) {
+	if u, err := url.Parse(rawURL); err == nil {
+		// Walk up from the host to its parent domains
+		for host := normalizeHost(u.Hostname()); host != ""; {
+			if b.domains[host] {
+				return Verdict{Flagged: true, Source: "blocklist", Threat: host}, nil
+			}
+			_, parent, ok := strings.Cut(host, ".")
+			if !ok {
+				break
+			}
+			host = parent
+		}
+	}
+
+	for _, re := range b.patterns {
+		if re.MatchString(rawURL) {
+			return Verdict{Flagged: true, Source: "blocklist", Threat: re.String()}, nil
+		}
+	}
+
+	return Verdict{}, nil
+}
+
+func normalizeHost(host string) string {
+	return strings.TrimSuffix(strings.ToLower(strings.TrimSpace(host)), ".")
+}
@@ -0,0 +1,135 @@
+package reputation
+
+import (
+	"context"
+	"errors"
+	"os"
+	"strings"
+)
+
+// Verdict is the outcome of checking a URL. The zero value means the URL
+// isn't known to be unsafe.
+type Verdict struct {
+	Flagged bool
+	// Checker that flagged the URL
+	Source string
+	// Kind of threat, such as SOCIAL_ENGINEERING or the blocklist entry
+	// the URL matched
+	Threat string
+}
+
+// Reason describes why the URL was flagged, as shown to its visitors.
+// Source and Threat are left out, the threat may be an internal
+// blocklist pattern.
+func (v Verdict) Reason() string {
+	return "Flagged as unsafe by an automated check"
+}
+
+// Checker screens URLs against a source of known malicious destinations.
+// It is an interface so deployments can choose their sources and tests
+// can decide what gets flagged.
+type Checker interface {
+	Check(ctx context.Context, rawURL string) (Verdict, error)
+}
+
+// BatchChecker is a Checker that screens many URLs at once, such as with
+// a single request to a lookup API
+type BatchChecker interface {
+	Checker
+	// CheckAll returns the verdicts of the flagged URLs of urls
+	CheckAll(ctx context.Context, urls []string) (map[string]Verdict, error)
+}
+
+// CheckAll screens urls with checker and returns the verdicts of the
+// flagged ones, in batches when checker is a BatchChecker. URLs that
+// couldn't be checked are left out and reported in the error.
+func CheckAll(ctx context.Context, checker Checker, urls []string) (map[string]Verdict, error) {
+	if batch, ok := checker.(BatchChecker); ok {
+		return batch.CheckAll(ctx, urls)
+	}
+
+	verdicts := make(map[string]Verdict)
+	var errs []error
+	for _, u := range urls {
+		verdict, err := checker.Check(ctx, u)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if verdict.Flagged {
+			verdicts[u] = verdict
+		}
+	}
+	return verdicts, errors.Join(errs...)
+}
+
+// Multi asks each of its checkers in turn and returns the first verdict
+// flagging the URL. An empty Multi flags nothing.
+type Multi []Checker
+
+func (m Multi) Check(ctx context.Context, rawURL string) (Verdict, error) {
+	var errs []error
+	for _, checker := range m {
+		verdict, err := checker.Check(ctx, rawURL)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if verdict.Flagged {
+			return verdict, nil
+		}
+	}
+	return Verdict{}, errors.Join(errs...)
+}
+
+// CheckAll asks each checker about the URLs no earlier checker flagged
+func (m Multi) CheckAll(ctx context.Context, urls []string) (map[string]Verdict, error) {
+	verdicts := make(map[string]Verdict)
+	var errs []error
+	for _, checker := range m {
+		var remaining []string
+		for _, u := range urls {
+			if _, ok := verdicts[u]; !ok {
+				remaining = append(remaining, u)
+			}
+		}
+		if len(remaining) == 0 {
+			break
+		}
+
+		flagged, err := CheckAll(ctx, checker, remaining)
+		if err != nil {
+			errs = append(errs, err)
+		}
+		for u, verdict := range flagged {
+			verdicts[u] = verdict
+		}
+	}
+	return verdicts, errors.Join(errs...)
+}
+
+// NewFromEnv creates the checkers configured in the environment: the
+// blocklist file at URL_BLOCKLIST_FILE and the Safe Browsing lookup with
+// the key in SAFE_BROWSING_API_KEY, whose endpoint can be overridden with
+// SAFE_BROWSING_URL. Without either, no URL is flagged.
+func NewFromEnv() (Checker, error) {
+	var checkers Multi
+
+	if path := os.Getenv("URL_BLOCKLIST_FILE"); path != "" {
+		blocklist, err := LoadBlocklist(path)
+		if err != nil {
+			return nil, err
+		}
+		checkers = append(checkers, blocklist)
+	}
+
+	if key := strings.TrimSpace(os.Getenv("SAFE_BROWSING_API_KEY")); key != "" {
+		client := NewSafeBrowsingClient(key)
+		if endpoint := os.Getenv("SAFE_BROWSING_URL"); endpoint != "" {
+			client.Endpoint = endpoint
+		}
+		checkers = append(checkers, NewLookupChecker("safe browsing", client))
+	}
+
+	return checkers, nil
+}
@@ -0,0 +1,148 @@
+package reputation
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// ThreatLookup looks URLs up in a list of known threats, in the style of
+// the Google Safe Browsing Lookup API
+type ThreatLookup interface {
+	// Lookup returns the threat types of each listed URL of urls. URLs
+	// that aren't listed are left out.
+	Lookup(ctx context.Context, urls []string) (map[string][]string, error)
+}
+
+// MaxLookupURLs is the most URLs LookupChecker asks about at once, the
+// limit of a Safe Browsing Lookup API request
+const MaxLookupURLs = 500
+
+// LookupChecker flags the URLs a ThreatLookup lists
+type LookupChecker struct {
+	// Name of the lookup reported as the source of verdicts
+	Name   string
+	Lookup ThreatLookup
+}
+
+func NewLookupChecker(name string, lookup ThreatLookup) *LookupChecker {
+	return &LookupChecker{Name: name, Lookup: lookup}
+}
+
+func (c *LookupChecker) Check(ctx context.Context, rawURL string) (Verdict, error) {
+	matches, err := c.Lookup.Lookup(ctx, []string{rawURL})
+	if err != nil {
+		return Verdict{}, err
+	}
+	if threats := matches[rawURL]; len(threats) > 0 {
+		return Verdict{Flagged: true, Source: c.Name, Threat: strings.Join(threats, ", ")}, nil
+	}
+	return Verdict{}, nil
+}
+
+// CheckAll looks urls up in batches of up to MaxLookupURLs
+func (c *LookupChecker) CheckAll(ctx context.Context, urls []string) (map[string]Verdict, error) {
+	verdicts := make(map[string]Verdict)
+	for start := 0; start < len(urls); start += MaxLookupURLs {
+		batch := urls[start:min(start+MaxLookupURLs, len(urls))]
+		matches, err := c.Lookup.Lookup(ctx, batch)
+		if err != nil {
+			return verdicts, err
+		}
+		for _, u := range batch {
+			if threats := matches[u]; len(threats) > 0 {
+				verdicts[u] = Verdict{Flagged: true, Source: c.Name, Threat: strings.Join(threats, ", ")}
+			}
+		}
+	}
+	return verdicts, nil
+}
+
+const defaultSafeBrowsingEndpoint = "https://safebrowsing.googleapis.com/v4/threatMatches:find"
+
+// SafeBrowsingClient looks URLs up with the Google Safe Browsing v4
+// Lookup API
+type SafeBrowsingClient struct {
+	APIKey   string
+	Endpoint string
+	Client   *http.Client
+}
+
+func NewSafeBrowsingClient(apiKey string) *SafeBrowsingClient {
+	return &SafeBrowsingClient{
+		APIKey:   apiKey,
+		Endpoint: defaultSafeBrowsingEndpoint,
+		Client:   &http.Client{Timeout: 5 * time.Second},
+	}
+}
+
+type safeBrowsingEntry struct {
+	URL string `json:"url"`
+}
+
+type safeBrowsingRequest struct {
+	Client struct {
+		ClientID      string `json:"clientId"`
+		ClientVersion string `json:"clientVersion"`
+	} `json:"client"`
+	ThreatInfo struct {
+		ThreatTypes      []string            `json:"threatTypes"`
+		PlatformTypes    []string            `json:"platformTypes"`
+		ThreatEntryTypes []string            `json:"threatEntryTypes"`
+		ThreatEntries    []safeBrowsingEntry `json:"threatEntries"`
+	} `json:"threatInfo"`
+}
+
+type safeBrowsingResponse struct {
+	Matches []struct {
+		ThreatType string            `json:"threatType"`
+		Threat     safeBrowsingEntry `json:"threat"`
+	} `json:"matches"`
+}
+
+func (c *SafeBrowsingClient) Lookup(ctx context.Context, urls []string) (map[string][]string, error) {
+	var body safeBrowsingRequest
+	body.Client.ClientID = "shorty"
+	body.Client.ClientVersion = "1.0"
+	body.ThreatInfo.ThreatTypes = []string{"MALWARE", "SOCIAL_ENGINEERING", "UNWANTED_SOFTWARE", "POTENTIALLY_HARMFUL_APPLICATION"}
+	body.ThreatInfo.PlatformTypes = []string{"ANY_PLATFORM"}
+	body.ThreatInfo.ThreatEntryTypes = []string{"URL"}
+	for _, u := range urls {
+		body.ThreatInfo.ThreatEntries = append(body.ThreatInfo.ThreatEntries, safeBrowsingEntry{URL: u})
+	}
+
+	data, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.Endpoint+"?key="+url.QueryEscape(c.APIKey), bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("safe browsing lookup: unexpected status %d", resp.StatusCode)
+	}
+
+	var result safeBrowsingResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+
+	matches := make(map[string][]string)
+	for _, match := range result.Matches {
+		matches[match.Threat.URL] = append(matches[match.Threat.URL], match.ThreatType)
+	}
+	return matches, nil
+}
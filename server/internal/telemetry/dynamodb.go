@@ -0,0 +1,100 @@
+package telemetry
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsmiddleware "github.com/aws/aws-sdk-go-v2/aws/middleware"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/smithy-go"
+	"github.com/aws/smithy-go/middleware"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Error codes DynamoDB rejects requests over capacity with
+var throttleCodes = map[string]bool{
+	"ProvisionedThroughputExceededException": true,
+	"ThrottlingException":                    true,
+	"RequestLimitExceeded":                   true,
+}
+
+// InstrumentDynamoDB adds a span and latency metric to every operation of
+// a DynamoDB client, and counts the attempts rejected by throttling. It
+// goes in the APIOptions of the client's config.
+func InstrumentDynamoDB(stack *middleware.Stack) error {
+	// Operations are measured as a whole, retries included, while the
+	// throttles are counted after the retryer so every attempt is seen
+	if err := stack.Initialize.Add(middleware.InitializeMiddlewareFunc("ShortyTelemetry", measureOperation), middleware.After); err != nil {
+		return err
+	}
+	return stack.Finalize.Add(middleware.FinalizeMiddlewareFunc("ShortyThrottles", countThrottles), middleware.After)
+}
+
+func measureOperation(ctx context.Context, in middleware.InitializeInput, next middleware.InitializeHandler) (middleware.InitializeOutput, middleware.Metadata, error) {
+	inst := current.Load()
+	operation := awsmiddleware.GetOperationName(ctx)
+	attrs := []attribute.KeyValue{
+		attribute.String("db.system.name", "aws.dynamodb"),
+		attribute.String("db.operation.name", operation),
+	}
+	if table := tableName(in.Parameters); table != "" {
+		attrs = append(attrs, attribute.String("db.collection.name", table))
+	}
+
+	ctx, span := inst.tracer.Start(ctx, "DynamoDB."+operation,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attrs...))
+	defer span.End()
+
+	start := time.Now()
+	out, metadata, err := next.HandleInitialize(ctx, in)
+	if err != nil {
+		errorType := "error"
+		var apiErr smithy.APIError
+		if errors.As(err, &apiErr) {
+			errorType = apiErr.ErrorCode()
+		}
+		attrs = append(attrs, attribute.String("error.type", errorType))
+		span.RecordError(err)
+		span.SetStatus(codes.Error, errorType)
+	}
+	inst.dbDuration.Record(ctx, time.Since(start).Seconds(), metric.WithAttributes(attrs...))
+	return out, metadata, err
+}
+
+func countThrottles(ctx context.Context, in middleware.FinalizeInput, next middleware.FinalizeHandler) (middleware.FinalizeOutput, middleware.Metadata, error) {
+	out, metadata, err := next.HandleFinalize(ctx, in)
+
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) && throttleCodes[apiErr.ErrorCode()] {
+		current.Load().dbThrottles.Add(ctx, 1, metric.WithAttributes(
+			attribute.String("db.operation.name", awsmiddleware.GetOperationName(ctx)),
+			attribute.String("error.type", apiErr.ErrorCode()),
+		))
+	}
+	return out, metadata, err
+}
+
+// Returns the table an operation works on, if it works on a single one
+func tableName(params interface{}) string {
+	switch input := params.(type) {
+	case *dynamodb.GetItemInput:
+		return aws.ToString(input.TableName)
+	case *dynamodb.PutItemInput:
+		return aws.ToString(input.TableName)
+	case *dynamodb.UpdateItemInput:
+		return aws.ToString(input.TableName)
+	case *dynamodb.DeleteItemInput:
+		return aws.ToString(input.TableName)
+	case *dynamodb.QueryInput:
+		return aws.ToString(input.TableName)
+	case *dynamodb.ScanInput:
+		return aws.ToString(input.TableName)
+	}
+	return ""
+}
@@ -0,0 +1,227 @@
+package telemetry
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetrichttp"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	otelprometheus "go.opentelemetry.io/otel/exporters/prometheus"
+	"go.opentelemetry.io/otel/metric"
+	metricnoop "go.opentelemetry.io/otel/metric/noop"
+	"go.opentelemetry.io/otel/propagation"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	tracenoop "go.opentelemetry.io/otel/trace/noop"
+)
+
+// Name of the instrumentation scope of all spans and metrics
+const scope = "github.com/SunPodder/shorty"
+
+var ErrInvalidExporter = errors.New("invalid TELEMETRY_EXPORTER: must be otlp or none")
+
+// Bucket boundaries in seconds of the latency histograms, from a fast
+// DynamoDB read up to the API Gateway timeout
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+// Options of the telemetry of a process
+type Options struct {
+	// Name of the function or binary the telemetry comes from
+	Service string
+	// Collect metrics for a Prometheus scrape endpoint, served by
+	// MetricsHandler. Only useful for long running processes.
+	Prometheus bool
+}
+
+// Provider owns the exporters of a process
+type Provider struct {
+	tracer  *sdktrace.TracerProvider
+	meter   *sdkmetric.MeterProvider
+	metrics http.Handler
+}
+
+// NewFromEnv sets up tracing and metrics for the process. Spans and
+// metrics are sent to an OpenTelemetry collector when TELEMETRY_EXPORTER
+// is otlp, configured by the standard OTEL_EXPORTER_OTLP_* variables.
+// Without an exporter the instruments are no-ops.
+func NewFromEnv(ctx context.Context, opts Options) (*Provider, error) {
+	var otlp bool
+	switch strings.ToLower(os.Getenv("TELEMETRY_EXPORTER")) {
+	case "", "none":
+	case "otlp":
+		otlp = true
+	default:
+		return nil, ErrInvalidExporter
+	}
+
+	p := &Provider{}
+	if !otlp && !opts.Prometheus {
+		return p, nil
+	}
+
+	// OTEL_SERVICE_NAME and OTEL_RESOURCE_ATTRIBUTES take precedence
+	res, err := resource.New(ctx,
+		resource.WithAttributes(
+			attribute.String("service.name", "shorty"),
+			attribute.String("faas.name", opts.Service),
+		),
+		resource.WithFromEnv(),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	meterOpts := []sdkmetric.Option{sdkmetric.WithResource(res)}
+	traceOpts := []sdktrace.TracerProviderOption{sdktrace.WithResource(res)}
+	if otlp {
+		spans, err := otlptracehttp.New(ctx)
+		if err != nil {
+			return nil, err
+		}
+		traceOpts = append(traceOpts, sdktrace.WithBatcher(spans))
+
+		metrics, err := otlpmetrichttp.New(ctx)
+		if err != nil {
+			return nil, err
+		}
+		meterOpts = append(meterOpts, sdkmetric.WithReader(sdkmetric.NewPeriodicReader(metrics)))
+	}
+	if opts.Prometheus {
+		registry := prometheus.NewRegistry()
+		exporter, err := otelprometheus.New(otelprometheus.WithRegisterer(registry))
+		if err != nil {
+			return nil, err
+		}
+		meterOpts = append(meterOpts, sdkmetric.WithReader(exporter))
+		p.metrics = promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+	}
+
+	p.tracer = sdktrace.NewTracerProvider(traceOpts...)
+	p.meter = sdkmetric.NewMeterProvider(meterOpts...)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	Use(p.tracer, p.meter)
+
+	// A Lambda execution environment is frozen between invocations, so
+	// whatever was recorded is exported before the invocation returns
+	if otlp && os.Getenv("AWS_LAMBDA_FUNCTION_NAME") != "" {
+		flushing.Store(p)
+	}
+	return p, nil
+}
+
+// MetricsHandler returns the handler of the Prometheus scrape endpoint,
+// or nil when the provider wasn't created for Prometheus
+func (p *Provider) MetricsHandler() http.Handler {
+	return p.metrics
+}
+
+// Shutdown exports what is left and stops the exporters
+func (p *Provider) Shutdown(ctx context.Context) error {
+	var errs []error
+	if p.tracer != nil {
+		errs = append(errs, p.tracer.Shutdown(ctx))
+	}
+	if p.meter != nil {
+		errs = append(errs, p.meter.Shutdown(ctx))
+	}
+	return errors.Join(errs...)
+}
+
+// Provider flushed at the end of every request, set on Lambda
+var flushing atomic.Pointer[Provider]
+
+// Flush exports the spans and metrics recorded so far when running on
+// Lambda, and does nothing otherwise
+func Flush(ctx context.Context) error {
+	p := flushing.Load()
+	if p == nil {
+		return nil
+	}
+	return errors.Join(p.tracer.ForceFlush(ctx), p.meter.ForceFlush(ctx))
+}
+
+// Tracer and instruments everything is recorded with
+type instruments struct {
+	tracer          trace.Tracer
+	requests        metric.Int64Counter
+	requestDuration metric.Float64Histogram
+	dbDuration      metric.Float64Histogram
+	dbThrottles     metric.Int64Counter
+	cacheLookups    metric.Int64Counter
+}
+
+var current atomic.Pointer[instruments]
+
+func init() {
+	Use(tracenoop.NewTracerProvider(), metricnoop.NewMeterProvider())
+}
+
+// Use records spans and metrics with the given providers from now on.
+// NewFromEnv calls it, and tests can call it with in-memory providers.
+func Use(tracerProvider trace.TracerProvider, meterProvider metric.MeterProvider) {
+	meter := meterProvider.Meter(scope)
+	inst := &instruments{tracer: tracerProvider.Tracer(scope)}
+
+	// Creating instruments only fails for invalid names, and the errors
+	// leave no-op instruments behind
+	inst.requests, _ = meter.Int64Counter("http.server.requests",
+		metric.WithDescription("Number of requests served"),
+		metric.WithUnit("{request}"))
+	inst.requestDuration, _ = meter.Float64Histogram("http.server.request.duration",
+		metric.WithDescription("Duration of requests"),
+		metric.WithUnit("s"),
+		metric.WithExplicitBucketBoundaries(latencyBuckets...))
+	inst.dbDuration, _ = meter.Float64Histogram("db.client.operation.duration",
+		metric.WithDescription("Duration of DynamoDB operations, including retries"),
+		metric.WithUnit("s"),
+		metric.WithExplicitBucketBoundaries(latencyBuckets...))
+	inst.dbThrottles, _ = meter.Int64Counter("db.client.throttles",
+		metric.WithDescription("Number of DynamoDB attempts rejected by throttling"),
+		metric.WithUnit("{attempt}"))
+	inst.cacheLookups, _ = meter.Int64Counter("cache.lookups",
+		metric.WithDescription("Number of cache lookups, by result"),
+		metric.WithUnit("{lookup}"))
+	current.Store(inst)
+}
+
+// Tracer returns the tracer spans are started with
+func Tracer() trace.Tracer {
+	return current.Load().tracer
+}
+
+// RecordRequest records a request served on route with the status of
+// its response
+func RecordRequest(ctx context.Context, method, route string, status int, duration time.Duration) {
+	inst := current.Load()
+	attrs := metric.WithAttributes(
+		attribute.String("http.request.method", method),
+		attribute.String("http.route", route),
+		attribute.Int("http.response.status_code", status),
+	)
+	inst.requests.Add(ctx, 1, attrs)
+	inst.requestDuration.Record(ctx, duration.Seconds(), attrs)
+}
+
+// RecordCacheLookup records a lookup in the named cache, the hit rate
+// being the share of lookups with result hit
+func RecordCacheLookup(ctx context.Context, cache string, hit bool) {
+	result := "miss"
+	if hit {
+		result = "hit"
+	}
+	current.Load().cacheLookups.Add(ctx, 1, metric.WithAttributes(
+		attribute.String("cache.name", cache),
+		attribute.String("cache.result", result),
+	))
+}
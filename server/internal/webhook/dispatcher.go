@@ -0,0 +1,147 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/SunPodder/shorty/internal/db"
+	"github.com/google/uuid"
+)
+
+// Dispatcher hands events of a user's links to the webhooks subscribed
+// to them. It is an interface so deployments can turn webhooks off and
+// tests can capture what was sent.
+type Dispatcher interface {
+	Dispatch(ctx context.Context, userID string, event Event) error
+}
+
+// NewDelivery creates a pending delivery of event to hook, due now
+func NewDelivery(hook *db.Webhook, event Event, now time.Time) (db.WebhookDelivery, error) {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return db.WebhookDelivery{}, err
+	}
+	return db.WebhookDelivery{
+		ID:            uuid.NewString(),
+		WebhookID:     hook.ID,
+		UserID:        hook.UserID,
+		Event:         event.Type,
+		EventID:       event.ID,
+		Payload:       string(payload),
+		Status:        db.DeliveryStatusPending,
+		NextAttemptAt: now.Unix(),
+		CreatedAt:     now.Format(time.RFC3339),
+	}, nil
+}
+
+const (
+	// SubscriptionsTTL is how long a dispatcher reuses the webhooks of a
+	// user before reading them again, so created and deleted webhooks
+	// take up to this long to be picked up
+	SubscriptionsTTL = time.Minute
+	// The cache is cleared once it holds this many users
+	maxCachedUsers = 10000
+)
+
+// QueueDispatcher stores a pending delivery for every subscribed webhook.
+// The webhooks worker sends them, so dispatching never waits on a
+// receiver. The webhooks of each user are cached for TTL, as clicks are
+// dispatched on the redirect path and most users have none.
+type QueueDispatcher struct {
+	TTL time.Duration
+
+	mu    sync.Mutex
+	cache map[string]cachedWebhooks
+}
+
+type cachedWebhooks struct {
+	hooks   []db.Webhook
+	expires time.Time
+}
+
+func NewQueueDispatcher() *QueueDispatcher {
+	return &QueueDispatcher{TTL: SubscriptionsTTL, cache: map[string]cachedWebhooks{}}
+}
+
+// Returns the webhooks of userID from the cache, reading them when they
+// are missing or expired
+func (d *QueueDispatcher) webhooks(ctx context.Context, userID string, now time.Time) ([]db.Webhook, error) {
+	d.mu.Lock()
+	cached, ok := d.cache[userID]
+	d.mu.Unlock()
+	if ok && now.Before(cached.expires) {
+		return cached.hooks, nil
+	}
+
+	hooks, err := db.ListUserWebhooks(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	d.mu.Lock()
+	if d.cache == nil || len(d.cache) >= maxCachedUsers {
+		d.cache = map[string]cachedWebhooks{}
+	}
+	d.cache[userID] = cachedWebhooks{hooks: hooks, expires: now.Add(d.TTL)}
+	d.mu.Unlock()
+	return hooks, nil
+}
+
+func (d *QueueDispatcher) Dispatch(ctx context.Context, userID string, event Event) error {
+	now := time.Now()
+	hooks, err := d.webhooks(ctx, userID, now)
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	for i := range hooks {
+		if !hooks[i].Subscribed(event.Type) {
+			continue
+		}
+		delivery, err := NewDelivery(&hooks[i], event, now)
+		if err == nil {
+			err = db.PutWebhookDelivery(ctx, delivery)
+		}
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// LogDispatcher writes events to the log instead of delivering them, for
+// local development and deployments without webhooks
+type LogDispatcher struct{}
+
+func NewLogDispatcher() *LogDispatcher {
+	return &LogDispatcher{}
+}
+
+func (d *LogDispatcher) Dispatch(ctx context.Context, userID string, event Event) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	log.Printf("webhook event for user %s: %s", userID, data)
+	return nil
+}
+
+var ErrInvalidDispatcher = errors.New("invalid webhook dispatcher: must be queue or log")
+
+// NewFromEnv creates the dispatcher selected by WEBHOOK_DISPATCHER, which
+// defaults to queue
+func NewFromEnv() (Dispatcher, error) {
+	switch os.Getenv("WEBHOOK_DISPATCHER") {
+	case "", "queue":
+		return NewQueueDispatcher(), nil
+	case "log":
+		return NewLogDispatcher(), nil
+	}
+	return nil, ErrInvalidDispatcher
+}
@@ -0,0 +1,61 @@
+package webhook
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Event types webhooks can subscribe to
+const (
+	EventLinkCreated = "link.created"
+	// Sent for a sample of clicks, see LinkData.SampleRate
+	EventLinkClicked = "link.clicked"
+	EventLinkExpired = "link.expired"
+	EventLinkDeleted = "link.deleted"
+	// Sent when a user tests a webhook, every webhook receives it
+	EventPing = "ping"
+)
+
+// Events lists the event types a webhook can subscribe to
+var Events = []string{EventLinkCreated, EventLinkClicked, EventLinkExpired, EventLinkDeleted}
+
+// ValidEvent reports whether event can be subscribed to
+func ValidEvent(event string) bool {
+	for _, e := range Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// Event is the body of a delivery
+type Event struct {
+	ID        string `json:"id"`
+	Type      string `json:"type"`
+	CreatedAt string `json:"created_at"`
+	Data      any    `json:"data,omitempty"`
+}
+
+// NewEvent creates an event of the given type carrying data
+func NewEvent(eventType string, data any) Event {
+	return Event{
+		ID:        uuid.NewString(),
+		Type:      eventType,
+		CreatedAt: time.Now().Format(time.RFC3339),
+		Data:      data,
+	}
+}
+
+// LinkData describes the link a link.* event is about
+type LinkData struct {
+	Domain      string `json:"domain"`
+	ShortCode   string `json:"short_code"`
+	OriginalURL string `json:"original_url"`
+	// Total clicks of the link, including the one that triggered the event
+	Clicks int64 `json:"clicks"`
+	// Share of clicks that are sent as link.clicked events. Receivers
+	// counting events should divide by it.
+	SampleRate float64 `json:"sample_rate,omitempty"`
+}
@@ -0,0 +1,185 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"syscall"
+	"time"
+
+	"github.com/SunPodder/shorty/internal/db"
+)
+
+const (
+	// Deliveries still failing after this many attempts are dead-lettered
+	MaxAttempts = 8
+
+	baseBackoff = 30 * time.Second
+	maxBackoff  = 6 * time.Hour
+
+	requestTimeout = 10 * time.Second
+	dialTimeout    = 5 * time.Second
+	// Responses are drained up to this size so connections can be reused
+	maxResponseBody = 1024
+)
+
+// Backoff returns how long to wait before retrying a delivery that
+// failed attempt times, doubling every attempt up to maxBackoff
+func Backoff(attempts int) time.Duration {
+	delay := baseBackoff
+	for i := 1; i < attempts; i++ {
+		delay *= 2
+		if delay >= maxBackoff {
+			return maxBackoff
+		}
+	}
+	return delay
+}
+
+// ErrNonPublicAddress is returned when a receiver resolves to an address
+// that isn't reachable from the internet, such as loopback, private and
+// link-local addresses
+var ErrNonPublicAddress = errors.New("receiver address is not public")
+
+// Recorded on deliveries that couldn't reach their receiver. The reason
+// is only logged, so webhooks can't be used to probe hosts and ports.
+var errConnectionFailed = errors.New("could not connect to the receiver")
+
+// Ranges that aren't reachable from the internet on top of the loopback,
+// private, link-local and multicast ones netip already knows about
+var nonPublicPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"),
+	netip.MustParsePrefix("192.0.0.0/24"),
+	netip.MustParsePrefix("192.0.2.0/24"),
+	netip.MustParsePrefix("198.18.0.0/15"),
+	netip.MustParsePrefix("198.51.100.0/24"),
+	netip.MustParsePrefix("203.0.113.0/24"),
+	netip.MustParsePrefix("240.0.0.0/4"),
+	netip.MustParsePrefix("64:ff9b::/96"),
+	netip.MustParsePrefix("64:ff9b:1::/48"),
+	netip.MustParsePrefix("2001:db8::/32"),
+}
+
+// AllowPrivateReceivers lets webhooks deliver to plain HTTP receivers on
+// private and loopback addresses, for testing them against a local
+// receiver in development. It can be overridden at startup.
+var AllowPrivateReceivers = false
+
+// PublicAddr reports whether ip can be reached from the internet
+func PublicAddr(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	if !ip.IsGlobalUnicast() || ip.IsPrivate() {
+		return false
+	}
+	for _, prefix := range nonPublicPrefixes {
+		if prefix.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// Refuses connections to addresses that aren't public. It is called with
+// the address being dialed after DNS resolution, so hostnames resolving to
+// internal addresses are refused as well.
+func publicAddressOnly(network, address string, c syscall.RawConn) error {
+	if AllowPrivateReceivers {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip, err := netip.ParseAddr(host)
+	if err != nil || !PublicAddr(ip) {
+		return ErrNonPublicAddress
+	}
+	return nil
+}
+
+// Sender posts deliveries to the receivers' endpoints
+type Sender struct {
+	Client *http.Client
+}
+
+// NewSender creates a sender that only connects to public addresses and
+// doesn't follow redirects, so receivers can't point deliveries at
+// services inside the deployment
+func NewSender() *Sender {
+	dialer := &net.Dialer{Timeout: dialTimeout, Control: publicAddressOnly}
+	return &Sender{Client: &http.Client{
+		Timeout: requestTimeout,
+		Transport: &http.Transport{
+			DialContext:         dialer.DialContext,
+			ForceAttemptHTTP2:   true,
+			MaxIdleConns:        100,
+			IdleConnTimeout:     90 * time.Second,
+			TLSHandshakeTimeout: dialTimeout,
+		},
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}}
+}
+
+// Attempt posts delivery to hook once and records the outcome on it.
+// Failed deliveries are scheduled for a retry after a backoff, or marked
+// dead once they ran out of attempts.
+func (s *Sender) Attempt(ctx context.Context, hook *db.Webhook, delivery *db.WebhookDelivery, now time.Time) {
+	delivery.Attempts++
+	delivery.LastAttemptAt = now.Format(time.RFC3339)
+
+	status, err := s.post(ctx, hook, delivery, now)
+	delivery.LastStatusCode = status
+	if err == nil {
+		delivery.Status = db.DeliveryStatusDelivered
+		delivery.LastError = ""
+		delivery.NextAttemptAt = 0
+		return
+	}
+
+	delivery.LastError = err.Error()
+	if delivery.Attempts >= MaxAttempts {
+		delivery.Status = db.DeliveryStatusDead
+		delivery.NextAttemptAt = 0
+		return
+	}
+	delivery.Status = db.DeliveryStatusPending
+	delivery.NextAttemptAt = now.Add(Backoff(delivery.Attempts)).Unix()
+}
+
+// Posts the payload of delivery, returning the response status and an
+// error unless the receiver answered with a 2xx status
+func (s *Sender) post(ctx context.Context, hook *db.Webhook, delivery *db.WebhookDelivery, now time.Time) (int, error) {
+	body := []byte(delivery.Payload)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, hook.URL, bytes.NewReader(body))
+	if err != nil {
+		slog.WarnContext(ctx, "build webhook request", "webhook_id", hook.ID, "delivery_id", delivery.ID, "error", err)
+		return 0, errConnectionFailed
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "Shorty-Webhooks/1.0")
+	req.Header.Set(EventHeader, delivery.Event)
+	req.Header.Set(DeliveryHeader, delivery.ID)
+	req.Header.Set(SignatureHeader, Sign(hook.Secret, now.Unix(), body))
+
+	resp, err := s.Client.Do(req)
+	if err != nil {
+		slog.WarnContext(ctx, "send webhook delivery", "webhook_id", hook.ID, "delivery_id", delivery.ID, "error", err)
+		return 0, errConnectionFailed
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, maxResponseBody))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("receiver responded with %d", resp.StatusCode)
+	}
+	return resp.StatusCode, nil
+}
@@ -0,0 +1,345 @@
+package tests
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"bou.ke/monkey"
+	"github.com/SunPodder/shorty/internal/db"
+	"github.com/SunPodder/shorty/internal/handler"
+	"github.com/SunPodder/shorty/utils"
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/stretchr/testify/assert"
+)
+
+// Patches db.GetUser to return a user with the given password
+func patchAccountUser(t *testing.T, password string) *db.User {
+	hash, err := utils.HashPassword(password)
+	if err != nil {
+		t.Fatalf("HashPassword failed: %v", err)
+	}
+	user := &db.User{ID: "user-id", Email: "jane@example.com", Password: hash, Verified: true}
+
+	monkey.Patch(db.GetUser, func(ctx context.Context, id string) (*db.User, error) {
+		copied := *user
+		return &copied, nil
+	})
+	t.Cleanup(func() { monkey.Unpatch(db.GetUser) })
+	monkey.Patch(db.RecordFailedLogin, func(ctx context.Context, id string) (int, error) {
+		return 1, nil
+	})
+	t.Cleanup(func() { monkey.Unpatch(db.RecordFailedLogin) })
+	return user
+}
+
+func accountRequest(t *testing.T, method, resource, body string) events.APIGatewayProxyRequest {
+	return events.APIGatewayProxyRequest{
+		HTTPMethod: method,
+		Resource:   resource,
+		Headers:    authHeaders(t, "user-id"),
+		Body:       body,
+	}
+}
+
+func TestGetProfile(t *testing.T) {
+	patchAccountUser(t, "correct-horse-battery")
+
+	resp, _ := authed(handler.Account)(context.Background(), accountRequest(t, "GET", "/me/profile", ""))
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.NotContains(t, resp.Body, "password\":\"")
+
+	var profile handler.ProfileResponse
+	json.Unmarshal([]byte(resp.Body), &profile)
+	assert.Equal(t, "jane@example.com", profile.Email)
+	assert.True(t, profile.HasPassword)
+}
+
+func TestUpdateProfile_ChangeEmail(t *testing.T) {
+	ctx := context.Background()
+	patchAccountUser(t, "correct-horse-battery")
+	mailer := captureMail(t)
+	entries := captureAudit(t)
+
+	changed := ""
+	monkey.Patch(db.ChangeEmail, func(ctx context.Context, id, oldEmail, email string) error {
+		changed = email
+		return nil
+	})
+	defer monkey.Unpatch(db.ChangeEmail)
+
+	// The current password is required
+	resp, _ := authed(handler.Account)(ctx, accountRequest(t, "PATCH", "/me/profile",
+		`{"email": "new@example.com", "current_password": "wrong"}`))
+	assert.Equal(t, 403, resp.StatusCode)
+	assert.Empty(t, changed)
+
+	resp, _ = authed(handler.Account)(ctx, accountRequest(t, "PATCH", "/me/profile",
+		`{"email": "new@example.com", "current_password": "correct-horse-battery"}`))
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, "new@example.com", changed)
+
+	var profile handler.ProfileResponse
+	json.Unmarshal([]byte(resp.Body), &profile)
+	assert.Equal(t, "new@example.com", profile.Email)
+	assert.False(t, profile.Verified)
+
+	// The old address is told and the new one has to be verified
+	if assert.Len(t, mailer.sent, 2) {
+		assert.Equal(t, "jane@example.com", mailer.sent[0].To)
+		assert.Equal(t, "new@example.com", mailer.sent[1].To)
+	}
+	if assert.Len(t, *entries, 1) {
+		assert.Equal(t, handler.AuditEmailChange, (*entries)[0].Action)
+		assert.Equal(t, db.AuditChange{Before: "jane@example.com", After: "new@example.com"}, (*entries)[0].Changes["email"])
+	}
+}
+
+func TestUpdateProfile_DisplayName(t *testing.T) {
+	patchAccountUser(t, "correct-horse-battery")
+
+	name := ""
+	monkey.Patch(db.UpdateProfile, func(ctx context.Context, id, displayName string) error {
+		name = displayName
+		return nil
+	})
+	defer monkey.Unpatch(db.UpdateProfile)
+
+	// Changing the display name alone doesn't need the password
+	resp, _ := authed(handler.Account)(context.Background(), accountRequest(t, "PATCH", "/me/profile",
+		`{"display_name": "  Jane  "}`))
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, "Jane", name)
+}
+
+func TestChangePassword(t *testing.T) {
+	ctx := context.Background()
+	patchAccountUser(t, "correct-horse-battery")
+	entries := captureAudit(t)
+
+	var stored string
+	monkey.Patch(db.ChangePassword, func(ctx context.Context, id, hash string, now int64) error {
+		stored = hash
+		return nil
+	})
+	defer monkey.Unpatch(db.ChangePassword)
+
+	resp, _ := authed(handler.Account)(ctx, accountRequest(t, "POST", "/me/password",
+		`{"current_password": "wrong", "new_password": "staple-battery-horse"}`))
+	assert.Equal(t, 403, resp.StatusCode)
+
+	resp, _ = authed(handler.Account)(ctx, accountRequest(t, "POST", "/me/password",
+		`{"current_password": "correct-horse-battery", "new_password": "short"}`))
+	assert.Equal(t, 400, resp.StatusCode)
+	assert.Empty(t, stored)
+
+	resp, _ = authed(handler.Account)(ctx, accountRequest(t, "POST", "/me/password",
+		`{"current_password": "correct-horse-battery", "new_password": "staple-battery-horse"}`))
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.True(t, utils.CheckPasswordHash("staple-battery-horse", stored))
+	assert.Contains(t, resp.Body, `"token"`)
+	if assert.Len(t, *entries, 1) {
+		assert.Equal(t, handler.AuditPasswordChange, (*entries)[0].Action)
+		assert.Equal(t, "user-id", (*entries)[0].TargetID)
+	}
+}
+
+// Records the cleanup done by DeleteAccount
+type accountCleanup struct {
+	deleted, anonymized, keys, identities, memberships, domains int
+	// IDs of the webhooks deleted, and of those whose deliveries were
+	webhooks, deliveries []string
+	userDeleted          bool
+}
+
+func patchAccountData(t *testing.T, members []db.WorkspaceMember) *accountCleanup {
+	cleanup := &accountCleanup{}
+	patches := []func(){
+		func() {
+			monkey.Patch(db.ForEachUserURL, func(ctx context.Context, userID string, fn func([]db.URL) error) error {
+				// Links come in several pages
+				if err := fn([]db.URL{{Domain: "default", ShortCode: "a"}, {Domain: "default", ShortCode: "b"}}); err != nil {
+					return err
+				}
+				return fn([]db.URL{{Domain: "go.acme.com", ShortCode: "c"}})
+			})
+		},
+		func() {
+			monkey.Patch(db.DeleteURL, func(ctx context.Context, domain, code string) error {
+				cleanup.deleted++
+				return nil
+			})
+		},
+		func() {
+			monkey.Patch(db.AnonymizeURL, func(ctx context.Context, domain, code string) error {
+				cleanup.anonymized++
+				return nil
+			})
+		},
+		func() {
+			monkey.Patch(db.ListUserAPIKeys, func(ctx context.Context, userID string) ([]db.APIKey, error) {
+				return []db.APIKey{{ID: "key-1"}}, nil
+			})
+		},
+		func() {
+			monkey.Patch(db.DeleteAPIKey, func(ctx context.Context, id string) error {
+				cleanup.keys++
+				return nil
+			})
+		},
+		func() {
+			monkey.Patch(db.ListUserIdentities, func(ctx context.Context, userID string) ([]db.Identity, error) {
+				return []db.Identity{{ID: "mock|sub"}}, nil
+			})
+		},
+		func() {
+			monkey.Patch(db.DeleteIdentity, func(ctx context.Context, id string) error {
+				cleanup.identities++
+				return nil
+			})
+		},
+		func() {
+			monkey.Patch(db.ListUserWebhooks, func(ctx context.Context, userID string) ([]db.Webhook, error) {
+				return []db.Webhook{{ID: "hook-1", UserID: userID}, {ID: "hook-2", UserID: userID}}, nil
+			})
+		},
+		func() {
+			monkey.Patch(db.DeleteWebhook, func(ctx context.Context, id string) error {
+				cleanup.webhooks = append(cleanup.webhooks, id)
+				return nil
+			})
+		},
+		func() {
+			monkey.Patch(db.DeleteWebhookDeliveries, func(ctx context.Context, webhookID string) error {
+				cleanup.deliveries = append(cleanup.deliveries, webhookID)
+				return nil
+			})
+		},
+		func() {
+			monkey.Patch(db.ListUserMemberships, func(ctx context.Context, userID string) ([]db.WorkspaceMember, error) {
+				return []db.WorkspaceMember{{WorkspaceID: "ws-1", UserID: userID, Role: db.RoleOwner}}, nil
+			})
+		},
+		func() {
+			monkey.Patch(db.ListWorkspaceMembers, func(ctx context.Context, workspaceID string) ([]db.WorkspaceMember, error) {
+				return members, nil
+			})
+		},
+		func() {
+			monkey.Patch(db.DeleteWorkspaceMember, func(ctx context.Context, workspaceID, userID string) error {
+				cleanup.memberships++
+				return nil
+			})
+		},
+		func() {
+			monkey.Patch(db.ListUserDomains, func(ctx context.Context, userID string) ([]db.Domain, error) {
+				return []db.Domain{{Domain: "go.acme.com"}}, nil
+			})
+		},
+		func() {
+			monkey.Patch(db.DeleteDomain, func(ctx context.Context, domain string) error {
+				cleanup.domains++
+				return nil
+			})
+		},
+		func() {
+			monkey.Patch(db.DeleteUser, func(ctx context.Context, id, email string) error {
+				cleanup.userDeleted = true
+				return nil
+			})
+		},
+	}
+	for _, patch := range patches {
+		patch()
+	}
+	t.Cleanup(monkey.UnpatchAll)
+	return cleanup
+}
+
+func TestDeleteAccount_Anonymize(t *testing.T) {
+	patchAccountUser(t, "correct-horse-battery")
+	cleanup := patchAccountData(t, []db.WorkspaceMember{{WorkspaceID: "ws-1", UserID: "user-id", Role: db.RoleOwner}})
+
+	resp, _ := authed(handler.Account)(context.Background(), accountRequest(t, "DELETE", "/me",
+		`{"password": "correct-horse-battery", "links": "anonymize"}`))
+	assert.Equal(t, 204, resp.StatusCode)
+	assert.Equal(t, 3, cleanup.anonymized)
+	assert.Equal(t, 0, cleanup.deleted)
+	assert.Equal(t, 1, cleanup.keys)
+	assert.Equal(t, 1, cleanup.identities)
+	assert.Equal(t, 1, cleanup.memberships)
+	assert.Equal(t, 0, cleanup.domains)
+	assert.True(t, cleanup.userDeleted)
+}
+
+func TestDeleteAccount_Delete(t *testing.T) {
+	patchAccountUser(t, "correct-horse-battery")
+	cleanup := patchAccountData(t, nil)
+	entries := captureAudit(t)
+
+	resp, _ := authed(handler.Account)(context.Background(), accountRequest(t, "DELETE", "/me",
+		`{"password": "correct-horse-battery", "links": "delete"}`))
+	assert.Equal(t, 204, resp.StatusCode)
+	assert.Equal(t, 3, cleanup.deleted)
+	assert.Equal(t, 0, cleanup.anonymized)
+	assert.Equal(t, 1, cleanup.domains)
+	assert.True(t, cleanup.userDeleted)
+	if assert.Len(t, *entries, 1) {
+		assert.Equal(t, handler.AuditAccountDelete, (*entries)[0].Action)
+		assert.Equal(t, "delete", (*entries)[0].Details["links"])
+	}
+}
+
+func TestDeleteAccount_KeepsWorkspaceLinks(t *testing.T) {
+	patchAccountUser(t, "correct-horse-battery")
+	cleanup := patchAccountData(t, nil)
+
+	workspaceID := "ws-2"
+	monkey.Patch(db.ForEachUserURL, func(ctx context.Context, userID string, fn func([]db.URL) error) error {
+		return fn([]db.URL{
+			{Domain: "default", ShortCode: "own"},
+			{Domain: "go.acme.com", ShortCode: "shared", WorkspaceID: &workspaceID},
+		})
+	})
+
+	resp, _ := authed(handler.Account)(context.Background(), accountRequest(t, "DELETE", "/me",
+		`{"password": "correct-horse-battery", "links": "delete"}`))
+	assert.Equal(t, 204, resp.StatusCode)
+	assert.Equal(t, 1, cleanup.deleted)
+	assert.Equal(t, 1, cleanup.anonymized)
+	// The domain keeps serving the workspace link
+	assert.Equal(t, 0, cleanup.domains)
+}
+
+func TestDeleteAccount_DeletesWebhooks(t *testing.T) {
+	patchAccountUser(t, "correct-horse-battery")
+	cleanup := patchAccountData(t, nil)
+
+	// Whichever option was chosen for the links
+	resp, _ := authed(handler.Account)(context.Background(), accountRequest(t, "DELETE", "/me",
+		`{"password": "correct-horse-battery", "links": "anonymize"}`))
+	assert.Equal(t, 204, resp.StatusCode)
+	assert.Equal(t, []string{"hook-1", "hook-2"}, cleanup.webhooks)
+	assert.Equal(t, []string{"hook-1", "hook-2"}, cleanup.deliveries)
+	assert.True(t, cleanup.userDeleted)
+}
+
+func TestDeleteAccount_Refused(t *testing.T) {
+	ctx := context.Background()
+	patchAccountUser(t, "correct-horse-battery")
+	cleanup := patchAccountData(t, []db.WorkspaceMember{
+		{WorkspaceID: "ws-1", UserID: "user-id", Role: db.RoleOwner},
+		{WorkspaceID: "ws-1", UserID: "other", Role: db.RoleEditor},
+	})
+
+	for body, status := range map[string]int{
+		`{"password": "correct-horse-battery"}`:                    400,
+		`{"password": "wrong", "links": "delete"}`:                 403,
+		`{"password": "correct-horse-battery", "links": "delete"}`: 409,
+	} {
+		resp, _ := authed(handler.Account)(ctx, accountRequest(t, "DELETE", "/me", body))
+		assert.Equal(t, status, resp.StatusCode, body)
+	}
+	assert.False(t, cleanup.userDeleted)
+	assert.Equal(t, 0, cleanup.deleted)
+}
@@ -0,0 +1,282 @@
+package tests
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"bou.ke/monkey"
+	"github.com/SunPodder/shorty/internal/db"
+	"github.com/SunPodder/shorty/internal/handler"
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/stretchr/testify/assert"
+)
+
+// Makes "admin-id" an admin and every other user ID resolve to the user
+// of the same ID in users, or a plain user when it isn't in there
+func patchAdmin(t *testing.T, users map[string]*db.User) {
+	monkey.Patch(db.GetUser, func(ctx context.Context, id string) (*db.User, error) {
+		if id == "admin-id" {
+			return &db.User{ID: id, Role: db.UserRoleAdmin}, nil
+		}
+		if user, ok := users[id]; ok {
+			if user == nil {
+				return nil, db.ErrUserNotFound
+			}
+			return user, nil
+		}
+		return &db.User{ID: id}, nil
+	})
+	t.Cleanup(func() { monkey.Unpatch(db.GetUser) })
+}
+
+func adminRequest(t *testing.T, method, resource, body string) events.APIGatewayProxyRequest {
+	return events.APIGatewayProxyRequest{
+		HTTPMethod: method,
+		Resource:   resource,
+		Body:       body,
+		Headers:    authHeaders(t, "admin-id"),
+	}
+}
+
+func TestAdmin_RequiresAdmin(t *testing.T) {
+	ctx := context.Background()
+	patchAdmin(t, nil)
+
+	for _, route := range [][2]string{
+		{"GET", "/admin/users"},
+		{"GET", "/admin/links"},
+		{"GET", "/admin/stats"},
+		{"POST", "/admin/users/{user_id}/disable"},
+		{"POST", "/admin/links/{short_code}/takedown"},
+	} {
+		request := adminRequest(t, route[0], route[1], `{"reason": "spam"}`)
+		request.Headers = authHeaders(t, "user-id")
+		resp, _ := authed(handler.Admin)(ctx, request)
+		assert.Equal(t, 403, resp.StatusCode, route[1])
+	}
+}
+
+func TestAdminListUsers_OmitsSecrets(t *testing.T) {
+	ctx := context.Background()
+	patchAdmin(t, nil)
+
+	patchListUsers := monkey.Patch(db.ListUsers, func(ctx context.Context, query string, limit int32, cursor string) ([]db.User, string, error) {
+		assert.Equal(t, "alice", query)
+		assert.Equal(t, int32(10), limit)
+		assert.Equal(t, "page-1", cursor)
+		return []db.User{{
+			ID:         "user-1",
+			Email:      "alice@example.com",
+			Password:   "hash",
+			TOTPSecret: "secret",
+		}}, "page-2", nil
+	})
+	defer patchListUsers.Unpatch()
+
+	request := adminRequest(t, "GET", "/admin/users", "")
+	request.QueryStringParameters = map[string]string{"q": "alice", "limit": "10", "cursor": "page-1"}
+	resp, _ := authed(handler.Admin)(ctx, request)
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.NotContains(t, resp.Body, "hash")
+	assert.NotContains(t, resp.Body, "secret")
+
+	var body handler.AdminUsersResponse
+	assert.NoError(t, json.Unmarshal([]byte(resp.Body), &body))
+	assert.Equal(t, "page-2", body.NextCursor)
+	if assert.Len(t, body.Users, 1) {
+		assert.Equal(t, "alice@example.com", body.Users[0].Email)
+	}
+
+	request.QueryStringParameters = map[string]string{"limit": "1000"}
+	resp, _ = authed(handler.Admin)(ctx, request)
+	assert.Equal(t, 400, resp.StatusCode)
+}
+
+func TestAdminDisableUser(t *testing.T) {
+	ctx := context.Background()
+	patchAdmin(t, nil)
+	audit := captureAudit(t)
+
+	var disabled, reason string
+	patchDisable := monkey.Patch(db.DisableUser, func(ctx context.Context, id, r string, now int64) error {
+		disabled, reason = id, r
+		return nil
+	})
+	defer patchDisable.Unpatch()
+
+	revoked := "2020-01-01T00:00:00Z"
+	patchListKeys := monkey.Patch(db.ListUserAPIKeys, func(ctx context.Context, userID string) ([]db.APIKey, error) {
+		return []db.APIKey{{ID: "key-1"}, {ID: "key-2", RevokedAt: &revoked}}, nil
+	})
+	defer patchListKeys.Unpatch()
+
+	var revokedKeys []string
+	patchRevoke := monkey.Patch(db.RevokeAPIKey, func(ctx context.Context, userID, id string) error {
+		revokedKeys = append(revokedKeys, id)
+		return nil
+	})
+	defer patchRevoke.Unpatch()
+
+	request := adminRequest(t, "POST", "/admin/users/{user_id}/disable", `{"reason": ""}`)
+	request.PathParameters = map[string]string{"user_id": "user-id"}
+	resp, _ := authed(handler.Admin)(ctx, request)
+	assert.Equal(t, 400, resp.StatusCode)
+	assert.Empty(t, disabled)
+
+	request.Body = `{"reason": "spam"}`
+	resp, _ = authed(handler.Admin)(ctx, request)
+	assert.Equal(t, 204, resp.StatusCode)
+	assert.Equal(t, "user-id", disabled)
+	assert.Equal(t, "spam", reason)
+	assert.Equal(t, []string{"key-1"}, revokedKeys)
+
+	if assert.Len(t, *audit, 1) {
+		entry := (*audit)[0]
+		assert.Equal(t, "admin-id", entry.ActorID)
+		assert.Equal(t, handler.AuditAdminDisableUser, entry.Action)
+		assert.Equal(t, handler.AuditTargetUser, entry.TargetType)
+		assert.Equal(t, "user-id", entry.TargetID)
+		assert.Equal(t, "spam", entry.Details["reason"])
+	}
+
+	// Admins can't lock themselves out
+	request.PathParameters["user_id"] = "admin-id"
+	resp, _ = authed(handler.Admin)(ctx, request)
+	assert.Equal(t, 400, resp.StatusCode)
+}
+
+func TestDisabledUser_CantAuthenticate(t *testing.T) {
+	ctx := context.Background()
+	patchAdmin(t, map[string]*db.User{
+		"user-id": {ID: "user-id", DisabledAt: 1, DisabledReason: "spam"},
+	})
+
+	request := events.APIGatewayProxyRequest{Headers: authHeaders(t, "user-id")}
+	resp, _ := authed(okHandler)(ctx, request)
+	assert.Equal(t, 401, resp.StatusCode)
+
+	user := &db.User{ID: "user-id", Email: "test@example.com", Password: "hash", Verified: true, DisabledAt: 1}
+	defer patchLoginUser(user)()
+	resp, _ = handler.Login(ctx, loginRequest("password"))
+	assert.Equal(t, 403, resp.StatusCode)
+	assert.Contains(t, resp.Body, "disabled")
+}
+
+func TestAdminTakeDown_ShownOnResolve(t *testing.T) {
+	ctx := context.Background()
+	patchAdmin(t, nil)
+	audit := captureAudit(t)
+
+	stored := db.URL{ShortCode: "abc123", Domain: db.DefaultDomain, OriginalURL: "https://example.com"}
+	patchTakeDown := monkey.Patch(db.TakeDownURL, func(ctx context.Context, domain, shortCode, reason, at string) error {
+		assert.Equal(t, db.DefaultDomain, domain)
+		assert.Equal(t, "abc123", shortCode)
+		stored.TakedownReason, stored.TakenDownAt = &reason, &at
+		return nil
+	})
+	defer patchTakeDown.Unpatch()
+
+	patchGetURL := monkey.Patch(db.GetURL, func(context.Context, string, string) (*db.URL, error) {
+		url := stored
+		return &url, nil
+	})
+	defer patchGetURL.Unpatch()
+
+	clicked := false
+	patchIncrementClicks := monkey.Patch(db.IncrementClicks, func(context.Context, string, string) error {
+		clicked = true
+		return nil
+	})
+	defer patchIncrementClicks.Unpatch()
+
+	request := adminRequest(t, "POST", "/admin/links/{short_code}/takedown", `{"reason": "<b>Phishing</b>"}`)
+	request.PathParameters = map[string]string{"short_code": "abc123"}
+	resp, _ := authed(handler.Admin)(ctx, request)
+	assert.Equal(t, 204, resp.StatusCode)
+	if assert.Len(t, *audit, 1) {
+		assert.Equal(t, handler.AuditAdminTakeDown, (*audit)[0].Action)
+		assert.Equal(t, db.DefaultDomain+"/abc123", (*audit)[0].TargetID)
+	}
+
+	resp, _ = handler.Resolve(ctx, events.APIGatewayProxyRequest{
+		PathParameters: map[string]string{"short_code": "abc123"},
+	})
+	assert.Equal(t, 410, resp.StatusCode)
+	assert.Empty(t, resp.Headers["Location"])
+	assert.Contains(t, resp.Body, "&lt;b&gt;Phishing&lt;/b&gt;")
+	assert.False(t, strings.Contains(resp.Body, "<b>"))
+	assert.False(t, clicked)
+}
+
+func TestAdminReassignLink(t *testing.T) {
+	ctx := context.Background()
+	patchAdmin(t, map[string]*db.User{"missing": nil})
+	audit := captureAudit(t)
+
+	owner := "old-owner"
+	patchGetURL := monkey.Patch(db.GetURL, func(context.Context, string, string) (*db.URL, error) {
+		return &db.URL{ShortCode: "abc123", UserID: &owner}, nil
+	})
+	defer patchGetURL.Unpatch()
+
+	var newOwner string
+	patchSetOwner := monkey.Patch(db.SetURLOwner, func(ctx context.Context, domain, shortCode, userID string) error {
+		newOwner = userID
+		return nil
+	})
+	defer patchSetOwner.Unpatch()
+
+	request := adminRequest(t, "PUT", "/admin/links/{short_code}/owner", `{"user_id": "missing"}`)
+	request.PathParameters = map[string]string{"short_code": "abc123"}
+	resp, _ := authed(handler.Admin)(ctx, request)
+	assert.Equal(t, 404, resp.StatusCode)
+	assert.Empty(t, newOwner)
+
+	request.Body = `{"user_id": "new-owner"}`
+	resp, _ = authed(handler.Admin)(ctx, request)
+	assert.Equal(t, 204, resp.StatusCode)
+	assert.Equal(t, "new-owner", newOwner)
+	if assert.Len(t, *audit, 1) {
+		assert.Equal(t, map[string]string{"from": "old-owner", "to": "new-owner"}, (*audit)[0].Details)
+	}
+}
+
+func TestAdminStats(t *testing.T) {
+	ctx := context.Background()
+	patchAdmin(t, nil)
+
+	// Counted by the scheduled job, requests only read the result
+	var saved *db.Stats
+	patchCount := monkey.Patch(db.CountStats, func(ctx context.Context) (*db.Stats, error) {
+		return &db.Stats{Users: 3, Links: 7, Clicks: 42}, nil
+	})
+	defer patchCount.Unpatch()
+	patchSave := monkey.Patch(db.SaveStats, func(ctx context.Context, stats db.Stats) error {
+		saved = &stats
+		return nil
+	})
+	defer patchSave.Unpatch()
+	patchGet := monkey.Patch(db.GetStats, func(ctx context.Context) (*db.Stats, error) {
+		if saved == nil {
+			return nil, db.ErrStatsNotComputed
+		}
+		return saved, nil
+	})
+	defer patchGet.Unpatch()
+
+	resp, _ := authed(handler.Admin)(ctx, adminRequest(t, "GET", "/admin/stats", ""))
+	assert.Equal(t, 503, resp.StatusCode)
+
+	assert.NoError(t, handler.RefreshStats(ctx))
+	resp, _ = authed(handler.Admin)(ctx, adminRequest(t, "GET", "/admin/stats", ""))
+	assert.Equal(t, 200, resp.StatusCode)
+
+	var stats db.Stats
+	assert.NoError(t, json.Unmarshal([]byte(resp.Body), &stats))
+	assert.Equal(t, int64(3), stats.Users)
+	assert.Equal(t, int64(7), stats.Links)
+	assert.Equal(t, int64(42), stats.Clicks)
+	assert.NotEmpty(t, stats.ComputedAt)
+}
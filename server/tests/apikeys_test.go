@@ -0,0 +1,170 @@
+package tests
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"bou.ke/monkey"
+	"github.com/SunPodder/shorty/internal/db"
+	"github.com/SunPodder/shorty/internal/handler"
+	"github.com/SunPodder/shorty/utils"
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/stretchr/testify/assert"
+)
+
+// Patches the key store with a single key and returns its plaintext
+func patchAPIKey(t *testing.T, key db.APIKey) (string, func()) {
+	id, plaintext, err := utils.GenerateAPIKey()
+	if err != nil {
+		t.Fatalf("GenerateAPIKey failed: %v", err)
+	}
+	key.ID = id
+	key.KeyHash = utils.HashAPIKey(plaintext)
+
+	patchGet := monkey.Patch(db.GetAPIKey, func(_ context.Context, lookup string) (*db.APIKey, error) {
+		if lookup != id {
+			return nil, db.ErrAPIKeyNotFound
+		}
+		k := key
+		return &k, nil
+	})
+	patchTouch := monkey.Patch(db.TouchAPIKey, func(context.Context, string) error {
+		return nil
+	})
+	return plaintext, func() {
+		patchGet.Unpatch()
+		patchTouch.Unpatch()
+	}
+}
+
+func TestCreateAPIKey_Success(t *testing.T) {
+	ctx := context.Background()
+	patchSessions(t)
+	request := events.APIGatewayProxyRequest{
+		HTTPMethod: "POST",
+		Headers:    authHeaders(t, "user-id"),
+		Body:       `{"name": "deploy script", "scopes": ["links:write"]}`,
+	}
+
+	var stored db.APIKey
+	patchCreate := monkey.Patch(db.CreateAPIKey, func(_ context.Context, key db.APIKey) error {
+		stored = key
+		return nil
+	})
+	defer patchCreate.Unpatch()
+
+	resp, err := authed(handler.APIKeys)(ctx, request)
+	assert.NoError(t, err)
+	assert.Equal(t, 201, resp.StatusCode)
+
+	var body handler.CreateAPIKeyResponse
+	assert.NoError(t, json.Unmarshal([]byte(resp.Body), &body))
+	assert.True(t, utils.IsAPIKey(body.Key))
+	assert.True(t, utils.CheckAPIKeyHash(body.Key, stored.KeyHash))
+	assert.NotContains(t, resp.Body, stored.KeyHash)
+	assert.Equal(t, "user-id", stored.UserID)
+}
+
+func TestCreateAPIKey_UnknownScope(t *testing.T) {
+	ctx := context.Background()
+	patchSessions(t)
+	request := events.APIGatewayProxyRequest{
+		HTTPMethod: "POST",
+		Headers:    authHeaders(t, "user-id"),
+		Body:       `{"name": "script", "scopes": ["admin"]}`,
+	}
+
+	resp, _ := authed(handler.APIKeys)(ctx, request)
+	assert.Equal(t, 400, resp.StatusCode)
+}
+
+func TestCreateAPIKey_RejectsAPIKeyAuth(t *testing.T) {
+	ctx := context.Background()
+	plaintext, unpatch := patchAPIKey(t, db.APIKey{UserID: "user-id", Scopes: []string{db.ScopeLinksWrite}})
+	defer unpatch()
+
+	request := events.APIGatewayProxyRequest{
+		HTTPMethod: "POST",
+		Headers:    map[string]string{"Authorization": "Bearer " + plaintext},
+		Body:       `{"name": "script", "scopes": ["links:write"]}`,
+	}
+
+	resp, _ := authed(handler.APIKeys)(ctx, request)
+	assert.Equal(t, 403, resp.StatusCode)
+}
+
+func TestMe_WithAPIKey(t *testing.T) {
+	ctx := context.Background()
+	plaintext, unpatch := patchAPIKey(t, db.APIKey{UserID: "user-id", Scopes: []string{db.ScopeLinksRead}})
+	defer unpatch()
+
+	request := events.APIGatewayProxyRequest{
+		Headers: map[string]string{"Authorization": "Bearer " + plaintext},
+	}
+
+	patchListUserURLs := monkey.Patch(db.ListUserURLs, func(_ context.Context, userID string) ([]db.URL, error) {
+		assert.Equal(t, "user-id", userID)
+		return nil, nil
+	})
+	defer patchListUserURLs.Unpatch()
+
+	patchMemberships := monkey.Patch(db.ListUserMemberships, func(context.Context, string) ([]db.WorkspaceMember, error) {
+		return nil, nil
+	})
+	defer patchMemberships.Unpatch()
+
+	resp, err := authed(handler.Me)(ctx, request)
+	assert.NoError(t, err)
+	assert.Equal(t, 200, resp.StatusCode)
+}
+
+func TestMe_APIKeyWithoutScope(t *testing.T) {
+	ctx := context.Background()
+	plaintext, unpatch := patchAPIKey(t, db.APIKey{UserID: "user-id", Scopes: []string{db.ScopeLinksWrite}})
+	defer unpatch()
+
+	request := events.APIGatewayProxyRequest{
+		Headers: map[string]string{"Authorization": "Bearer " + plaintext},
+	}
+
+	resp, _ := authed(handler.Me)(ctx, request)
+	assert.Equal(t, 403, resp.StatusCode)
+}
+
+func TestMe_ExpiredAPIKey(t *testing.T) {
+	ctx := context.Background()
+	expired := time.Now().Add(-time.Hour).Unix()
+	plaintext, unpatch := patchAPIKey(t, db.APIKey{UserID: "user-id", Scopes: []string{db.ScopeLinksRead}, ExpiresAt: &expired})
+	defer unpatch()
+
+	request := events.APIGatewayProxyRequest{
+		Headers: map[string]string{"Authorization": "Bearer " + plaintext},
+	}
+
+	resp, _ := authed(handler.Me)(ctx, request)
+	assert.Equal(t, 401, resp.StatusCode)
+}
+
+func TestShorten_WithAPIKey(t *testing.T) {
+	ctx := context.Background()
+	plaintext, unpatch := patchAPIKey(t, db.APIKey{UserID: "user-id", Scopes: []string{db.ScopeLinksWrite}})
+	defer unpatch()
+
+	body, _ := json.Marshal(handler.ShortenRequest{OriginalURL: "https://example.com", Token: &plaintext})
+	request := events.APIGatewayProxyRequest{Body: string(body)}
+
+	var created *db.URL
+	patchCreateURL := monkey.Patch(db.CreateURL, func(_ context.Context, url *db.URL) error {
+		created = url
+		return nil
+	})
+	defer patchCreateURL.Unpatch()
+
+	resp, _ := handler.Shorten(ctx, request)
+	assert.Equal(t, 200, resp.StatusCode)
+	if assert.NotNil(t, created.UserID) {
+		assert.Equal(t, "user-id", *created.UserID)
+	}
+}
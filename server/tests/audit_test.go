@@ -0,0 +1,208 @@
+package tests
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"bou.ke/monkey"
+	"github.com/SunPodder/shorty/internal/audit"
+	"github.com/SunPodder/shorty/internal/db"
+	"github.com/SunPodder/shorty/internal/handler"
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/stretchr/testify/assert"
+)
+
+// Audit sink recording the entries it was asked to write
+type fakeSink struct {
+	entries []db.AuditEntry
+}
+
+func (s *fakeSink) Write(ctx context.Context, entry db.AuditEntry) error {
+	s.entries = append(s.entries, entry)
+	return nil
+}
+
+// Replaces handler.AuditSink with a fake for the duration of the test
+func captureAudit(t *testing.T) *[]db.AuditEntry {
+	sink := &fakeSink{}
+	previous := handler.AuditSink
+	handler.AuditSink = sink
+	t.Cleanup(func() { handler.AuditSink = previous })
+	return &sink.entries
+}
+
+func TestUpdateLink_AuditsDiff(t *testing.T) {
+	ctx := context.Background()
+	patchSessions(t)
+	entries := captureAudit(t)
+
+	owner := "user-id"
+	patchGetURL := monkey.Patch(db.GetURL, func(context.Context, string, string) (*db.URL, error) {
+		return &db.URL{Domain: db.DefaultDomain, ShortCode: "abc123", OriginalURL: "https://example.com", UserID: &owner}, nil
+	})
+	defer patchGetURL.Unpatch()
+
+	patchUpdate := monkey.Patch(db.UpdateURL, func(_ context.Context, domain, shortCode string, _ db.URLUpdate) (*db.URL, error) {
+		return &db.URL{Domain: domain, ShortCode: shortCode}, nil
+	})
+	defer patchUpdate.Unpatch()
+
+	request := requestFrom("1.2.3.4")
+	request.RequestContext.RequestID = "req-1"
+	request.HTTPMethod = "PATCH"
+	request.Headers = authHeaders(t, "user-id")
+	request.PathParameters = map[string]string{"short_code": "abc123"}
+	request.Body = `{"original_url": "https://example.org", "title": "Example"}`
+
+	resp, _ := authed(handler.Links)(ctx, request)
+	assert.Equal(t, 200, resp.StatusCode)
+
+	if assert.Len(t, *entries, 1) {
+		entry := (*entries)[0]
+		assert.Equal(t, handler.AuditLinkUpdate, entry.Action)
+		assert.Equal(t, "user-id", entry.ActorID)
+		assert.Equal(t, db.DefaultDomain+"/abc123", entry.TargetID)
+		assert.Equal(t, "1.2.3.4", entry.IP)
+		assert.Equal(t, "req-1", entry.RequestID)
+		assert.Equal(t, map[string]db.AuditChange{
+			"original_url": {Before: `"https://example.com"`, After: `"https://example.org"`},
+			"title":        {After: `"Example"`},
+		}, entry.Changes)
+	}
+
+	// Updates changing nothing aren't recorded
+	request.Body = `{"original_url": "https://example.com"}`
+	resp, _ = authed(handler.Links)(ctx, request)
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Len(t, *entries, 1)
+}
+
+func TestDeleteLink_Audited(t *testing.T) {
+	ctx := context.Background()
+	patchSessions(t)
+	entries := captureAudit(t)
+
+	owner := "user-id"
+	patchGetURL := monkey.Patch(db.GetURL, func(context.Context, string, string) (*db.URL, error) {
+		return &db.URL{Domain: db.DefaultDomain, ShortCode: "abc123", OriginalURL: "https://example.com", UserID: &owner}, nil
+	})
+	defer patchGetURL.Unpatch()
+
+	patchDelete := monkey.Patch(db.DeleteURL, func(context.Context, string, string) error { return nil })
+	defer patchDelete.Unpatch()
+
+	resp, _ := authed(handler.Links)(ctx, events.APIGatewayProxyRequest{
+		HTTPMethod:     "DELETE",
+		Headers:        authHeaders(t, "user-id"),
+		PathParameters: map[string]string{"short_code": "abc123"},
+	})
+	assert.Equal(t, 204, resp.StatusCode)
+
+	if assert.Len(t, *entries, 1) {
+		entry := (*entries)[0]
+		assert.Equal(t, handler.AuditLinkDelete, entry.Action)
+		assert.Equal(t, db.AuditChange{Before: `"https://example.com"`}, entry.Changes["original_url"])
+	}
+}
+
+func TestShorten_AuditsAnonymousCreate(t *testing.T) {
+	ctx := context.Background()
+	entries := captureAudit(t)
+
+	patchCreateURL := monkey.Patch(db.CreateURL, func(context.Context, *db.URL) error { return nil })
+	defer patchCreateURL.Unpatch()
+
+	request := requestFrom("1.2.3.4")
+	request.Body = `{"original_url": "https://example.com"}`
+	resp, _ := handler.Shorten(ctx, request)
+	assert.Equal(t, 200, resp.StatusCode)
+
+	if assert.Len(t, *entries, 1) {
+		entry := (*entries)[0]
+		assert.Equal(t, handler.AuditLinkCreate, entry.Action)
+		assert.Empty(t, entry.ActorID)
+		assert.Equal(t, "1.2.3.4", entry.IP)
+		assert.Equal(t, `"https://example.com"`, entry.Changes["original_url"].After)
+	}
+}
+
+func TestLogin_Audited(t *testing.T) {
+	ctx := context.Background()
+	entries := captureAudit(t)
+	user := &db.User{ID: "user-id", Email: "test@example.com", Password: "hash", Verified: true}
+
+	unpatch := patchLoginUser(user)
+	patchFailed := monkey.Patch(db.RecordFailedLogin, func(context.Context, string) (int, error) { return 1, nil })
+	resp, _ := handler.Login(ctx, loginRequest("wrong"))
+	patchFailed.Unpatch()
+	unpatch()
+	assert.Equal(t, 401, resp.StatusCode)
+
+	defer patchLoginUser(user)()
+	resp, _ = handler.Login(ctx, loginRequest("password"))
+	assert.Equal(t, 200, resp.StatusCode)
+
+	if assert.Len(t, *entries, 2) {
+		assert.Equal(t, handler.AuditLoginFailed, (*entries)[0].Action)
+		assert.Equal(t, handler.AuditLogin, (*entries)[1].Action)
+		assert.Equal(t, "user-id", (*entries)[1].ActorID)
+		assert.Equal(t, "password", (*entries)[1].Details["method"])
+	}
+}
+
+func TestMyAudit_OnlyOwnEntries(t *testing.T) {
+	ctx := context.Background()
+	patchSessions(t)
+
+	var filter db.AuditFilter
+	patchList := monkey.Patch(db.ListAuditEntries, func(ctx context.Context, f db.AuditFilter, limit int32, cursor string) ([]db.AuditEntry, string, error) {
+		filter = f
+		return []db.AuditEntry{{ID: "entry-1", ActorID: f.ActorID, Action: handler.AuditLogin}}, "next", nil
+	})
+	defer patchList.Unpatch()
+
+	request := accountRequest(t, "GET", "/me/audit", "")
+	// Filters of other users' entries are ignored
+	request.QueryStringParameters = map[string]string{"actor_id": "other-id", "action": handler.AuditLogin}
+	resp, _ := authed(handler.Account)(ctx, request)
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, db.AuditFilter{ActorID: "user-id", Action: handler.AuditLogin}, filter)
+
+	var body handler.AuditResponse
+	assert.NoError(t, json.Unmarshal([]byte(resp.Body), &body))
+	assert.Equal(t, "next", body.NextCursor)
+	assert.Len(t, body.Entries, 1)
+}
+
+func TestAdminAudit(t *testing.T) {
+	ctx := context.Background()
+	patchAdmin(t, nil)
+
+	var filter db.AuditFilter
+	patchList := monkey.Patch(db.ListAuditEntries, func(ctx context.Context, f db.AuditFilter, limit int32, cursor string) ([]db.AuditEntry, string, error) {
+		filter = f
+		return nil, "", nil
+	})
+	defer patchList.Unpatch()
+
+	request := adminRequest(t, "GET", "/admin/audit", "")
+	request.QueryStringParameters = map[string]string{"target_type": "link", "target_id": "sho.rt/abc123"}
+	resp, _ := authed(handler.Admin)(ctx, request)
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, db.AuditFilter{TargetType: "link", TargetID: "sho.rt/abc123"}, filter)
+	assert.JSONEq(t, `{"entries": []}`, resp.Body)
+
+	request.Headers = authHeaders(t, "user-id")
+	resp, _ = authed(handler.Admin)(ctx, request)
+	assert.Equal(t, 403, resp.StatusCode)
+}
+
+func TestMultiSink_WritesEverySink(t *testing.T) {
+	first, second := &fakeSink{}, &fakeSink{}
+	sink := audit.MultiSink{first, second}
+
+	assert.NoError(t, sink.Write(context.Background(), db.AuditEntry{ID: "entry-1"}))
+	assert.Len(t, first.entries, 1)
+	assert.Len(t, second.entries, 1)
+}
@@ -0,0 +1,100 @@
+package tests
+
+import (
+	"context"
+	"testing"
+
+	"bou.ke/monkey"
+	"github.com/SunPodder/shorty/internal/db"
+
+	"github.com/SunPodder/shorty/internal/middleware"
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/stretchr/testify/assert"
+)
+
+// Wraps a handler with the authentication middleware in required mode
+func authed(next middleware.HandlerFunc) middleware.HandlerFunc {
+	return middleware.WithAuth(middleware.AuthRequired, next)
+}
+
+// Lets every JWT session through the revocation check of WithAuth by
+// making any user ID resolve to a user without revoked sessions
+func patchSessions(t *testing.T) {
+	monkey.Patch(db.GetUser, func(ctx context.Context, id string) (*db.User, error) {
+		return &db.User{ID: id}, nil
+	})
+	t.Cleanup(func() { monkey.Unpatch(db.GetUser) })
+}
+
+// Handler recording the principal it was called with
+func principalRecorder(principal **middleware.Principal) middleware.HandlerFunc {
+	return func(ctx context.Context, _ events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+		*principal, _ = middleware.PrincipalFromContext(ctx)
+		return events.APIGatewayProxyResponse{StatusCode: 200}, nil
+	}
+}
+
+func TestWithAuth_AnyHeaderCasing(t *testing.T) {
+	ctx := context.Background()
+	patchSessions(t)
+	token := mustJWT(t, "user-id")
+
+	for _, name := range []string{"Authorization", "authorization", "AUTHORIZATION"} {
+		var principal *middleware.Principal
+		request := events.APIGatewayProxyRequest{
+			Headers: map[string]string{name: "bearer " + token},
+		}
+
+		resp, err := authed(principalRecorder(&principal))(ctx, request)
+		assert.NoError(t, err)
+		assert.Equal(t, 200, resp.StatusCode, name)
+		if assert.NotNil(t, principal, name) {
+			assert.Equal(t, "user-id", principal.UserID)
+			assert.True(t, principal.IsSession())
+		}
+	}
+}
+
+func TestWithAuth_RequiredRejectsMissing(t *testing.T) {
+	ctx := context.Background()
+	var principal *middleware.Principal
+
+	resp, _ := authed(principalRecorder(&principal))(ctx, events.APIGatewayProxyRequest{})
+	assert.Equal(t, 401, resp.StatusCode)
+	assert.Nil(t, principal)
+}
+
+func TestWithAuth_OptionalAllowsAnonymous(t *testing.T) {
+	ctx := context.Background()
+	var principal *middleware.Principal
+
+	next := middleware.WithAuth(middleware.AuthOptional, principalRecorder(&principal))
+	resp, _ := next(ctx, events.APIGatewayProxyRequest{})
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Nil(t, principal)
+}
+
+func TestWithAuth_OptionalRejectsInvalidToken(t *testing.T) {
+	ctx := context.Background()
+	patchSessions(t)
+	var principal *middleware.Principal
+	request := events.APIGatewayProxyRequest{
+		Headers: map[string]string{"Authorization": "Bearer invalid.token.here"},
+	}
+
+	next := middleware.WithAuth(middleware.AuthOptional, principalRecorder(&principal))
+	resp, _ := next(ctx, request)
+	assert.Equal(t, 401, resp.StatusCode)
+	assert.Nil(t, principal)
+}
+
+func TestWithAuth_RejectsOtherSchemes(t *testing.T) {
+	ctx := context.Background()
+	var principal *middleware.Principal
+	request := events.APIGatewayProxyRequest{
+		Headers: map[string]string{"Authorization": "Basic dXNlcjpwYXNz"},
+	}
+
+	resp, _ := authed(principalRecorder(&principal))(ctx, request)
+	assert.Equal(t, 401, resp.StatusCode)
+}
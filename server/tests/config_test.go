@@ -0,0 +1,300 @@
+package tests
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"bou.ke/monkey"
+	"github.com/SunPodder/shorty/internal/config"
+	"github.com/SunPodder/shorty/internal/db"
+	"github.com/SunPodder/shorty/internal/handler"
+	"github.com/SunPodder/shorty/internal/middleware"
+	"github.com/SunPodder/shorty/utils"
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/stretchr/testify/assert"
+)
+
+const testJWTSecret = "0123456789abcdef0123456789abcdef"
+
+// Points CONFIG_FILE at a file with the given content, or clears it
+func useConfigFile(t *testing.T, name, content string) {
+	if name == "" {
+		t.Setenv("CONFIG_FILE", "")
+		return
+	}
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("CONFIG_FILE", path)
+}
+
+func TestConfig_Defaults(t *testing.T) {
+	useConfigFile(t, "", "")
+	t.Setenv("JWT_SECRET", testJWTSecret)
+
+	cfg, err := config.Load()
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, "shorty_links", cfg.Tables.URLs)
+	assert.Equal(t, "shorty_webhook_deliveries", cfg.Tables.WebhookDeliveries)
+	assert.Equal(t, config.Duration(24*time.Hour), cfg.Tokens.Session)
+	assert.Equal(t, []string{"*"}, cfg.CORS.AllowedOrigins)
+	assert.Equal(t, 6, cfg.Links.CodeLength)
+	assert.Equal(t, 302, cfg.Links.RedirectStatus)
+	assert.True(t, cfg.Features.Registration)
+	assert.False(t, cfg.Features.RequireEmailVerification)
+}
+
+func TestConfig_RequiresJWTSecret(t *testing.T) {
+	useConfigFile(t, "", "")
+	for secret, problem := range map[string]string{
+		"":                "must be set",
+		"your-secret-key": "must not be the example secret",
+		"short":           "at least 32 characters",
+	} {
+		t.Setenv("JWT_SECRET", secret)
+		_, err := config.Load()
+		assert.ErrorIs(t, err, config.ErrInvalidConfig)
+		if assert.Error(t, err) {
+			assert.Contains(t, err.Error(), "JWT_SECRET")
+			assert.Contains(t, err.Error(), problem)
+		}
+	}
+}
+
+func TestConfig_Env(t *testing.T) {
+	useConfigFile(t, "", "")
+	t.Setenv("JWT_SECRET", testJWTSecret)
+	t.Setenv("TABLE_URLS", "staging_urls")
+	t.Setenv("DYNAMODB_ENDPOINT", "http://localhost:8000")
+	t.Setenv("SESSION_TTL", "2h")
+	t.Setenv("CORS_ALLOWED_ORIGINS", "https://app.sho.rt, https://admin.sho.rt")
+	t.Setenv("PUBLIC_URL", "https://sho.rt")
+	t.Setenv("SHORT_CODE_LENGTH", "8")
+	t.Setenv("REDIRECT_STATUS", "301")
+	t.Setenv("SCREENING_ACTION", "quarantine")
+	t.Setenv("WEBHOOK_CLICK_SAMPLE_RATE", "0.5")
+	t.Setenv("WEBHOOK_ALLOW_PRIVATE_RECEIVERS", "true")
+	t.Setenv("REGISTRATION_ENABLED", "false")
+
+	cfg, err := config.Load()
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, "staging_urls", cfg.Tables.URLs)
+	assert.Equal(t, "shorty_users", cfg.Tables.Users)
+	assert.Equal(t, "http://localhost:8000", cfg.DynamoDB.Endpoint)
+	assert.Equal(t, config.Duration(2*time.Hour), cfg.Tokens.Session)
+	assert.Equal(t, []string{"https://app.sho.rt", "https://admin.sho.rt"}, cfg.CORS.AllowedOrigins)
+	assert.Equal(t, "https://sho.rt", cfg.Links.BaseURL)
+	assert.Equal(t, 8, cfg.Links.CodeLength)
+	assert.Equal(t, 301, cfg.Links.RedirectStatus)
+	assert.Equal(t, handler.ScreenQuarantine, cfg.Abuse.ScreeningAction)
+	assert.Equal(t, 0.5, cfg.Webhooks.ClickSampleRate)
+	assert.True(t, cfg.Webhooks.AllowPrivateReceivers)
+	assert.False(t, cfg.Features.Registration)
+}
+
+func TestConfig_ReportsEveryProblem(t *testing.T) {
+	useConfigFile(t, "", "")
+	t.Setenv("JWT_SECRET", testJWTSecret)
+	t.Setenv("SESSION_TTL", "forever")
+	t.Setenv("SHORT_CODE_LENGTH", "six")
+	_, err := config.Load()
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), `SESSION_TTL "forever": must be a duration`)
+		assert.Contains(t, err.Error(), `SHORT_CODE_LENGTH "six": must be a whole number`)
+	}
+
+	t.Setenv("SESSION_TTL", "")
+	t.Setenv("SHORT_CODE_LENGTH", "2")
+	t.Setenv("TABLE_REPORTS", "no spaces allowed")
+	t.Setenv("CORS_ALLOWED_ORIGINS", "https://app.sho.rt/login")
+	t.Setenv("REDIRECT_STATUS", "200")
+	t.Setenv("DYNAMODB_ENDPOINT", "localhost:8000")
+	_, err = config.Load()
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "links.code_length (SHORT_CODE_LENGTH): 2 must be between 4 and 32")
+		assert.Contains(t, err.Error(), "tables.reports (TABLE_REPORTS)")
+		assert.Contains(t, err.Error(), "cors.allowed_origins (CORS_ALLOWED_ORIGINS)")
+		assert.Contains(t, err.Error(), "links.redirect_status (REDIRECT_STATUS)")
+		assert.Contains(t, err.Error(), "dynamodb.endpoint (DYNAMODB_ENDPOINT)")
+	}
+}
+
+func TestConfig_File(t *testing.T) {
+	t.Setenv("JWT_SECRET", "")
+	useConfigFile(t, "shorty.yaml", `
+tables:
+  urls: dev_urls
+secrets:
+  jwt_secret: `+testJWTSecret+`
+tokens:
+  mfa_challenge_ttl: 2m
+cors:
+  allowed_origins: [https://app.sho.rt]
+links:
+  code_length: 10
+features:
+  require_email_verification: true
+`)
+	t.Setenv("SHORT_CODE_LENGTH", "12")
+
+	cfg, err := config.Load()
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, "dev_urls", cfg.Tables.URLs)
+	assert.Equal(t, testJWTSecret, cfg.Secrets.JWTSecret)
+	assert.Equal(t, config.Duration(2*time.Minute), cfg.Tokens.MFAChallenge)
+	assert.Equal(t, []string{"https://app.sho.rt"}, cfg.CORS.AllowedOrigins)
+	assert.True(t, cfg.Features.RequireEmailVerification)
+	// The environment takes precedence over the file
+	assert.Equal(t, 12, cfg.Links.CodeLength)
+
+	data, _ := json.Marshal(map[string]any{
+		"secrets": map[string]any{"jwt_secret": testJWTSecret},
+		"tokens":  map[string]any{"session_ttl": "30m"},
+	})
+	useConfigFile(t, "shorty.json", string(data))
+	cfg, err = config.Load()
+	if assert.NoError(t, err) {
+		assert.Equal(t, config.Duration(30*time.Minute), cfg.Tokens.Session)
+	}
+
+	// Typos are caught rather than silently ignored
+	useConfigFile(t, "shorty.yaml", "links:\n  code_lenght: 10\n")
+	_, err = config.Load()
+	if assert.ErrorIs(t, err, config.ErrInvalidConfig) {
+		assert.Contains(t, err.Error(), "code_lenght")
+	}
+
+	useConfigFile(t, "shorty.toml", "")
+	_, err = config.Load()
+	assert.ErrorIs(t, err, config.ErrInvalidConfig)
+}
+
+func TestConfig_Apply(t *testing.T) {
+	previous := struct {
+		secret       []byte
+		hashKey      []byte
+		session      time.Duration
+		origins      []string
+		publicURL    string
+		codeLength   int
+		registration bool
+	}{utils.JWTSecret, utils.HashKey, utils.SessionTTL, middleware.AllowedOrigins, handler.PublicURL, handler.ShortCodeLength, handler.RegistrationEnabled}
+	t.Cleanup(func() {
+		utils.JWTSecret = previous.secret
+		utils.HashKey = previous.hashKey
+		utils.SessionTTL = previous.session
+		middleware.AllowedOrigins = previous.origins
+		handler.PublicURL = previous.publicURL
+		handler.ShortCodeLength = previous.codeLength
+		handler.RegistrationEnabled = previous.registration
+		db.SetTables(db.DefaultTables)
+		db.Endpoint = ""
+	})
+
+	cfg := config.Default()
+	cfg.Secrets.JWTSecret = testJWTSecret
+	cfg.Tokens.Session = config.Duration(time.Hour)
+	cfg.CORS.AllowedOrigins = []string{"https://app.sho.rt"}
+	cfg.Links.BaseURL = "https://sho.rt"
+	cfg.Links.CodeLength = 10
+	cfg.Features.Registration = false
+	cfg.Apply()
+
+	assert.Equal(t, []byte(testJWTSecret), utils.JWTSecret)
+	// Hashes are keyed with the JWT secret unless a key is configured
+	assert.Equal(t, []byte(testJWTSecret), utils.HashKey)
+	assert.Equal(t, time.Hour, utils.SessionTTL)
+	assert.Equal(t, []string{"https://app.sho.rt"}, middleware.AllowedOrigins)
+	assert.Equal(t, "https://sho.rt", handler.PublicURL)
+	assert.Equal(t, 10, handler.ShortCodeLength)
+	assert.False(t, handler.RegistrationEnabled)
+
+	// Sessions are signed with the configured secret
+	token, err := utils.GenerateJWT("user-id")
+	assert.NoError(t, err)
+	userID, err := utils.ValidateJWT(token)
+	assert.NoError(t, err)
+	assert.Equal(t, "user-id", userID)
+	utils.JWTSecret = []byte("another-secret-another-secret-00")
+	_, err = utils.ValidateJWT(token)
+	assert.Error(t, err)
+
+	// Nothing is signed or accepted without a secret
+	utils.JWTSecret = nil
+	_, err = utils.GenerateJWT("user-id")
+	assert.ErrorIs(t, err, utils.ErrNoJWTSecret)
+	_, err = utils.GenerateMFAChallenge("user-id")
+	assert.ErrorIs(t, err, utils.ErrNoJWTSecret)
+	_, err = utils.ValidateJWT(token)
+	assert.Error(t, err)
+
+	cfg.Secrets.HashKey = "fedcba9876543210fedcba9876543210"
+	cfg.Apply()
+	assert.Equal(t, []byte(cfg.Secrets.HashKey), utils.HashKey)
+}
+
+func TestCORS_AllowedOrigins(t *testing.T) {
+	previous := middleware.AllowedOrigins
+	middleware.AllowedOrigins = []string{"https://app.sho.rt"}
+	t.Cleanup(func() { middleware.AllowedOrigins = previous })
+	ctx := context.Background()
+
+	resp, _ := middleware.WithCORS(okHandler)(ctx, events.APIGatewayProxyRequest{
+		HTTPMethod: "GET",
+		Headers:    map[string]string{"origin": "https://app.sho.rt"},
+	})
+	assert.Equal(t, "https://app.sho.rt", resp.Headers["Access-Control-Allow-Origin"])
+	assert.Equal(t, "Origin", resp.Headers["Vary"])
+
+	resp, _ = middleware.WithCORS(okHandler)(ctx, events.APIGatewayProxyRequest{
+		HTTPMethod: "OPTIONS",
+		Headers:    map[string]string{"Origin": "https://evil.example"},
+	})
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.NotContains(t, resp.Headers, "Access-Control-Allow-Origin")
+
+	middleware.AllowedOrigins = []string{"*"}
+	resp, _ = middleware.WithCORS(okHandler)(ctx, events.APIGatewayProxyRequest{HTTPMethod: "GET"})
+	assert.Equal(t, "*", resp.Headers["Access-Control-Allow-Origin"])
+	assert.NotContains(t, resp.Headers, "Vary")
+}
+
+func TestRegister_Disabled(t *testing.T) {
+	handler.RegistrationEnabled = false
+	t.Cleanup(func() { handler.RegistrationEnabled = true })
+
+	resp, _ := handler.Register(context.Background(), events.APIGatewayProxyRequest{
+		Body: `{"email": "new@example.com", "password": "correct horse battery staple"}`,
+	})
+	assert.Equal(t, 403, resp.StatusCode)
+	assert.Contains(t, resp.Body, "Registration is disabled")
+}
+
+func TestShorten_CodeLength(t *testing.T) {
+	handler.ShortCodeLength = 12
+	t.Cleanup(func() { handler.ShortCodeLength = 6 })
+
+	var created *db.URL
+	monkey.Patch(db.CreateURL, func(_ context.Context, url *db.URL) error {
+		created = url
+		return nil
+	})
+	t.Cleanup(monkey.UnpatchAll)
+
+	resp, _ := handler.Shorten(context.Background(), events.APIGatewayProxyRequest{Body: `{"original_url": "https://example.com"}`})
+	assert.Equal(t, 200, resp.StatusCode)
+	if assert.NotNil(t, created) {
+		assert.Len(t, created.ShortCode, 12)
+	}
+}
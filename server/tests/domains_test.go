@@ -0,0 +1,341 @@
+package tests
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"bou.ke/monkey"
+	"github.com/SunPodder/shorty/internal/db"
+	"github.com/SunPodder/shorty/internal/dns"
+	"github.com/SunPodder/shorty/internal/handler"
+	"github.com/SunPodder/shorty/utils"
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeResolver serves TXT records from memory
+type fakeResolver map[string][]string
+
+func (f fakeResolver) LookupTXT(_ context.Context, name string) ([]string, error) {
+	return f[name], nil
+}
+
+func authHeaders(t *testing.T, userID string) map[string]string {
+	return map[string]string{"Authorization": "Bearer " + mustJWT(t, userID)}
+}
+
+func TestAddDomain_Success(t *testing.T) {
+	ctx := context.Background()
+	patchSessions(t)
+	request := events.APIGatewayProxyRequest{
+		HTTPMethod: "POST",
+		Headers:    authHeaders(t, "user-id"),
+		Body:       `{"domain": "Go.Acme.com"}`,
+	}
+
+	var created db.Domain
+	patchCreateDomain := monkey.Patch(db.CreateDomain, func(_ context.Context, domain db.Domain) error {
+		created = domain
+		return nil
+	})
+	defer patchCreateDomain.Unpatch()
+
+	resp, err := authed(handler.Domains)(ctx, request)
+	assert.NoError(t, err)
+	assert.Equal(t, 201, resp.StatusCode)
+	assert.Equal(t, "go.acme.com", created.Domain)
+	assert.Equal(t, "user-id", created.UserID)
+	assert.False(t, created.Verified)
+	if assert.NotNil(t, created.ExpiresAt) {
+		assert.InDelta(t, time.Now().Add(handler.PendingDomainTTL).Unix(), *created.ExpiresAt, 5)
+	}
+
+	var body handler.DomainResponse
+	assert.NoError(t, json.Unmarshal([]byte(resp.Body), &body))
+	assert.Equal(t, "_shorty-verification.go.acme.com", body.RecordName)
+	assert.Equal(t, dns.RecordValue(created.VerificationToken), body.RecordValue)
+}
+
+func TestAddDomain_InvalidDomain(t *testing.T) {
+	ctx := context.Background()
+	patchSessions(t)
+	request := events.APIGatewayProxyRequest{
+		HTTPMethod: "POST",
+		Headers:    authHeaders(t, "user-id"),
+		Body:       `{"domain": "not a domain"}`,
+	}
+
+	resp, _ := authed(handler.Domains)(ctx, request)
+	assert.Equal(t, 400, resp.StatusCode)
+}
+
+func TestVerifyDomain_Success(t *testing.T) {
+	ctx := context.Background()
+	patchSessions(t)
+	request := events.APIGatewayProxyRequest{
+		HTTPMethod:     "POST",
+		Headers:        authHeaders(t, "user-id"),
+		PathParameters: map[string]string{"domain": "go.acme.com"},
+	}
+
+	patchGetDomain := monkey.Patch(db.GetDomain, func(context.Context, string) (*db.Domain, error) {
+		return &db.Domain{Domain: "go.acme.com", UserID: "user-id", VerificationToken: "secret"}, nil
+	})
+	defer patchGetDomain.Unpatch()
+
+	verified := false
+	patchMarkVerified := monkey.Patch(db.MarkDomainVerified, func(context.Context, string) error {
+		verified = true
+		return nil
+	})
+	defer patchMarkVerified.Unpatch()
+
+	handler.DNSResolver = fakeResolver{
+		"_shorty-verification.go.acme.com": {"unrelated", "shorty-verification=secret"},
+	}
+	defer func() { handler.DNSResolver = dns.NewNetResolver() }()
+
+	resp, err := authed(handler.Domains)(ctx, request)
+	assert.NoError(t, err)
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.True(t, verified)
+}
+
+func TestVerifyDomain_RecordMissing(t *testing.T) {
+	ctx := context.Background()
+	patchSessions(t)
+	request := events.APIGatewayProxyRequest{
+		HTTPMethod:     "POST",
+		Headers:        authHeaders(t, "user-id"),
+		PathParameters: map[string]string{"domain": "go.acme.com"},
+	}
+
+	patchGetDomain := monkey.Patch(db.GetDomain, func(context.Context, string) (*db.Domain, error) {
+		return &db.Domain{Domain: "go.acme.com", UserID: "user-id", VerificationToken: "secret"}, nil
+	})
+	defer patchGetDomain.Unpatch()
+
+	handler.DNSResolver = fakeResolver{}
+	defer func() { handler.DNSResolver = dns.NewNetResolver() }()
+
+	resp, _ := authed(handler.Domains)(ctx, request)
+	assert.Equal(t, 422, resp.StatusCode)
+}
+
+func TestVerifyDomain_NotOwner(t *testing.T) {
+	ctx := context.Background()
+	patchSessions(t)
+	request := events.APIGatewayProxyRequest{
+		HTTPMethod:     "POST",
+		Headers:        authHeaders(t, "someone-else"),
+		PathParameters: map[string]string{"domain": "go.acme.com"},
+	}
+
+	patchGetDomain := monkey.Patch(db.GetDomain, func(context.Context, string) (*db.Domain, error) {
+		return &db.Domain{Domain: "go.acme.com", UserID: "user-id", VerificationToken: "secret"}, nil
+	})
+	defer patchGetDomain.Unpatch()
+
+	resp, _ := authed(handler.Domains)(ctx, request)
+	assert.Equal(t, 404, resp.StatusCode)
+}
+
+func TestDomain_Expired(t *testing.T) {
+	past := time.Now().Add(-time.Minute).Unix()
+	future := time.Now().Add(time.Hour).Unix()
+
+	assert.True(t, (&db.Domain{ExpiresAt: &past}).Expired())
+	assert.False(t, (&db.Domain{ExpiresAt: &future}).Expired())
+	assert.False(t, (&db.Domain{}).Expired())
+	// Verified domains never expire
+	assert.False(t, (&db.Domain{Verified: true, ExpiresAt: &past}).Expired())
+}
+
+func TestRemoveDomain_Success(t *testing.T) {
+	ctx := context.Background()
+	patchSessions(t)
+	request := events.APIGatewayProxyRequest{
+		HTTPMethod:     "DELETE",
+		Headers:        authHeaders(t, "user-id"),
+		PathParameters: map[string]string{"domain": "Go.Acme.com"},
+	}
+
+	patchGetDomain := monkey.Patch(db.GetDomain, func(_ context.Context, domain string) (*db.Domain, error) {
+		return &db.Domain{Domain: domain, UserID: "user-id"}, nil
+	})
+	defer patchGetDomain.Unpatch()
+
+	var deleted string
+	patchDeleteDomain := monkey.Patch(db.DeleteDomain, func(_ context.Context, domain string) error {
+		deleted = domain
+		return nil
+	})
+	defer patchDeleteDomain.Unpatch()
+
+	resp, err := authed(handler.Domains)(ctx, request)
+	assert.NoError(t, err)
+	assert.Equal(t, 204, resp.StatusCode)
+	assert.Equal(t, "go.acme.com", deleted)
+}
+
+func TestRemoveDomain_NotOwner(t *testing.T) {
+	ctx := context.Background()
+	patchSessions(t)
+	request := events.APIGatewayProxyRequest{
+		HTTPMethod:     "DELETE",
+		Headers:        authHeaders(t, "someone-else"),
+		PathParameters: map[string]string{"domain": "go.acme.com"},
+	}
+
+	patchGetDomain := monkey.Patch(db.GetDomain, func(context.Context, string) (*db.Domain, error) {
+		return &db.Domain{Domain: "go.acme.com", UserID: "user-id"}, nil
+	})
+	defer patchGetDomain.Unpatch()
+
+	patchDeleteDomain := monkey.Patch(db.DeleteDomain, func(context.Context, string) error {
+		t.Fatal("domain of another user deleted")
+		return nil
+	})
+	defer patchDeleteDomain.Unpatch()
+
+	resp, _ := authed(handler.Domains)(ctx, request)
+	assert.Equal(t, 404, resp.StatusCode)
+}
+
+func TestResolve_CustomDomainNamespace(t *testing.T) {
+	ctx := context.Background()
+	request := events.APIGatewayProxyRequest{
+		Headers:        map[string]string{"host": "go.acme.com"},
+		PathParameters: map[string]string{"short_code": "abc123"},
+	}
+
+	patchGetDomain := monkey.Patch(db.GetDomain, func(context.Context, string) (*db.Domain, error) {
+		return &db.Domain{Domain: "go.acme.com", UserID: "user-id", Verified: true}, nil
+	})
+	defer patchGetDomain.Unpatch()
+
+	patchGetURL := monkey.Patch(db.GetURL, func(_ context.Context, domain, _ string) (*db.URL, error) {
+		assert.Equal(t, "go.acme.com", domain)
+		return &db.URL{Domain: domain, OriginalURL: "https://acme.com"}, nil
+	})
+	defer patchGetURL.Unpatch()
+
+	patchIncrementClicks := monkey.Patch(db.IncrementClicks, func(_ context.Context, domain, _ string) error {
+		assert.Equal(t, "go.acme.com", domain)
+		return nil
+	})
+	defer patchIncrementClicks.Unpatch()
+
+	resp, err := handler.Resolve(ctx, request)
+	assert.NoError(t, err)
+	assert.Equal(t, "https://acme.com", resp.Headers["Location"])
+}
+
+func TestResolve_UnknownHostUsesDefaultDomain(t *testing.T) {
+	ctx := context.Background()
+	request := events.APIGatewayProxyRequest{
+		Headers:        map[string]string{"Host": "abc.execute-api.us-east-1.amazonaws.com"},
+		PathParameters: map[string]string{"short_code": "abc123"},
+	}
+
+	patchGetDomain := monkey.Patch(db.GetDomain, func(context.Context, string) (*db.Domain, error) {
+		return nil, db.ErrDomainNotFound
+	})
+	defer patchGetDomain.Unpatch()
+
+	patchGetURL := monkey.Patch(db.GetURL, func(_ context.Context, domain, _ string) (*db.URL, error) {
+		assert.Equal(t, db.DefaultDomain, domain)
+		return &db.URL{Domain: domain, OriginalURL: "https://example.com"}, nil
+	})
+	defer patchGetURL.Unpatch()
+
+	patchIncrementClicks := monkey.Patch(db.IncrementClicks, func(context.Context, string, string) error {
+		return nil
+	})
+	defer patchIncrementClicks.Unpatch()
+
+	resp, _ := handler.Resolve(ctx, request)
+	assert.Equal(t, 302, resp.StatusCode)
+}
+
+func TestShorten_UnverifiedDomain(t *testing.T) {
+	ctx := context.Background()
+	patchSessions(t)
+	domain := "go.acme.com"
+	token, _ := utils.GenerateJWT("user-id")
+	body, _ := json.Marshal(handler.ShortenRequest{
+		OriginalURL: "https://example.com",
+		Domain:      &domain,
+		Token:       &token,
+	})
+	request := events.APIGatewayProxyRequest{Body: string(body)}
+
+	patchGetDomain := monkey.Patch(db.GetDomain, func(context.Context, string) (*db.Domain, error) {
+		return &db.Domain{Domain: domain, UserID: "user-id", Verified: false}, nil
+	})
+	defer patchGetDomain.Unpatch()
+
+	resp, _ := handler.Shorten(ctx, request)
+	assert.Equal(t, 403, resp.StatusCode)
+}
+
+func TestAddDomain_ServiceHostsReserved(t *testing.T) {
+	ctx := context.Background()
+	patchSessions(t)
+	previous := handler.PublicURL
+	handler.PublicURL = "https://sho.rt"
+	defer func() { handler.PublicURL = previous }()
+
+	patchCreateDomain := monkey.Patch(db.CreateDomain, func(context.Context, db.Domain) error {
+		t.Error("Expected no service host to be claimed")
+		return nil
+	})
+	defer patchCreateDomain.Unpatch()
+
+	for _, name := range []string{"sho.rt", "abc123.execute-api.us-east-1.amazonaws.com", "api.sho.example"} {
+		request := events.APIGatewayProxyRequest{
+			HTTPMethod: "POST",
+			Headers:    authHeaders(t, "user-id"),
+			Body:       `{"domain": "` + name + `"}`,
+		}
+		request.Headers["Host"] = "api.sho.example"
+		resp, _ := authed(handler.Domains)(ctx, request)
+		assert.Equal(t, 409, resp.StatusCode, name)
+	}
+}
+
+func TestResolve_PendingClaimKeepsDefaultDomain(t *testing.T) {
+	ctx := context.Background()
+	previous := handler.PublicURL
+	handler.PublicURL = "https://sho.rt"
+	defer func() { handler.PublicURL = previous }()
+
+	var lookups []string
+	patchGetDomain := monkey.Patch(db.GetDomain, func(_ context.Context, name string) (*db.Domain, error) {
+		lookups = append(lookups, name)
+		return &db.Domain{Domain: name, UserID: "attacker", Verified: false}, nil
+	})
+	defer patchGetDomain.Unpatch()
+
+	patchGetURL := monkey.Patch(db.GetURL, func(_ context.Context, domain, _ string) (*db.URL, error) {
+		assert.Equal(t, db.DefaultDomain, domain)
+		return &db.URL{Domain: domain, OriginalURL: "https://example.com"}, nil
+	})
+	defer patchGetURL.Unpatch()
+	patchIncrementClicks := monkey.Patch(db.IncrementClicks, func(context.Context, string, string) error {
+		return nil
+	})
+	defer patchIncrementClicks.Unpatch()
+
+	for _, host := range []string{"go.acme.com", "sho.rt", "abc.execute-api.us-east-1.amazonaws.com"} {
+		resp, _ := handler.Resolve(ctx, events.APIGatewayProxyRequest{
+			Headers:        map[string]string{"Host": host},
+			PathParameters: map[string]string{"short_code": "abc123"},
+		})
+		assert.Equal(t, 302, resp.StatusCode, host)
+	}
+	// The service's own hosts are never looked up
+	assert.Equal(t, []string{"go.acme.com"}, lookups)
+}
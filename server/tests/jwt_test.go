@@ -8,6 +8,14 @@ import (
 	"github.com/golang-jwt/jwt/v5"
 )
 
+// Secret the tokens of the tests are signed with, set from the
+// configured secret at startup
+var testSigningSecret = []byte("fedcba9876543210fedcba9876543210")
+
+func init() {
+	utils.JWTSecret = testSigningSecret
+}
+
 func TestGenerateJWT(t *testing.T) {
 	userID := "test-user-id"
 	tokenStr, err := utils.GenerateJWT(userID)
@@ -19,7 +27,7 @@ func TestGenerateJWT(t *testing.T) {
 		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
 			return nil, nil
 		}
-		return []byte("your-secret-key"), nil
+		return testSigningSecret, nil
 	})
 	if err != nil {
 		t.Fatalf("JWT parse failed: %v", err)
@@ -69,7 +77,7 @@ func TestValidateJWT(t *testing.T) {
 		"iat": time.Now().Add(-2 * time.Hour).Unix(),
 	}
 	expiredToken := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	expiredStr, _ := expiredToken.SignedString([]byte("your-secret-key"))
+	expiredStr, _ := expiredToken.SignedString(testSigningSecret)
 	_, err = utils.ValidateJWT(expiredStr)
 	if err == nil {
 		t.Error("Expected error for expired token, got nil")
@@ -0,0 +1,128 @@
+package tests
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"bou.ke/monkey"
+	"github.com/SunPodder/shorty/internal/db"
+	"github.com/SunPodder/shorty/internal/handler"
+	"github.com/SunPodder/shorty/utils"
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/stretchr/testify/assert"
+)
+
+func mustJWT(t *testing.T, userID string) string {
+	token, err := utils.GenerateJWT(userID)
+	if err != nil {
+		t.Fatalf("generateJWT failed: %v", err)
+	}
+	return token
+}
+
+func TestUpdateLink_WorkspaceEditor(t *testing.T) {
+	ctx := context.Background()
+	patchSessions(t)
+	request := events.APIGatewayProxyRequest{
+		HTTPMethod:     "PATCH",
+		Headers:        authHeaders(t, "editor-id"),
+		PathParameters: map[string]string{"short_code": "abc123"},
+		Body:           `{"original_url": "https://example.org"}`,
+	}
+
+	workspaceID := "ws-1"
+	patchGetURL := monkey.Patch(db.GetURL, func(context.Context, string, string) (*db.URL, error) {
+		return &db.URL{Domain: db.DefaultDomain, ShortCode: "abc123", OriginalURL: "https://example.com", WorkspaceID: &workspaceID}, nil
+	})
+	defer patchGetURL.Unpatch()
+
+	patch := patchMembers(map[string]string{"editor-id": db.RoleEditor})
+	defer patch.Unpatch()
+
+	var updated db.URLUpdate
+	patchUpdate := monkey.Patch(db.UpdateURL, func(_ context.Context, domain, shortCode string, update db.URLUpdate) (*db.URL, error) {
+		updated = update
+		return &db.URL{Domain: domain, ShortCode: shortCode, OriginalURL: *update.OriginalURL, Clicks: 42}, nil
+	})
+	defer patchUpdate.Unpatch()
+
+	resp, err := authed(handler.Links)(ctx, request)
+	assert.NoError(t, err)
+	assert.Equal(t, 200, resp.StatusCode)
+	// Only the edited attributes are written
+	assert.Equal(t, db.URLUpdate{OriginalURL: updated.OriginalURL}, updated)
+	assert.Equal(t, "https://example.org", *updated.OriginalURL)
+
+	var body db.URL
+	assert.NoError(t, json.Unmarshal([]byte(resp.Body), &body))
+	assert.Equal(t, int64(42), body.Clicks)
+}
+
+func TestDeleteLink_WorkspaceViewerForbidden(t *testing.T) {
+	ctx := context.Background()
+	patchSessions(t)
+	request := events.APIGatewayProxyRequest{
+		HTTPMethod:     "DELETE",
+		Headers:        authHeaders(t, "viewer-id"),
+		PathParameters: map[string]string{"short_code": "abc123"},
+	}
+
+	workspaceID := "ws-1"
+	patchGetURL := monkey.Patch(db.GetURL, func(context.Context, string, string) (*db.URL, error) {
+		return &db.URL{Domain: db.DefaultDomain, ShortCode: "abc123", WorkspaceID: &workspaceID}, nil
+	})
+	defer patchGetURL.Unpatch()
+
+	patch := patchMembers(map[string]string{"viewer-id": db.RoleViewer})
+	defer patch.Unpatch()
+
+	resp, _ := authed(handler.Links)(ctx, request)
+	assert.Equal(t, 403, resp.StatusCode)
+}
+
+func TestDeleteLink_NotOwner(t *testing.T) {
+	ctx := context.Background()
+	patchSessions(t)
+	request := events.APIGatewayProxyRequest{
+		HTTPMethod:     "DELETE",
+		Headers:        authHeaders(t, "someone-else"),
+		PathParameters: map[string]string{"short_code": "abc123"},
+	}
+
+	owner := "user-id"
+	patchGetURL := monkey.Patch(db.GetURL, func(context.Context, string, string) (*db.URL, error) {
+		return &db.URL{Domain: db.DefaultDomain, ShortCode: "abc123", UserID: &owner}, nil
+	})
+	defer patchGetURL.Unpatch()
+
+	resp, _ := authed(handler.Links)(ctx, request)
+	assert.Equal(t, 404, resp.StatusCode)
+}
+
+func TestDeleteLink_Creator(t *testing.T) {
+	ctx := context.Background()
+	patchSessions(t)
+	request := events.APIGatewayProxyRequest{
+		HTTPMethod:     "DELETE",
+		Headers:        authHeaders(t, "user-id"),
+		PathParameters: map[string]string{"short_code": "abc123"},
+	}
+
+	owner := "user-id"
+	patchGetURL := monkey.Patch(db.GetURL, func(context.Context, string, string) (*db.URL, error) {
+		return &db.URL{Domain: db.DefaultDomain, ShortCode: "abc123", UserID: &owner}, nil
+	})
+	defer patchGetURL.Unpatch()
+
+	deleted := false
+	patchDelete := monkey.Patch(db.DeleteURL, func(context.Context, string, string) error {
+		deleted = true
+		return nil
+	})
+	defer patchDelete.Unpatch()
+
+	resp, _ := authed(handler.Links)(ctx, request)
+	assert.Equal(t, 204, resp.StatusCode)
+	assert.True(t, deleted)
+}
@@ -0,0 +1,276 @@
+package tests
+
+import (
+	"context"
+	"encoding/json"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"bou.ke/monkey"
+	"github.com/SunPodder/shorty/internal/db"
+	"github.com/SunPodder/shorty/internal/handler"
+	"github.com/SunPodder/shorty/internal/mail"
+	"github.com/SunPodder/shorty/utils"
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/stretchr/testify/assert"
+)
+
+// Mailer recording the messages it was asked to send, or failing with err
+type fakeMailer struct {
+	sent []mail.Message
+	err  error
+}
+
+func (m *fakeMailer) Send(ctx context.Context, msg mail.Message) error {
+	if m.err != nil {
+		return m.err
+	}
+	m.sent = append(m.sent, msg)
+	return nil
+}
+
+// Replaces handler.Mailer with a fake for the duration of the test
+func captureMail(t *testing.T) *fakeMailer {
+	mailer := &fakeMailer{}
+	previous := handler.Mailer
+	handler.Mailer = mailer
+	t.Cleanup(func() { handler.Mailer = previous })
+	return mailer
+}
+
+func init() {
+	// Only TestLogin_FailuresTakeEqualTime waits for failed logins
+	handler.FailedLoginResponseTime = 0
+}
+
+func loginRequest(password string) events.APIGatewayProxyRequest {
+	body, _ := json.Marshal(handler.LoginRequest{Email: "test@example.com", Password: password})
+	return events.APIGatewayProxyRequest{Body: string(body)}
+}
+
+// Serves user from the email lookup with "password" as its password.
+// The hash is real because CheckPasswordHash is small enough to be
+// inlined, out of reach of a patch.
+func patchLoginUser(user *db.User) func() {
+	hash, err := utils.HashPassword("password")
+	if err != nil {
+		panic(err)
+	}
+	user.Password = hash
+	patchGetUserByEmail := monkey.Patch(db.GetUserByEmail, func(context.Context, string) (*db.User, error) {
+		return user, nil
+	})
+	return patchGetUserByEmail.Unpatch
+}
+
+func TestLogin_LockedAccountLooksLikeWrongPassword(t *testing.T) {
+	ctx := context.Background()
+	user := &db.User{ID: "user-id", Email: "test@example.com", LockedUntil: time.Now().Add(time.Minute).Unix()}
+	defer patchLoginUser(user)()
+
+	locked, _ := handler.Login(ctx, loginRequest("password"))
+
+	monkey.Patch(db.GetUserByEmail, func(context.Context, string) (*db.User, error) {
+		return nil, db.ErrUserNotFound
+	})
+	unknown, _ := handler.Login(ctx, loginRequest("password"))
+
+	assert.Equal(t, 401, locked.StatusCode)
+	assert.Equal(t, unknown.StatusCode, locked.StatusCode)
+	assert.Equal(t, unknown.Body, locked.Body)
+}
+
+func TestLogin_BackoffAfterFreeAttempts(t *testing.T) {
+	ctx := context.Background()
+	user := &db.User{ID: "user-id", Email: "test@example.com"}
+	defer patchLoginUser(user)()
+
+	failures := 0
+	patchRecord := monkey.Patch(db.RecordFailedLogin, func(context.Context, string) (int, error) {
+		failures++
+		return failures, nil
+	})
+	defer patchRecord.Unpatch()
+
+	var lockedUntil int64
+	var tokenHash string
+	patchLock := monkey.Patch(db.LockUser, func(ctx context.Context, id string, until int64, hash string) error {
+		lockedUntil, tokenHash = until, hash
+		return nil
+	})
+	defer patchLock.Unpatch()
+
+	mailer := captureMail(t)
+
+	for i := 0; i < 2; i++ {
+		handler.Login(ctx, loginRequest("wrong"))
+	}
+	assert.Zero(t, lockedUntil, "the first failures aren't delayed")
+
+	handler.Login(ctx, loginRequest("wrong"))
+	assert.Greater(t, lockedUntil, time.Now().Unix()-1)
+	assert.Empty(t, tokenHash)
+	assert.Empty(t, mailer.sent)
+
+	failures = 9
+	resp, _ := handler.Login(ctx, loginRequest("wrong"))
+	assert.Equal(t, 401, resp.StatusCode)
+	assert.GreaterOrEqual(t, lockedUntil, time.Now().Add(time.Hour).Unix()-1)
+	assert.NotEmpty(t, tokenHash)
+	if assert.Len(t, mailer.sent, 1) {
+		assert.Equal(t, "test@example.com", mailer.sent[0].To)
+		assert.Contains(t, mailer.sent[0].Body, "/unlock?token=user-id.")
+	}
+}
+
+func TestLogin_SuccessResetsFailedLogins(t *testing.T) {
+	ctx := context.Background()
+	user := &db.User{ID: "user-id", Email: "test@example.com", FailedLogins: 4}
+	defer patchLoginUser(user)()
+
+	var unlocked string
+	patchUnlock := monkey.Patch(db.UnlockUser, func(ctx context.Context, id string) error {
+		unlocked = id
+		return nil
+	})
+	defer patchUnlock.Unpatch()
+
+	resp, _ := handler.Login(ctx, loginRequest("password"))
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, "user-id", unlocked)
+}
+
+func TestUnlock_WithEmailedToken(t *testing.T) {
+	ctx := context.Background()
+	user := &db.User{ID: "user-id", Email: "test@example.com"}
+	defer patchLoginUser(user)()
+
+	patchRecord := monkey.Patch(db.RecordFailedLogin, func(context.Context, string) (int, error) {
+		return 10, nil
+	})
+	defer patchRecord.Unpatch()
+	patchLock := monkey.Patch(db.LockUser, func(ctx context.Context, id string, until int64, hash string) error {
+		user.LockedUntil, user.UnlockTokenHash = until, hash
+		return nil
+	})
+	defer patchLock.Unpatch()
+	patchGetUser := monkey.Patch(db.GetUser, func(ctx context.Context, id string) (*db.User, error) {
+		if id != user.ID {
+			return nil, db.ErrUserNotFound
+		}
+		return user, nil
+	})
+	defer patchGetUser.Unpatch()
+	var unlocked string
+	patchUnlock := monkey.Patch(db.UnlockUser, func(ctx context.Context, id string) error {
+		unlocked = id
+		return nil
+	})
+	defer patchUnlock.Unpatch()
+
+	mailer := captureMail(t)
+	handler.Login(ctx, loginRequest("wrong"))
+	if !assert.Len(t, mailer.sent, 1) {
+		return
+	}
+	link := strings.TrimSpace(mailer.sent[0].Body[strings.Index(mailer.sent[0].Body, "/unlock?"):])
+	query, _ := url.ParseQuery(strings.TrimPrefix(link, "/unlock?"))
+	token := query.Get("token")
+
+	// Opening the link only shows a page confirming by POST
+	resp, _ := handler.Unlock(ctx, events.APIGatewayProxyRequest{
+		HTTPMethod:            "GET",
+		QueryStringParameters: map[string]string{"token": token},
+	})
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Contains(t, resp.Body, `<form method="post">`)
+	assert.Contains(t, resp.Body, `value="`+token+`"`)
+	assert.Empty(t, unlocked)
+
+	for _, bad := range []string{"", "user-id", "user-id.wrong", "other." + strings.SplitN(token, ".", 2)[1]} {
+		body, _ := json.Marshal(handler.UnlockRequest{Token: bad})
+		resp, _ := handler.Unlock(ctx, events.APIGatewayProxyRequest{HTTPMethod: "POST", Body: string(body)})
+		assert.Equal(t, 400, resp.StatusCode, bad)
+	}
+	assert.Empty(t, unlocked)
+
+	resp, _ = handler.Unlock(ctx, events.APIGatewayProxyRequest{
+		HTTPMethod: "POST",
+		Headers:    map[string]string{"content-type": "application/x-www-form-urlencoded"},
+		Body:       url.Values{"token": {token}}.Encode(),
+	})
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, "text/html; charset=utf-8", resp.Headers["Content-Type"])
+	assert.Contains(t, resp.Body, "Account unlocked")
+	assert.Equal(t, "user-id", unlocked)
+}
+
+func TestLogin_FailuresTakeEqualTime(t *testing.T) {
+	ctx := context.Background()
+	handler.FailedLoginResponseTime = 200 * time.Millisecond
+	defer func() { handler.FailedLoginResponseTime = 0 }()
+
+	user := &db.User{ID: "user-id", Email: "test@example.com"}
+	defer patchLoginUser(user)()
+	patchRecord := monkey.Patch(db.RecordFailedLogin, func(context.Context, string) (int, error) {
+		time.Sleep(50 * time.Millisecond)
+		return 1, nil
+	})
+	defer patchRecord.Unpatch()
+
+	start := time.Now()
+	resp, _ := handler.Login(ctx, loginRequest("wrong"))
+	assert.Equal(t, 401, resp.StatusCode)
+	wrongPassword := time.Since(start)
+
+	monkey.Patch(db.GetUserByEmail, func(context.Context, string) (*db.User, error) {
+		return nil, db.ErrUserNotFound
+	})
+	start = time.Now()
+	resp, _ = handler.Login(ctx, loginRequest("wrong"))
+	assert.Equal(t, 401, resp.StatusCode)
+	unknown := time.Since(start)
+
+	assert.GreaterOrEqual(t, wrongPassword, handler.FailedLoginResponseTime)
+	assert.GreaterOrEqual(t, unknown, handler.FailedLoginResponseTime)
+	assert.InDelta(t, wrongPassword.Seconds(), unknown.Seconds(), 0.1)
+}
+
+func TestAdminUnlock(t *testing.T) {
+	ctx := context.Background()
+	patchGetUser := monkey.Patch(db.GetUser, func(ctx context.Context, id string) (*db.User, error) {
+		if id == "admin-id" {
+			return &db.User{ID: id, Role: db.UserRoleAdmin}, nil
+		}
+		return &db.User{ID: id}, nil
+	})
+	defer patchGetUser.Unpatch()
+
+	var unlocked string
+	patchUnlock := monkey.Patch(db.UnlockUser, func(ctx context.Context, id string) error {
+		unlocked = id
+		return nil
+	})
+	defer patchUnlock.Unpatch()
+	audit := captureAudit(t)
+
+	request := events.APIGatewayProxyRequest{
+		HTTPMethod:     "POST",
+		Resource:       "/admin/users/{user_id}/unlock",
+		PathParameters: map[string]string{"user_id": "user-id"},
+		Headers:        authHeaders(t, "user-id"),
+	}
+	resp, _ := authed(handler.Admin)(ctx, request)
+	assert.Equal(t, 403, resp.StatusCode)
+	assert.Empty(t, unlocked)
+
+	request.Headers = authHeaders(t, "admin-id")
+	resp, _ = authed(handler.Admin)(ctx, request)
+	assert.Equal(t, 204, resp.StatusCode)
+	assert.Equal(t, "user-id", unlocked)
+	if assert.Len(t, *audit, 1) {
+		assert.Equal(t, handler.AuditAdminUnlockUser, (*audit)[0].Action)
+	}
+}
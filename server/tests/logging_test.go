@@ -0,0 +1,115 @@
+package tests
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"strings"
+	"testing"
+
+	"github.com/SunPodder/shorty/internal/logging"
+	"github.com/SunPodder/shorty/internal/middleware"
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/stretchr/testify/assert"
+)
+
+// Makes the default logger write JSON to a buffer for the duration of
+// the test and returns a function decoding the lines written so far
+func captureLogs(t *testing.T) func() []map[string]any {
+	var buf bytes.Buffer
+	previous := slog.Default()
+	slog.SetDefault(logging.New(&buf, slog.LevelDebug))
+	t.Cleanup(func() { slog.SetDefault(previous) })
+
+	return func() []map[string]any {
+		var lines []map[string]any
+		for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+			if line == "" {
+				continue
+			}
+			var fields map[string]any
+			if err := json.Unmarshal([]byte(line), &fields); err != nil {
+				t.Fatalf("log line isn't JSON: %s", line)
+			}
+			lines = append(lines, fields)
+		}
+		return lines
+	}
+}
+
+func TestRedact(t *testing.T) {
+	assert.Equal(t, "mail to a***@example.com failed", logging.Redact("mail to alice@example.com failed"))
+	assert.Equal(t, "Bearer [REDACTED]", logging.Redact("Bearer abc.def.ghi"))
+	assert.Equal(t, "token [REDACTED]", logging.Redact("token eyJhbGciOiJIUzI1NiJ9.eyJzdWIiOiIxIn0.sig"))
+	assert.Equal(t, "key [REDACTED] rejected", logging.Redact("key shorty_ab12cd34_0123456789abcdef rejected"))
+	assert.Equal(t, "table shorty_urls not found", logging.Redact("table shorty_urls not found"))
+	assert.Equal(t, "https://s.example/reset?token=[REDACTED]&x=1", logging.Redact("https://s.example/reset?token=abcdef&x=1"))
+	assert.Equal(t, "https://example.com/page", logging.Redact("https://example.com/page"))
+}
+
+func TestLogger_RequestFieldsAndRedaction(t *testing.T) {
+	logs := captureLogs(t)
+
+	ctx := logging.WithRequest(context.Background(), "req-1", "POST /login")
+	slog.InfoContext(ctx, "before auth")
+	logging.SetUser(ctx, "user-id", "")
+	slog.ErrorContext(ctx, "send mail", "password", "hunter2", "error", errors.New("rejected bob@example.com"))
+	slog.Info("outside a request")
+
+	lines := logs()
+	if !assert.Len(t, lines, 3) {
+		return
+	}
+	assert.Equal(t, "req-1", lines[0]["request_id"])
+	assert.Equal(t, "POST /login", lines[0]["route"])
+	assert.NotContains(t, lines[0], "user_id")
+
+	assert.Equal(t, "user-id", lines[1]["user_id"])
+	assert.Equal(t, "[REDACTED]", lines[1]["password"])
+	assert.Equal(t, "rejected b***@example.com", lines[1]["error"])
+
+	assert.NotContains(t, lines[2], "request_id")
+}
+
+func TestWithLogging(t *testing.T) {
+	ctx := context.Background()
+	patchSessions(t)
+	logs := captureLogs(t)
+
+	request := events.APIGatewayProxyRequest{
+		HTTPMethod: "GET",
+		Resource:   "/me",
+		Headers:    authHeaders(t, "user-id"),
+	}
+	request.RequestContext.RequestID = "req-1"
+
+	resp, _ := middleware.WithLogging(authed(okHandler))(ctx, request)
+	assert.Equal(t, "req-1", resp.Headers["X-Request-Id"])
+
+	failing := func(ctx context.Context, _ events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+		slog.InfoContext(ctx, "inside handler")
+		return events.APIGatewayProxyResponse{StatusCode: 500, Body: `{"error": "table gone"}`}, nil
+	}
+	middleware.WithLogging(failing)(ctx, request)
+
+	lines := logs()
+	if !assert.Len(t, lines, 3) {
+		return
+	}
+	assert.Equal(t, "request", lines[0]["msg"])
+	assert.Equal(t, "req-1", lines[0]["request_id"])
+	assert.Equal(t, "GET /me", lines[0]["route"])
+	assert.Equal(t, "user-id", lines[0]["user_id"])
+	assert.Equal(t, float64(200), lines[0]["status"])
+	assert.Equal(t, "success", lines[0]["outcome"])
+	assert.Contains(t, lines[0], "latency_ms")
+
+	assert.Equal(t, "inside handler", lines[1]["msg"])
+	assert.Equal(t, "req-1", lines[1]["request_id"])
+
+	assert.Equal(t, "ERROR", lines[2]["level"])
+	assert.Equal(t, "server_error", lines[2]["outcome"])
+	assert.Equal(t, "table gone", lines[2]["error"])
+}
@@ -61,6 +61,11 @@ func TestLogin_InvalidPassword(t *testing.T) {
 	})
 	defer patchCheckPasswordHash.Unpatch()
 
+	patchRecordFailedLogin := monkey.Patch(db.RecordFailedLogin, func(context.Context, string) (int, error) {
+		return 1, nil
+	})
+	defer patchRecordFailedLogin.Unpatch()
+
 	resp, _ := handler.Login(ctx, req)
 	assert.Equal(t, 401, resp.StatusCode)
 }
@@ -2,6 +2,7 @@ package tests
 
 import (
 	"context"
+	"encoding/json"
 	"testing"
 
 	"bou.ke/monkey"
@@ -57,3 +58,48 @@ func TestMe_DBError(t *testing.T) {
 	assert.Equal(t, 500, resp.StatusCode)
 	assert.Contains(t, resp.Body, "Internal server error")
 }
+
+func TestMe_IncludesWorkspaceLinks(t *testing.T) {
+	ctx := context.Background()
+	patchSessions(t)
+	request := events.APIGatewayProxyRequest{
+		Headers: authHeaders(t, "test-user"),
+	}
+
+	current, left := "ws-1", "ws-old"
+	patchListUserURLs := monkey.Patch(db.ListUserURLs, func(context.Context, string) ([]db.URL, error) {
+		return []db.URL{
+			{Domain: db.DefaultDomain, ShortCode: "personal"},
+			{Domain: db.DefaultDomain, ShortCode: "mine", WorkspaceID: &current},
+			{Domain: db.DefaultDomain, ShortCode: "former", WorkspaceID: &left},
+		}, nil
+	})
+	defer patchListUserURLs.Unpatch()
+
+	patchMemberships := monkey.Patch(db.ListUserMemberships, func(context.Context, string) ([]db.WorkspaceMember, error) {
+		return []db.WorkspaceMember{{WorkspaceID: "ws-1", UserID: "test-user", Role: db.RoleViewer}}, nil
+	})
+	defer patchMemberships.Unpatch()
+
+	patchWorkspaceURLs := monkey.Patch(db.ListWorkspaceURLs, func(context.Context, string) ([]db.URL, error) {
+		return []db.URL{
+			{Domain: db.DefaultDomain, ShortCode: "mine", WorkspaceID: &current},
+			{Domain: "go.acme.com", ShortCode: "team", WorkspaceID: &current},
+		}, nil
+	})
+	defer patchWorkspaceURLs.Unpatch()
+
+	resp, err := authed(handler.Me)(ctx, request)
+	assert.NoError(t, err)
+	assert.Equal(t, 200, resp.StatusCode)
+
+	var grouped map[string][]db.URL
+	assert.NoError(t, json.Unmarshal([]byte(resp.Body), &grouped))
+	var codes []string
+	for _, url := range grouped[db.DefaultDomain] {
+		codes = append(codes, url.ShortCode)
+	}
+	// Links created in a workspace the user left stay with the workspace
+	assert.ElementsMatch(t, []string{"personal", "mine"}, codes)
+	assert.Len(t, grouped["go.acme.com"], 1)
+}
@@ -0,0 +1,346 @@
+package tests
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"bou.ke/monkey"
+	"github.com/SunPodder/shorty/internal/db"
+	"github.com/SunPodder/shorty/internal/handler"
+	"github.com/SunPodder/shorty/internal/middleware"
+	"github.com/SunPodder/shorty/utils"
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func init() {
+	// Only TestForgotPassword_TakesEqualTime waits for the response time
+	handler.ForgotPasswordResponseTime = 0
+}
+
+// Keeps the mail outbox in memory
+func patchMailOutbox(t *testing.T) map[string]db.QueuedMail {
+	outbox := map[string]db.QueuedMail{}
+	patchPut := monkey.Patch(db.PutQueuedMail, func(ctx context.Context, mail db.QueuedMail) error {
+		outbox[mail.ID] = mail
+		return nil
+	})
+	patchEach := monkey.Patch(db.ForEachQueuedMail, func(ctx context.Context, fn func([]db.QueuedMail) error) error {
+		var mails []db.QueuedMail
+		for _, mail := range outbox {
+			mails = append(mails, mail)
+		}
+		return fn(mails)
+	})
+	patchDelete := monkey.Patch(db.DeleteQueuedMail, func(ctx context.Context, id string) error {
+		delete(outbox, id)
+		return nil
+	})
+	t.Cleanup(func() {
+		patchPut.Unpatch()
+		patchEach.Unpatch()
+		patchDelete.Unpatch()
+	})
+	return outbox
+}
+
+func TestForgotPassword_SameResponseForUnknownEmail(t *testing.T) {
+	ctx := context.Background()
+	mailer := captureMail(t)
+	outbox := patchMailOutbox(t)
+
+	monkey.Patch(db.GetUserByEmail, func(ctx context.Context, email string) (*db.User, error) {
+		if email == "jane@example.com" {
+			return &db.User{ID: "user-id", Email: email}, nil
+		}
+		return nil, db.ErrUserNotFound
+	})
+	defer monkey.Unpatch(db.GetUserByEmail)
+	monkey.Patch(db.SetPasswordReset, func(ctx context.Context, id, hash string, expires int64) error {
+		return nil
+	})
+	defer monkey.Unpatch(db.SetPasswordReset)
+
+	known, _ := handler.ForgotPassword(ctx, events.APIGatewayProxyRequest{Body: `{"email": "jane@example.com"}`})
+	unknown, _ := handler.ForgotPassword(ctx, events.APIGatewayProxyRequest{Body: `{"email": "nobody@example.com"}`})
+
+	assert.Equal(t, 202, known.StatusCode)
+	assert.Equal(t, known.StatusCode, unknown.StatusCode)
+	assert.Equal(t, known.Body, unknown.Body)
+
+	// The email is sent by the mail worker, not while answering
+	assert.Empty(t, mailer.sent)
+	assert.Len(t, outbox, 1)
+	assert.NoError(t, handler.SendQueuedMail(ctx))
+	assert.Empty(t, outbox)
+	if assert.Len(t, mailer.sent, 1) {
+		assert.Equal(t, "jane@example.com", mailer.sent[0].To)
+	}
+}
+
+func TestForgotPassword_TakesEqualTime(t *testing.T) {
+	ctx := context.Background()
+	handler.ForgotPasswordResponseTime = 200 * time.Millisecond
+	defer func() { handler.ForgotPasswordResponseTime = 0 }()
+	patchMailOutbox(t)
+
+	patchUser := monkey.Patch(db.GetUserByEmail, func(ctx context.Context, email string) (*db.User, error) {
+		if email == "jane@example.com" {
+			return &db.User{ID: "user-id", Email: email}, nil
+		}
+		return nil, db.ErrUserNotFound
+	})
+	defer patchUser.Unpatch()
+	patchReset := monkey.Patch(db.SetPasswordReset, func(ctx context.Context, id, hash string, expires int64) error {
+		time.Sleep(50 * time.Millisecond)
+		return nil
+	})
+	defer patchReset.Unpatch()
+
+	for _, email := range []string{"jane@example.com", "nobody@example.com"} {
+		start := time.Now()
+		handler.ForgotPassword(ctx, events.APIGatewayProxyRequest{Body: `{"email": "` + email + `"}`})
+		assert.GreaterOrEqual(t, time.Since(start), 200*time.Millisecond, email)
+	}
+}
+
+func TestResetPassword_WithEmailedToken(t *testing.T) {
+	ctx := context.Background()
+	mailer := captureMail(t)
+	patchMailOutbox(t)
+	entries := captureAudit(t)
+
+	monkey.Patch(db.GetUserByEmail, func(ctx context.Context, email string) (*db.User, error) {
+		return &db.User{ID: "user-id", Email: email}, nil
+	})
+	defer monkey.Unpatch(db.GetUserByEmail)
+
+	var storedHash string
+	var storedExpiry int64
+	monkey.Patch(db.SetPasswordReset, func(ctx context.Context, id, hash string, expires int64) error {
+		storedHash, storedExpiry = hash, expires
+		return nil
+	})
+	defer monkey.Unpatch(db.SetPasswordReset)
+
+	handler.ForgotPassword(ctx, events.APIGatewayProxyRequest{Body: `{"email": "jane@example.com"}`})
+	assert.NoError(t, handler.SendQueuedMail(ctx))
+	if !assert.Len(t, mailer.sent, 1) {
+		return
+	}
+	assert.Greater(t, storedExpiry, time.Now().Unix())
+
+	_, link, _ := strings.Cut(mailer.sent[0].Body, "/password/reset?")
+	query, _ := url.ParseQuery(strings.TrimSpace(link))
+	token := query.Get("token")
+
+	// Mimics the conditional update consuming the token
+	var newHash string
+	monkey.Patch(db.ResetPassword, func(ctx context.Context, id, hash, passwordHash string, now int64) error {
+		if id != "user-id" || hash != storedHash || now >= storedExpiry {
+			return db.ErrInvalidResetToken
+		}
+		storedHash = ""
+		newHash = passwordHash
+		return nil
+	})
+	defer monkey.Unpatch(db.ResetPassword)
+
+	revokedAt := "2024-01-01T00:00:00Z"
+	patchKeys := monkey.Patch(db.ListUserAPIKeys, func(ctx context.Context, userID string) ([]db.APIKey, error) {
+		return []db.APIKey{{ID: "active"}, {ID: "revoked", RevokedAt: &revokedAt}}, nil
+	})
+	defer patchKeys.Unpatch()
+	var revoked []string
+	patchRevoke := monkey.Patch(db.RevokeAPIKey, func(ctx context.Context, userID, id string) error {
+		revoked = append(revoked, id)
+		return nil
+	})
+	defer patchRevoke.Unpatch()
+
+	// Opening the link only shows a page posting the new password
+	resp, _ := handler.ResetPassword(ctx, events.APIGatewayProxyRequest{
+		HTTPMethod:            "GET",
+		QueryStringParameters: map[string]string{"token": token},
+	})
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Contains(t, resp.Body, `<form method="post">`)
+	assert.Contains(t, resp.Body, `value="`+token+`"`)
+	assert.Contains(t, resp.Body, `type="password"`)
+	assert.Empty(t, newHash)
+
+	// Weak passwords show the page again
+	form := func(password string) events.APIGatewayProxyRequest {
+		return events.APIGatewayProxyRequest{
+			HTTPMethod: "POST",
+			Headers:    map[string]string{"content-type": "application/x-www-form-urlencoded"},
+			Body:       url.Values{"token": {token}, "password": {password}}.Encode(),
+		}
+	}
+	resp, _ = handler.ResetPassword(ctx, form("short"))
+	assert.Equal(t, 400, resp.StatusCode)
+	assert.Contains(t, resp.Body, `value="`+token+`"`)
+	assert.Empty(t, newHash)
+
+	resp, _ = handler.ResetPassword(ctx, form("new-password"))
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, "text/html; charset=utf-8", resp.Headers["Content-Type"])
+	assert.True(t, utils.CheckPasswordHash("new-password", newHash))
+	assert.Equal(t, []string{"active"}, revoked)
+	if assert.Len(t, *entries, 1) {
+		assert.Equal(t, handler.AuditPasswordReset, (*entries)[0].Action)
+		assert.Equal(t, "user-id", (*entries)[0].ActorID)
+	}
+
+	body := `{"token": "` + token + `", "password": "new-password"}`
+
+	// Tokens are single-use
+	resp, _ = handler.ResetPassword(ctx, events.APIGatewayProxyRequest{Body: body})
+	assert.Equal(t, 400, resp.StatusCode)
+}
+
+func TestSendQueuedMail_RetriesThenDrops(t *testing.T) {
+	ctx := context.Background()
+	outbox := patchMailOutbox(t)
+	previous := handler.Mailer
+	handler.Mailer = &fakeMailer{err: errors.New("mail server unavailable")}
+	defer func() { handler.Mailer = previous }()
+
+	outbox["mail-1"] = db.QueuedMail{ID: "mail-1", To: "jane@example.com", ExpiresAt: time.Now().Add(time.Hour).Unix()}
+	outbox["expired"] = db.QueuedMail{ID: "expired", To: "jane@example.com", ExpiresAt: time.Now().Add(-time.Minute).Unix()}
+
+	assert.NoError(t, handler.SendQueuedMail(ctx))
+	assert.NotContains(t, outbox, "expired")
+	assert.Equal(t, 1, outbox["mail-1"].Attempts)
+
+	for i := 0; i < 10 && len(outbox) > 0; i++ {
+		assert.NoError(t, handler.SendQueuedMail(ctx))
+	}
+	assert.Empty(t, outbox)
+}
+
+func TestResetPassword_MalformedToken(t *testing.T) {
+	ctx := context.Background()
+
+	for _, token := range []string{"", "user-id", ".secret", "user-id."} {
+		resp, _ := handler.ResetPassword(ctx, events.APIGatewayProxyRequest{
+			Body: `{"token": "` + token + `", "password": "new-password"}`,
+		})
+		assert.Equal(t, 400, resp.StatusCode, token)
+	}
+}
+
+func TestWithAuth_RejectsRevokedSession(t *testing.T) {
+	ctx := context.Background()
+	token := mustJWT(t, "user-id")
+
+	validAfter := time.Now().Add(time.Minute).Unix()
+	monkey.Patch(db.GetUser, func(ctx context.Context, id string) (*db.User, error) {
+		return &db.User{ID: id, SessionsValidAfter: validAfter}, nil
+	})
+	defer monkey.Unpatch(db.GetUser)
+
+	var principal *middleware.Principal
+	request := events.APIGatewayProxyRequest{
+		Headers: map[string]string{"Authorization": "Bearer " + token},
+	}
+	resp, _ := authed(principalRecorder(&principal))(ctx, request)
+	assert.Equal(t, 401, resp.StatusCode)
+	assert.Nil(t, principal)
+
+	validAfter = time.Now().Add(-time.Minute).Unix()
+	resp, _ = authed(principalRecorder(&principal))(ctx, request)
+	assert.Equal(t, 200, resp.StatusCode)
+}
+
+func TestPasswordPolicy(t *testing.T) {
+	policy := utils.DefaultPasswordPolicy
+
+	cases := map[string]error{
+		"":                       utils.ErrPasswordTooShort,
+		"short":                  utils.ErrPasswordTooShort,
+		"Password123":            utils.ErrPasswordTooCommon,
+		"QWERTYUIOP":             utils.ErrPasswordTooCommon,
+		strings.Repeat("a", 73):  utils.ErrPasswordTooLong,
+		"correct-horse-battery":  nil,
+		strings.Repeat("ab", 36): nil,
+		"pässwörd-ünicode-ok":    nil,
+	}
+	for password, want := range cases {
+		if err := policy.Check(password); err != want {
+			t.Errorf("Check(%q) = %v, want %v", password, err, want)
+		}
+	}
+
+	policy.RejectCommon = false
+	if err := policy.Check("password123"); err != nil {
+		t.Errorf("Expected common passwords to be allowed, got %v", err)
+	}
+}
+
+func TestHashPassword_Argon2id(t *testing.T) {
+	hash, err := utils.HashPassword("correct-horse-battery")
+	if err != nil {
+		t.Fatalf("HashPassword failed: %v", err)
+	}
+	if !strings.HasPrefix(hash, "$argon2id$") {
+		t.Errorf("Expected an argon2id hash, got %q", hash)
+	}
+	if !utils.CheckPasswordHash("correct-horse-battery", hash) {
+		t.Error("Expected the password to match its hash")
+	}
+	if utils.CheckPasswordHash("wrong-horse-battery", hash) {
+		t.Error("Expected another password not to match")
+	}
+	if utils.NeedsRehash(hash) {
+		t.Error("Expected a fresh hash not to need rehashing")
+	}
+}
+
+func TestCheckPasswordHash_LegacyBcrypt(t *testing.T) {
+	hash, _ := bcrypt.GenerateFromPassword([]byte("correct-horse-battery"), bcrypt.MinCost)
+
+	if !utils.CheckPasswordHash("correct-horse-battery", string(hash)) {
+		t.Error("Expected bcrypt hashes to keep working")
+	}
+	if !utils.NeedsRehash(string(hash)) {
+		t.Error("Expected bcrypt hashes to need rehashing")
+	}
+}
+
+func TestLogin_RehashesLegacyPassword(t *testing.T) {
+	ctx := context.Background()
+	legacy, _ := bcrypt.GenerateFromPassword([]byte("correct-horse-battery"), bcrypt.MinCost)
+
+	monkey.Patch(db.GetUserByEmail, func(ctx context.Context, email string) (*db.User, error) {
+		return &db.User{ID: "user-id", Email: email, Password: string(legacy)}, nil
+	})
+	defer monkey.Unpatch(db.GetUserByEmail)
+
+	var updated string
+	monkey.Patch(db.UpdatePassword, func(ctx context.Context, id, hash string) error {
+		updated = hash
+		return nil
+	})
+	defer monkey.Unpatch(db.UpdatePassword)
+
+	resp, _ := handler.Login(ctx, loginRequest("correct-horse-battery"))
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.True(t, strings.HasPrefix(updated, "$argon2id$"))
+	assert.True(t, utils.CheckPasswordHash("correct-horse-battery", updated))
+}
+
+func TestRegister_WeakPassword(t *testing.T) {
+	ctx := context.Background()
+
+	for _, password := range []string{"", "short", "letmein123"} {
+		body := `{"email": "jane@example.com", "password": "` + password + `"}`
+		resp, _ := handler.Register(ctx, events.APIGatewayProxyRequest{Body: body})
+		assert.Equal(t, 400, resp.StatusCode, password)
+	}
+}
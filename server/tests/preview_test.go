@@ -0,0 +1,155 @@
+package tests
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"bou.ke/monkey"
+	"github.com/SunPodder/shorty/internal/db"
+	"github.com/SunPodder/shorty/internal/handler"
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPreview_JSON(t *testing.T) {
+	ctx := context.Background()
+	patchJobs(t)
+	request := events.APIGatewayProxyRequest{
+		PathParameters: map[string]string{"short_code": "abc123"},
+		Headers:        map[string]string{"accept": "application/json"},
+	}
+	userID := "user-id"
+	showOwner := true
+	patchGetURL := monkey.Patch(db.GetURL, func(context.Context, string, string) (*db.URL, error) {
+		return &db.URL{ShortCode: "abc123", OriginalURL: "https://example.com", UserID: &userID, ShowOwner: &showOwner}, nil
+	})
+	defer patchGetURL.Unpatch()
+
+	patchGetUser := monkey.Patch(db.GetUser, func(context.Context, string) (*db.User, error) {
+		return &db.User{ID: userID, DisplayName: "Jane"}, nil
+	})
+	defer patchGetUser.Unpatch()
+
+	resp, err := handler.Preview(ctx, request)
+	assert.NoError(t, err)
+	assert.Equal(t, 200, resp.StatusCode)
+
+	var preview handler.PreviewResponse
+	assert.NoError(t, json.Unmarshal([]byte(resp.Body), &preview))
+	assert.Equal(t, "https://example.com", preview.Destination)
+	if assert.NotNil(t, preview.Owner) {
+		assert.Equal(t, "Jane", *preview.Owner)
+	}
+}
+
+func TestPreview_OwnerHiddenByDefault(t *testing.T) {
+	ctx := context.Background()
+	patchJobs(t)
+	request := events.APIGatewayProxyRequest{
+		PathParameters:        map[string]string{"short_code": "abc123"},
+		QueryStringParameters: map[string]string{"format": "json"},
+	}
+	userID := "user-id"
+	patchGetURL := monkey.Patch(db.GetURL, func(context.Context, string, string) (*db.URL, error) {
+		return &db.URL{ShortCode: "abc123", OriginalURL: "https://example.com", UserID: &userID}, nil
+	})
+	defer patchGetURL.Unpatch()
+
+	resp, _ := handler.Preview(ctx, request)
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.NotContains(t, resp.Body, "owner")
+}
+
+func TestResolve_PlusSuffixPreviews(t *testing.T) {
+	ctx := context.Background()
+	patchJobs(t)
+	request := events.APIGatewayProxyRequest{
+		PathParameters: map[string]string{"short_code": "abc123+"},
+	}
+	viewOnce := true
+	patchGetURL := monkey.Patch(db.GetURL, func(_ context.Context, _ string, code string) (*db.URL, error) {
+		assert.Equal(t, "abc123", code)
+		return &db.URL{ShortCode: "abc123", OriginalURL: "https://example.com", ViewOnce: &viewOnce}, nil
+	})
+	defer patchGetURL.Unpatch()
+
+	incremented := false
+	patchIncrementClicks := monkey.Patch(db.IncrementClicks, func(context.Context, string, string) error {
+		incremented = true
+		return nil
+	})
+	defer patchIncrementClicks.Unpatch()
+
+	resp, err := handler.Resolve(ctx, request)
+	assert.NoError(t, err)
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Contains(t, resp.Body, "https://example.com")
+	assert.False(t, incremented)
+}
+
+func TestPreview_ScreeningState(t *testing.T) {
+	ctx := context.Background()
+	jobs := patchJobs(t)
+	request := events.APIGatewayProxyRequest{
+		PathParameters:        map[string]string{"short_code": "abc123"},
+		QueryStringParameters: map[string]string{"format": "json"},
+	}
+	created := "2026-01-10T12:00:00Z"
+	link := &db.URL{ShortCode: "abc123", OriginalURL: "http://example.com", CreatedAt: created}
+	patchGetURL := monkey.Patch(db.GetURL, func(context.Context, string, string) (*db.URL, error) {
+		copied := *link
+		return &copied, nil
+	})
+	defer patchGetURL.Unpatch()
+
+	preview := func() handler.PreviewResponse {
+		resp, _ := handler.Preview(ctx, request)
+		assert.Equal(t, 200, resp.StatusCode)
+		var preview handler.PreviewResponse
+		assert.NoError(t, json.Unmarshal([]byte(resp.Body), &preview))
+		return preview
+	}
+
+	got := preview()
+	assert.Equal(t, handler.SafetyUnscreened, got.Safety)
+	assert.Nil(t, got.ScreenedAt)
+	assert.True(t, got.Insecure)
+
+	// Screened when it was created
+	link.ScreenedAt = &created
+	got = preview()
+	assert.Equal(t, handler.SafetyScreened, got.Safety)
+	if assert.NotNil(t, got.ScreenedAt) {
+		assert.Equal(t, created, *got.ScreenedAt)
+	}
+
+	// A complete rescan started since screened it again
+	passStart, _ := time.Parse(time.RFC3339, "2026-02-01T00:00:00Z")
+	passEnd := passStart.Add(time.Hour)
+	jobs["rescan"] = db.Job{Name: "rescan", StartedAt: passStart.Unix(), CompletedAt: passEnd.Unix(), CompletedPassStartedAt: passStart.Unix()}
+	got = preview()
+	assert.Equal(t, handler.SafetyScreened, got.Safety)
+	if assert.NotNil(t, got.ScreenedAt) {
+		assert.Equal(t, passEnd.Format(time.RFC3339), *got.ScreenedAt)
+	}
+
+	// Restored by an admin
+	link.ScreeningReviewedURL = &link.OriginalURL
+	assert.Equal(t, handler.SafetyReviewed, preview().Safety)
+}
+
+func TestPreview_NotFound(t *testing.T) {
+	ctx := context.Background()
+	request := events.APIGatewayProxyRequest{
+		PathParameters: map[string]string{"short_code": "missing"},
+	}
+	patchGetURL := monkey.Patch(db.GetURL, func(context.Context, string, string) (*db.URL, error) {
+		return nil, db.ErrURLNotFound
+	})
+	defer patchGetURL.Unpatch()
+
+	resp, _ := handler.Preview(ctx, request)
+	assert.Equal(t, 404, resp.StatusCode)
+}
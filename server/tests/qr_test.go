@@ -0,0 +1,150 @@
+package tests
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"image"
+	"image/color"
+	"image/png"
+	"testing"
+
+	"bou.ke/monkey"
+	"github.com/SunPodder/shorty/internal/db"
+	"github.com/SunPodder/shorty/internal/handler"
+	"github.com/SunPodder/shorty/internal/qr"
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/stretchr/testify/assert"
+)
+
+func patchQRLink(t *testing.T, url *db.URL) {
+	patchGetURL := monkey.Patch(db.GetURL, func(context.Context, string, string) (*db.URL, error) {
+		return url, nil
+	})
+	t.Cleanup(patchGetURL.Unpatch)
+}
+
+func qrRequest(query map[string]string) events.APIGatewayProxyRequest {
+	return events.APIGatewayProxyRequest{
+		PathParameters:        map[string]string{"short_code": "abc123"},
+		QueryStringParameters: query,
+	}
+}
+
+func TestQR_PNG(t *testing.T) {
+	ctx := context.Background()
+	patchQRLink(t, &db.URL{ShortCode: "abc123", Domain: db.DefaultDomain, OriginalURL: "https://example.com"})
+
+	resp, _ := handler.QR(ctx, qrRequest(map[string]string{"size": "300", "fg": "#ff0000", "bg": "00f", "margin": "2"}))
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, "image/png", resp.Headers["Content-Type"])
+	assert.True(t, resp.IsBase64Encoded)
+
+	data, err := base64.StdEncoding.DecodeString(resp.Body)
+	assert.NoError(t, err)
+	img, err := png.Decode(bytes.NewReader(data))
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, image.Rect(0, 0, 300, 300), img.Bounds())
+
+	// The corner sits in the margin and the finder pattern starts right after it
+	assert.Equal(t, color.RGBA{B: 0xff, A: 0xff}, color.RGBAModel.Convert(img.At(0, 0)))
+	seen := map[color.RGBA]bool{}
+	for i := 0; i < 300; i++ {
+		seen[color.RGBAModel.Convert(img.At(i, i)).(color.RGBA)] = true
+	}
+	assert.True(t, seen[color.RGBA{R: 0xff, A: 0xff}])
+}
+
+func TestQR_SVGWithLogo(t *testing.T) {
+	ctx := context.Background()
+	patchQRLink(t, &db.URL{ShortCode: "abc123", Domain: "go.example.com", OriginalURL: "https://example.com"})
+
+	resp, _ := handler.QR(ctx, qrRequest(map[string]string{"format": "svg", "logo": "true"}))
+	assert.Equal(t, 400, resp.StatusCode)
+
+	logo := image.NewRGBA(image.Rect(0, 0, 4, 2))
+	handler.QRLogo = logo
+	defer func() { handler.QRLogo = nil }()
+
+	resp, _ = handler.QR(ctx, qrRequest(map[string]string{"format": "svg", "logo": "true", "size": "128"}))
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, "image/svg+xml", resp.Headers["Content-Type"])
+	assert.Contains(t, resp.Body, `width="128"`)
+	assert.Contains(t, resp.Body, "data:image/png;base64,")
+}
+
+func TestQR_InvalidOptions(t *testing.T) {
+	ctx := context.Background()
+	patchQRLink(t, &db.URL{ShortCode: "abc123", OriginalURL: "https://example.com"})
+
+	for _, query := range []map[string]string{
+		{"format": "gif"},
+		{"size": "10"},
+		{"size": "big"},
+		{"ecc": "X"},
+		{"margin": "-1"},
+		{"fg": "red"},
+		{"bg": "#12345"},
+	} {
+		resp, _ := handler.QR(ctx, qrRequest(query))
+		assert.Equal(t, 400, resp.StatusCode, query)
+	}
+}
+
+func TestQR_UnavailableLinks(t *testing.T) {
+	ctx := context.Background()
+
+	patchQRLink(t, nil)
+	resp, _ := handler.QR(ctx, qrRequest(nil))
+	assert.Equal(t, 404, resp.StatusCode)
+
+	reason := "spam"
+	patchQRLink(t, &db.URL{ShortCode: "abc123", OriginalURL: "https://example.com", TakedownReason: &reason})
+	resp, _ = handler.QR(ctx, qrRequest(nil))
+	assert.Equal(t, 410, resp.StatusCode)
+}
+
+func TestQRParseColor(t *testing.T) {
+	c, err := qr.ParseColor("#11223380")
+	assert.NoError(t, err)
+	assert.Equal(t, color.RGBA{R: 0x11, G: 0x22, B: 0x33, A: 0x80}, c)
+
+	c, err = qr.ParseColor("fff")
+	assert.NoError(t, err)
+	assert.Equal(t, color.RGBA{R: 0xff, G: 0xff, B: 0xff, A: 0xff}, c)
+
+	_, err = qr.ParseColor("ggg")
+	assert.ErrorIs(t, err, qr.ErrInvalidColor)
+}
+
+func TestResolve_CountsQRScans(t *testing.T) {
+	ctx := context.Background()
+	forward := true
+	patchQRLink(t, &db.URL{ShortCode: "abc123", OriginalURL: "https://example.com", ForwardQuery: &forward})
+
+	var clicks, scans int
+	patchClicks := monkey.Patch(db.IncrementClicks, func(context.Context, string, string) error {
+		clicks++
+		return nil
+	})
+	defer patchClicks.Unpatch()
+	patchScans := monkey.Patch(db.IncrementQRClicks, func(context.Context, string, string) error {
+		scans++
+		return nil
+	})
+	defer patchScans.Unpatch()
+
+	resp, _ := handler.Resolve(ctx, qrRequest(map[string]string{"src": "qr", "utm_source": "poster"}))
+	assert.Equal(t, 302, resp.StatusCode)
+	assert.Equal(t, "https://example.com?utm_source=poster", resp.Headers["Location"])
+	assert.Equal(t, 0, clicks)
+	assert.Equal(t, 1, scans)
+
+	// Other sources are forwarded untouched
+	resp, _ = handler.Resolve(ctx, qrRequest(map[string]string{"src": "newsletter"}))
+	assert.Equal(t, "https://example.com?src=newsletter", resp.Headers["Location"])
+	assert.Equal(t, 1, clicks)
+	assert.Equal(t, 1, scans)
+}
@@ -0,0 +1,170 @@
+package tests
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"bou.ke/monkey"
+	"github.com/SunPodder/shorty/internal/db"
+	"github.com/SunPodder/shorty/internal/middleware"
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/stretchr/testify/assert"
+)
+
+var testRateLimit = middleware.RateLimit{
+	Route:    "test",
+	Requests: 2,
+	Per:      time.Minute,
+	Key:      middleware.KeyByIP,
+}
+
+func requestFrom(ip string) events.APIGatewayProxyRequest {
+	return events.APIGatewayProxyRequest{
+		RequestContext: events.APIGatewayProxyRequestContext{
+			Identity: events.APIGatewayRequestIdentity{SourceIP: ip},
+		},
+	}
+}
+
+func okHandler(ctx context.Context, _ events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	return events.APIGatewayProxyResponse{StatusCode: 200}, nil
+}
+
+func TestWithRateLimit_RejectsWhenEmpty(t *testing.T) {
+	ctx := context.Background()
+	next := middleware.WithRateLimit(testRateLimit, middleware.NewMemoryRateLimitStore(), okHandler)
+
+	resp, _ := next(ctx, requestFrom("1.2.3.4"))
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, "2", resp.Headers["X-RateLimit-Limit"])
+	assert.Equal(t, "1", resp.Headers["X-RateLimit-Remaining"])
+	assert.NotEmpty(t, resp.Headers["X-RateLimit-Reset"])
+
+	resp, _ = next(ctx, requestFrom("1.2.3.4"))
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, "0", resp.Headers["X-RateLimit-Remaining"])
+
+	resp, _ = next(ctx, requestFrom("1.2.3.4"))
+	assert.Equal(t, 429, resp.StatusCode)
+	assert.Equal(t, "30", resp.Headers["Retry-After"])
+	assert.Equal(t, "0", resp.Headers["X-RateLimit-Remaining"])
+
+	// Other callers have their own bucket
+	resp, _ = next(ctx, requestFrom("5.6.7.8"))
+	assert.Equal(t, 200, resp.StatusCode)
+}
+
+func TestMemoryRateLimitStore_Refills(t *testing.T) {
+	ctx := context.Background()
+	store := middleware.NewMemoryRateLimitStore()
+	now := time.Now()
+
+	for i := 0; i < 2; i++ {
+		decision, _ := store.Take(ctx, "k", testRateLimit, now)
+		assert.True(t, decision.Allowed)
+	}
+	decision, _ := store.Take(ctx, "k", testRateLimit, now.Add(10*time.Second))
+	assert.False(t, decision.Allowed)
+	assert.Equal(t, 20*time.Second, decision.RetryAfter)
+
+	decision, _ = store.Take(ctx, "k", testRateLimit, now.Add(30*time.Second))
+	assert.True(t, decision.Allowed)
+
+	// A long idle period never fills the bucket beyond its size
+	decision, _ = store.Take(ctx, "k", testRateLimit, now.Add(time.Hour))
+	assert.True(t, decision.Allowed)
+	assert.Equal(t, 1, decision.Remaining)
+}
+
+func TestWithRateLimit_KeyByPrincipal(t *testing.T) {
+	ctx := context.Background()
+	patchSessions(t)
+	limit := testRateLimit
+	limit.Requests = 1
+	limit.Key = middleware.KeyByPrincipal
+	next := authed(middleware.WithRateLimit(limit, middleware.NewMemoryRateLimitStore(), okHandler))
+
+	// The same user is limited across IPs
+	request := requestFrom("1.2.3.4")
+	request.Headers = authHeaders(t, "user-1")
+	resp, _ := next(ctx, request)
+	assert.Equal(t, 200, resp.StatusCode)
+
+	request = requestFrom("5.6.7.8")
+	request.Headers = authHeaders(t, "user-1")
+	resp, _ = next(ctx, request)
+	assert.Equal(t, 429, resp.StatusCode)
+
+	request.Headers = authHeaders(t, "user-2")
+	resp, _ = next(ctx, request)
+	assert.Equal(t, 200, resp.StatusCode)
+}
+
+func TestDynamoRateLimitStore_RetriesOnConflict(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+	stored := db.RateLimitBucket{Key: "k", Tokens: 1, UpdatedAt: now.UnixMilli()}
+
+	monkey.Patch(db.GetRateLimitBucket, func(ctx context.Context, key string) (*db.RateLimitBucket, error) {
+		bucket := stored
+		return &bucket, nil
+	})
+	defer monkey.Unpatch(db.GetRateLimitBucket)
+
+	puts := 0
+	monkey.Patch(db.PutRateLimitBucket, func(ctx context.Context, bucket db.RateLimitBucket, previous int64) error {
+		puts++
+		if puts == 1 {
+			// Another instance took the last token in the meantime
+			stored = db.RateLimitBucket{Key: "k", Tokens: 0, UpdatedAt: previous + 1}
+			return db.ErrBucketConflict
+		}
+		assert.Equal(t, stored.UpdatedAt, previous)
+		stored = bucket
+		return nil
+	})
+	defer monkey.Unpatch(db.PutRateLimitBucket)
+
+	decision, err := middleware.NewDynamoRateLimitStore().Take(ctx, "k", testRateLimit, now)
+	assert.NoError(t, err)
+	assert.False(t, decision.Allowed)
+	assert.Equal(t, 2, puts)
+}
+
+func TestDynamoRateLimitStore_NewBucket(t *testing.T) {
+	ctx := context.Background()
+
+	monkey.Patch(db.GetRateLimitBucket, func(ctx context.Context, key string) (*db.RateLimitBucket, error) {
+		return nil, db.ErrBucketNotFound
+	})
+	defer monkey.Unpatch(db.GetRateLimitBucket)
+
+	var saved db.RateLimitBucket
+	monkey.Patch(db.PutRateLimitBucket, func(ctx context.Context, bucket db.RateLimitBucket, previous int64) error {
+		assert.Equal(t, int64(0), previous)
+		saved = bucket
+		return nil
+	})
+	defer monkey.Unpatch(db.PutRateLimitBucket)
+
+	decision, err := middleware.NewDynamoRateLimitStore().Take(ctx, "k", testRateLimit, time.Now())
+	assert.NoError(t, err)
+	assert.True(t, decision.Allowed)
+	assert.Equal(t, 1, decision.Remaining)
+	assert.Equal(t, float64(1), saved.Tokens)
+	assert.NotZero(t, saved.ExpiresAt)
+}
+
+func TestParseRateLimit(t *testing.T) {
+	limit, err := middleware.ParseRateLimit(testRateLimit, "10/5m")
+	assert.NoError(t, err)
+	assert.Equal(t, 10, limit.Requests)
+	assert.Equal(t, 5*time.Minute, limit.Per)
+	assert.Equal(t, "test", limit.Route)
+
+	for _, value := range []string{"10", "0/1m", "x/1m", "10/x", "10/-1s"} {
+		_, err := middleware.ParseRateLimit(testRateLimit, value)
+		assert.ErrorIs(t, err, middleware.ErrInvalidRateLimit, value)
+	}
+}
@@ -15,7 +15,7 @@ import (
 
 func TestRegister_Success(t *testing.T) {
 	ctx := context.Background()
-	body, _ := json.Marshal(handler.RegisterRequest{Email: "test@example.com", Password: "password"})
+	body, _ := json.Marshal(handler.RegisterRequest{Email: "test@example.com", Password: "correct-horse-battery"})
 	req := events.APIGatewayProxyRequest{Body: string(body)}
 
 	patchHash := monkey.Patch(utils.HashPassword, func(string) (string, error) {
@@ -47,7 +47,7 @@ func TestRegister_InvalidBody(t *testing.T) {
 
 func TestRegister_DuplicateEmail(t *testing.T) {
 	ctx := context.Background()
-	body, _ := json.Marshal(handler.RegisterRequest{Email: "existing@example.com", Password: "password"})
+	body, _ := json.Marshal(handler.RegisterRequest{Email: "existing@example.com", Password: "correct-horse-battery"})
 	req := events.APIGatewayProxyRequest{Body: string(body)}
 
 	patchHash := monkey.Patch(utils.HashPassword, func(string) (string, error) {
@@ -63,3 +63,34 @@ func TestRegister_DuplicateEmail(t *testing.T) {
 	resp, _ := handler.Register(ctx, req)
 	assert.Equal(t, 409, resp.StatusCode)
 }
+
+func TestRegister_NormalizesEmail(t *testing.T) {
+	ctx := context.Background()
+	body, _ := json.Marshal(handler.RegisterRequest{Email: "  Jane@Example.COM ", Password: "correct-horse-battery"})
+	req := events.APIGatewayProxyRequest{Body: string(body)}
+
+	var created db.User
+	patchCreateUser := monkey.Patch(db.CreateUser, func(ctx context.Context, user db.User) error {
+		created = user
+		return nil
+	})
+	defer patchCreateUser.Unpatch()
+
+	resp, _ := handler.Register(ctx, req)
+	assert.Equal(t, 201, resp.StatusCode)
+	assert.Equal(t, "jane@example.com", created.Email)
+}
+
+func TestEmailsMigrated_OnlyOnceCompleted(t *testing.T) {
+	ctx := context.Background()
+	jobs := patchJobs(t)
+
+	migrated, err := db.EmailsMigrated(ctx)
+	assert.NoError(t, err)
+	assert.False(t, migrated)
+
+	jobs["normalize_emails"] = db.Job{Name: "normalize_emails", CompletedAt: 1}
+	migrated, err = db.EmailsMigrated(ctx)
+	assert.NoError(t, err)
+	assert.True(t, migrated)
+}
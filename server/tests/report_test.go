@@ -0,0 +1,207 @@
+package tests
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"bou.ke/monkey"
+	"github.com/SunPodder/shorty/internal/db"
+	"github.com/SunPodder/shorty/internal/handler"
+	"github.com/SunPodder/shorty/utils"
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/stretchr/testify/assert"
+)
+
+// Stores reports in memory, rejecting a second report of the same ID,
+// and counts them on the link
+func patchReports(t *testing.T, url *db.URL) map[string]db.Report {
+	reports := map[string]db.Report{}
+	monkey.Patch(db.GetURL, func(context.Context, string, string) (*db.URL, error) {
+		found := *url
+		return &found, nil
+	})
+	monkey.Patch(db.CreateReport, func(ctx context.Context, report db.Report) error {
+		if _, ok := reports[report.ID]; ok {
+			return db.ErrDuplicateReport
+		}
+		reports[report.ID] = report
+		return nil
+	})
+	monkey.Patch(db.AddURLReport, func(ctx context.Context, domain, shortCode string) (int, error) {
+		url.ReportCount++
+		return url.ReportCount, nil
+	})
+	t.Cleanup(func() {
+		monkey.Unpatch(db.GetURL)
+		monkey.Unpatch(db.CreateReport)
+		monkey.Unpatch(db.AddURLReport)
+	})
+	return reports
+}
+
+func reportRequest(ip, body string) events.APIGatewayProxyRequest {
+	request := requestFrom(ip)
+	request.PathParameters = map[string]string{"short_code": "abc123"}
+	request.Body = body
+	return request
+}
+
+func TestReportLink_DeduplicatedPerIP(t *testing.T) {
+	ctx := context.Background()
+	url := &db.URL{Domain: db.DefaultDomain, ShortCode: "abc123", OriginalURL: "https://example.com"}
+	reports := patchReports(t, url)
+
+	body := `{"category": "phishing", "details": "Asks for my bank password"}`
+	for i := 0; i < 2; i++ {
+		resp, _ := handler.ReportLink(ctx, reportRequest("1.2.3.4", body))
+		assert.Equal(t, 202, resp.StatusCode)
+	}
+	assert.Len(t, reports, 1)
+	assert.Equal(t, 1, url.ReportCount)
+
+	resp, _ := handler.ReportLink(ctx, reportRequest("5.6.7.8", body))
+	assert.Equal(t, 202, resp.StatusCode)
+	assert.Len(t, reports, 2)
+
+	for _, report := range reports {
+		assert.Equal(t, db.DefaultDomain+"/abc123", report.LinkID)
+		assert.Equal(t, db.ReportStatusOpen, report.Status)
+		// Only a keyed hash of the address is kept
+		assert.NotContains(t, []string{"1.2.3.4", "5.6.7.8"}, report.ReporterHash)
+		assert.NotContains(t, []string{utils.HashToken("1.2.3.4"), utils.HashToken("5.6.7.8")}, report.ReporterHash)
+	}
+}
+
+func TestReportLink_InvalidCategory(t *testing.T) {
+	resp, _ := handler.ReportLink(context.Background(), reportRequest("1.2.3.4", `{"category": "boring"}`))
+	assert.Equal(t, 400, resp.StatusCode)
+}
+
+func TestReportLink_ThresholdDisablesLink(t *testing.T) {
+	ctx := context.Background()
+	mailer := captureMail(t)
+	entries := captureAudit(t)
+	previous := handler.ReportThreshold
+	handler.ReportThreshold = 2
+	t.Cleanup(func() { handler.ReportThreshold = previous })
+
+	owner := "owner-id"
+	url := &db.URL{Domain: db.DefaultDomain, ShortCode: "abc123", OriginalURL: "https://example.com", UserID: &owner}
+	patchReports(t, url)
+
+	patchGetUser := monkey.Patch(db.GetUser, func(ctx context.Context, id string) (*db.User, error) {
+		return &db.User{ID: id, Email: "owner@example.com"}, nil
+	})
+	defer patchGetUser.Unpatch()
+
+	patchAdmins := monkey.Patch(db.ListAdmins, func(context.Context) ([]db.User, error) {
+		return []db.User{{ID: "admin-id", Email: "admin@example.com", Role: db.UserRoleAdmin}}, nil
+	})
+	defer patchAdmins.Unpatch()
+
+	takedowns := 0
+	patchTakeDown := monkey.Patch(db.TakeDownURL, func(ctx context.Context, domain, shortCode, reason, at string) error {
+		takedowns++
+		return nil
+	})
+	defer patchTakeDown.Unpatch()
+
+	for _, ip := range []string{"1.1.1.1", "2.2.2.2", "3.3.3.3"} {
+		resp, _ := handler.ReportLink(ctx, reportRequest(ip, `{"category": "malware"}`))
+		assert.Equal(t, 202, resp.StatusCode)
+	}
+
+	assert.Equal(t, 1, takedowns)
+	if assert.Len(t, mailer.sent, 2) {
+		assert.Equal(t, "owner@example.com", mailer.sent[0].To)
+		assert.Equal(t, "admin@example.com", mailer.sent[1].To)
+	}
+	if assert.Len(t, *entries, 1) {
+		assert.Equal(t, handler.AuditLinkReportDisabled, (*entries)[0].Action)
+	}
+}
+
+func TestAdminListReports(t *testing.T) {
+	ctx := context.Background()
+	patchAdmin(t, nil)
+
+	var status string
+	patchList := monkey.Patch(db.ListReports, func(ctx context.Context, s string, limit int32, cursor string) ([]db.Report, string, error) {
+		status = s
+		return []db.Report{{ID: "r1", ReporterHash: "secret-hash", Category: "spam"}}, "", nil
+	})
+	defer patchList.Unpatch()
+
+	resp, _ := authed(handler.Admin)(ctx, adminRequest(t, "GET", "/admin/reports", ""))
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, db.ReportStatusOpen, status)
+	assert.NotContains(t, resp.Body, "secret-hash")
+
+	var body handler.ReportsResponse
+	assert.NoError(t, json.Unmarshal([]byte(resp.Body), &body))
+	assert.Len(t, body.Reports, 1)
+
+	request := adminRequest(t, "GET", "/admin/reports", "")
+	request.QueryStringParameters = map[string]string{"status": "bogus"}
+	resp, _ = authed(handler.Admin)(ctx, request)
+	assert.Equal(t, 400, resp.StatusCode)
+}
+
+func TestResolveLinkReports_DismissRestoresLink(t *testing.T) {
+	ctx := context.Background()
+	patchAdmin(t, nil)
+	entries := captureAudit(t)
+
+	reason := "Disabled pending review after multiple abuse reports"
+	patchGetURL := monkey.Patch(db.GetURL, func(context.Context, string, string) (*db.URL, error) {
+		return &db.URL{Domain: db.DefaultDomain, ShortCode: "abc123", TakedownReason: &reason}, nil
+	})
+	defer patchGetURL.Unpatch()
+
+	restored := false
+	patchRestore := monkey.Patch(db.RestoreURL, func(context.Context, string, string) error {
+		restored = true
+		return nil
+	})
+	defer patchRestore.Unpatch()
+
+	reset := false
+	patchReset := monkey.Patch(db.ResetURLReports, func(context.Context, string, string) error {
+		reset = true
+		return nil
+	})
+	defer patchReset.Unpatch()
+
+	patchLinkReports := monkey.Patch(db.ListLinkReports, func(ctx context.Context, linkID string) ([]db.Report, error) {
+		return []db.Report{
+			{ID: "r1", Status: db.ReportStatusOpen},
+			{ID: "r2", Status: db.ReportStatusDismissed},
+		}, nil
+	})
+	defer patchLinkReports.Unpatch()
+
+	resolved := map[string]string{}
+	patchResolve := monkey.Patch(db.ResolveReport, func(ctx context.Context, id, status, by, at string) error {
+		resolved[id] = status
+		assert.Equal(t, "admin-id", by)
+		return nil
+	})
+	defer patchResolve.Unpatch()
+
+	request := adminRequest(t, "POST", "/admin/links/{short_code}/reports", `{"resolution": "takedown"}`)
+	request.PathParameters = map[string]string{"short_code": "abc123"}
+	resp, _ := authed(handler.Admin)(ctx, request)
+	assert.Equal(t, 400, resp.StatusCode)
+
+	request.Body = `{"resolution": "dismiss"}`
+	resp, _ = authed(handler.Admin)(ctx, request)
+	assert.Equal(t, 204, resp.StatusCode)
+	assert.True(t, restored)
+	assert.True(t, reset)
+	assert.Equal(t, map[string]string{"r1": db.ReportStatusDismissed}, resolved)
+	if assert.Len(t, *entries, 1) {
+		assert.Equal(t, handler.AuditAdminDismissReports, (*entries)[0].Action)
+		assert.Equal(t, "1", (*entries)[0].Details["reports"])
+	}
+}
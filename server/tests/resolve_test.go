@@ -16,12 +16,12 @@ func TestResolve_Found(t *testing.T) {
 	request := events.APIGatewayProxyRequest{
 		PathParameters: map[string]string{"short_code": "abc123"},
 	}
-	patchGetURL := monkey.Patch(db.GetURL, func(context.Context, string) (*db.URL, error) {
+	patchGetURL := monkey.Patch(db.GetURL, func(context.Context, string, string) (*db.URL, error) {
 		return &db.URL{OriginalURL: "https://example.com"}, nil
 	})
 	defer patchGetURL.Unpatch()
 
-	patchIncrementClicks := monkey.Patch(db.IncrementClicks, func(context.Context, string) error {
+	patchIncrementClicks := monkey.Patch(db.IncrementClicks, func(context.Context, string, string) error {
 		return nil
 	})
 	defer patchIncrementClicks.Unpatch()
@@ -37,7 +37,7 @@ func TestResolve_NotFound(t *testing.T) {
 	request := events.APIGatewayProxyRequest{
 		PathParameters: map[string]string{"short_code": "notfound"},
 	}
-	patchGetURL := monkey.Patch(db.GetURL, func(context.Context, string) (*db.URL, error) {
+	patchGetURL := monkey.Patch(db.GetURL, func(context.Context, string, string) (*db.URL, error) {
 		return nil, nil
 	})
 	defer patchGetURL.Unpatch()
@@ -51,7 +51,7 @@ func TestResolve_DBError(t *testing.T) {
 	request := events.APIGatewayProxyRequest{
 		PathParameters: map[string]string{"short_code": "abc123"},
 	}
-	patchGetURL := monkey.Patch(db.GetURL, func(context.Context, string) (*db.URL, error) {
+	patchGetURL := monkey.Patch(db.GetURL, func(context.Context, string, string) (*db.URL, error) {
 		return nil, assert.AnError // Database error
 	})
 	defer patchGetURL.Unpatch()
@@ -66,12 +66,12 @@ func TestResolve_IncrementClicksError(t *testing.T) {
 	request := events.APIGatewayProxyRequest{
 		PathParameters: map[string]string{"short_code": "abc123"},
 	}
-	patchGetURL := monkey.Patch(db.GetURL, func(context.Context, string) (*db.URL, error) {
+	patchGetURL := monkey.Patch(db.GetURL, func(context.Context, string, string) (*db.URL, error) {
 		return &db.URL{OriginalURL: "https://example.com"}, nil
 	})
 	defer patchGetURL.Unpatch()
 
-	patchIncrementClicks := monkey.Patch(db.IncrementClicks, func(context.Context, string) error {
+	patchIncrementClicks := monkey.Patch(db.IncrementClicks, func(context.Context, string, string) error {
 		return assert.AnError // Error incrementing clicks
 	})
 	defer patchIncrementClicks.Unpatch()
@@ -79,3 +79,113 @@ func TestResolve_IncrementClicksError(t *testing.T) {
 	resp, _ := handler.Resolve(ctx, request)
 	assert.Equal(t, 500, resp.StatusCode)
 }
+
+func TestResolve_ForwardQuery(t *testing.T) {
+	ctx := context.Background()
+	request := events.APIGatewayProxyRequest{
+		PathParameters:        map[string]string{"short_code": "abc123"},
+		QueryStringParameters: map[string]string{"ref": "x"},
+	}
+	forward := true
+	patchGetURL := monkey.Patch(db.GetURL, func(context.Context, string, string) (*db.URL, error) {
+		return &db.URL{OriginalURL: "https://example.com/?a=1", ForwardQuery: &forward}, nil
+	})
+	defer patchGetURL.Unpatch()
+
+	patchIncrementClicks := monkey.Patch(db.IncrementClicks, func(context.Context, string, string) error {
+		return nil
+	})
+	defer patchIncrementClicks.Unpatch()
+
+	resp, err := handler.Resolve(ctx, request)
+	assert.NoError(t, err)
+	assert.Equal(t, 302, resp.StatusCode)
+	assert.Equal(t, "https://example.com/?a=1&ref=x", resp.Headers["Location"])
+}
+
+func TestResolve_QueryNotForwardedByDefault(t *testing.T) {
+	ctx := context.Background()
+	request := events.APIGatewayProxyRequest{
+		PathParameters:        map[string]string{"short_code": "abc123"},
+		QueryStringParameters: map[string]string{"ref": "x"},
+	}
+	patchGetURL := monkey.Patch(db.GetURL, func(context.Context, string, string) (*db.URL, error) {
+		return &db.URL{OriginalURL: "https://example.com"}, nil
+	})
+	defer patchGetURL.Unpatch()
+
+	patchIncrementClicks := monkey.Patch(db.IncrementClicks, func(context.Context, string, string) error {
+		return nil
+	})
+	defer patchIncrementClicks.Unpatch()
+
+	resp, _ := handler.Resolve(ctx, request)
+	assert.Equal(t, "https://example.com", resp.Headers["Location"])
+}
+
+func TestResolve_PermanentRedirect(t *testing.T) {
+	ctx := context.Background()
+	request := events.APIGatewayProxyRequest{
+		PathParameters: map[string]string{"short_code": "abc123"},
+	}
+	status := 301
+	patchGetURL := monkey.Patch(db.GetURL, func(context.Context, string, string) (*db.URL, error) {
+		return &db.URL{OriginalURL: "https://example.com", RedirectStatus: &status}, nil
+	})
+	defer patchGetURL.Unpatch()
+
+	patchIncrementClicks := monkey.Patch(db.IncrementClicks, func(context.Context, string, string) error {
+		return nil
+	})
+	defer patchIncrementClicks.Unpatch()
+
+	resp, err := handler.Resolve(ctx, request)
+	assert.NoError(t, err)
+	assert.Equal(t, 301, resp.StatusCode)
+	assert.Equal(t, "public, max-age=3600", resp.Headers["Cache-Control"])
+}
+
+func TestResolve_TemporaryRedirectNotCached(t *testing.T) {
+	ctx := context.Background()
+	request := events.APIGatewayProxyRequest{
+		PathParameters: map[string]string{"short_code": "abc123"},
+	}
+	status := 307
+	patchGetURL := monkey.Patch(db.GetURL, func(context.Context, string, string) (*db.URL, error) {
+		return &db.URL{OriginalURL: "https://example.com", RedirectStatus: &status}, nil
+	})
+	defer patchGetURL.Unpatch()
+
+	patchIncrementClicks := monkey.Patch(db.IncrementClicks, func(context.Context, string, string) error {
+		return nil
+	})
+	defer patchIncrementClicks.Unpatch()
+
+	resp, _ := handler.Resolve(ctx, request)
+	assert.Equal(t, 307, resp.StatusCode)
+	assert.Equal(t, "no-store", resp.Headers["Cache-Control"])
+}
+
+func TestResolve_Interstitial(t *testing.T) {
+	ctx := context.Background()
+	request := events.APIGatewayProxyRequest{
+		PathParameters: map[string]string{"short_code": "abc123"},
+	}
+	interstitial := true
+	delay := 3
+	patchGetURL := monkey.Patch(db.GetURL, func(context.Context, string, string) (*db.URL, error) {
+		return &db.URL{OriginalURL: "https://example.com", Interstitial: &interstitial, InterstitialDelay: &delay}, nil
+	})
+	defer patchGetURL.Unpatch()
+
+	patchIncrementClicks := monkey.Patch(db.IncrementClicks, func(context.Context, string, string) error {
+		return nil
+	})
+	defer patchIncrementClicks.Unpatch()
+
+	resp, err := handler.Resolve(ctx, request)
+	assert.NoError(t, err)
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, "no-store", resp.Headers["Cache-Control"])
+	assert.Contains(t, resp.Body, `content="3;url=https://example.com"`)
+}
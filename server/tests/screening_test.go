@@ -0,0 +1,344 @@
+package tests
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"bou.ke/monkey"
+	"github.com/SunPodder/shorty/internal/db"
+	"github.com/SunPodder/shorty/internal/handler"
+	"github.com/SunPodder/shorty/internal/reputation"
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/stretchr/testify/assert"
+)
+
+// Checker returning the same verdict and error for every URL
+type fakeChecker struct {
+	verdict reputation.Verdict
+	err     error
+}
+
+func (c fakeChecker) Check(ctx context.Context, rawURL string) (reputation.Verdict, error) {
+	return c.verdict, c.err
+}
+
+var phishing = reputation.Verdict{Flagged: true, Source: "test", Threat: "SOCIAL_ENGINEERING"}
+
+// Replaces the URL checker and screening action for the duration of the test
+func useChecker(t *testing.T, checker reputation.Checker, action string) {
+	previousChecker, previousAction := handler.URLChecker, handler.ScreeningAction
+	handler.URLChecker, handler.ScreeningAction = checker, action
+	t.Cleanup(func() {
+		handler.URLChecker, handler.ScreeningAction = previousChecker, previousAction
+	})
+}
+
+func TestBlocklist(t *testing.T) {
+	blocklist, err := reputation.ParseBlocklist(strings.NewReader(`
+# Known phishing hosts
+evil.example
+re: ^https?://[^/]+/wp-login\.php
+`))
+	assert.NoError(t, err)
+
+	ctx := context.Background()
+	for rawURL, flagged := range map[string]bool{
+		"https://evil.example/login":           true,
+		"https://login.EVIL.example./":         true,
+		"https://notevil.example/":             false,
+		"https://example.com/evil.example":     false,
+		"http://blog.example.com/wp-login.php": true,
+		"https://example.com/":                 false,
+	} {
+		verdict, err := blocklist.Check(ctx, rawURL)
+		assert.NoError(t, err)
+		assert.Equal(t, flagged, verdict.Flagged, rawURL)
+	}
+
+	_, err = reputation.ParseBlocklist(strings.NewReader("ok.example\nre: ("))
+	assert.ErrorContains(t, err, "line 2")
+}
+
+func TestSafeBrowsingClient(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "test-key", r.URL.Query().Get("key"))
+		body, _ := io.ReadAll(r.Body)
+		assert.Contains(t, string(body), `"url":"https://bad.example/"`)
+		w.Write([]byte(`{"matches": [{"threatType": "MALWARE", "threat": {"url": "https://bad.example/"}}]}`))
+	}))
+	defer server.Close()
+
+	client := reputation.NewSafeBrowsingClient("test-key")
+	client.Endpoint = server.URL
+	checker := reputation.NewLookupChecker("safe browsing", client)
+
+	verdict, err := checker.Check(context.Background(), "https://bad.example/")
+	assert.NoError(t, err)
+	assert.True(t, verdict.Flagged)
+	assert.Equal(t, "MALWARE", verdict.Threat)
+	// Visitors aren't shown what matched
+	assert.NotContains(t, verdict.Reason(), "MALWARE")
+}
+
+func TestLookupChecker_CheckAllInBatches(t *testing.T) {
+	var batches []int
+	lookup := lookupFunc(func(ctx context.Context, urls []string) (map[string][]string, error) {
+		batches = append(batches, len(urls))
+		return map[string][]string{"https://bad.example/0": {"MALWARE"}}, nil
+	})
+
+	urls := make([]string, reputation.MaxLookupURLs+1)
+	for i := range urls {
+		urls[i] = "https://bad.example/" + strconv.Itoa(i)
+	}
+	verdicts, err := reputation.CheckAll(context.Background(), reputation.Multi{reputation.NewLookupChecker("lookup", lookup)}, urls)
+	assert.NoError(t, err)
+	assert.Equal(t, []int{reputation.MaxLookupURLs, 1}, batches)
+	if assert.Len(t, verdicts, 1) {
+		assert.Equal(t, "MALWARE", verdicts["https://bad.example/0"].Threat)
+	}
+}
+
+type lookupFunc func(ctx context.Context, urls []string) (map[string][]string, error)
+
+func (f lookupFunc) Lookup(ctx context.Context, urls []string) (map[string][]string, error) {
+	return f(ctx, urls)
+}
+
+func TestShorten_RejectsFlagged(t *testing.T) {
+	ctx := context.Background()
+	useChecker(t, fakeChecker{verdict: phishing}, handler.ScreenReject)
+
+	created := false
+	patchCreateURL := monkey.Patch(db.CreateURL, func(context.Context, *db.URL) error {
+		created = true
+		return nil
+	})
+	defer patchCreateURL.Unpatch()
+
+	resp, _ := handler.Shorten(ctx, events.APIGatewayProxyRequest{Body: `{"original_url": "https://bad.example"}`})
+	assert.Equal(t, 400, resp.StatusCode)
+	assert.Contains(t, resp.Body, "flagged as unsafe")
+	assert.False(t, created)
+}
+
+func TestShorten_QuarantinesFlagged(t *testing.T) {
+	ctx := context.Background()
+	useChecker(t, fakeChecker{verdict: phishing}, handler.ScreenQuarantine)
+
+	var created *db.URL
+	patchCreateURL := monkey.Patch(db.CreateURL, func(_ context.Context, url *db.URL) error {
+		created = url
+		return nil
+	})
+	defer patchCreateURL.Unpatch()
+
+	resp, _ := handler.Shorten(ctx, events.APIGatewayProxyRequest{Body: `{"original_url": "https://bad.example"}`})
+	assert.Equal(t, 200, resp.StatusCode)
+	if assert.NotNil(t, created) {
+		assert.True(t, created.TakenDown())
+		assert.Equal(t, phishing.Reason(), *created.TakedownReason)
+	}
+}
+
+func TestShorten_CheckerFailureLetsThrough(t *testing.T) {
+	ctx := context.Background()
+	useChecker(t, fakeChecker{err: assert.AnError}, handler.ScreenReject)
+
+	patchCreateURL := monkey.Patch(db.CreateURL, func(context.Context, *db.URL) error { return nil })
+	defer patchCreateURL.Unpatch()
+
+	resp, _ := handler.Shorten(ctx, events.APIGatewayProxyRequest{Body: `{"original_url": "https://example.com"}`})
+	assert.Equal(t, 200, resp.StatusCode)
+}
+
+func TestUpdateLink_RejectsFlagged(t *testing.T) {
+	ctx := context.Background()
+	patchSessions(t)
+	useChecker(t, fakeChecker{verdict: phishing}, handler.ScreenReject)
+
+	owner := "user-id"
+	patchGetURL := monkey.Patch(db.GetURL, func(context.Context, string, string) (*db.URL, error) {
+		return &db.URL{Domain: db.DefaultDomain, ShortCode: "abc123", OriginalURL: "https://example.com", UserID: &owner}, nil
+	})
+	defer patchGetURL.Unpatch()
+
+	updated := false
+	patchUpdate := monkey.Patch(db.UpdateURL, func(context.Context, string, string, db.URLUpdate) (*db.URL, error) {
+		updated = true
+		return &db.URL{}, nil
+	})
+	defer patchUpdate.Unpatch()
+
+	resp, _ := authed(handler.Links)(ctx, events.APIGatewayProxyRequest{
+		HTTPMethod:     "PATCH",
+		Headers:        authHeaders(t, "user-id"),
+		PathParameters: map[string]string{"short_code": "abc123"},
+		Body:           `{"original_url": "https://bad.example"}`,
+	})
+	assert.Equal(t, 400, resp.StatusCode)
+	assert.False(t, updated)
+}
+
+// Stores the progress of scheduled jobs in memory
+func patchJobs(t *testing.T) map[string]db.Job {
+	jobs := map[string]db.Job{}
+	patchGet := monkey.Patch(db.GetJob, func(ctx context.Context, name string) (*db.Job, error) {
+		job := jobs[name]
+		job.Name = name
+		return &job, nil
+	})
+	patchSave := monkey.Patch(db.SaveJob, func(ctx context.Context, job db.Job) error {
+		jobs[job.Name] = job
+		return nil
+	})
+	t.Cleanup(func() {
+		patchGet.Unpatch()
+		patchSave.Unpatch()
+	})
+	return jobs
+}
+
+func TestRescanLinks_TakesDownFlagged(t *testing.T) {
+	ctx := context.Background()
+	entries := captureAudit(t)
+	jobs := patchJobs(t)
+	blocklist, _ := reputation.ParseBlocklist(strings.NewReader("bad.example"))
+	useChecker(t, blocklist, handler.ScreenReject)
+
+	reason := "already down"
+	var cursors []string
+	patchScan := monkey.Patch(db.ScanURLs, func(ctx context.Context, cursor string, limit int32) ([]db.URL, string, error) {
+		cursors = append(cursors, cursor)
+		if cursor == "" {
+			return []db.URL{
+				{Domain: db.DefaultDomain, ShortCode: "good", OriginalURL: "https://example.com"},
+				{Domain: db.DefaultDomain, ShortCode: "bad", OriginalURL: "https://bad.example/login"},
+			}, "page-2", nil
+		}
+		return []db.URL{
+			{Domain: db.DefaultDomain, ShortCode: "down", OriginalURL: "https://bad.example/", TakedownReason: &reason},
+		}, "", nil
+	})
+	defer patchScan.Unpatch()
+
+	var takenDown []string
+	patchTakeDown := monkey.Patch(db.TakeDownURL, func(ctx context.Context, domain, shortCode, reason, at string) error {
+		takenDown = append(takenDown, shortCode)
+		// The blocklist entry isn't shown to visitors
+		assert.NotContains(t, reason, "bad.example")
+		return nil
+	})
+	defer patchTakeDown.Unpatch()
+
+	assert.NoError(t, handler.RescanLinks(ctx))
+	assert.Equal(t, []string{"", "page-2"}, cursors)
+	assert.Equal(t, []string{"bad"}, takenDown)
+	if assert.Len(t, *entries, 1) {
+		entry := (*entries)[0]
+		assert.Equal(t, handler.AuditLinkFlagged, entry.Action)
+		assert.Empty(t, entry.ActorID)
+		assert.Equal(t, "blocklist", entry.Details["source"])
+		assert.Equal(t, "bad.example", entry.Details["threat"])
+	}
+	assert.Empty(t, jobs["rescan"].Cursor)
+	// Previews report the links screened as of the complete pass
+	assert.NotZero(t, jobs["rescan"].CompletedAt)
+	assert.Equal(t, jobs["rescan"].StartedAt, jobs["rescan"].CompletedPassStartedAt)
+
+	// The next pass waits for the interval
+	assert.NoError(t, handler.RescanLinks(ctx))
+	assert.Len(t, cursors, 2)
+}
+
+func TestRescanLinks_SkipsReviewedDestinations(t *testing.T) {
+	ctx := context.Background()
+	captureAudit(t)
+	patchJobs(t)
+	blocklist, _ := reputation.ParseBlocklist(strings.NewReader("bad.example"))
+	useChecker(t, blocklist, handler.ScreenReject)
+
+	reviewed := "https://bad.example/false-positive"
+	patchScan := monkey.Patch(db.ScanURLs, func(ctx context.Context, cursor string, limit int32) ([]db.URL, string, error) {
+		return []db.URL{
+			{Domain: db.DefaultDomain, ShortCode: "restored", OriginalURL: reviewed, ScreeningReviewedURL: &reviewed},
+			// Edited since the review
+			{Domain: db.DefaultDomain, ShortCode: "edited", OriginalURL: "https://bad.example/login", ScreeningReviewedURL: &reviewed},
+		}, "", nil
+	})
+	defer patchScan.Unpatch()
+
+	var takenDown []string
+	patchTakeDown := monkey.Patch(db.TakeDownURL, func(ctx context.Context, domain, shortCode, reason, at string) error {
+		takenDown = append(takenDown, shortCode)
+		return nil
+	})
+	defer patchTakeDown.Unpatch()
+
+	assert.NoError(t, handler.RescanLinks(ctx))
+	assert.Equal(t, []string{"edited"}, takenDown)
+}
+
+func TestRescanLinks_ResumesBeforeDeadline(t *testing.T) {
+	jobs := patchJobs(t)
+	jobs["rescan"] = db.Job{Name: "rescan", Cursor: "page-2", StartedAt: time.Now().Add(-time.Hour).Unix()}
+	useChecker(t, fakeChecker{}, handler.ScreenReject)
+
+	var cursors []string
+	patchScan := monkey.Patch(db.ScanURLs, func(ctx context.Context, cursor string, limit int32) ([]db.URL, string, error) {
+		cursors = append(cursors, cursor)
+		if cursor == "page-2" {
+			return nil, "page-3", nil
+		}
+		return nil, "", nil
+	})
+	defer patchScan.Unpatch()
+
+	// Too close to the deadline to start a batch
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	assert.NoError(t, handler.RescanLinks(ctx))
+	assert.Empty(t, cursors)
+	assert.Equal(t, "page-2", jobs["rescan"].Cursor)
+
+	// A run with time left resumes where the last one stopped
+	ctx, cancel = context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+	assert.NoError(t, handler.RescanLinks(ctx))
+	assert.Equal(t, []string{"page-2", "page-3"}, cursors)
+	assert.Empty(t, jobs["rescan"].Cursor)
+}
+
+func TestParseScreeningAction(t *testing.T) {
+	action, err := handler.ParseScreeningAction("")
+	assert.NoError(t, err)
+	assert.Equal(t, handler.ScreenReject, action)
+
+	_, err = handler.ParseScreeningAction("ignore")
+	assert.ErrorIs(t, err, handler.ErrInvalidScreeningAction)
+}
+
+// The Safe Browsing request follows the v4 Lookup API
+func TestSafeBrowsingClient_RequestFormat(t *testing.T) {
+	var body map[string]map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&body)
+		w.Write([]byte(`{}`))
+	}))
+	defer server.Close()
+
+	client := reputation.NewSafeBrowsingClient("test-key")
+	client.Endpoint = server.URL
+	matches, err := client.Lookup(context.Background(), []string{"https://example.com/"})
+	assert.NoError(t, err)
+	assert.Empty(t, matches)
+	assert.Equal(t, []interface{}{map[string]interface{}{"url": "https://example.com/"}}, body["threatInfo"]["threatEntries"])
+	assert.Equal(t, []interface{}{"ANY_PLATFORM"}, body["threatInfo"]["platformTypes"])
+}
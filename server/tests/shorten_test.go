@@ -8,6 +8,7 @@ import (
 	"bou.ke/monkey"
 	"github.com/SunPodder/shorty/internal/db"
 	"github.com/SunPodder/shorty/internal/handler"
+	"github.com/SunPodder/shorty/internal/middleware"
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/google/uuid"
 	"github.com/stretchr/testify/assert"
@@ -19,7 +20,7 @@ func TestShorten_Success(t *testing.T) {
 	request := events.APIGatewayProxyRequest{Body: string(body)}
 
 	// We can't patch the private function directly, but we can patch db.GetURL which it calls
-	patchGetURL := monkey.Patch(db.GetURL, func(context.Context, string) (*db.URL, error) {
+	patchGetURL := monkey.Patch(db.GetURL, func(context.Context, string, string) (*db.URL, error) {
 		return nil, db.ErrURLNotFound // This will make checkIfCodeExists return false
 	})
 	defer patchGetURL.Unpatch()
@@ -58,7 +59,7 @@ func TestShorten_CustomCodeExists(t *testing.T) {
 	})
 	request := events.APIGatewayProxyRequest{Body: string(body)}
 
-	patchGetURL := monkey.Patch(db.GetURL, func(context.Context, string) (*db.URL, error) {
+	patchGetURL := monkey.Patch(db.GetURL, func(context.Context, string, string) (*db.URL, error) {
 		return &db.URL{ShortCode: customCode}, nil // Code already exists
 	})
 	defer patchGetURL.Unpatch()
@@ -73,7 +74,7 @@ func TestShorten_DBError(t *testing.T) {
 	body, _ := json.Marshal(handler.ShortenRequest{OriginalURL: "https://example.com"})
 	request := events.APIGatewayProxyRequest{Body: string(body)}
 
-	patchGetURL := monkey.Patch(db.GetURL, func(context.Context, string) (*db.URL, error) {
+	patchGetURL := monkey.Patch(db.GetURL, func(context.Context, string, string) (*db.URL, error) {
 		return nil, db.ErrURLNotFound
 	})
 	defer patchGetURL.Unpatch()
@@ -93,3 +94,93 @@ func TestShorten_DBError(t *testing.T) {
 	assert.Equal(t, 500, resp.StatusCode)
 	assert.Contains(t, resp.Body, "Failed to create URL")
 }
+
+func TestShorten_UTMParameters(t *testing.T) {
+	ctx := context.Background()
+	body, _ := json.Marshal(handler.ShortenRequest{
+		OriginalURL: "https://example.com/landing",
+		UTMSource:   "newsletter",
+		UTMMedium:   "email",
+	})
+	request := events.APIGatewayProxyRequest{Body: string(body)}
+
+	var created *db.URL
+	patchCreateURL := monkey.Patch(db.CreateURL, func(_ context.Context, url *db.URL) error {
+		created = url
+		return nil
+	})
+	defer patchCreateURL.Unpatch()
+
+	resp, err := handler.Shorten(ctx, request)
+	assert.NoError(t, err)
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, "https://example.com/landing?utm_medium=email&utm_source=newsletter", created.OriginalURL)
+}
+
+func TestShorten_InvalidURL(t *testing.T) {
+	ctx := context.Background()
+	body, _ := json.Marshal(handler.ShortenRequest{OriginalURL: "not a url"})
+	request := events.APIGatewayProxyRequest{Body: string(body)}
+
+	resp, _ := handler.Shorten(ctx, request)
+	assert.Equal(t, 400, resp.StatusCode)
+}
+
+func TestShorten_InvalidQueryPrecedence(t *testing.T) {
+	ctx := context.Background()
+	precedence := "sideways"
+	body, _ := json.Marshal(handler.ShortenRequest{
+		OriginalURL:     "https://example.com",
+		QueryPrecedence: &precedence,
+	})
+	request := events.APIGatewayProxyRequest{Body: string(body)}
+
+	resp, _ := handler.Shorten(ctx, request)
+	assert.Equal(t, 400, resp.StatusCode)
+}
+
+func TestShorten_InvalidRedirectStatus(t *testing.T) {
+	ctx := context.Background()
+	status := 303
+	body, _ := json.Marshal(handler.ShortenRequest{
+		OriginalURL:    "https://example.com",
+		RedirectStatus: &status,
+	})
+	request := events.APIGatewayProxyRequest{Body: string(body)}
+
+	resp, _ := handler.Shorten(ctx, request)
+	assert.Equal(t, 400, resp.StatusCode)
+}
+
+func TestShorten_InvalidBodyTokenRejected(t *testing.T) {
+	ctx := context.Background()
+	token := "invalid.token.here"
+	body, _ := json.Marshal(handler.ShortenRequest{OriginalURL: "https://example.com", Token: &token})
+	request := events.APIGatewayProxyRequest{Body: string(body)}
+
+	resp, _ := handler.Shorten(ctx, request)
+	assert.Equal(t, 401, resp.StatusCode)
+}
+
+func TestShorten_AuthorizationHeader(t *testing.T) {
+	ctx := context.Background()
+	patchSessions(t)
+	body, _ := json.Marshal(handler.ShortenRequest{OriginalURL: "https://example.com"})
+	request := events.APIGatewayProxyRequest{
+		Headers: authHeaders(t, "user-id"),
+		Body:    string(body),
+	}
+
+	var created *db.URL
+	patchCreateURL := monkey.Patch(db.CreateURL, func(_ context.Context, url *db.URL) error {
+		created = url
+		return nil
+	})
+	defer patchCreateURL.Unpatch()
+
+	resp, _ := middleware.WithAuth(middleware.AuthOptional, handler.Shorten)(ctx, request)
+	assert.Equal(t, 200, resp.StatusCode)
+	if assert.NotNil(t, created.UserID) {
+		assert.Equal(t, "user-id", *created.UserID)
+	}
+}
@@ -0,0 +1,358 @@
+package tests
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"bou.ke/monkey"
+	"github.com/SunPodder/shorty/internal/db"
+	"github.com/SunPodder/shorty/internal/handler"
+	"github.com/SunPodder/shorty/internal/oidc"
+	"github.com/SunPodder/shorty/utils"
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+)
+
+// mockIdP is a minimal OpenID provider. Codes are issued by the test
+// with authorize and redeemed by the token endpoint, which enforces PKCE.
+type mockIdP struct {
+	server *httptest.Server
+	key    *rsa.PrivateKey
+
+	mu    sync.Mutex
+	codes map[string]mockGrant
+}
+
+type mockGrant struct {
+	challenge string
+	claims    jwt.MapClaims
+}
+
+func newMockIdP(t *testing.T) *mockIdP {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idp := &mockIdP{key: key, codes: make(map[string]mockGrant)}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 idp.server.URL,
+			"authorization_endpoint": idp.server.URL + "/authorize",
+			"token_endpoint":         idp.server.URL + "/token",
+			"jwks_uri":               idp.server.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"keys": []map[string]string{{
+				"kty": "RSA",
+				"kid": "test",
+				"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			}},
+		})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		idp.mu.Lock()
+		grant, ok := idp.codes[r.PostForm.Get("code")]
+		delete(idp.codes, r.PostForm.Get("code"))
+		idp.mu.Unlock()
+
+		if !ok || r.PostForm.Get("client_id") != "shorty" ||
+			oidc.CodeChallenge(r.PostForm.Get("code_verifier")) != grant.challenge {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error": "invalid_grant"}`))
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"id_token": idp.sign(grant.claims)})
+	})
+
+	idp.server = httptest.NewServer(mux)
+	t.Cleanup(idp.server.Close)
+	return idp
+}
+
+func (idp *mockIdP) sign(claims jwt.MapClaims) string {
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = "test"
+	signed, _ := token.SignedString(idp.key)
+	return signed
+}
+
+// Logs the user in at the provider for the authorization URL and returns
+// the code the provider redirects back with
+func (idp *mockIdP) authorize(t *testing.T, authURL string, claims jwt.MapClaims) string {
+	parsed, err := url.Parse(authURL)
+	assert.NoError(t, err)
+	query := parsed.Query()
+	assert.Equal(t, "S256", query.Get("code_challenge_method"))
+
+	full := jwt.MapClaims{
+		"iss":   idp.server.URL,
+		"aud":   "shorty",
+		"exp":   time.Now().Add(time.Minute).Unix(),
+		"nonce": query.Get("nonce"),
+	}
+	for name, value := range claims {
+		full[name] = value
+	}
+
+	code, _ := utils.RandomToken(16)
+	idp.mu.Lock()
+	idp.codes[code] = mockGrant{challenge: query.Get("code_challenge"), claims: full}
+	idp.mu.Unlock()
+	return code
+}
+
+func useMockIdP(t *testing.T) *mockIdP {
+	idp := newMockIdP(t)
+	handler.SSOProviders = map[string]*oidc.Provider{
+		"mock": oidc.NewProvider(oidc.Config{
+			Name:        "mock",
+			Issuer:      idp.server.URL,
+			ClientID:    "shorty",
+			RedirectURL: "https://sho.rt/sso/mock/callback",
+		}),
+	}
+	t.Cleanup(func() { handler.SSOProviders = map[string]*oidc.Provider{} })
+	return idp
+}
+
+// Runs a full login against the mock provider, which vouches for claims
+func ssoLogin(t *testing.T, idp *mockIdP, claims jwt.MapClaims) events.APIGatewayProxyResponse {
+	ctx := context.Background()
+	login, _ := handler.SSO(ctx, events.APIGatewayProxyRequest{
+		Resource:       "/sso/{provider}/login",
+		HTTPMethod:     "GET",
+		PathParameters: map[string]string{"provider": "mock"},
+	})
+	assert.Equal(t, 302, login.StatusCode)
+
+	cookie, err := http.ParseSetCookie(login.Headers["Set-Cookie"])
+	assert.NoError(t, err)
+	assert.True(t, cookie.HttpOnly)
+	assert.True(t, cookie.Secure)
+	// Sent back whatever stage prefix the API is served under
+	assert.Equal(t, "/", cookie.Path)
+
+	location := login.Headers["Location"]
+	assert.True(t, strings.HasPrefix(location, idp.server.URL+"/authorize?"))
+	parsed, _ := url.Parse(location)
+
+	resp, _ := handler.SSO(ctx, events.APIGatewayProxyRequest{
+		Resource:       "/sso/{provider}/callback",
+		HTTPMethod:     "GET",
+		PathParameters: map[string]string{"provider": "mock"},
+		Headers:        map[string]string{"Cookie": cookie.Name + "=" + cookie.Value},
+		QueryStringParameters: map[string]string{
+			"code":  idp.authorize(t, location, claims),
+			"state": parsed.Query().Get("state"),
+		},
+	})
+	return resp
+}
+
+func patchNoIdentity(t *testing.T) {
+	monkey.Patch(db.GetIdentity, func(ctx context.Context, provider, subject string) (*db.Identity, error) {
+		return nil, db.ErrIdentityNotFound
+	})
+	t.Cleanup(func() { monkey.Unpatch(db.GetIdentity) })
+}
+
+func tokenUser(t *testing.T, body string) string {
+	var response struct {
+		Token string `json:"token"`
+	}
+	assert.NoError(t, json.Unmarshal([]byte(body), &response))
+	userID, err := utils.ValidateJWT(response.Token)
+	assert.NoError(t, err)
+	return userID
+}
+
+func TestSSO_CreatesUser(t *testing.T) {
+	idp := useMockIdP(t)
+	patchNoIdentity(t)
+
+	monkey.Patch(db.GetUserByEmail, func(ctx context.Context, email string) (*db.User, error) {
+		return nil, db.ErrUserNotFound
+	})
+	defer monkey.Unpatch(db.GetUserByEmail)
+
+	var created db.User
+	monkey.Patch(db.CreateUser, func(ctx context.Context, user db.User) error {
+		created = user
+		return nil
+	})
+	defer monkey.Unpatch(db.CreateUser)
+
+	var identity db.Identity
+	monkey.Patch(db.CreateIdentity, func(ctx context.Context, i db.Identity) error {
+		identity = i
+		return nil
+	})
+	defer monkey.Unpatch(db.CreateIdentity)
+
+	resp := ssoLogin(t, idp, jwt.MapClaims{"sub": "sub-1", "email": "new@example.com", "email_verified": true})
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, created.ID, tokenUser(t, resp.Body))
+	assert.Equal(t, "new@example.com", created.Email)
+	assert.True(t, created.Verified)
+	assert.Empty(t, created.Password)
+	assert.Equal(t, created.ID, identity.UserID)
+	assert.Equal(t, "mock", identity.Provider)
+	assert.Equal(t, "sub-1", identity.Subject)
+}
+
+func TestSSO_LinksVerifiedAccount(t *testing.T) {
+	idp := useMockIdP(t)
+	patchNoIdentity(t)
+
+	monkey.Patch(db.GetUserByEmail, func(ctx context.Context, email string) (*db.User, error) {
+		return &db.User{ID: "user-1", Email: email, Verified: true}, nil
+	})
+	defer monkey.Unpatch(db.GetUserByEmail)
+
+	var identity db.Identity
+	monkey.Patch(db.CreateIdentity, func(ctx context.Context, i db.Identity) error {
+		identity = i
+		return nil
+	})
+	defer monkey.Unpatch(db.CreateIdentity)
+
+	resp := ssoLogin(t, idp, jwt.MapClaims{"sub": "sub-1", "email": "user@example.com", "email_verified": "true"})
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, "user-1", tokenUser(t, resp.Body))
+	assert.Equal(t, "user-1", identity.UserID)
+}
+
+func TestSSO_RefusesUnverifiedAccount(t *testing.T) {
+	idp := useMockIdP(t)
+	patchNoIdentity(t)
+
+	monkey.Patch(db.GetUserByEmail, func(ctx context.Context, email string) (*db.User, error) {
+		return &db.User{ID: "user-1", Email: email}, nil
+	})
+	defer monkey.Unpatch(db.GetUserByEmail)
+
+	resp := ssoLogin(t, idp, jwt.MapClaims{"sub": "sub-1", "email": "user@example.com", "email_verified": true})
+	assert.Equal(t, 403, resp.StatusCode)
+}
+
+func TestSSO_RequiresVerifiedEmail(t *testing.T) {
+	idp := useMockIdP(t)
+	patchNoIdentity(t)
+
+	resp := ssoLogin(t, idp, jwt.MapClaims{"sub": "sub-1", "email": "user@example.com", "email_verified": false})
+	assert.Equal(t, 403, resp.StatusCode)
+}
+
+func TestSSO_KnownIdentity(t *testing.T) {
+	idp := useMockIdP(t)
+	handler.SSORedirectURL = "https://app.sho.rt/sso"
+	defer func() { handler.SSORedirectURL = "" }()
+
+	monkey.Patch(db.GetIdentity, func(ctx context.Context, provider, subject string) (*db.Identity, error) {
+		assert.Equal(t, "sub-1", subject)
+		return &db.Identity{UserID: "user-1"}, nil
+	})
+	defer monkey.Unpatch(db.GetIdentity)
+	patchSessions(t)
+
+	// The subject decides, whatever email the provider reports now
+	resp := ssoLogin(t, idp, jwt.MapClaims{"sub": "sub-1"})
+	assert.Equal(t, 302, resp.StatusCode)
+
+	location, err := url.Parse(resp.Headers["Location"])
+	assert.NoError(t, err)
+	assert.Equal(t, "app.sho.rt", location.Host)
+	fragment, _ := url.ParseQuery(location.Fragment)
+	userID, err := utils.ValidateJWT(fragment.Get("token"))
+	assert.NoError(t, err)
+	assert.Equal(t, "user-1", userID)
+}
+
+func TestSSO_TwoFactorChallenge(t *testing.T) {
+	idp := useMockIdP(t)
+	handler.SSORedirectURL = "https://app.sho.rt/sso"
+	defer func() { handler.SSORedirectURL = "" }()
+
+	secret, _ := utils.GenerateTOTPSecret()
+	user := &db.User{ID: "user-1", Email: "user@example.com", TOTPEnabled: true, TOTPSecret: secret}
+	patchIdentity := monkey.Patch(db.GetIdentity, func(ctx context.Context, provider, subject string) (*db.Identity, error) {
+		return &db.Identity{UserID: user.ID}, nil
+	})
+	defer patchIdentity.Unpatch()
+	patchUser := monkey.Patch(db.GetUser, func(ctx context.Context, id string) (*db.User, error) {
+		return user, nil
+	})
+	defer patchUser.Unpatch()
+	patchStep := monkey.Patch(db.UseTOTPStep, func(ctx context.Context, id string, step int64) error {
+		return nil
+	})
+	defer patchStep.Unpatch()
+	patchMFAChallenges(t)
+
+	// No session before the second factor
+	resp := ssoLogin(t, idp, jwt.MapClaims{"sub": "sub-1"})
+	assert.Equal(t, 302, resp.StatusCode)
+	location, _ := url.Parse(resp.Headers["Location"])
+	fragment, _ := url.ParseQuery(location.Fragment)
+	assert.Empty(t, fragment.Get("token"))
+	assert.Equal(t, "true", fragment.Get("mfa_required"))
+
+	code, _ := utils.TOTPCode(secret, utils.TOTPStep(time.Now()))
+	body := `{"challenge": "` + fragment.Get("challenge") + `", "code": "` + code + `"}`
+	resp, _ = handler.LoginMFA(context.Background(), events.APIGatewayProxyRequest{Body: body})
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, "user-1", tokenUser(t, resp.Body))
+}
+
+func TestSSO_NonceMismatch(t *testing.T) {
+	idp := useMockIdP(t)
+
+	resp := ssoLogin(t, idp, jwt.MapClaims{"sub": "sub-1", "nonce": "replayed"})
+	assert.Equal(t, 401, resp.StatusCode)
+}
+
+func TestSSOCallback_StateMismatch(t *testing.T) {
+	useMockIdP(t)
+	state, _ := utils.GenerateSSOState(utils.SSOState{Provider: "mock", State: "expected", Nonce: "n", Verifier: "v"})
+
+	resp, _ := handler.SSOCallback(context.Background(), events.APIGatewayProxyRequest{
+		PathParameters:        map[string]string{"provider": "mock"},
+		Headers:               map[string]string{"Cookie": "shorty_sso=" + state},
+		QueryStringParameters: map[string]string{"code": "code", "state": "forged"},
+	})
+	assert.Equal(t, 400, resp.StatusCode)
+
+	// A state cookie can't be used with another provider
+	handler.SSOProviders["other"] = oidc.NewProvider(oidc.Config{Name: "other", Issuer: "https://other.example.com", ClientID: "shorty"})
+	resp, _ = handler.SSOCallback(context.Background(), events.APIGatewayProxyRequest{
+		PathParameters:        map[string]string{"provider": "other"},
+		Headers:               map[string]string{"Cookie": "shorty_sso=" + state},
+		QueryStringParameters: map[string]string{"code": "code", "state": "expected"},
+	})
+	assert.Equal(t, 400, resp.StatusCode)
+}
+
+func TestSSOLogin_UnknownProvider(t *testing.T) {
+	resp, _ := handler.SSOLogin(context.Background(), events.APIGatewayProxyRequest{
+		PathParameters: map[string]string{"provider": "nope"},
+	})
+	assert.Equal(t, 404, resp.StatusCode)
+}
@@ -0,0 +1,318 @@
+package tests
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/SunPodder/shorty/internal/handler"
+	"github.com/SunPodder/shorty/internal/httpapi"
+	"github.com/SunPodder/shorty/internal/middleware"
+	"github.com/SunPodder/shorty/internal/oidc"
+	"github.com/SunPodder/shorty/internal/telemetry"
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	smithymiddleware "github.com/aws/smithy-go/middleware"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	metricnoop "go.opentelemetry.io/otel/metric/noop"
+	"go.opentelemetry.io/otel/propagation"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	tracenoop "go.opentelemetry.io/otel/trace/noop"
+)
+
+// Records spans and metrics in memory for the duration of the test
+func captureTelemetry(t *testing.T) (*tracetest.SpanRecorder, *sdkmetric.ManualReader) {
+	spans := tracetest.NewSpanRecorder()
+	reader := sdkmetric.NewManualReader()
+	telemetry.Use(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(spans)), sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader)))
+	t.Cleanup(func() { telemetry.Use(tracenoop.NewTracerProvider(), metricnoop.NewMeterProvider()) })
+	return spans, reader
+}
+
+// Returns the data points of the named metric whose attributes include
+// attrs
+func metricPoints[N int64 | float64](t *testing.T, reader *sdkmetric.ManualReader, name string, attrs ...attribute.KeyValue) []metricdata.DataPoint[N] {
+	var rm metricdata.ResourceMetrics
+	if err := reader.Collect(context.Background(), &rm); err != nil {
+		t.Fatalf("collect metrics: %v", err)
+	}
+	var points []metricdata.DataPoint[N]
+	for _, scope := range rm.ScopeMetrics {
+		for _, m := range scope.Metrics {
+			if m.Name != name {
+				continue
+			}
+			sum, ok := m.Data.(metricdata.Sum[N])
+			if !ok {
+				t.Fatalf("%s isn't a sum", name)
+			}
+			for _, point := range sum.DataPoints {
+				if hasAttrs(point.Attributes, attrs) {
+					points = append(points, point)
+				}
+			}
+		}
+	}
+	return points
+}
+
+// Returns the histogram points of the named metric whose attributes
+// include attrs
+func histogramPoints(t *testing.T, reader *sdkmetric.ManualReader, name string, attrs ...attribute.KeyValue) []metricdata.HistogramDataPoint[float64] {
+	var rm metricdata.ResourceMetrics
+	if err := reader.Collect(context.Background(), &rm); err != nil {
+		t.Fatalf("collect metrics: %v", err)
+	}
+	var points []metricdata.HistogramDataPoint[float64]
+	for _, scope := range rm.ScopeMetrics {
+		for _, m := range scope.Metrics {
+			if m.Name != name {
+				continue
+			}
+			for _, point := range m.Data.(metricdata.Histogram[float64]).DataPoints {
+				if hasAttrs(point.Attributes, attrs) {
+					points = append(points, point)
+				}
+			}
+		}
+	}
+	return points
+}
+
+func hasAttrs(set attribute.Set, attrs []attribute.KeyValue) bool {
+	for _, attr := range attrs {
+		if value, ok := set.Value(attr.Key); !ok || value != attr.Value {
+			return false
+		}
+	}
+	return true
+}
+
+func TestWithTelemetry(t *testing.T) {
+	ctx := context.Background()
+	spans, reader := captureTelemetry(t)
+	logs := captureLogs(t)
+	previous := otel.GetTextMapPropagator()
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	t.Cleanup(func() { otel.SetTextMapPropagator(previous) })
+
+	request := events.APIGatewayProxyRequest{
+		HTTPMethod: "GET",
+		Resource:   "/{short_code}",
+		Headers:    map[string]string{"Traceparent": "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"},
+	}
+	next := func(status int, err error) middleware.HandlerFunc {
+		return func(ctx context.Context, _ events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+			return events.APIGatewayProxyResponse{StatusCode: status}, err
+		}
+	}
+
+	middleware.WithTelemetry(middleware.WithLogging(next(302, nil)))(ctx, request)
+	middleware.WithTelemetry(next(302, nil))(ctx, request)
+	middleware.WithTelemetry(next(404, nil))(ctx, request)
+	middleware.WithTelemetry(next(0, errors.New("boom")))(ctx, request)
+
+	ended := spans.Ended()
+	if assert.Len(t, ended, 4) {
+		assert.Equal(t, "GET /{short_code}", ended[0].Name())
+		assert.Equal(t, "0af7651916cd43dd8448eb211c80319c", ended[0].SpanContext().TraceID().String())
+		assert.Equal(t, "b7ad6b7169203331", ended[0].Parent().SpanID().String())
+		assert.Equal(t, "Error", ended[3].Status().Code.String())
+	}
+
+	lines := logs()
+	if assert.Len(t, lines, 1) {
+		assert.Equal(t, "0af7651916cd43dd8448eb211c80319c", lines[0]["trace_id"])
+	}
+
+	route := attribute.String("http.route", "/{short_code}")
+	found := metricPoints[int64](t, reader, "http.server.requests", route, attribute.Int("http.response.status_code", 302))
+	if assert.Len(t, found, 1) {
+		assert.Equal(t, int64(2), found[0].Value)
+	}
+	assert.Len(t, metricPoints[int64](t, reader, "http.server.requests", route, attribute.Int("http.response.status_code", 404)), 1)
+	assert.Len(t, metricPoints[int64](t, reader, "http.server.requests", route, attribute.Int("http.response.status_code", 502)), 1)
+
+	latency := histogramPoints(t, reader, "http.server.request.duration", route, attribute.Int("http.response.status_code", 302))
+	if assert.Len(t, latency, 1) {
+		assert.Equal(t, uint64(2), latency[0].Count)
+	}
+}
+
+// Answers DynamoDB requests with the queued responses
+type fakeDynamoDB struct {
+	responses []*http.Response
+}
+
+func (f *fakeDynamoDB) Do(req *http.Request) (*http.Response, error) {
+	resp := f.responses[0]
+	f.responses = f.responses[1:]
+	resp.Request = req
+	return resp, nil
+}
+
+func dynamoResponse(status int, body string) *http.Response {
+	return &http.Response{
+		StatusCode: status,
+		Header:     http.Header{"Content-Type": []string{"application/x-amz-json-1.0"}},
+		Body:       io.NopCloser(strings.NewReader(body)),
+	}
+}
+
+func TestInstrumentDynamoDB(t *testing.T) {
+	spans, reader := captureTelemetry(t)
+
+	throttled := `{"__type":"com.amazonaws.dynamodb.v20120810#ProvisionedThroughputExceededException","message":"Rate exceeded"}`
+	fake := &fakeDynamoDB{responses: []*http.Response{
+		dynamoResponse(400, throttled),
+		dynamoResponse(200, `{"Item":{"short_code":{"S":"abc123"}}}`),
+		dynamoResponse(400, `{"__type":"com.amazonaws.dynamodb.v20120810#ResourceNotFoundException","message":"no table"}`),
+	}}
+	client := dynamodb.New(dynamodb.Options{
+		Region:      "us-east-1",
+		Credentials: aws.AnonymousCredentials{},
+		HTTPClient:  fake,
+		APIOptions:  []func(*smithymiddleware.Stack) error{telemetry.InstrumentDynamoDB},
+		Retryer: retry.NewStandard(func(o *retry.StandardOptions) {
+			o.MaxAttempts = 2
+			o.Backoff = retry.BackoffDelayerFunc(func(int, error) (time.Duration, error) { return 0, nil })
+		}),
+	})
+
+	key := map[string]types.AttributeValue{"short_code": &types.AttributeValueMemberS{Value: "abc123"}}
+	_, err := client.GetItem(context.Background(), &dynamodb.GetItemInput{TableName: aws.String("shorty_urls"), Key: key})
+	assert.NoError(t, err)
+	_, err = client.GetItem(context.Background(), &dynamodb.GetItemInput{TableName: aws.String("shorty_gone"), Key: key})
+	assert.Error(t, err)
+
+	ended := spans.Ended()
+	if assert.Len(t, ended, 2) {
+		assert.Equal(t, "DynamoDB.GetItem", ended[0].Name())
+		assert.Equal(t, "Error", ended[1].Status().Code.String())
+	}
+
+	operation := attribute.String("db.operation.name", "GetItem")
+	throttles := metricPoints[int64](t, reader, "db.client.throttles", operation)
+	if assert.Len(t, throttles, 1) {
+		assert.Equal(t, int64(1), throttles[0].Value)
+	}
+
+	table := attribute.String("db.collection.name", "shorty_urls")
+	latency := histogramPoints(t, reader, "db.client.operation.duration", operation, table)
+	if assert.Len(t, latency, 1) {
+		assert.Equal(t, uint64(1), latency[0].Count)
+		_, failed := latency[0].Attributes.Value("error.type")
+		assert.False(t, failed)
+	}
+	failed := histogramPoints(t, reader, "db.client.operation.duration", attribute.String("error.type", "ResourceNotFoundException"))
+	assert.Len(t, failed, 1)
+}
+
+func TestOIDCDiscoveryCacheMetrics(t *testing.T) {
+	_, reader := captureTelemetry(t)
+	useMockIdP(t)
+
+	provider := handler.SSOProviders["mock"]
+	for i := 0; i < 3; i++ {
+		authRequest, err := oidc.NewAuthRequest()
+		assert.NoError(t, err)
+		_, err = provider.AuthURL(context.Background(), authRequest)
+		assert.NoError(t, err)
+	}
+
+	cache := attribute.String("cache.name", "oidc_discovery")
+	hits := metricPoints[int64](t, reader, "cache.lookups", cache, attribute.String("cache.result", "hit"))
+	misses := metricPoints[int64](t, reader, "cache.lookups", cache, attribute.String("cache.result", "miss"))
+	if assert.Len(t, hits, 1) && assert.Len(t, misses, 1) {
+		assert.Equal(t, int64(2), hits[0].Value)
+		assert.Equal(t, int64(1), misses[0].Value)
+	}
+}
+
+func TestHTTPAPI(t *testing.T) {
+	var got events.APIGatewayProxyRequest
+	echo := func(ctx context.Context, req events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+		got = req
+		return events.APIGatewayProxyResponse{
+			StatusCode:      201,
+			Headers:         map[string]string{"Content-Type": "image/png"},
+			Body:            base64.StdEncoding.EncodeToString([]byte{0x89, 'P', 'N', 'G'}),
+			IsBase64Encoded: true,
+		}, nil
+	}
+	failing := func(ctx context.Context, req events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+		return events.APIGatewayProxyResponse{}, errors.New("boom")
+	}
+	server := httptest.NewServer(httpapi.NewMux([]httpapi.Route{
+		{Method: "ANY", Resource: "/me", Handler: failing},
+		{Method: "POST", Resource: "/{short_code}/report", Handler: echo},
+		{Method: "GET", Resource: "/{short_code}", Handler: echo},
+		{Method: "GET", Resource: "/{short_code}/qr", Handler: echo},
+		{Method: "GET", Resource: "/preview/{short_code}", Handler: echo},
+	}))
+	defer server.Close()
+
+	resp, err := http.Post(server.URL+"/abc123/report?reason=spam", "application/json", strings.NewReader(`{"a":1}`))
+	if !assert.NoError(t, err) {
+		return
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, 201, resp.StatusCode)
+	assert.Equal(t, "image/png", resp.Header.Get("Content-Type"))
+	assert.True(t, bytes.Equal([]byte{0x89, 'P', 'N', 'G'}, body))
+
+	assert.Equal(t, "/{short_code}/report", got.Resource)
+	assert.Equal(t, "POST", got.HTTPMethod)
+	assert.Equal(t, "abc123", got.PathParameters["short_code"])
+	assert.Equal(t, "spam", got.QueryStringParameters["reason"])
+	assert.Equal(t, `{"a":1}`, got.Body)
+	assert.Equal(t, "application/json", got.Headers["Content-Type"])
+	assert.NotEmpty(t, got.RequestContext.RequestID)
+	assert.Equal(t, "127.0.0.1", got.RequestContext.Identity.SourceIP)
+
+	resp, err = http.Get(server.URL + "/abc123/report")
+	if assert.NoError(t, err) {
+		assert.Equal(t, 405, resp.StatusCode)
+		resp.Body.Close()
+	}
+
+	resp, err = http.Get(server.URL + "/me")
+	if assert.NoError(t, err) {
+		assert.Equal(t, 502, resp.StatusCode)
+		resp.Body.Close()
+	}
+
+	// Literal segments take precedence, from left to right
+	resp, err = http.Get(server.URL + "/preview/qr")
+	if assert.NoError(t, err) {
+		resp.Body.Close()
+		assert.Equal(t, "/preview/{short_code}", got.Resource)
+		assert.Equal(t, "qr", got.PathParameters["short_code"])
+	}
+	resp, err = http.Get(server.URL + "/me?x=1")
+	if assert.NoError(t, err) {
+		resp.Body.Close()
+		assert.Equal(t, 502, resp.StatusCode)
+	}
+	resp, err = http.Get(server.URL + "/abc123/stats/x")
+	if assert.NoError(t, err) {
+		resp.Body.Close()
+		assert.Equal(t, 404, resp.StatusCode)
+	}
+}
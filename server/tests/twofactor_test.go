@@ -0,0 +1,269 @@
+package tests
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"bou.ke/monkey"
+	"github.com/SunPodder/shorty/internal/db"
+	"github.com/SunPodder/shorty/internal/handler"
+	"github.com/SunPodder/shorty/utils"
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/stretchr/testify/assert"
+)
+
+func init() {
+	// Set from the configured secrets at startup
+	utils.HashKey = []byte("0123456789abcdef0123456789abcdef")
+}
+
+// Stores the challenges issued to users like the conditional updates of
+// the user table, so each can be used once
+func patchMFAChallenges(t *testing.T) {
+	stored := map[string]string{}
+	patchSet := monkey.Patch(db.SetMFAChallenge, func(ctx context.Context, id, hash string) error {
+		stored[id] = hash
+		return nil
+	})
+	patchUse := monkey.Patch(db.UseMFAChallenge, func(ctx context.Context, id, hash string) error {
+		if stored[id] == "" || stored[id] != hash {
+			return db.ErrInvalidChallenge
+		}
+		delete(stored, id)
+		return nil
+	})
+	t.Cleanup(func() {
+		patchSet.Unpatch()
+		patchUse.Unpatch()
+	})
+}
+
+func TestTOTPCode_RFC6238(t *testing.T) {
+	// Test vectors of RFC 6238 for SHA1, truncated to 6 digits
+	secret := "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+	for unix, want := range map[int64]string{
+		59:         "287082",
+		1111111109: "081804",
+		1234567890: "005924",
+		2000000000: "279037",
+	} {
+		code, err := utils.TOTPCode(secret, utils.TOTPStep(time.Unix(unix, 0)))
+		if err != nil {
+			t.Fatalf("TOTPCode failed: %v", err)
+		}
+		if code != want {
+			t.Errorf("TOTPCode at %d = %s, want %s", unix, code, want)
+		}
+	}
+}
+
+func TestValidateTOTP_Skew(t *testing.T) {
+	secret, _ := utils.GenerateTOTPSecret()
+	now := time.Now()
+
+	previous, _ := utils.TOTPCode(secret, utils.TOTPStep(now)-1)
+	if _, ok := utils.ValidateTOTP(secret, previous, now); !ok {
+		t.Error("Expected the previous code to be accepted")
+	}
+	stale, _ := utils.TOTPCode(secret, utils.TOTPStep(now)-3)
+	if _, ok := utils.ValidateTOTP(secret, stale, now); ok {
+		t.Error("Expected an old code to be refused")
+	}
+}
+
+func TestMFAChallenge_NotASession(t *testing.T) {
+	challenge, _ := utils.GenerateMFAChallenge("user-id")
+	if _, err := utils.ValidateJWT(challenge); err == nil {
+		t.Error("Expected the challenge to be rejected as a session")
+	}
+}
+
+func TestTwoFactor_Enrollment(t *testing.T) {
+	ctx := context.Background()
+	user := &db.User{ID: "user-id", Email: "jane@example.com"}
+	entries := captureAudit(t)
+
+	monkey.Patch(db.GetUser, func(ctx context.Context, id string) (*db.User, error) {
+		return user, nil
+	})
+	defer monkey.Unpatch(db.GetUser)
+	monkey.Patch(db.StartTOTPEnrollment, func(ctx context.Context, id, secret string) error {
+		user.TOTPSecret = secret
+		return nil
+	})
+	defer monkey.Unpatch(db.StartTOTPEnrollment)
+	var hashes []string
+	monkey.Patch(db.EnableTOTP, func(ctx context.Context, id, secret string, step int64, codes []string) error {
+		user.TOTPEnabled = true
+		hashes = codes
+		return nil
+	})
+	defer monkey.Unpatch(db.EnableTOTP)
+
+	request := events.APIGatewayProxyRequest{
+		HTTPMethod: "POST",
+		Resource:   "/me/2fa",
+		Headers:    authHeaders(t, "user-id"),
+	}
+	resp, _ := authed(handler.TwoFactor)(ctx, request)
+	assert.Equal(t, 200, resp.StatusCode)
+
+	var enrollment handler.EnrollTwoFactorResponse
+	json.Unmarshal([]byte(resp.Body), &enrollment)
+	assert.Equal(t, user.TOTPSecret, enrollment.Secret)
+	assert.True(t, strings.HasPrefix(enrollment.URI, "otpauth://totp/Shorty:jane@example.com?"))
+	assert.True(t, strings.HasPrefix(enrollment.QRCode, "data:image/png;base64,"))
+
+	// A wrong code doesn't enable anything
+	request.Resource = "/me/2fa/verify"
+	request.Body = `{"code": "000000"}`
+	if code, _ := utils.TOTPCode(user.TOTPSecret, utils.TOTPStep(time.Now())); code == "000000" {
+		request.Body = `{"code": "111111"}`
+	}
+	resp, _ = authed(handler.TwoFactor)(ctx, request)
+	assert.Equal(t, 400, resp.StatusCode)
+	assert.False(t, user.TOTPEnabled)
+
+	code, _ := utils.TOTPCode(user.TOTPSecret, utils.TOTPStep(time.Now()))
+	request.Body = `{"code": "` + code + `"}`
+	resp, _ = authed(handler.TwoFactor)(ctx, request)
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.True(t, user.TOTPEnabled)
+
+	var confirmation handler.ConfirmTwoFactorResponse
+	json.Unmarshal([]byte(resp.Body), &confirmation)
+	assert.Len(t, confirmation.BackupCodes, 10)
+	if assert.Len(t, hashes, 10) {
+		assert.Equal(t, utils.HashBackupCode(confirmation.BackupCodes[0]), hashes[0])
+		// Without the key a dump of the hashes can't be brute-forced
+		assert.NotEqual(t, utils.HashToken(utils.NormalizeBackupCode(confirmation.BackupCodes[0])), hashes[0])
+	}
+
+	// Enrolling again is refused while enabled
+	request.Resource = "/me/2fa"
+	request.Body = ""
+	resp, _ = authed(handler.TwoFactor)(ctx, request)
+	assert.Equal(t, 409, resp.StatusCode)
+
+	var actions []string
+	for _, entry := range *entries {
+		actions = append(actions, entry.Action)
+	}
+	assert.Equal(t, []string{handler.AuditTwoFactorEnroll, handler.AuditTwoFactorEnable}, actions)
+}
+
+func TestLogin_TwoStepWithTOTP(t *testing.T) {
+	ctx := context.Background()
+	secret, _ := utils.GenerateTOTPSecret()
+	user := &db.User{ID: "user-id", Email: "test@example.com", TOTPEnabled: true, TOTPSecret: secret}
+	defer patchLoginUser(user)()
+	patchMFAChallenges(t)
+
+	resp, _ := handler.Login(ctx, loginRequest("password"))
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Empty(t, resp.Headers["Authorization"])
+
+	var challenge struct {
+		MFARequired bool   `json:"mfa_required"`
+		Challenge   string `json:"challenge"`
+		Token       string `json:"token"`
+	}
+	json.Unmarshal([]byte(resp.Body), &challenge)
+	assert.True(t, challenge.MFARequired)
+	assert.Empty(t, challenge.Token)
+
+	monkey.Patch(db.GetUser, func(ctx context.Context, id string) (*db.User, error) {
+		return user, nil
+	})
+	defer monkey.Unpatch(db.GetUser)
+	var lastStep int64
+	monkey.Patch(db.UseTOTPStep, func(ctx context.Context, id string, step int64) error {
+		if step <= lastStep {
+			return db.ErrCodeAlreadyUsed
+		}
+		lastStep = step
+		return nil
+	})
+	defer monkey.Unpatch(db.UseTOTPStep)
+	monkey.Patch(db.RecordFailedLogin, func(ctx context.Context, id string) (int, error) {
+		return 1, nil
+	})
+	defer monkey.Unpatch(db.RecordFailedLogin)
+
+	code, _ := utils.TOTPCode(secret, utils.TOTPStep(time.Now()))
+	body := `{"challenge": "` + challenge.Challenge + `", "code": "` + code + `"}`
+	resp, _ = handler.LoginMFA(ctx, events.APIGatewayProxyRequest{Body: body})
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Contains(t, resp.Body, `"token"`)
+
+	// Neither the challenge nor the code can be replayed
+	resp, _ = handler.LoginMFA(ctx, events.APIGatewayProxyRequest{Body: body})
+	assert.Equal(t, 401, resp.StatusCode)
+	resp, _ = handler.Login(ctx, loginRequest("password"))
+	json.Unmarshal([]byte(resp.Body), &challenge)
+	body = `{"challenge": "` + challenge.Challenge + `", "code": "` + code + `"}`
+	resp, _ = handler.LoginMFA(ctx, events.APIGatewayProxyRequest{Body: body})
+	assert.Equal(t, 401, resp.StatusCode)
+
+	// A session token isn't a challenge
+	body = `{"challenge": "` + mustJWT(t, "user-id") + `", "code": "` + code + `"}`
+	resp, _ = handler.LoginMFA(ctx, events.APIGatewayProxyRequest{Body: body})
+	assert.Equal(t, 401, resp.StatusCode)
+}
+
+func TestLoginMFA_BackupCode(t *testing.T) {
+	ctx := context.Background()
+	secret, _ := utils.GenerateTOTPSecret()
+	codes, _ := utils.GenerateBackupCodes(2)
+	user := &db.User{ID: "user-id", TOTPEnabled: true, TOTPSecret: secret}
+	remaining := map[string]bool{}
+	for _, code := range codes {
+		remaining[utils.HashBackupCode(code)] = true
+	}
+
+	monkey.Patch(db.GetUser, func(ctx context.Context, id string) (*db.User, error) {
+		return user, nil
+	})
+	defer monkey.Unpatch(db.GetUser)
+	monkey.Patch(db.UseBackupCode, func(ctx context.Context, id, hash string) error {
+		if !remaining[hash] {
+			return db.ErrCodeAlreadyUsed
+		}
+		delete(remaining, hash)
+		return nil
+	})
+	defer monkey.Unpatch(db.UseBackupCode)
+	monkey.Patch(db.RecordFailedLogin, func(ctx context.Context, id string) (int, error) {
+		return 1, nil
+	})
+	defer monkey.Unpatch(db.RecordFailedLogin)
+
+	patchMFAChallenges(t)
+	challenge := func() string {
+		resp, _ := handler.Login(ctx, loginRequest("password"))
+		var body struct {
+			Challenge string `json:"challenge"`
+		}
+		json.Unmarshal([]byte(resp.Body), &body)
+		return body.Challenge
+	}
+	defer patchLoginUser(user)()
+
+	// Backup codes work regardless of case and dashes, but only once
+	code := strings.ToUpper(strings.ReplaceAll(codes[0], "-", ""))
+	resp, _ := handler.LoginMFA(ctx, events.APIGatewayProxyRequest{Body: `{"challenge": "` + challenge() + `", "code": "` + code + `"}`})
+	assert.Equal(t, 200, resp.StatusCode)
+
+	resp, _ = handler.LoginMFA(ctx, events.APIGatewayProxyRequest{Body: `{"challenge": "` + challenge() + `", "code": "` + code + `"}`})
+	assert.Equal(t, 401, resp.StatusCode)
+	assert.Len(t, remaining, 1)
+
+	// A challenge that was never issued is refused, even when signed
+	forged, _ := utils.GenerateMFAChallenge("user-id")
+	resp, _ = handler.LoginMFA(ctx, events.APIGatewayProxyRequest{Body: `{"challenge": "` + forged + `", "code": "` + codes[1] + `"}`})
+	assert.Equal(t, 401, resp.StatusCode)
+	assert.Len(t, remaining, 1)
+}
@@ -0,0 +1,73 @@
+package tests
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/SunPodder/shorty/utils"
+)
+
+func TestBuildDestination(t *testing.T) {
+	dest, err := utils.BuildDestination("https://example.com/page?utm_source=old&a=1", utils.UTMParams{
+		Source:   "newsletter",
+		Medium:   "email",
+		Campaign: "spring sale",
+	})
+	if err != nil {
+		t.Fatalf("BuildDestination failed: %v", err)
+	}
+
+	parsed, err := url.Parse(dest)
+	if err != nil {
+		t.Fatalf("Result is not a valid URL: %v", err)
+	}
+	query := parsed.Query()
+	if query.Get("utm_source") != "newsletter" {
+		t.Errorf("Expected utm_source %q, got %q", "newsletter", query.Get("utm_source"))
+	}
+	if query.Get("utm_campaign") != "spring sale" {
+		t.Errorf("Expected utm_campaign %q, got %q", "spring sale", query.Get("utm_campaign"))
+	}
+	if query.Get("a") != "1" {
+		t.Errorf("Expected existing parameter to be kept, got %q", query.Get("a"))
+	}
+
+	// UTM parameters without a source are rejected
+	_, err = utils.BuildDestination("https://example.com", utils.UTMParams{Medium: "email"})
+	if err != utils.ErrInvalidUTM {
+		t.Errorf("Expected ErrInvalidUTM, got %v", err)
+	}
+
+	// Non http(s) destinations are rejected
+	_, err = utils.BuildDestination("javascript:alert(1)", utils.UTMParams{})
+	if err != utils.ErrInvalidURL {
+		t.Errorf("Expected ErrInvalidURL, got %v", err)
+	}
+}
+
+func TestMergeQuery(t *testing.T) {
+	incoming := url.Values{"ref": {"x"}, "a": {"incoming"}}
+
+	dest, err := utils.MergeQuery("https://example.com/?a=dest", incoming, utils.QueryPrecedenceDestination)
+	if err != nil {
+		t.Fatalf("MergeQuery failed: %v", err)
+	}
+	parsed, _ := url.Parse(dest)
+	if parsed.Query().Get("a") != "dest" || parsed.Query().Get("ref") != "x" {
+		t.Errorf("Unexpected merge with destination precedence: %s", dest)
+	}
+
+	dest, err = utils.MergeQuery("https://example.com/?a=dest", incoming, utils.QueryPrecedenceIncoming)
+	if err != nil {
+		t.Fatalf("MergeQuery failed: %v", err)
+	}
+	parsed, _ = url.Parse(dest)
+	if parsed.Query().Get("a") != "incoming" || parsed.Query().Get("ref") != "x" {
+		t.Errorf("Unexpected merge with incoming precedence: %s", dest)
+	}
+
+	_, err = utils.MergeQuery("https://example.com", incoming, "bogus")
+	if err != utils.ErrInvalidQueryPrecedence {
+		t.Errorf("Expected ErrInvalidQueryPrecedence, got %v", err)
+	}
+}
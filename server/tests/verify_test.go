@@ -0,0 +1,206 @@
+package tests
+
+import (
+	"context"
+	"encoding/json"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"bou.ke/monkey"
+	"github.com/SunPodder/shorty/internal/db"
+	"github.com/SunPodder/shorty/internal/handler"
+	"github.com/SunPodder/shorty/internal/mail"
+	"github.com/SunPodder/shorty/utils"
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateEmail(t *testing.T) {
+	for _, email := range []string{"jane@example.com", " jane.doe+tag@mail.example.co.uk "} {
+		if _, err := utils.ValidateEmail(email); err != nil {
+			t.Errorf("Expected %q to be valid, got %v", email, err)
+		}
+	}
+	for _, email := range []string{"", "jane", "jane@", "@example.com", "jane@localhost", "Jane <jane@example.com>", "jane@example.com."} {
+		if _, err := utils.ValidateEmail(email); err == nil {
+			t.Errorf("Expected %q to be invalid", email)
+		}
+	}
+}
+
+func TestNormalizeEmail(t *testing.T) {
+	for _, email := range []string{"A@x.com", " a@x.com", "a@X.COM\n"} {
+		if got := utils.NormalizeEmail(email); got != "a@x.com" {
+			t.Errorf("NormalizeEmail(%q) = %q, want a@x.com", email, got)
+		}
+	}
+	if email, _ := utils.ValidateEmail(" Jane@Example.com "); email != "jane@example.com" {
+		t.Errorf("Expected ValidateEmail to normalize, got %q", email)
+	}
+}
+
+func TestVerificationToken_NotASession(t *testing.T) {
+	token, err := utils.GenerateVerificationToken("user-id", "jane@example.com")
+	if err != nil {
+		t.Fatalf("GenerateVerificationToken failed: %v", err)
+	}
+	if _, err := utils.ValidateJWT(token); err == nil {
+		t.Error("Expected verification token to be rejected as a session")
+	}
+
+	session := mustJWT(t, "user-id")
+	if _, _, err := utils.ValidateVerificationToken(session); err == nil {
+		t.Error("Expected session token to be rejected as a verification token")
+	}
+}
+
+func TestRegister_InvalidEmail(t *testing.T) {
+	ctx := context.Background()
+	body, _ := json.Marshal(handler.RegisterRequest{Email: "not-an-email", Password: "correct-horse-battery"})
+
+	resp, _ := handler.Register(ctx, events.APIGatewayProxyRequest{Body: string(body)})
+	assert.Equal(t, 400, resp.StatusCode)
+}
+
+func TestRegister_SendsVerificationEmail(t *testing.T) {
+	ctx := context.Background()
+	body, _ := json.Marshal(handler.RegisterRequest{Email: "jane@example.com", Password: "correct-horse-battery"})
+
+	var created db.User
+	monkey.Patch(db.CreateUser, func(ctx context.Context, user db.User) error {
+		created = user
+		return nil
+	})
+	defer monkey.Unpatch(db.CreateUser)
+
+	path := filepath.Join(t.TempDir(), "mail.log")
+	previous := handler.Mailer
+	handler.Mailer = mail.NewFileMailer(path)
+	defer func() { handler.Mailer = previous }()
+
+	resp, _ := handler.Register(ctx, events.APIGatewayProxyRequest{Body: string(body)})
+	assert.Equal(t, 201, resp.StatusCode)
+	assert.False(t, created.Verified)
+
+	sent, err := os.ReadFile(path)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Contains(t, string(sent), "To: jane@example.com")
+
+	// Follow the link from the email
+	_, link, _ := strings.Cut(string(sent), "/verify?")
+	query, _ := url.ParseQuery(strings.TrimSpace(link))
+
+	var verified []string
+	monkey.Patch(db.MarkUserVerified, func(ctx context.Context, id, email string) error {
+		verified = []string{id, email}
+		return nil
+	})
+	defer monkey.Unpatch(db.MarkUserVerified)
+
+	resp, _ = handler.Verify(ctx, events.APIGatewayProxyRequest{
+		QueryStringParameters: map[string]string{"token": query.Get("token")},
+	})
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, []string{created.ID, "jane@example.com"}, verified)
+}
+
+func TestVerify_InvalidToken(t *testing.T) {
+	ctx := context.Background()
+
+	for _, token := range []string{"", "garbage", mustJWT(t, "user-id")} {
+		resp, _ := handler.Verify(ctx, events.APIGatewayProxyRequest{
+			QueryStringParameters: map[string]string{"token": token},
+		})
+		assert.Equal(t, 400, resp.StatusCode)
+	}
+}
+
+func TestVerify_EmailChanged(t *testing.T) {
+	ctx := context.Background()
+	token, _ := utils.GenerateVerificationToken("user-id", "old@example.com")
+
+	monkey.Patch(db.MarkUserVerified, func(ctx context.Context, id, email string) error {
+		return db.ErrUserNotFound
+	})
+	defer monkey.Unpatch(db.MarkUserVerified)
+
+	resp, _ := handler.Verify(ctx, events.APIGatewayProxyRequest{
+		QueryStringParameters: map[string]string{"token": token},
+	})
+	assert.Equal(t, 400, resp.StatusCode)
+}
+
+func TestShorten_RequiresVerifiedEmail(t *testing.T) {
+	ctx := context.Background()
+	handler.RequireVerifiedEmail = true
+	defer func() { handler.RequireVerifiedEmail = false }()
+
+	verified := false
+	monkey.Patch(db.GetUser, func(ctx context.Context, id string) (*db.User, error) {
+		return &db.User{ID: id, Verified: verified}, nil
+	})
+	defer monkey.Unpatch(db.GetUser)
+	monkey.Patch(db.CreateURL, func(ctx context.Context, url *db.URL) error {
+		return nil
+	})
+	defer monkey.Unpatch(db.CreateURL)
+
+	request := events.APIGatewayProxyRequest{
+		Headers: authHeaders(t, "user-id"),
+		Body:    `{"original_url": "https://example.com"}`,
+	}
+	resp, _ := authed(handler.Shorten)(ctx, request)
+	assert.Equal(t, 403, resp.StatusCode)
+
+	verified = true
+	resp, _ = authed(handler.Shorten)(ctx, request)
+	assert.Equal(t, 200, resp.StatusCode)
+}
+
+func TestShorten_AnonymousRequiresVerifiedEmail(t *testing.T) {
+	ctx := context.Background()
+	handler.RequireVerifiedEmail = true
+	defer func() { handler.RequireVerifiedEmail = false }()
+
+	monkey.Patch(db.CreateURL, func(ctx context.Context, url *db.URL) error {
+		t.Fatal("anonymous link created")
+		return nil
+	})
+	defer monkey.Unpatch(db.CreateURL)
+
+	resp, _ := handler.Shorten(ctx, events.APIGatewayProxyRequest{Body: `{"original_url": "https://example.com"}`})
+	assert.Equal(t, 401, resp.StatusCode)
+}
+
+func TestResendVerification(t *testing.T) {
+	ctx := context.Background()
+	patchSessions(t)
+	mailer := captureMail(t)
+
+	verified := false
+	monkey.Patch(db.GetUser, func(ctx context.Context, id string) (*db.User, error) {
+		return &db.User{ID: id, Email: "jane@example.com", Verified: verified}, nil
+	})
+	defer monkey.Unpatch(db.GetUser)
+
+	request := events.APIGatewayProxyRequest{HTTPMethod: "POST", Headers: authHeaders(t, "user-id")}
+	resp, _ := authed(handler.ResendVerification)(ctx, request)
+	assert.Equal(t, 202, resp.StatusCode)
+	if assert.Len(t, mailer.sent, 1) {
+		assert.Equal(t, "jane@example.com", mailer.sent[0].To)
+		assert.Contains(t, mailer.sent[0].Body, "/verify?token=")
+	}
+
+	verified = true
+	resp, _ = authed(handler.ResendVerification)(ctx, request)
+	assert.Equal(t, 409, resp.StatusCode)
+	assert.Len(t, mailer.sent, 1)
+
+	resp, _ = handler.ResendVerification(ctx, events.APIGatewayProxyRequest{HTTPMethod: "POST"})
+	assert.Equal(t, 401, resp.StatusCode)
+}
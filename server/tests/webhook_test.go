@@ -0,0 +1,430 @@
+package tests
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+
+	"bou.ke/monkey"
+	"github.com/SunPodder/shorty/internal/db"
+	"github.com/SunPodder/shorty/internal/handler"
+	"github.com/SunPodder/shorty/internal/webhook"
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/stretchr/testify/assert"
+)
+
+// Dispatcher recording the events it was asked to send
+type fakeDispatcher struct {
+	mu     sync.Mutex
+	users  []string
+	events []webhook.Event
+}
+
+func (d *fakeDispatcher) Dispatch(ctx context.Context, userID string, event webhook.Event) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.users = append(d.users, userID)
+	d.events = append(d.events, event)
+	return nil
+}
+
+// Replaces handler.WebhookDispatcher with a fake for the duration of the test
+func captureWebhooks(t *testing.T) *fakeDispatcher {
+	dispatcher := &fakeDispatcher{}
+	previous := handler.WebhookDispatcher
+	handler.WebhookDispatcher = dispatcher
+	t.Cleanup(func() { handler.WebhookDispatcher = previous })
+	return dispatcher
+}
+
+// Local HTTP receiver answering with status and recording the requests
+// it got along with their bodies. handler.WebhookSender is replaced with
+// one allowed to reach it, as the real one refuses loopback addresses.
+type receiver struct {
+	*httptest.Server
+	mu       sync.Mutex
+	status   int
+	requests []*http.Request
+	bodies   []string
+}
+
+func newReceiver(t *testing.T, status int) *receiver {
+	r := &receiver{status: status}
+	r.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		r.mu.Lock()
+		r.requests = append(r.requests, req)
+		r.bodies = append(r.bodies, string(body))
+		status := r.status
+		r.mu.Unlock()
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(r.Close)
+
+	previous := handler.WebhookSender
+	handler.WebhookSender = &webhook.Sender{Client: r.Client()}
+	t.Cleanup(func() { handler.WebhookSender = previous })
+	return r
+}
+
+// Stores deliveries in memory in place of the deliveries table
+func patchDeliveries(t *testing.T) map[string]db.WebhookDelivery {
+	stored := map[string]db.WebhookDelivery{}
+	var mu sync.Mutex
+	patchPut := monkey.Patch(db.PutWebhookDelivery, func(ctx context.Context, delivery db.WebhookDelivery) error {
+		mu.Lock()
+		defer mu.Unlock()
+		stored[delivery.ID] = delivery
+		return nil
+	})
+	t.Cleanup(patchPut.Unpatch)
+	return stored
+}
+
+func webhookRequest(t *testing.T, method, resource, body string) events.APIGatewayProxyRequest {
+	request := accountRequest(t, method, resource, body)
+	request.PathParameters = map[string]string{"webhook_id": "hook-1"}
+	return request
+}
+
+func TestWebhookSignature(t *testing.T) {
+	body := []byte(`{"type": "ping"}`)
+	now := time.Unix(1700000000, 0)
+	header := webhook.Sign("secret", now.Unix(), body)
+
+	assert.NoError(t, webhook.Verify("secret", header, body, 5*time.Minute, now))
+	assert.ErrorIs(t, webhook.Verify("other", header, body, 5*time.Minute, now), webhook.ErrInvalidSignature)
+	assert.ErrorIs(t, webhook.Verify("secret", header, []byte(`{}`), 5*time.Minute, now), webhook.ErrInvalidSignature)
+	assert.ErrorIs(t, webhook.Verify("secret", header, body, 5*time.Minute, now.Add(time.Hour)), webhook.ErrInvalidSignature)
+	assert.ErrorIs(t, webhook.Verify("secret", "v1=abc", body, 5*time.Minute, now), webhook.ErrInvalidSignature)
+}
+
+func TestWebhookBackoff(t *testing.T) {
+	assert.Equal(t, 30*time.Second, webhook.Backoff(1))
+	assert.Equal(t, time.Minute, webhook.Backoff(2))
+	assert.Equal(t, 4*time.Minute, webhook.Backoff(4))
+	assert.Equal(t, 6*time.Hour, webhook.Backoff(20))
+}
+
+func TestWebhookSender_SignsAndRetries(t *testing.T) {
+	ctx := context.Background()
+	local := newReceiver(t, 200)
+	hook := &db.Webhook{ID: "hook-1", UserID: "user-id", URL: local.URL, Secret: "secret"}
+	now := time.Now()
+
+	delivery, err := webhook.NewDelivery(hook, webhook.NewEvent(webhook.EventLinkCreated, webhook.LinkData{ShortCode: "abc123"}), now)
+	assert.NoError(t, err)
+	handler.WebhookSender.Attempt(ctx, hook, &delivery, now)
+
+	assert.Equal(t, db.DeliveryStatusDelivered, delivery.Status)
+	assert.Equal(t, 1, delivery.Attempts)
+	assert.Equal(t, 200, delivery.LastStatusCode)
+	if assert.Len(t, local.requests, 1) {
+		req := local.requests[0]
+		assert.Equal(t, webhook.EventLinkCreated, req.Header.Get(webhook.EventHeader))
+		assert.Equal(t, delivery.ID, req.Header.Get(webhook.DeliveryHeader))
+		assert.NoError(t, webhook.Verify("secret", req.Header.Get(webhook.SignatureHeader), []byte(local.bodies[0]), time.Minute, time.Now()))
+		assert.Contains(t, local.bodies[0], `"short_code":"abc123"`)
+	}
+
+	// Failures are retried with a growing delay until they are dead-lettered
+	local.mu.Lock()
+	local.status = 500
+	local.mu.Unlock()
+	delivery.Status, delivery.Attempts = db.DeliveryStatusPending, 0
+	handler.WebhookSender.Attempt(ctx, hook, &delivery, now)
+	assert.Equal(t, db.DeliveryStatusPending, delivery.Status)
+	assert.Equal(t, 500, delivery.LastStatusCode)
+	assert.Equal(t, now.Add(30*time.Second).Unix(), delivery.NextAttemptAt)
+
+	for delivery.Status == db.DeliveryStatusPending {
+		handler.WebhookSender.Attempt(ctx, hook, &delivery, now)
+	}
+	assert.Equal(t, db.DeliveryStatusDead, delivery.Status)
+	assert.Equal(t, webhook.MaxAttempts, delivery.Attempts)
+	assert.Zero(t, delivery.NextAttemptAt)
+}
+
+func TestWebhookSender_RefusesInternalAddresses(t *testing.T) {
+	ctx := context.Background()
+	local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		t.Error("Expected the loopback receiver not to be reached")
+	}))
+	defer local.Close()
+
+	hook := &db.Webhook{ID: "hook-1", UserID: "user-id", URL: local.URL, Secret: "secret"}
+	now := time.Now()
+	delivery, _ := webhook.NewDelivery(hook, webhook.NewEvent(webhook.EventPing, nil), now)
+	webhook.NewSender().Attempt(ctx, hook, &delivery, now)
+
+	assert.Equal(t, db.DeliveryStatusPending, delivery.Status)
+	assert.Zero(t, delivery.LastStatusCode)
+	// The connection error isn't shown, it would tell which ports are open
+	assert.Equal(t, "could not connect to the receiver", delivery.LastError)
+
+	for addr, public := range map[string]bool{
+		"93.184.216.34":    true,
+		"2606:4700::1111":  true,
+		"127.0.0.1":        false,
+		"10.0.0.1":         false,
+		"172.16.5.4":       false,
+		"192.168.1.1":      false,
+		"169.254.169.254":  false,
+		"100.64.0.1":       false,
+		"0.0.0.0":          false,
+		"::1":              false,
+		"fd00:ec2::254":    false,
+		"fe80::1":          false,
+		"::ffff:127.0.0.1": false,
+	} {
+		assert.Equal(t, public, webhook.PublicAddr(netip.MustParseAddr(addr)), addr)
+	}
+}
+
+func TestWebhookSender_AllowPrivateReceivers(t *testing.T) {
+	ctx := context.Background()
+	webhook.AllowPrivateReceivers = true
+	defer func() { webhook.AllowPrivateReceivers = false }()
+
+	var received int
+	local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		received++
+	}))
+	defer local.Close()
+
+	hook := &db.Webhook{ID: "hook-1", UserID: "user-id", URL: local.URL, Secret: "secret"}
+	now := time.Now()
+	delivery, _ := webhook.NewDelivery(hook, webhook.NewEvent(webhook.EventPing, nil), now)
+	webhook.NewSender().Attempt(ctx, hook, &delivery, now)
+
+	assert.Equal(t, db.DeliveryStatusDelivered, delivery.Status)
+	assert.Equal(t, 1, received)
+}
+
+func TestCreateWebhook(t *testing.T) {
+	ctx := context.Background()
+	patchSessions(t)
+	captureAudit(t)
+
+	patchList := monkey.Patch(db.ListUserWebhooks, func(ctx context.Context, userID string) ([]db.Webhook, error) {
+		return nil, nil
+	})
+	defer patchList.Unpatch()
+
+	var created db.Webhook
+	patchCreate := monkey.Patch(db.CreateWebhook, func(ctx context.Context, hook db.Webhook) error {
+		created = hook
+		return nil
+	})
+	defer patchCreate.Unpatch()
+
+	for _, body := range []string{
+		`{"url": "ftp://example.com", "events": ["link.created"]}`,
+		`{"url": "http://example.com/hook", "events": ["link.created"]}`,
+		`{"url": "https://localhost:8080/hook", "events": ["link.created"]}`,
+		`{"url": "https://127.0.0.1:9001/2018-06-01/runtime", "events": ["link.created"]}`,
+		`{"url": "https://[fd00:ec2::254]/latest", "events": ["link.created"]}`,
+		`{"url": "https://example.com/hook", "events": []}`,
+		`{"url": "https://example.com/hook", "events": ["link.exploded"]}`,
+	} {
+		resp, _ := authed(handler.Webhooks)(ctx, accountRequest(t, "POST", "/webhooks", body))
+		assert.Equal(t, 400, resp.StatusCode, body)
+	}
+
+	resp, _ := authed(handler.Webhooks)(ctx, accountRequest(t, "POST", "/webhooks", `{"url": "https://example.com/hook", "events": ["link.clicked"]}`))
+	assert.Equal(t, 201, resp.StatusCode)
+
+	var body handler.CreateWebhookResponse
+	assert.NoError(t, json.Unmarshal([]byte(resp.Body), &body))
+	assert.Equal(t, "user-id", created.UserID)
+	assert.NotEmpty(t, body.Secret)
+	assert.Equal(t, created.Secret, body.Secret)
+
+	// The secret isn't part of the webhook when it's listed later
+	listed, _ := json.Marshal(created)
+	assert.NotContains(t, string(listed), created.Secret)
+
+	// Local receivers only with the development setting
+	webhook.AllowPrivateReceivers = true
+	defer func() { webhook.AllowPrivateReceivers = false }()
+	resp, _ = authed(handler.Webhooks)(ctx, accountRequest(t, "POST", "/webhooks", `{"url": "http://localhost:8080/hook", "events": ["link.clicked"]}`))
+	assert.Equal(t, 201, resp.StatusCode)
+	resp, _ = authed(handler.Webhooks)(ctx, accountRequest(t, "POST", "/webhooks", `{"url": "ftp://localhost/hook", "events": ["link.clicked"]}`))
+	assert.Equal(t, 400, resp.StatusCode)
+}
+
+func TestQueueDispatcher_OnlySubscribedWebhooks(t *testing.T) {
+	ctx := context.Background()
+	stored := patchDeliveries(t)
+
+	patchList := monkey.Patch(db.ListUserWebhooks, func(ctx context.Context, userID string) ([]db.Webhook, error) {
+		return []db.Webhook{
+			{ID: "hook-1", UserID: userID, Events: []string{webhook.EventLinkClicked}},
+			{ID: "hook-2", UserID: userID, Events: []string{webhook.EventLinkDeleted}},
+		}, nil
+	})
+	defer patchList.Unpatch()
+
+	err := webhook.NewQueueDispatcher().Dispatch(ctx, "user-id", webhook.NewEvent(webhook.EventLinkClicked, nil))
+	assert.NoError(t, err)
+	if assert.Len(t, stored, 1) {
+		for _, delivery := range stored {
+			assert.Equal(t, "hook-1", delivery.WebhookID)
+			assert.Equal(t, db.DeliveryStatusPending, delivery.Status)
+			assert.NotZero(t, delivery.NextAttemptAt)
+		}
+	}
+}
+
+func TestQueueDispatcher_CachesSubscriptions(t *testing.T) {
+	ctx := context.Background()
+	stored := patchDeliveries(t)
+
+	reads := map[string]int{}
+	patchList := monkey.Patch(db.ListUserWebhooks, func(ctx context.Context, userID string) ([]db.Webhook, error) {
+		reads[userID]++
+		if userID == "user-id" {
+			return []db.Webhook{{ID: "hook-1", UserID: userID, Events: []string{webhook.EventLinkClicked}}}, nil
+		}
+		return nil, nil
+	})
+	defer patchList.Unpatch()
+
+	dispatcher := webhook.NewQueueDispatcher()
+	for i := 0; i < 3; i++ {
+		assert.NoError(t, dispatcher.Dispatch(ctx, "user-id", webhook.NewEvent(webhook.EventLinkClicked, nil)))
+		assert.NoError(t, dispatcher.Dispatch(ctx, "no-webhooks", webhook.NewEvent(webhook.EventLinkClicked, nil)))
+	}
+	assert.Equal(t, map[string]int{"user-id": 1, "no-webhooks": 1}, reads)
+	assert.Len(t, stored, 3)
+
+	// Expired entries are read again
+	dispatcher = webhook.NewQueueDispatcher()
+	dispatcher.TTL = 0
+	assert.NoError(t, dispatcher.Dispatch(ctx, "user-id", webhook.NewEvent(webhook.EventLinkClicked, nil)))
+	assert.NoError(t, dispatcher.Dispatch(ctx, "user-id", webhook.NewEvent(webhook.EventLinkClicked, nil)))
+	assert.Equal(t, 3, reads["user-id"])
+}
+
+func TestDeliverWebhooks(t *testing.T) {
+	ctx := context.Background()
+	local := newReceiver(t, 204)
+	stored := patchDeliveries(t)
+
+	hook := &db.Webhook{ID: "hook-1", UserID: "user-id", URL: local.URL, Secret: "secret"}
+	patchGet := monkey.Patch(db.GetWebhook, func(ctx context.Context, id string) (*db.Webhook, error) {
+		if id == hook.ID {
+			return hook, nil
+		}
+		return nil, db.ErrWebhookNotFound
+	})
+	defer patchGet.Unpatch()
+
+	first, _ := webhook.NewDelivery(hook, webhook.NewEvent(webhook.EventLinkCreated, nil), time.Now())
+	orphan, _ := webhook.NewDelivery(&db.Webhook{ID: "deleted"}, webhook.NewEvent(webhook.EventLinkCreated, nil), time.Now())
+	patchDue := monkey.Patch(db.ListDueWebhookDeliveries, func(ctx context.Context, now int64, limit int32) ([]db.WebhookDelivery, error) {
+		return []db.WebhookDelivery{first, orphan}, nil
+	})
+	defer patchDue.Unpatch()
+
+	assert.NoError(t, handler.DeliverWebhooks(ctx))
+	assert.Len(t, local.requests, 1)
+	assert.Equal(t, db.DeliveryStatusDelivered, stored[first.ID].Status)
+	assert.Equal(t, db.DeliveryStatusDead, stored[orphan.ID].Status)
+}
+
+func TestRedeliverWebhook(t *testing.T) {
+	ctx := context.Background()
+	patchSessions(t)
+	stored := patchDeliveries(t)
+
+	patchGet := monkey.Patch(db.GetWebhook, func(ctx context.Context, id string) (*db.Webhook, error) {
+		return &db.Webhook{ID: id, UserID: "user-id"}, nil
+	})
+	defer patchGet.Unpatch()
+
+	dead := db.WebhookDelivery{ID: "delivery-1", WebhookID: "hook-1", Status: db.DeliveryStatusDead, Attempts: webhook.MaxAttempts}
+	patchGetDelivery := monkey.Patch(db.GetWebhookDelivery, func(ctx context.Context, id string) (*db.WebhookDelivery, error) {
+		delivery := dead
+		return &delivery, nil
+	})
+	defer patchGetDelivery.Unpatch()
+
+	request := webhookRequest(t, "POST", "/webhooks/{webhook_id}/deliveries/{delivery_id}/redeliver", "")
+	request.PathParameters["delivery_id"] = "delivery-1"
+	resp, _ := authed(handler.Webhooks)(ctx, request)
+	assert.Equal(t, 202, resp.StatusCode)
+	assert.Equal(t, db.DeliveryStatusPending, stored["delivery-1"].Status)
+	assert.Zero(t, stored["delivery-1"].Attempts)
+
+	// Webhooks of other users can't be touched
+	request.Headers = authHeaders(t, "other-user")
+	resp, _ = authed(handler.Webhooks)(ctx, request)
+	assert.Equal(t, 404, resp.StatusCode)
+}
+
+func TestTestWebhook_PingsLocalReceiver(t *testing.T) {
+	ctx := context.Background()
+	patchSessions(t)
+	local := newReceiver(t, 200)
+	stored := patchDeliveries(t)
+
+	patchGet := monkey.Patch(db.GetWebhook, func(ctx context.Context, id string) (*db.Webhook, error) {
+		return &db.Webhook{ID: id, UserID: "user-id", URL: local.URL, Secret: "secret"}, nil
+	})
+	defer patchGet.Unpatch()
+
+	resp, _ := authed(handler.Webhooks)(ctx, webhookRequest(t, "POST", "/webhooks/{webhook_id}/test", ""))
+	assert.Equal(t, 200, resp.StatusCode)
+	if assert.Len(t, local.requests, 1) {
+		assert.Equal(t, webhook.EventPing, local.requests[0].Header.Get(webhook.EventHeader))
+	}
+	assert.Len(t, stored, 1)
+}
+
+func TestLinkEvents_Dispatched(t *testing.T) {
+	ctx := context.Background()
+	dispatcher := captureWebhooks(t)
+
+	owner := "user-id"
+	patchGetURL := monkey.Patch(db.GetURL, func(context.Context, string, string) (*db.URL, error) {
+		return &db.URL{ShortCode: "abc123", OriginalURL: "https://example.com", UserID: &owner, Clicks: 41}, nil
+	})
+	defer patchGetURL.Unpatch()
+	patchClicks := monkey.Patch(db.IncrementClicks, func(context.Context, string, string) error { return nil })
+	defer patchClicks.Unpatch()
+
+	resp, _ := handler.Resolve(ctx, events.APIGatewayProxyRequest{PathParameters: map[string]string{"short_code": "abc123"}})
+	assert.Equal(t, 302, resp.StatusCode)
+	if assert.Len(t, dispatcher.events, 1) {
+		assert.Equal(t, "user-id", dispatcher.users[0])
+		assert.Equal(t, webhook.EventLinkClicked, dispatcher.events[0].Type)
+		data := dispatcher.events[0].Data.(webhook.LinkData)
+		assert.Equal(t, int64(42), data.Clicks)
+		assert.Equal(t, 1.0, data.SampleRate)
+	}
+
+	// Expired links are notified once and marked
+	var marked []string
+	patchExpired := monkey.Patch(db.ForEachExpiredURL, func(ctx context.Context, now int64, fn func([]db.URL) error) error {
+		return fn([]db.URL{{ShortCode: "old", UserID: &owner}, {ShortCode: "anonymous"}})
+	})
+	defer patchExpired.Unpatch()
+	patchMark := monkey.Patch(db.MarkURLExpiryNotified, func(ctx context.Context, domain, shortCode, at string) error {
+		marked = append(marked, shortCode)
+		return nil
+	})
+	defer patchMark.Unpatch()
+
+	assert.NoError(t, handler.RunWebhookJob(ctx, handler.WebhookJob{Job: handler.WebhookJobExpire}))
+	assert.Equal(t, []string{"old", "anonymous"}, marked)
+	if assert.Len(t, dispatcher.events, 2) {
+		assert.Equal(t, webhook.EventLinkExpired, dispatcher.events[1].Type)
+	}
+}
@@ -0,0 +1,284 @@
+package tests
+
+import (
+	"context"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"bou.ke/monkey"
+	"github.com/SunPodder/shorty/internal/db"
+	"github.com/SunPodder/shorty/internal/handler"
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/stretchr/testify/assert"
+)
+
+func patchMembers(members map[string]string) *monkey.PatchGuard {
+	return monkey.Patch(db.GetWorkspaceMember, func(_ context.Context, workspaceID, userID string) (*db.WorkspaceMember, error) {
+		role, ok := members[userID]
+		if !ok {
+			return nil, db.ErrMemberNotFound
+		}
+		return &db.WorkspaceMember{WorkspaceID: workspaceID, UserID: userID, Role: role}, nil
+	})
+}
+
+func TestCreateWorkspace_Success(t *testing.T) {
+	ctx := context.Background()
+	patchSessions(t)
+	request := events.APIGatewayProxyRequest{
+		HTTPMethod: "POST",
+		Resource:   "/workspaces",
+		Headers:    authHeaders(t, "user-id"),
+		Body:       `{"name": "Marketing"}`,
+	}
+
+	var owner db.WorkspaceMember
+	patchCreate := monkey.Patch(db.CreateWorkspace, func(_ context.Context, _ db.Workspace, member db.WorkspaceMember) error {
+		owner = member
+		return nil
+	})
+	defer patchCreate.Unpatch()
+
+	resp, err := authed(handler.Workspaces)(ctx, request)
+	assert.NoError(t, err)
+	assert.Equal(t, 201, resp.StatusCode)
+	assert.Equal(t, "user-id", owner.UserID)
+	assert.Equal(t, db.RoleOwner, owner.Role)
+}
+
+func TestPutWorkspaceMember_RequiresOwner(t *testing.T) {
+	ctx := context.Background()
+	patchSessions(t)
+	request := events.APIGatewayProxyRequest{
+		HTTPMethod:     "POST",
+		Resource:       "/workspaces/{workspace_id}/members",
+		Headers:        authHeaders(t, "editor-id"),
+		PathParameters: map[string]string{"workspace_id": "ws-1"},
+		Body:           `{"user_id": "new-user", "role": "editor"}`,
+	}
+
+	patch := patchMembers(map[string]string{"editor-id": db.RoleEditor})
+	defer patch.Unpatch()
+
+	resp, _ := authed(handler.Workspaces)(ctx, request)
+	assert.Equal(t, 403, resp.StatusCode)
+}
+
+func TestPutWorkspaceMember_ChangesRole(t *testing.T) {
+	ctx := context.Background()
+	patchSessions(t)
+	request := events.APIGatewayProxyRequest{
+		HTTPMethod:     "POST",
+		Resource:       "/workspaces/{workspace_id}/members",
+		Headers:        authHeaders(t, "owner-id"),
+		PathParameters: map[string]string{"workspace_id": "ws-1"},
+		Body:           `{"user_id": "member-id", "role": "viewer"}`,
+	}
+
+	patch := patchMembers(map[string]string{"owner-id": db.RoleOwner, "member-id": db.RoleEditor})
+	defer patch.Unpatch()
+	patchUser := monkey.Patch(db.GetUser, func(_ context.Context, id string) (*db.User, error) {
+		return &db.User{ID: id, Email: "member@example.com"}, nil
+	})
+	defer patchUser.Unpatch()
+
+	patchList := monkey.Patch(db.ListWorkspaceMembers, func(context.Context, string) ([]db.WorkspaceMember, error) {
+		return []db.WorkspaceMember{{UserID: "owner-id", Role: db.RoleOwner}, {UserID: "member-id", Role: db.RoleEditor}}, nil
+	})
+	defer patchList.Unpatch()
+
+	var updated db.WorkspaceMember
+	patchPut := monkey.Patch(db.PutWorkspaceMember, func(_ context.Context, member db.WorkspaceMember) error {
+		updated = member
+		return nil
+	})
+	defer patchPut.Unpatch()
+
+	resp, err := authed(handler.Workspaces)(ctx, request)
+	assert.NoError(t, err)
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, "member-id", updated.UserID)
+	assert.Equal(t, db.RoleViewer, updated.Role)
+}
+
+// Stores workspace invitations in memory, accepting them like the
+// conditional transaction does
+func patchInvites(t *testing.T) (map[string]db.WorkspaceInvite, *[]db.WorkspaceMember) {
+	invites := map[string]db.WorkspaceInvite{}
+	var joined []db.WorkspaceMember
+	patchPut := monkey.Patch(db.PutWorkspaceInvite, func(_ context.Context, invite db.WorkspaceInvite) error {
+		invites[invite.WorkspaceID+"/"+invite.UserID] = invite
+		return nil
+	})
+	patchGet := monkey.Patch(db.GetWorkspaceInvite, func(_ context.Context, workspaceID, userID string) (*db.WorkspaceInvite, error) {
+		invite, ok := invites[workspaceID+"/"+userID]
+		if !ok || invite.ExpiresAt <= time.Now().Unix() {
+			return nil, db.ErrInviteNotFound
+		}
+		return &invite, nil
+	})
+	patchAccept := monkey.Patch(db.AcceptWorkspaceInvite, func(_ context.Context, tokenHash string, member db.WorkspaceMember) error {
+		key := member.WorkspaceID + "/" + member.UserID
+		if invite, ok := invites[key]; !ok || invite.TokenHash != tokenHash {
+			return db.ErrInviteNotFound
+		}
+		delete(invites, key)
+		joined = append(joined, member)
+		return nil
+	})
+	t.Cleanup(func() {
+		patchPut.Unpatch()
+		patchGet.Unpatch()
+		patchAccept.Unpatch()
+	})
+	return invites, &joined
+}
+
+func TestPutWorkspaceMember_InvitesByEmail(t *testing.T) {
+	ctx := context.Background()
+	patchSessions(t)
+	mailer := captureMail(t)
+	invites, joined := patchInvites(t)
+
+	owners := map[string]string{"owner-id": db.RoleOwner}
+	patch := patchMembers(owners)
+	defer patch.Unpatch()
+	patchWorkspace := monkey.Patch(db.GetWorkspace, func(_ context.Context, id string) (*db.Workspace, error) {
+		return &db.Workspace{ID: id, Name: "Marketing"}, nil
+	})
+	defer patchWorkspace.Unpatch()
+	patchByEmail := monkey.Patch(db.GetUserByEmail, func(_ context.Context, email string) (*db.User, error) {
+		if email == "jane@example.com" {
+			return &db.User{ID: "jane-id", Email: email}, nil
+		}
+		return nil, db.ErrUserNotFound
+	})
+	defer patchByEmail.Unpatch()
+	patchPut := monkey.Patch(db.PutWorkspaceMember, func(context.Context, db.WorkspaceMember) error {
+		t.Error("Expected nobody to be added without accepting")
+		return nil
+	})
+	defer patchPut.Unpatch()
+
+	invite := func(body string) events.APIGatewayProxyResponse {
+		resp, _ := authed(handler.Workspaces)(ctx, events.APIGatewayProxyRequest{
+			HTTPMethod:     "POST",
+			Resource:       "/workspaces/{workspace_id}/members",
+			Headers:        authHeaders(t, "owner-id"),
+			PathParameters: map[string]string{"workspace_id": "ws-1"},
+			Body:           body,
+		})
+		return resp
+	}
+
+	// Registered and unknown emails get the same answer
+	registered := invite(`{"email": "jane@example.com", "role": "editor"}`)
+	unknown := invite(`{"email": "nobody@example.com", "role": "editor"}`)
+	assert.Equal(t, 202, registered.StatusCode)
+	assert.Equal(t, registered, unknown)
+	assert.Len(t, invites, 1)
+	if !assert.Len(t, mailer.sent, 1) {
+		return
+	}
+	assert.Equal(t, "jane@example.com", mailer.sent[0].To)
+	assert.Contains(t, mailer.sent[0].Body, `"Marketing"`)
+
+	_, link, _ := strings.Cut(mailer.sent[0].Body, "/workspaces/invitation?")
+	query, _ := url.ParseQuery(strings.TrimSpace(strings.SplitN(link, "\n", 2)[0]))
+	token := query.Get("token")
+
+	accept := func(token string) events.APIGatewayProxyResponse {
+		resp, _ := handler.Workspaces(ctx, events.APIGatewayProxyRequest{
+			HTTPMethod: "POST",
+			Resource:   "/workspaces/invitation",
+			Body:       `{"token": "` + token + `"}`,
+		})
+		return resp
+	}
+
+	// The emailed link opens a page confirming by POST
+	page, _ := handler.Workspaces(ctx, events.APIGatewayProxyRequest{
+		HTTPMethod:            "GET",
+		Resource:              "/workspaces/invitation",
+		QueryStringParameters: map[string]string{"token": token},
+	})
+	assert.Equal(t, 200, page.StatusCode)
+	assert.Contains(t, page.Body, `method="post"`)
+
+	assert.Equal(t, 400, accept(token+"x").StatusCode)
+	assert.Equal(t, 200, accept(token).StatusCode)
+	if assert.Len(t, *joined, 1) {
+		assert.Equal(t, "jane-id", (*joined)[0].UserID)
+		assert.Equal(t, db.RoleEditor, (*joined)[0].Role)
+	}
+	// Invitations can only be used once
+	assert.Equal(t, 400, accept(token).StatusCode)
+
+	// Invitations of owners who have since left are void
+	invite(`{"email": "jane@example.com", "role": "viewer"}`)
+	_, link, _ = strings.Cut(mailer.sent[1].Body, "/workspaces/invitation?")
+	query, _ = url.ParseQuery(strings.TrimSpace(strings.SplitN(link, "\n", 2)[0]))
+	delete(owners, "owner-id")
+	assert.Equal(t, 400, accept(query.Get("token")).StatusCode)
+	assert.Len(t, *joined, 1)
+}
+
+func TestPutWorkspaceMember_UnknownUserID(t *testing.T) {
+	ctx := context.Background()
+	patchSessions(t)
+	patchInvites(t)
+
+	patch := patchMembers(map[string]string{"owner-id": db.RoleOwner})
+	defer patch.Unpatch()
+	patchUser := monkey.Patch(db.GetUser, func(_ context.Context, id string) (*db.User, error) {
+		if id == "missing" {
+			return nil, db.ErrUserNotFound
+		}
+		return &db.User{ID: id}, nil
+	})
+	defer patchUser.Unpatch()
+
+	resp, _ := authed(handler.Workspaces)(ctx, events.APIGatewayProxyRequest{
+		HTTPMethod:     "POST",
+		Resource:       "/workspaces/{workspace_id}/members",
+		Headers:        authHeaders(t, "owner-id"),
+		PathParameters: map[string]string{"workspace_id": "ws-1"},
+		Body:           `{"user_id": "missing", "role": "viewer"}`,
+	})
+	assert.Equal(t, 404, resp.StatusCode)
+}
+
+func TestRemoveWorkspaceMember_LastOwner(t *testing.T) {
+	ctx := context.Background()
+	patchSessions(t)
+	request := events.APIGatewayProxyRequest{
+		HTTPMethod:     "DELETE",
+		Resource:       "/workspaces/{workspace_id}/members/{user_id}",
+		Headers:        authHeaders(t, "owner-id"),
+		PathParameters: map[string]string{"workspace_id": "ws-1", "user_id": "owner-id"},
+	}
+
+	patchList := monkey.Patch(db.ListWorkspaceMembers, func(context.Context, string) ([]db.WorkspaceMember, error) {
+		return []db.WorkspaceMember{{UserID: "owner-id", Role: db.RoleOwner}, {UserID: "viewer-id", Role: db.RoleViewer}}, nil
+	})
+	defer patchList.Unpatch()
+
+	resp, _ := authed(handler.Workspaces)(ctx, request)
+	assert.Equal(t, 409, resp.StatusCode)
+}
+
+func TestShorten_WorkspaceViewerForbidden(t *testing.T) {
+	ctx := context.Background()
+	patchSessions(t)
+	request := events.APIGatewayProxyRequest{
+		Body: `{"original_url": "https://example.com", "workspace_id": "ws-1", "token": "` + mustJWT(t, "viewer-id") + `"}`,
+	}
+
+	patch := patchMembers(map[string]string{"viewer-id": db.RoleViewer})
+	defer patch.Unpatch()
+
+	resp, _ := handler.Shorten(ctx, request)
+	assert.Equal(t, 403, resp.StatusCode)
+}
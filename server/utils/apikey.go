@@ -0,0 +1,48 @@
+package utils
+
+import "strings"
+
+// Prefix of every API key, which makes keys easy to recognise in configs and logs
+const APIKeyPrefix = "shorty_"
+
+// GenerateAPIKey returns a new API key along with its ID.
+// Keys look like shorty_<id>_<secret>, the ID part is stored in clear
+// to look the key up and the whole key is only stored hashed.
+func GenerateAPIKey() (id string, key string, err error) {
+	id, err = RandomToken(4)
+	if err != nil {
+		return "", "", err
+	}
+	secret, err := RandomToken(24)
+	if err != nil {
+		return "", "", err
+	}
+	return id, APIKeyPrefix + id + "_" + secret, nil
+}
+
+// IsAPIKey reports whether token looks like an API key rather than a JWT
+func IsAPIKey(token string) bool {
+	return strings.HasPrefix(token, APIKeyPrefix)
+}
+
+// ParseAPIKey extracts the ID of an API key
+func ParseAPIKey(key string) (string, bool) {
+	if !IsAPIKey(key) {
+		return "", false
+	}
+	id, secret, ok := strings.Cut(strings.TrimPrefix(key, APIKeyPrefix), "_")
+	if !ok || id == "" || secret == "" {
+		return "", false
+	}
+	return id, true
+}
+
+// HashAPIKey returns the hash of an API key as stored in the database
+func HashAPIKey(key string) string {
+	return HashToken(key)
+}
+
+// CheckAPIKeyHash reports whether key matches the stored hash
+func CheckAPIKeyHash(key, hash string) bool {
+	return CheckTokenHash(key, hash)
+}
@@ -0,0 +1,18 @@
+package utils
+
+import "strings"
+
+// GetHeader looks up a header by name regardless of its casing.
+// API Gateway passes headers through as sent by the client, so the
+// same header can arrive as "Authorization" or "authorization".
+func GetHeader(headers map[string]string, name string) (string, bool) {
+	if value, ok := headers[name]; ok {
+		return value, true
+	}
+	for key, value := range headers {
+		if strings.EqualFold(key, name) {
+			return value, true
+		}
+	}
+	return "", false
+}
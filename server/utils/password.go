@@ -0,0 +1,218 @@
+package utils
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/subtle"
+	_ "embed"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// bcrypt ignores everything past 72 bytes, so longer passwords are
+// refused rather than silently truncated while bcrypt hashes remain
+const MaxPasswordBytes = 72
+
+var (
+	ErrPasswordTooShort  = errors.New("password is too short")
+	ErrPasswordTooLong   = errors.New("password is too long")
+	ErrPasswordTooCommon = errors.New("password is too common")
+)
+
+// PasswordPolicy describes the passwords users may choose
+type PasswordPolicy struct {
+	// Minimum length in characters
+	MinLength int
+	// Maximum length in bytes, capped at MaxPasswordBytes
+	MaxLength int
+	// Whether passwords from the bundled common password list are refused
+	RejectCommon bool
+}
+
+var DefaultPasswordPolicy = PasswordPolicy{
+	MinLength:    8,
+	MaxLength:    MaxPasswordBytes,
+	RejectCommon: true,
+}
+
+// PasswordPolicyFromEnv returns the default policy with the overrides
+// from PASSWORD_MIN_LENGTH, PASSWORD_MAX_LENGTH and PASSWORD_REJECT_COMMON
+func PasswordPolicyFromEnv() (PasswordPolicy, error) {
+	policy := DefaultPasswordPolicy
+
+	for name, target := range map[string]*int{
+		"PASSWORD_MIN_LENGTH": &policy.MinLength,
+		"PASSWORD_MAX_LENGTH": &policy.MaxLength,
+	} {
+		if value := os.Getenv(name); value != "" {
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 0 {
+				return policy, fmt.Errorf("invalid %s %q: must be a positive number", name, value)
+			}
+			*target = n
+		}
+	}
+	if policy.MaxLength > MaxPasswordBytes {
+		return policy, fmt.Errorf("invalid PASSWORD_MAX_LENGTH %d: must be at most %d", policy.MaxLength, MaxPasswordBytes)
+	}
+
+	if value := os.Getenv("PASSWORD_REJECT_COMMON"); value != "" {
+		reject, err := strconv.ParseBool(value)
+		if err != nil {
+			return policy, fmt.Errorf("invalid PASSWORD_REJECT_COMMON %q: must be true or false", value)
+		}
+		policy.RejectCommon = reject
+	}
+
+	return policy, nil
+}
+
+// Check reports why password doesn't satisfy the policy, if it doesn't
+func (p PasswordPolicy) Check(password string) error {
+	if len([]rune(password)) < p.MinLength {
+		return ErrPasswordTooShort
+	}
+
+	maxLength := p.MaxLength
+	if maxLength <= 0 || maxLength > MaxPasswordBytes {
+		maxLength = MaxPasswordBytes
+	}
+	if len(password) > maxLength {
+		return ErrPasswordTooLong
+	}
+
+	if p.RejectCommon && IsCommonPassword(password) {
+		return ErrPasswordTooCommon
+	}
+	return nil
+}
+
+//go:embed common_passwords.txt
+var commonPasswordList string
+
+var (
+	commonPasswordsOnce sync.Once
+	commonPasswords     map[string]struct{}
+)
+
+// IsCommonPassword reports whether password, ignoring case, is on the
+// bundled list of commonly used passwords
+func IsCommonPassword(password string) bool {
+	commonPasswordsOnce.Do(func() {
+		commonPasswords = make(map[string]struct{})
+		scanner := bufio.NewScanner(strings.NewReader(commonPasswordList))
+		for scanner.Scan() {
+			if line := strings.TrimSpace(scanner.Text()); line != "" && !strings.HasPrefix(line, "#") {
+				commonPasswords[strings.ToLower(line)] = struct{}{}
+			}
+		}
+	})
+
+	_, ok := commonPasswords[strings.ToLower(password)]
+	return ok
+}
+
+// Argon2Params are the argon2id cost parameters of new password hashes
+type Argon2Params struct {
+	// Memory in KiB
+	Memory  uint32
+	Time    uint32
+	Threads uint8
+	SaltLen uint32
+	KeyLen  uint32
+}
+
+// PasswordHashParams are used for new hashes. The defaults follow the
+// OWASP recommendation while fitting in a small Lambda.
+var PasswordHashParams = Argon2Params{
+	Memory:  19 * 1024,
+	Time:    2,
+	Threads: 1,
+	SaltLen: 16,
+	KeyLen:  32,
+}
+
+const argon2idPrefix = "$argon2id$"
+
+var errInvalidHash = errors.New("invalid argon2id hash")
+
+// Returns the argon2id hash of password in the PHC string format
+func hashArgon2id(password string, params Argon2Params) (string, error) {
+	salt := make([]byte, params.SaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+
+	key := argon2.IDKey([]byte(password), salt, params.Time, params.Memory, params.Threads, params.KeyLen)
+	return fmt.Sprintf("%sv=%d$m=%d,t=%d,p=%d$%s$%s", argon2idPrefix, argon2.Version,
+		params.Memory, params.Time, params.Threads,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// Parses an argon2id hash into its parameters, salt and key
+func parseArgon2id(hash string) (Argon2Params, []byte, []byte, error) {
+	var params Argon2Params
+
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return params, nil, nil, errInvalidHash
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return params, nil, nil, errInvalidHash
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.Memory, &params.Time, &params.Threads); err != nil {
+		return params, nil, nil, errInvalidHash
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return params, nil, nil, errInvalidHash
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(key) == 0 {
+		return params, nil, nil, errInvalidHash
+	}
+
+	params.SaltLen = uint32(len(salt))
+	params.KeyLen = uint32(len(key))
+	return params, salt, key, nil
+}
+
+// Reports whether password matches an argon2id hash
+func checkArgon2id(password, hash string) bool {
+	params, salt, key, err := parseArgon2id(hash)
+	if err != nil {
+		return false
+	}
+
+	other := argon2.IDKey([]byte(password), salt, params.Time, params.Memory, params.Threads, params.KeyLen)
+	return subtle.ConstantTimeCompare(key, other) == 1
+}
+
+// NeedsRehash reports whether a valid password hash should be replaced
+// because it uses bcrypt or outdated argon2id parameters
+func NeedsRehash(hash string) bool {
+	if isBcryptHash(hash) {
+		return true
+	}
+
+	params, _, _, err := parseArgon2id(hash)
+	if err != nil {
+		return false
+	}
+	return params != PasswordHashParams
+}
+
+func isBcryptHash(hash string) bool {
+	return strings.HasPrefix(hash, "$2a$") || strings.HasPrefix(hash, "$2b$") || strings.HasPrefix(hash, "$2y$")
+}
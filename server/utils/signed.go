@@ -0,0 +1,141 @@
+package utils
+
+import (
+	"errors"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	// Purpose of the tokens emailed to verify an address
+	PurposeVerifyEmail = "verify_email"
+	// Purpose of the tokens proving the password step of a two-factor login
+	PurposeMFAChallenge = "mfa_challenge"
+	// Purpose of the tokens keeping the state of a single sign-on login
+	PurposeSSOState = "sso_state"
+)
+
+// How long signed tokens are valid. They can be overridden at startup.
+var (
+	VerificationTokenTTL = 48 * time.Hour
+	MFAChallengeTTL      = 5 * time.Minute
+	SSOStateTTL          = 10 * time.Minute
+)
+
+var ErrInvalidSignedToken = errors.New("invalid or expired token")
+
+// GenerateVerificationToken returns a signed token proving that whoever
+// holds it received mail sent to email. The email is part of the token,
+// so changing the address invalidates older tokens.
+func GenerateVerificationToken(userID, email string) (string, error) {
+	claims := jwt.MapClaims{
+		"sub":     userID,
+		"email":   email,
+		"purpose": PurposeVerifyEmail,
+		"exp":     time.Now().Add(VerificationTokenTTL).Unix(),
+		"iat":     time.Now().Unix(),
+	}
+	return signToken(claims)
+}
+
+// ValidateVerificationToken checks a token from GenerateVerificationToken
+// and returns the user and email it was issued for
+func ValidateVerificationToken(tokenString string) (userID, email string, err error) {
+	claims, err := parsePurposeToken(tokenString, PurposeVerifyEmail)
+	if err != nil {
+		return "", "", err
+	}
+
+	userID, _ = claims["sub"].(string)
+	email, _ = claims["email"].(string)
+	if userID == "" || email == "" {
+		return "", "", ErrInvalidSignedToken
+	}
+	return userID, email, nil
+}
+
+// GenerateMFAChallenge returns a short-lived token proving that the user
+// entered the right password, to be exchanged along with a second factor
+// for a session
+func GenerateMFAChallenge(userID string) (string, error) {
+	claims := jwt.MapClaims{
+		"sub":     userID,
+		"purpose": PurposeMFAChallenge,
+		"exp":     time.Now().Add(MFAChallengeTTL).Unix(),
+		"iat":     time.Now().Unix(),
+	}
+	return signToken(claims)
+}
+
+// ValidateMFAChallenge checks a token from GenerateMFAChallenge and
+// returns the user it was issued for
+func ValidateMFAChallenge(tokenString string) (string, error) {
+	claims, err := parsePurposeToken(tokenString, PurposeMFAChallenge)
+	if err != nil {
+		return "", err
+	}
+
+	userID, _ := claims["sub"].(string)
+	if userID == "" {
+		return "", ErrInvalidSignedToken
+	}
+	return userID, nil
+}
+
+// SSOState is what a single sign-on login has to remember between
+// sending the user to the identity provider and the callback
+type SSOState struct {
+	Provider string
+	State    string
+	Nonce    string
+	Verifier string
+}
+
+// GenerateSSOState returns a short-lived signed token holding state.
+// The token isn't encrypted, so it must only travel in an HttpOnly cookie.
+func GenerateSSOState(state SSOState) (string, error) {
+	claims := jwt.MapClaims{
+		"provider": state.Provider,
+		"state":    state.State,
+		"nonce":    state.Nonce,
+		"verifier": state.Verifier,
+		"purpose":  PurposeSSOState,
+		"exp":      time.Now().Add(SSOStateTTL).Unix(),
+		"iat":      time.Now().Unix(),
+	}
+	return signToken(claims)
+}
+
+// ValidateSSOState checks a token from GenerateSSOState and returns
+// the state it holds
+func ValidateSSOState(tokenString string) (SSOState, error) {
+	claims, err := parsePurposeToken(tokenString, PurposeSSOState)
+	if err != nil {
+		return SSOState{}, err
+	}
+
+	var state SSOState
+	state.Provider, _ = claims["provider"].(string)
+	state.State, _ = claims["state"].(string)
+	state.Nonce, _ = claims["nonce"].(string)
+	state.Verifier, _ = claims["verifier"].(string)
+	if state.Provider == "" || state.State == "" || state.Nonce == "" || state.Verifier == "" {
+		return SSOState{}, ErrInvalidSignedToken
+	}
+	return state, nil
+}
+
+// Parses a signed token and checks that it was issued for purpose
+func parsePurposeToken(tokenString, purpose string) (jwt.MapClaims, error) {
+	token, err := jwt.Parse(tokenString, tokenKey)
+	if err != nil || !token.Valid {
+		return nil, ErrInvalidSignedToken
+	}
+
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok || claims["purpose"] != purpose {
+		return nil, ErrInvalidSignedToken
+	}
+	return claims, nil
+}
@@ -0,0 +1,47 @@
+package utils
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+)
+
+// RandomToken returns a hex encoded random token of n bytes
+func RandomToken(n int) (string, error) {
+	buf := make([]byte, n)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// HashToken returns the hash of a random token as stored in the database.
+// Tokens are long random strings, so a fast hash is sufficient.
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// CheckTokenHash reports whether token matches the stored hash
+func CheckTokenHash(token, hash string) bool {
+	return subtle.ConstantTimeCompare([]byte(HashToken(token)), []byte(hash)) == 1
+}
+
+// HashKey keys the hashes of values short enough to guess, so they can't
+// be brute-forced from a copy of the database. It is set at startup.
+var HashKey []byte
+
+// KeyedHash returns the HMAC-SHA256 of value under a key derived from
+// HashKey for purpose, so hashes of one purpose never match another's
+func KeyedHash(purpose, value string) string {
+	if len(HashKey) == 0 {
+		panic("utils: HashKey isn't set")
+	}
+	key := hmac.New(sha256.New, HashKey)
+	key.Write([]byte(purpose))
+	mac := hmac.New(sha256.New, key.Sum(nil))
+	mac.Write([]byte(value))
+	return hex.EncodeToString(mac.Sum(nil))
+}
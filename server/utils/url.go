@@ -0,0 +1,116 @@
+package utils
+
+import (
+	"errors"
+	"net/url"
+	"strings"
+)
+
+const (
+	// Incoming query parameters replace destination parameters with the same key
+	QueryPrecedenceIncoming = "incoming"
+	// Destination query parameters are kept, incoming ones only fill the gaps
+	QueryPrecedenceDestination = "destination"
+)
+
+var (
+	ErrInvalidURL             = errors.New("invalid url")
+	ErrInvalidUTM             = errors.New("utm_source is required when utm parameters are set")
+	ErrInvalidQueryPrecedence = errors.New("invalid query precedence")
+)
+
+// UTMParams holds the campaign parameters appended to a destination URL
+type UTMParams struct {
+	Source   string
+	Medium   string
+	Campaign string
+	Term     string
+	Content  string
+}
+
+func (u UTMParams) isEmpty() bool {
+	return u.Source == "" && u.Medium == "" && u.Campaign == "" && u.Term == "" && u.Content == ""
+}
+
+// ValidateURL parses rawURL and checks that it is an absolute http(s) URL
+func ValidateURL(rawURL string) (*url.URL, error) {
+	parsed, err := url.Parse(strings.TrimSpace(rawURL))
+	if err != nil {
+		return nil, ErrInvalidURL
+	}
+	if parsed.Scheme != "http" && parsed.Scheme != "https" {
+		return nil, ErrInvalidURL
+	}
+	if parsed.Host == "" {
+		return nil, ErrInvalidURL
+	}
+	return parsed, nil
+}
+
+// BuildDestination validates rawURL and sets the given UTM parameters on it,
+// replacing any UTM values already present in the URL
+func BuildDestination(rawURL string, utm UTMParams) (string, error) {
+	parsed, err := ValidateURL(rawURL)
+	if err != nil {
+		return "", err
+	}
+
+	if utm.isEmpty() {
+		return strings.TrimSpace(rawURL), nil
+	}
+	if strings.TrimSpace(utm.Source) == "" {
+		return "", ErrInvalidUTM
+	}
+
+	query := parsed.Query()
+	for key, value := range map[string]string{
+		"utm_source":   utm.Source,
+		"utm_medium":   utm.Medium,
+		"utm_campaign": utm.Campaign,
+		"utm_term":     utm.Term,
+		"utm_content":  utm.Content,
+	} {
+		if value = strings.TrimSpace(value); value != "" {
+			query.Set(key, value)
+		}
+	}
+	parsed.RawQuery = query.Encode()
+
+	return parsed.String(), nil
+}
+
+// ValidQueryPrecedence reports whether precedence is a known precedence mode
+func ValidQueryPrecedence(precedence string) bool {
+	return precedence == QueryPrecedenceIncoming || precedence == QueryPrecedenceDestination
+}
+
+// MergeQuery merges the incoming query parameters into the destination URL.
+// Keys present on both sides are resolved according to precedence, which
+// defaults to QueryPrecedenceDestination when empty.
+func MergeQuery(destination string, incoming url.Values, precedence string) (string, error) {
+	if len(incoming) == 0 {
+		return destination, nil
+	}
+	if precedence == "" {
+		precedence = QueryPrecedenceDestination
+	}
+	if !ValidQueryPrecedence(precedence) {
+		return "", ErrInvalidQueryPrecedence
+	}
+
+	parsed, err := url.Parse(destination)
+	if err != nil {
+		return "", ErrInvalidURL
+	}
+
+	query := parsed.Query()
+	for key, values := range incoming {
+		if _, exists := query[key]; exists && precedence == QueryPrecedenceDestination {
+			continue
+		}
+		query[key] = values
+	}
+	parsed.RawQuery = query.Encode()
+
+	return parsed.String(), nil
+}
@@ -2,61 +2,100 @@ package utils
 
 import (
 	"errors"
+	"strings"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
 	"golang.org/x/crypto/bcrypt"
 )
 
+// HashPassword returns the argon2id hash of password
 func HashPassword(password string) (string, error) {
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
-	if err != nil {
-		return "", err
-	}
-	return string(hashedPassword), nil
+	return hashArgon2id(password, PasswordHashParams)
 }
 
-// checks if the password matches the hashed password
+// checks if the password matches the hashed password, which is either an
+// argon2id hash or a bcrypt hash from before argon2id was introduced
 // returns true if the password is correct, false otherwise
 func CheckPasswordHash(password, hashedPassword string) bool {
+	if strings.HasPrefix(hashedPassword, argon2idPrefix) {
+		return checkArgon2id(password, hashedPassword)
+	}
 	err := bcrypt.CompareHashAndPassword([]byte(hashedPassword), []byte(password))
 	return err == nil
 }
 
-func GenerateJWT(userID string) (string, error) {
-	var jwtSecret = []byte("your-secret-key")
+// JWTSecret signs session and other tokens. It is set from the
+// configured secret at startup, until then no token is issued or accepted.
+var JWTSecret []byte
+
+var ErrNoJWTSecret = errors.New("utils: JWTSecret isn't set")
+
+// Signs claims with JWTSecret
+func signToken(claims jwt.MapClaims) (string, error) {
+	if len(JWTSecret) == 0 {
+		return "", ErrNoJWTSecret
+	}
+	return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(JWTSecret)
+}
 
+// Returns the key to check token with, for jwt.Parse
+func tokenKey(token *jwt.Token) (interface{}, error) {
+	// Ensure the signing method is HMAC
+	if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+		return nil, errors.New("unexpected signing method")
+	}
+	if len(JWTSecret) == 0 {
+		return nil, ErrNoJWTSecret
+	}
+	return JWTSecret, nil
+}
+
+// SessionTTL is how long session tokens are valid. It can be overridden
+// at startup.
+var SessionTTL = 24 * time.Hour
+
+func GenerateJWT(userID string) (string, error) {
 	claims := jwt.MapClaims{
 		"sub": userID,
-		"exp": time.Now().Add(24 * time.Hour).Unix(),
+		"exp": time.Now().Add(SessionTTL).Unix(),
 		"iat": time.Now().Unix(),
 	}
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString(jwtSecret)
+	return signToken(claims)
 }
 
 func ValidateJWT(tokenString string) (string, error) {
-	var jwtSecret = []byte("your-secret-key")
-
-	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-		// Ensure the signing method is HMAC
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, errors.New("unexpected signing method")
-		}
-		return jwtSecret, nil
-	})
+	userID, _, err := ParseSessionJWT(tokenString)
+	return userID, err
+}
+
+// ParseSessionJWT validates a session token and returns the user it was
+// issued to along with the time it was issued at
+func ParseSessionJWT(tokenString string) (string, time.Time, error) {
+	token, err := jwt.Parse(tokenString, tokenKey)
 	if err != nil || !token.Valid {
-		return "", errors.New("invalid token")
+		return "", time.Time{}, errors.New("invalid token")
 	}
 
 	claims, ok := token.Claims.(jwt.MapClaims)
 	if !ok {
-		return "", errors.New("invalid claims")
+		return "", time.Time{}, errors.New("invalid claims")
+	}
+
+	// Tokens issued for another purpose, such as verifying an email,
+	// must not be usable as sessions
+	if _, ok := claims["purpose"]; ok {
+		return "", time.Time{}, errors.New("invalid token")
 	}
 
 	userID, ok := claims["sub"].(string)
 	if !ok || userID == "" {
-		return "", errors.New("user id not found in token")
+		return "", time.Time{}, errors.New("user id not found in token")
+	}
+
+	issuedAt, err := claims.GetIssuedAt()
+	if err != nil || issuedAt == nil {
+		return "", time.Time{}, errors.New("issue time not found in token")
 	}
-	return userID, nil
+	return userID, issuedAt.Time, nil
 }
@@ -37,10 +37,10 @@ function Dashboard() {
 					}
 					return response.json();
 				})
-				.then((data: URLData[] | null) => { // Data can be null if no URLs
-					if (data && Array.isArray(data)) {
+				.then((data: Record<string, URLData[]> | null) => { // Links grouped by domain
+					if (data && typeof data === "object") {
                         const baseShortUrl = API_ENDPOINT.replace(/(me|new|dev)\/$/, ""); // Regex corrected
-                        const processedUrls = data.map(url => ({
+                        const processedUrls = Object.values(data).flat().map(url => ({
                             ...url,
                             displayShort_url: `${baseShortUrl}${url.short_code}`
                         }));
@@ -1,6 +1,7 @@
 /// <reference types="vite/client" />
 
 interface URLData {
+  domain?: string;
   short_code: string;
   original_url: string;
   clicks: number;